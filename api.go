@@ -0,0 +1,257 @@
+package webapp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAPIBodySize limits the size of the JSON request bodies of the API
+const maxAPIBodySize = 1 << 20
+
+// FieldError describes the validation error of a single field of an API request
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	// err is a validation error translated to the language of the request by writeAPIError
+	err error
+}
+
+// APIError is the body of failed API requests, a problem details object (RFC 7807) served as
+// application/problem+json. Code identifies the kind of error for clients, Title is its localised message
+// and Detail describes the cause of this occurrence.
+type APIError struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Code     string       `json:"code"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// Codes of the API errors
+const (
+	codeBadRequest           = "bad_request"
+	codeInvalidJSON          = "invalid_json"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeNotAcceptable        = "not_acceptable"
+	codeConflict             = "conflict"
+	codeGone                 = "gone"
+	codePreconditionFailed   = "precondition_failed"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeValidationFailed     = "validation_failed"
+	codeTooManyRequests      = "too_many_requests"
+	codeInternalError        = "internal_error"
+)
+
+// apiErrorMessages are the message ids of the localised titles of the error codes
+var apiErrorMessages = map[string]string{
+	codeBadRequest:           "ErrorBadRequest",
+	codeInvalidJSON:          "ErrorInvalidJSON",
+	codeUnauthorized:         "ErrorUnauthorized",
+	codeForbidden:            "ErrorForbidden",
+	codeNotFound:             "ErrorNotFound",
+	codeMethodNotAllowed:     "ErrorMethodNotAllowed",
+	codeNotAcceptable:        "ErrorNotAcceptable",
+	codeConflict:             "ErrorConflict",
+	codeGone:                 "ErrorGone",
+	codePreconditionFailed:   "ErrorPreconditionFailed",
+	codeUnsupportedMediaType: "ErrorUnsupportedMediaType",
+	codeValidationFailed:     "ErrorValidationFailed",
+	codeTooManyRequests:      "ErrorTooManyRequests",
+	codeInternalError:        "ErrorInternalError",
+}
+
+var (
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	errInvalidJSON          = errors.New("invalid JSON body")
+	errInvalidDeleteOptions = errors.New("invalid delete options")
+	errPreconditionFailed   = errors.New("precondition failed")
+)
+
+// isAPIRequest reports if the request is for one of the API routes, which answer with JSON instead of pages
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// writeAPIError writes an APIError with the given status code, error code and detail. The title and
+// the messages of validation errors in fields are translated to the language of the request.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code, detail string, fields ...FieldError) {
+	title, lang := LookupTranslationWithLanguage(r, apiErrorMessages[code])
+	if title == "" {
+		title = http.StatusText(status)
+	}
+	for i, field := range fields {
+		if localized, ok := validationFieldError(field.err, lang); ok {
+			fields[i] = localized
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(status)
+	writer := json.NewEncoder(w)
+	writer.SetIndent("", "    ")
+	err := writer.Encode(APIError{
+		Type:     "about:blank",
+		Title:    title,
+		Status:   status,
+		Code:     code,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		Errors:   fields,
+	})
+	if err != nil {
+		log.Println("Unable to write API error:", err)
+	}
+}
+
+// writeAPIErrorFor translates err into the matching APIError. Validation errors are returned as
+// 422 Unprocessable Entity with the field they refer to, store errors with their matching status code.
+// The details of other errors are only logged.
+func writeAPIErrorFor(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errUnsupportedMediaType):
+		writeAPIError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+	case errors.Is(err, errInvalidJSON):
+		writeAPIError(w, r, http.StatusBadRequest, codeInvalidJSON, err.Error())
+	case errors.Is(err, errInvalidDeleteOptions), errors.Is(err, errInvalidQuery), errors.Is(err, errInvalidImport),
+		errors.Is(err, errInvalidObject):
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+	case errors.Is(err, errForbidden):
+		writeAPIError(w, r, http.StatusForbidden, codeForbidden, err.Error())
+	case errors.Is(err, errNotAcceptable):
+		writeAPIError(w, r, http.StatusNotAcceptable, codeNotAcceptable, err.Error())
+	case errors.Is(err, errPreconditionFailed), errors.Is(err, ErrVersionConflict) && r.Header.Get("If-Match") != "":
+		// the resource has been changed since the client read the version it sent
+		writeAPIError(w, r, http.StatusPreconditionFailed, codePreconditionFailed, err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeAPIError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+	case errors.Is(err, ErrConflict):
+		writeAPIError(w, r, http.StatusConflict, codeConflict, err.Error())
+	case errors.Is(err, errResourceVersionExpired):
+		writeAPIError(w, r, http.StatusGone, codeGone, err.Error())
+	default:
+		if _, ok := ValidationField(err); ok {
+			writeAPIError(w, r, http.StatusUnprocessableEntity, codeValidationFailed, "", FieldError{err: err})
+			return
+		}
+		logRequestError(r, "API request failed:", err)
+		writeAPIError(w, r, http.StatusInternalServerError, codeInternalError, "")
+	}
+}
+
+// decodeJSON decodes the JSON body of the request into v. The content type must be one of the given media
+// types or application/json, unknown fields are rejected.
+func decodeJSON(r *http.Request, v interface{}, mediaTypes ...string) error {
+	if err := checkContentType(r, append(mediaTypes, "application/json")...); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidJSON, err)
+	}
+	return nil
+}
+
+// checkContentType checks that the request body has one of the given media types
+func checkContentType(r *http.Request, mediaTypes ...string) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil {
+		for _, allowed := range mediaTypes {
+			if mediaType == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: expected %s", errUnsupportedMediaType, mediaTypes[0])
+}
+
+// etag returns the entity tag of a resource with the given version
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// checkIfMatch checks the If-Match header of a request to change a resource with the given version.
+// It returns errPreconditionFailed if the header is set and none of its entity tags match.
+func checkIfMatch(r *http.Request, version int64) error {
+	header := strings.Join(r.Header.Values("If-Match"), ",")
+	if header == "" {
+		return nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(version) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: the current entity tag is %s", errPreconditionFailed, etag(version))
+}
+
+// DeleteOptions is the optional JSON body of DELETE requests
+type DeleteOptions struct {
+	// GracePeriodSeconds is the time before the resource is purged, 0 deletes it immediately
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds,omitempty"`
+}
+
+// gracePeriod reads the grace period of a deletion from the gracePeriodSeconds url parameter or the
+// DeleteOptions in the body. Without one the default grace period of the kind in Config.DeletionGracePeriods
+// is returned.
+func gracePeriod(r *http.Request, kind string) (time.Duration, error) {
+	options := DeleteOptions{}
+	if r.ContentLength != 0 && r.Header.Get("Content-Type") != "" {
+		if err := decodeJSON(r, &options); err != nil {
+			return 0, err
+		}
+	}
+	if seconds := r.URL.Query().Get("gracePeriodSeconds"); seconds != "" {
+		value, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: gracePeriodSeconds must be a number", errInvalidDeleteOptions)
+		}
+		options.GracePeriodSeconds = &value
+	}
+
+	if options.GracePeriodSeconds == nil {
+		return Config.DeletionGracePeriods[kind], nil
+	}
+	if *options.GracePeriodSeconds < 0 {
+		return 0, fmt.Errorf("%w: gracePeriodSeconds must not be negative", errInvalidDeleteOptions)
+	}
+	return time.Duration(*options.GracePeriodSeconds) * time.Second, nil
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to the target document
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
@@ -0,0 +1,558 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The v2 API serves every kind of resource with the same handlers as Kubernetes-style objects with an
+// apiVersion, kind, metadata and spec, see doc/api-conventions.md. A kind is served below /api/v2/<plural>
+// once it's registered with RegisterAPIKind, the kind only implements the access to its objects.
+//
+// The metadata.resourceVersion of an object is its version, which is also its entity tag. The
+// metadata.resourceVersion of a list is the version of the GlobalEventBus to watch for changes from.
+
+// APIVersionV2 is the apiVersion of the objects of the v2 API
+const APIVersionV2 = "webapp/v2"
+
+// maxObjectListLimit is the maximum page size of the lists of the v2 API
+const maxObjectListLimit = 500
+
+var (
+	errInvalidObject = errors.New("invalid object")
+	errForbidden     = errors.New("forbidden")
+)
+
+// ObjectMeta is the metadata of an object of the v2 API
+type ObjectMeta struct {
+	// Name identifies the object within its kind, e.g. the id of a user
+	Name string `json:"name" yaml:"name"`
+	// ResourceVersion is the version of the object, an object can only be changed with its current version
+	ResourceVersion string `json:"resourceVersion,omitempty" yaml:"resourceVersion,omitempty"`
+	// DeletionTimestamp is set while the object is terminating
+	DeletionTimestamp *time.Time `json:"deletionTimestamp,omitempty" yaml:"deletionTimestamp,omitempty"`
+}
+
+// Object is a single object of the v2 API. Spec is the state set by the clients, Status the state
+// observed by the application, which is ignored in requests.
+type Object struct {
+	APIVersion string      `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string      `json:"kind" yaml:"kind"`
+	Metadata   ObjectMeta  `json:"metadata" yaml:"metadata"`
+	Spec       interface{} `json:"spec" yaml:"spec"`
+	Status     interface{} `json:"status,omitempty" yaml:"status,omitempty"`
+}
+
+// ListMeta is the metadata of a list of the v2 API
+type ListMeta struct {
+	// ResourceVersion is the version to watch for changes after the list from
+	ResourceVersion string `json:"resourceVersion,omitempty" yaml:"resourceVersion,omitempty"`
+	// Continue is the token of the next page, empty on the last page
+	Continue string `json:"continue,omitempty" yaml:"continue,omitempty"`
+	// RemainingItemCount is the number of objects after this page, if there's a next page
+	RemainingItemCount *int64 `json:"remainingItemCount,omitempty" yaml:"remainingItemCount,omitempty"`
+}
+
+// ObjectList is a page of the objects of a kind, its kind is the kind of the objects followed by List
+type ObjectList struct {
+	APIVersion string   `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string   `json:"kind" yaml:"kind"`
+	Metadata   ListMeta `json:"metadata" yaml:"metadata"`
+	Items      []Object `json:"items" yaml:"items"`
+}
+
+// objectRequest is the JSON body of requests creating or changing an object, the spec is decoded with
+// the NewSpec function of the kind
+type objectRequest struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   ObjectMeta      `json:"metadata"`
+	Spec       json.RawMessage `json:"spec"`
+	// the status is accepted, so an object can be sent back after modification, but it can't be changed
+	Status json.RawMessage `json:"status,omitempty"`
+}
+
+// ListOptions select a page of the objects of a kind
+type ListOptions struct {
+	Limit  int        // maximum number of objects in the page, 0 lists all objects
+	Offset int        // number of objects to skip, read from the continue token
+	Values url.Values // url parameters of the request, for the filters of a kind like q
+}
+
+// APIKind describes a kind of objects served by the v2 API. The functions check if the user of the request
+// may access the objects and return errForbidden otherwise, ErrNotFound if an object doesn't exist and
+// validation errors for invalid specs. Operations without a function aren't supported by the kind and
+// fail with 405 Method Not Allowed. Watching the objects of a kind is reserved for the admin.
+type APIKind struct {
+	Kind   string // kind of the objects and their events on the GlobalEventBus, e.g. User
+	Plural string // path segment of the kind, e.g. users
+
+	// NewSpec returns a pointer to an empty spec, the spec of a request is decoded into it
+	NewSpec func() interface{}
+	// Convert returns the object of a value published on the GlobalEventBus, e.g. of a User
+	Convert func(value interface{}) (Object, bool)
+
+	// List returns a page of the objects and the number of objects on all pages
+	List func(r *http.Request, options ListOptions) ([]Object, int, error)
+	// Get returns the object with the given name
+	Get func(r *http.Request, name string) (*Object, error)
+	// Create creates a new object, without a name in its metadata a name is generated
+	Create func(r *http.Request, object Object) (*Object, error)
+	// Update changes the object of the name in the metadata, its resource version has to be the current one
+	Update func(r *http.Request, object Object) (*Object, error)
+	// Delete deletes the object, with a grace period it returns the terminating object
+	Delete func(r *http.Request, name string, gracePeriod time.Duration) (*Object, error)
+}
+
+// apiKinds are the registered kinds by their plural names
+var apiKinds = map[string]*APIKind{}
+
+// RegisterAPIKind serves the objects of kind below /api/v2/<plural>. Kinds have to be registered before
+// the server is started.
+func RegisterAPIKind(kind APIKind) {
+	if kind.Kind == "" || kind.Plural == "" || kind.NewSpec == nil || kind.Get == nil {
+		panic("webapp: an API kind needs a kind, a plural, NewSpec and Get")
+	}
+	if _, ok := apiKinds[kind.Plural]; ok {
+		panic("webapp: API kind " + kind.Plural + " is already registered")
+	}
+	apiKinds[kind.Plural] = &kind
+}
+
+// NewObject returns an object of the kind with the given name, version and spec
+func NewObject(kind, name string, version int64, spec interface{}) Object {
+	return Object{
+		APIVersion: APIVersionV2,
+		Kind:       kind,
+		Metadata: ObjectMeta{
+			Name:            name,
+			ResourceVersion: strconv.FormatInt(version, 10),
+		},
+		Spec: spec,
+	}
+}
+
+// Version returns the resource version of the object as the version of the stored value, or 0 if the
+// object has no valid resource version
+func (o Object) Version() int64 {
+	version, _ := strconv.ParseInt(o.Metadata.ResourceVersion, 10, 64)
+	return version
+}
+
+// CheckVersion returns ErrVersionConflict if the object was read with another version than the current one
+func (o Object) CheckVersion(current int64) error {
+	if o.Metadata.ResourceVersion != "" && o.Version() != current {
+		return fmt.Errorf("%w: %s %s has version %d", ErrVersionConflict, o.Kind, o.Metadata.Name, current)
+	}
+	return nil
+}
+
+// allowedMethods returns the methods supported by the kind on its collection or on a single object
+func (kind *APIKind) allowedMethods(object bool) []string {
+	var methods []string
+	if !object {
+		if kind.List != nil {
+			methods = append(methods, http.MethodGet)
+		}
+		if kind.Create != nil {
+			methods = append(methods, http.MethodPost)
+		}
+		return methods
+	}
+	methods = append(methods, http.MethodGet)
+	if kind.Update != nil || kind.Create != nil {
+		methods = append(methods, http.MethodPut)
+	}
+	if kind.Update != nil {
+		methods = append(methods, http.MethodPatch)
+	}
+	if kind.Delete != nil {
+		methods = append(methods, http.MethodDelete)
+	}
+	return methods
+}
+
+// decode returns the object of a request body with the decoded spec of the kind
+func (kind *APIKind) decode(req objectRequest) (Object, error) {
+	if req.APIVersion != "" && req.APIVersion != APIVersionV2 {
+		return Object{}, fmt.Errorf("%w: apiVersion must be %s", errInvalidObject, APIVersionV2)
+	}
+	if req.Kind != "" && req.Kind != kind.Kind {
+		return Object{}, fmt.Errorf("%w: kind must be %s", errInvalidObject, kind.Kind)
+	}
+	if len(req.Spec) == 0 || string(req.Spec) == "null" {
+		return Object{}, fmt.Errorf("%w: the spec is missing", errInvalidObject)
+	}
+
+	spec := kind.NewSpec()
+	decoder := json.NewDecoder(bytes.NewReader(req.Spec))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(spec); err != nil {
+		return Object{}, fmt.Errorf("%w: spec: %s", errInvalidJSON, err)
+	}
+
+	return Object{
+		APIVersion: APIVersionV2,
+		Kind:       kind.Kind,
+		Metadata:   req.Metadata,
+		Spec:       spec,
+	}, nil
+}
+
+// convertEvent replaces the object of an event of the kind with its v2 object
+func (kind *APIKind) convertEvent(value interface{}) interface{} {
+	if kind.Convert == nil || value == nil {
+		return value
+	}
+	if object, ok := kind.Convert(value); ok {
+		return object
+	}
+	return value
+}
+
+// ParseListOptions reads the ListOptions from the limit and continue url parameters
+func ParseListOptions(values url.Values) (ListOptions, error) {
+	options := ListOptions{Values: values}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return options, fmt.Errorf("%w: invalid limit %s", errInvalidQuery, limit)
+		}
+		options.Limit = n
+	}
+	if options.Limit > maxObjectListLimit {
+		options.Limit = maxObjectListLimit
+	}
+
+	if token := values.Get("continue"); token != "" {
+		offset, err := DecodeCursor(token)
+		if err != nil {
+			return options, err
+		}
+		options.Offset = offset
+	}
+	return options, nil
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// requestedKind returns the registered kind of the resource parameter, otherwise 404 Not Found
+// has been written to the response
+func requestedKind(w http.ResponseWriter, r *http.Request, params httprouter.Params) (*APIKind, bool) {
+	kind, ok := apiKinds[params.ByName("resource")]
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("unknown resource %s", params.ByName("resource")))
+		return nil, false
+	}
+	return kind, true
+}
+
+// writeMethodNotAllowed writes the 405 error listing the methods supported by the kind
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, kind *APIKind, object bool) {
+	w.Header().Set("Allow", strings.Join(kind.allowedMethods(object), ", "))
+	writeAPIError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed,
+		fmt.Sprintf("%s don't support %s", kind.Plural, r.Method))
+}
+
+// writeObject writes an object with its entity tag
+func writeObject(w http.ResponseWriter, r *http.Request, status int, object *Object) {
+	w.Header().Set("ETag", etag(object.Version()))
+	writeResponse(w, r, status, object)
+}
+
+// checkObjectName checks that the name in the metadata of a request matches the name in the url
+func checkObjectName(object *Object, name string) error {
+	if object.Metadata.Name != "" && object.Metadata.Name != name {
+		return fmt.Errorf("%w: metadata.name %s doesn't match the name %s of the url", errInvalidObject, object.Metadata.Name, name)
+	}
+	object.Metadata.Name = name
+	return nil
+}
+
+// HandleObjectsGETv2 returns a page of the objects of a kind. Without a limit parameter all objects are
+// returned, otherwise the continue token of the list metadata selects the next page.
+// With watch=true the changes of the objects are streamed instead, see serveWatch.
+// (GET /api/v2/:resource?limit=&continue=&watch=&resourceVersion=&timeoutSeconds=)
+func HandleObjectsGETv2(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	kind, ok := requestedKind(w, r, params)
+	if !ok {
+		return
+	}
+	if kind.List == nil {
+		writeMethodNotAllowed(w, r, kind, false)
+		return
+	}
+
+	if watchRequested(r) {
+		if !IsAdmin(r) {
+			writeAPIError(w, r, http.StatusForbidden, codeForbidden, "only the admin can watch "+kind.Plural)
+			return
+		}
+		serveWatch(w, r, kind.Kind, kind.convertEvent)
+		return
+	}
+
+	options, err := ParseListOptions(r.URL.Query())
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	// changes after this version may already be listed, watching from it replays them at worst
+	resourceVersion := GlobalEventBus.ResourceVersion()
+	items, total, err := kind.List(r, options)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	list := ObjectList{
+		APIVersion: APIVersionV2,
+		Kind:       kind.Kind + "List",
+		Metadata:   ListMeta{ResourceVersion: strconv.FormatUint(resourceVersion, 10)},
+		Items:      items,
+	}
+	if list.Items == nil {
+		list.Items = []Object{}
+	}
+	if remaining := int64(total - options.Offset - len(items)); options.Limit > 0 && remaining > 0 {
+		list.Metadata.Continue = EncodeCursor(options.Offset + len(items))
+		list.Metadata.RemainingItemCount = &remaining
+	}
+	writeResponse(w, r, http.StatusOK, list)
+}
+
+// HandleObjectPOSTv2 creates a new object from the JSON body
+// (POST /api/v2/:resource)
+func HandleObjectPOSTv2(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	kind, ok := requestedKind(w, r, params)
+	if !ok {
+		return
+	}
+	if kind.Create == nil {
+		writeMethodNotAllowed(w, r, kind, false)
+		return
+	}
+
+	var req objectRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	object, err := kind.decode(req)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	createObject(w, r, kind, object)
+}
+
+// createObject creates the object and writes it with its location
+func createObject(w http.ResponseWriter, r *http.Request, kind *APIKind, object Object) {
+	created, err := kind.Create(r, object)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v2/"+kind.Plural+"/"+created.Metadata.Name)
+	writeObject(w, r, http.StatusCreated, created)
+}
+
+// HandleObjectGETv2 returns a single object
+// (GET /api/v2/:resource/:name)
+func HandleObjectGETv2(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	kind, ok := requestedKind(w, r, params)
+	if !ok {
+		return
+	}
+	object, err := kind.Get(r, params.ByName("name"))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	writeObject(w, r, http.StatusOK, object)
+}
+
+// HandleObjectPUTv2 replaces the spec of an object with the one of the JSON body, or creates the object
+// if it doesn't exist and the kind supports it. With an If-Match header the object is only changed if it
+// still has the given entity tag.
+// (PUT /api/v2/:resource/:name)
+func HandleObjectPUTv2(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	kind, ok := requestedKind(w, r, params)
+	if !ok {
+		return
+	}
+	if kind.Update == nil && kind.Create == nil {
+		writeMethodNotAllowed(w, r, kind, true)
+		return
+	}
+
+	var req objectRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	object, err := kind.decode(req)
+	if err == nil {
+		err = checkObjectName(&object, params.ByName("name"))
+	}
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	current, err := kind.Get(r, object.Metadata.Name)
+	if errors.Is(err, ErrNotFound) && kind.Create != nil {
+		// a missing object matches no entity tag
+		if r.Header.Get("If-Match") != "" {
+			writeAPIErrorFor(w, r, fmt.Errorf("%w: the object doesn't exist", errPreconditionFailed))
+			return
+		}
+		createObject(w, r, kind, object)
+		return
+	}
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	if kind.Update == nil {
+		writeMethodNotAllowed(w, r, kind, true)
+		return
+	}
+	updateObject(w, r, kind, current, object)
+}
+
+// HandleObjectPATCHv2 modifies the fields of an object given in the JSON merge patch (RFC 7386) of the body.
+// With an If-Match header the object is only changed if it still has the given entity tag.
+// (PATCH /api/v2/:resource/:name)
+func HandleObjectPATCHv2(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	kind, ok := requestedKind(w, r, params)
+	if !ok {
+		return
+	}
+	if kind.Update == nil {
+		writeMethodNotAllowed(w, r, kind, true)
+		return
+	}
+
+	current, err := kind.Get(r, params.ByName("name"))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	var patch interface{}
+	if err := decodeJSON(r, &patch, "application/merge-patch+json"); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	// apply the patch to the current object and decode the result like a PUT request
+	document, err := json.Marshal(current)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	var target interface{}
+	if err := json.Unmarshal(document, &target); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	patched, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	var req objectRequest
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeAPIErrorFor(w, r, fmt.Errorf("%w: %s", errInvalidJSON, err))
+		return
+	}
+	object, err := kind.decode(req)
+	if err == nil {
+		err = checkObjectName(&object, current.Metadata.Name)
+	}
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	updateObject(w, r, kind, current, object)
+}
+
+// updateObject checks the If-Match header and the resource version of a PUT or PATCH request against
+// the current object and updates it. Without a resource version the object is updated with the version
+// of the current object, so concurrent changes are still detected.
+func updateObject(w http.ResponseWriter, r *http.Request, kind *APIKind, current *Object, object Object) {
+	if err := checkIfMatch(r, current.Version()); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	if err := object.CheckVersion(current.Version()); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	object.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+
+	updated, err := kind.Update(r, object)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	writeObject(w, r, http.StatusOK, updated)
+}
+
+// HandleObjectDELETEv2 deletes an object immediately or, with a grace period, returns the terminating
+// object with its deletion timestamp. With an If-Match header the object is only deleted if it still
+// has the given entity tag.
+// (DELETE /api/v2/:resource/:name?gracePeriodSeconds=)
+func HandleObjectDELETEv2(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	kind, ok := requestedKind(w, r, params)
+	if !ok {
+		return
+	}
+	if kind.Delete == nil {
+		writeMethodNotAllowed(w, r, kind, true)
+		return
+	}
+
+	gracePeriod, err := gracePeriod(r, kind.Kind)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	current, err := kind.Get(r, params.ByName("name"))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	if err := checkIfMatch(r, current.Version()); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	terminating, err := kind.Delete(r, current.Metadata.Name, gracePeriod)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	if terminating != nil {
+		writeObject(w, r, http.StatusAccepted, terminating)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
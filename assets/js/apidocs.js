@@ -0,0 +1,8 @@
+// renders the generated OpenAPI document, requests made with "Try it out" use the session cookie
+window.onload = function () {
+    SwaggerUIBundle({
+        url: "/api/v1/openapi.json",
+        dom_id: "#apidocs",
+        withCredentials: true,
+    });
+};
@@ -1,69 +1,5 @@
-const markup = (user, sessions, editLabel, deleteLabel, confirmationText) => {
-    return `
-    <tr>
-        <td>${user.id}</td>
-        <td>${user.username}</td>
-        <td>${user.email}</td>
-        <td>${sessions}</td>
-        <td>
-            <ul class="list-inline m-0">
-                <li>
-                    <a href="/users/${user.id}" class="btn buttonaction btn-success btn-sm rounded-0"
-                        role="button" data-toggle="tooltip" data-placement="top" title="${editLabel}">
-                        <i class="fa-solid fa-pen"></i>
-                    </a>
-<!--                    <a href="/userrm/${user.id}" onclick="deleteUser(${user.id})" class="btn buttonaction btn-danger btn-sm rounded-0"-->
-                    <a onclick="deleteUser('${user.id}', '${confirmationText}')" class="btn buttonaction btn-danger btn-sm rounded-0"
-                        id="delete${user.id}" role="button" data-toggle="tooltip" data-placement="top" title="${deleteLabel}">
-                        <i class="fa-solid fa-trash"></i>
-                    </a>
-                </li>            
-            </ul>
-        </td>
-    </tr>    
-`;
-};
-
-var language = "en";
-
-function sortByName(response) {
-    let users = JSON.parse(response);
-    let sortedUsers = users.sort(
-        (s1, s2) => (s1.username < s2.username) ? -1 : (s1.username > s2.username) ? 1 : 0);
-    printListe(sortedUsers);
-}
-function sortByID(response) {
-    let users = JSON.parse(response);
-    let sortedUsers = users.sort(
-        (s1, s2) => (s1.id < s2.id) ? -1 : (s1.id > s2.id) ? 1 : 0);
-    printListe(sortedUsers);
-}
-function sortByEmail(response) {
-    let users = JSON.parse(response);
-    let sortedUsers = users.sort(
-        (s1, s2) => (s1.email < s2.email) ? -1 : (s1.email > s2.email) ? 1 : 0);
-    printListe(sortedUsers);
-}
-function sortBySessions(response) {
-    let users = JSON.parse(response);
-    let sortedUsers = users.sort(
-        (s1, s2) => (s1.sessions[0] < s2.sessions[0]) ? -1 : (s1.sessions[0] > s2.sessions[0]) ? 1 : 0);
-    printListe(sortedUsers);
-}
-
-function getUserConfig(userid) {
-    const url = "/api/v1/settings/" + userid;
-    let request = new XMLHttpRequest();
-
-    request.open("GET", url);
-    request.setRequestHeader("Accept", "application/json")
-    request.onload = function () {
-        if (request.status === 200) {
-            return JSON.parse(request.responseText)
-        }
-    }
-    request.send(null);
-}
+// watching is set while the table is updated by the watch stream
+let watching = false;
 
 function deleteUser(id, confirmationMessage) {
     let confirmation = confirm(confirmationMessage)
@@ -74,67 +10,125 @@ function deleteUser(id, confirmationMessage) {
         request.open("DELETE", url);
         request.setRequestHeader("Accept", "application/json")
         request.onload = function () {
-            if (request.status === 204) {
-                window.location.reload();
+            if (request.status === 204 && !watching && removeUserRow(id)) {
+                changeTotal(-1);
+            }
+            // users deleted with a grace period are terminating until they are purged
+            if (request.status === 202 && !watching) {
+                showTerminating(JSON.parse(request.responseText));
             }
         }
         request.send(null);
     }
 }
 
-function printListe(users) {
-    let usersTable = document.querySelector("#userslist");
-    usersTable.innerHTML = "";
-
-    users.forEach(function (user) {
-        let sessionsstr = "";
-        for (let r = 0; r < user.sessions.length; r++) {
-            sessionsstr += user.sessions[r].id + "<br>";
-        }
-        switch (language) {
-            case "de":
-                usersTable.innerHTML += markup(user, sessionsstr, "Bearbeiten", "Entfernen",
-                    "Sind sie sicher, dass sie den Benutzer "+ user.username +" löschen möchten?");
-                break;
-            default:
-                usersTable.innerHTML += markup(user, sessionsstr, "Edit", "Delete",
-                    "Are you sure you want to delete the user "+user.username+"?");
-        }
-    });
-    document.querySelector("#deleteadmin").hidden = true;
-}
-
-function getData(sorting) {
-    const url = "/api/v1/users/";
+function restoreUser(id) {
+    const url = "/api/v1/users/" + id + "/restore";
     let request = new XMLHttpRequest();
 
-    // console.log(sorting);
-
-    request.open("GET", url);
+    request.open("POST", url);
     request.setRequestHeader("Accept", "application/json")
     request.onload = function () {
-        if (request.status === 200) {
-            if (sorting === "id") {
-                sortByID(request.responseText);
-            } else if (sorting === "email") {
-                sortByEmail(request.responseText);
-            } else if (sorting === "sessions") {
-                sortBySessions(request.responseText);
-            } else {
-                sortByName(request.responseText);
-            }
+        if (request.status === 200 && !watching) {
+            showTerminating(JSON.parse(request.responseText));
         }
     }
     request.send(null);
 }
 
-function setLanguage(lang) {
-    language = lang;
-    getData("id");
+// showTerminating marks the row of a terminating user and replaces its delete button with the restore button
+function showTerminating(user) {
+    const row = document.getElementById("user" + user.id);
+    if (!row) {
+        return;
+    }
+    const terminating = !!user.deletionTimestamp;
+    row.classList.toggle("table-warning", terminating);
+    const deleteButton = row.querySelector(".delete");
+    const restoreButton = row.querySelector(".restore");
+    if (deleteButton && restoreButton) {
+        deleteButton.classList.toggle("d-none", terminating);
+        restoreButton.classList.toggle("d-none", !terminating);
+    }
+}
+
+// removeUserRow removes the row of the user from the table and returns false if it isn't shown
+function removeUserRow(id) {
+    const row = document.getElementById("user" + id);
+    if (!row) {
+        return false;
+    }
+    row.remove();
+    return true;
+}
+
+function addUserRow(list, user) {
+    const row = document.getElementById("userrow").content.firstElementChild.cloneNode(true);
+    row.id = "user" + user.id;
+    row.querySelector(".userid").textContent = user.id;
+    row.querySelector(".username").textContent = user.username;
+    row.querySelector(".email").textContent = user.email;
+    row.querySelector(".edit").href = "/users/" + user.id;
+    row.querySelector(".delete").onclick = function () {
+        deleteUser(user.id, list.dataset.confirmation.replace("%s", user.username));
+    };
+    row.querySelector(".restore").onclick = function () {
+        restoreUser(user.id);
+    };
+    list.appendChild(row);
+    showTerminating(user);
+}
+
+function changeTotal(delta) {
+    const total = document.getElementById("userstotal");
+    total.textContent = parseInt(total.textContent, 10) + delta;
 }
 
-function initJS() {
-    getData("id");
+// watchUsers applies the changes of the users to the table while the page is open.
+// New users are appended unless the list is filtered by a search.
+function watchUsers() {
+    const list = document.getElementById("userslist");
+    if (!list || !window.EventSource) {
+        return;
+    }
+    const filtered = list.dataset.search !== "";
+
+    const source = new EventSource("/api/v1/users?watch=true&resourceVersion=" + list.dataset.resourceVersion);
+    source.onopen = function () {
+        watching = true;
+    };
+    source.onmessage = function (message) {
+        const event = JSON.parse(message.data);
+        const user = event.object;
+        switch (event.type) {
+            case "ADDED":
+                if (!filtered && !document.getElementById("user" + user.id)) {
+                    addUserRow(list, user);
+                    changeTotal(1);
+                }
+                break;
+            case "MODIFIED":
+                const row = document.getElementById("user" + user.id);
+                if (row) {
+                    row.querySelector(".username").textContent = user.username;
+                    row.querySelector(".email").textContent = user.email;
+                    showTerminating(user);
+                }
+                break;
+            case "DELETED":
+                if (removeUserRow(user.id) || !filtered) {
+                    changeTotal(-1);
+                }
+                break;
+        }
+    };
+    source.onerror = function () {
+        watching = false;
+        // the stream can't be resumed, e.g. after a restart of the server
+        if (source.readyState === EventSource.CLOSED) {
+            window.location.reload();
+        }
+    };
 }
 
-document.addEventListener('DOMContentLoaded', initJS);
+document.addEventListener("DOMContentLoaded", watchUsers);
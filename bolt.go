@@ -0,0 +1,153 @@
+package webapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var GlobalBoltDB *bolt.DB // embedded bbolt key-value database
+
+// bucket names of the bolt stores
+var (
+	boltUsersBucket                = []byte("users")
+	boltUsernameIndexBucket        = []byte("users_by_username")
+	boltEmailIndexBucket           = []byte("users_by_email")
+	boltSessionsBucket             = []byte("sessions")
+	boltSessionsByUserBucket       = []byte("sessions_by_user")
+	boltUserConfigsBucket          = []byte("userconfigs")
+	boltJobRunsBucket              = []byte("jobruns")
+	boltWebhooksBucket             = []byte("webhooks")
+	boltWebhookDeliveriesBucket    = []byte("webhook_deliveries")
+	boltWebhookDeliveryIndexBucket = []byte("webhook_deliveries_by_id")
+)
+
+// NewBoltDB opens the bolt database file at the given path and creates the buckets of the stores
+func NewBoltDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{
+			boltUsersBucket,
+			boltUsernameIndexBucket,
+			boltEmailIndexBucket,
+			boltSessionsBucket,
+			boltSessionsByUserBucket,
+			boltUserConfigsBucket,
+			boltJobRunsBucket,
+			boltWebhooksBucket,
+			boltWebhookDeliveriesBucket,
+			boltWebhookDeliveryIndexBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// boltStore is the common base of the bolt stores. Outside of a transaction every call runs in its own
+// bolt transaction, inside of one all calls use the transaction of the store.
+type boltStore struct {
+	db *bolt.DB
+	tx *bolt.Tx
+}
+
+// view runs fn in a read-only transaction
+func (s boltStore) view(fn func(*bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.View(fn)
+}
+
+// update runs fn in a read-write transaction. Bolt serializes write transactions,
+// so concurrent writes can't leave the indexes inconsistent.
+func (s boltStore) update(fn func(*bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.Update(fn)
+}
+
+// boltGet decodes the value stored under key in bucket into v, or returns ErrNotFound
+func boltGet(tx *bolt.Tx, bucket, key []byte, v interface{}) error {
+	data := tx.Bucket(bucket).Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// boltPut encodes v and stores it under key in bucket
+func boltPut(tx *bolt.Tx, bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put(key, data)
+}
+
+/**********************************
+***  Bolt Transactor            ***
+***********************************/
+
+// BoltTransactor implements transactions for the bolt stores with bolt read-write transactions
+type BoltTransactor struct {
+	db *bolt.DB
+}
+
+// NewBoltTransactor creates a BoltTransactor for the given database
+func NewBoltTransactor(db *bolt.DB) *BoltTransactor {
+	return &BoltTransactor{
+		db: db,
+	}
+}
+
+// Begin starts a new read-write transaction
+func (t *BoltTransactor) Begin(_ context.Context) (Tx, error) {
+	tx, err := t.db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	return &boltTx{tx: tx}, nil
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Users() UserStore {
+	return &BoltUserStore{boltStore{db: t.tx.DB(), tx: t.tx}}
+}
+
+func (t *boltTx) Sessions() SessionStore {
+	return &BoltSessionStore{boltStore{db: t.tx.DB(), tx: t.tx}}
+}
+
+func (t *boltTx) UserConfigs() UserConfigStore {
+	return &BoltUserConfigStore{boltStore{db: t.tx.DB(), tx: t.tx}}
+}
+
+func (t *boltTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *boltTx) Rollback() error {
+	err := t.tx.Rollback()
+	if errors.Is(err, bolt.ErrTxClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,676 @@
+package webapp
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stores can be wrapped by caching stores, which answer the lookups by id, username and email from
+//   - a per-request cache in the request context, installed by the Middleware, which also remembers
+//     missing entries, so e.g. a page render reads the current session, user and user config only once
+//   - an optional process-wide LRU cache with a TTL, which is only safe as long as a single process
+//     writes to the storage backend, or when stale entries for the duration of the TTL are acceptable
+// Both caches are invalidated by Save and Delete, including the ones made inside of transactions.
+// Every invalidation advances the generation of the LRU cache, and values read from a store are only
+// cached if no invalidation happened while they were read, since they might already be stale.
+// Lists and queries are always passed through to the wrapped store.
+
+// requestCacheKey is the context key of the per-request cache
+type requestCacheKey struct{}
+
+// requestCache memoises store lookups for the duration of a single request
+type requestCache struct {
+	mu      sync.Mutex
+	entries map[string]interface{}
+}
+
+// WithRequestCache returns a copy of ctx carrying a new per-request cache for the caching stores
+func WithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheKey{}, &requestCache{entries: map[string]interface{}{}})
+}
+
+func requestCacheFrom(ctx context.Context) *requestCache {
+	cache, _ := ctx.Value(requestCacheKey{}).(*requestCache)
+	return cache
+}
+
+func (c *requestCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.entries[key]
+	return value, ok
+}
+
+func (c *requestCache) set(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = value
+}
+
+func (c *requestCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]interface{}{}
+}
+
+/**********************************
+***  LRU Cache                  ***
+***********************************/
+
+// LRUCache is a thread-safe, size limited cache whose entries expire after a TTL
+type LRUCache struct {
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	order      *list.List // most recently used entry in front
+	entries    map[string]*list.Element
+	generation uint64 // advanced by Delete and Clear
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewLRUCache creates an LRUCache holding up to size entries, each for at most ttl or forever if ttl is 0
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// Get returns the value stored under key, if it exists and hasn't expired
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Set stores value under key and evicts the least recently used entry if the cache is full
+func (c *LRUCache) Set(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(key, value)
+}
+
+// put stores value under key, the caller has to hold the lock
+func (c *LRUCache) put(key string, value interface{}) {
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// currentGeneration returns the generation of the cache, which changes whenever entries are removed
+func (c *LRUCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// setIfCurrent stores value under key like Set, unless the generation of the cache has changed
+// since the value was read, and reports if it has been stored
+func (c *LRUCache) setIfCurrent(key string, value interface{}, generation uint64) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return false
+	}
+	c.put(key, value)
+	return true
+}
+
+// Delete removes the entries stored under the given keys
+func (c *LRUCache) Delete(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear removes all entries
+func (c *LRUCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
+
+/**********************************
+***  Store Cache                ***
+***********************************/
+
+// storeCache combines the per-request cache of the context with the optional process-wide LRU cache
+type storeCache struct {
+	lru *LRUCache
+}
+
+// get looks the key up in the request cache first and in the LRU cache second
+func (c storeCache) get(ctx context.Context, key string) (interface{}, bool) {
+	if value, ok := requestCacheFrom(ctx).get(key); ok {
+		return value, true
+	}
+	value, ok := c.lru.Get(key)
+	if ok {
+		requestCacheFrom(ctx).set(key, value)
+	}
+	return value, ok
+}
+
+// generation returns the generation of the LRU cache, it has to be taken before reading from the store
+func (c storeCache) generation() uint64 {
+	return c.lru.currentGeneration()
+}
+
+// set remembers a found value in both caches, unless the caches have been invalidated since
+// the value has been read at the given generation
+func (c storeCache) set(ctx context.Context, key string, value interface{}, generation uint64) {
+	if c.lru.setIfCurrent(key, value, generation) {
+		requestCacheFrom(ctx).set(key, value)
+	}
+}
+
+// setMissing remembers in the request cache that there is no value for key.
+// Missing entries aren't kept in the LRU cache, since other processes may create them.
+func (c storeCache) setMissing(ctx context.Context, key string) {
+	requestCacheFrom(ctx).set(key, ErrNotFound)
+}
+
+// invalidate removes the keys from the LRU cache and clears the request cache,
+// whose entries might refer to the changed values by another key
+func (c storeCache) invalidate(ctx context.Context, keys ...string) {
+	requestCacheFrom(ctx).clear()
+	c.lru.Delete(keys...)
+}
+
+// invalidateAll clears the request cache and the LRU cache
+func (c storeCache) invalidateAll(ctx context.Context) {
+	requestCacheFrom(ctx).clear()
+	c.lru.Clear()
+}
+
+// cache keys of the store entries, usernames and email addresses are looked up case-insensitively
+func userCacheKey(id string) string           { return "user:" + id }
+func usernameCacheKey(username string) string { return "username:" + strings.ToLower(username) }
+func emailCacheKey(email string) string       { return "email:" + strings.ToLower(email) }
+func sessionCacheKey(id string) string        { return "session:" + id }
+func userConfigCacheKey(userid string) string { return "userconfig:" + userid }
+
+// copyUser returns a copy of the user, so callers can't modify cached values
+func copyUser(user *User) *User {
+	copied := *user
+	copied.Sessions = append([]Session(nil), user.Sessions...)
+	return &copied
+}
+
+/**********************************
+***  Cached User Store          ***
+***********************************/
+
+// CachedUserStore is a read-through cache in front of a UserStore
+type CachedUserStore struct {
+	store UserStore
+	cache storeCache
+}
+
+// NewCachedUserStore wraps store with the per-request cache and the LRU cache, which may be nil
+func NewCachedUserStore(store UserStore, lru *LRUCache) *CachedUserStore {
+	return &CachedUserStore{
+		store: store,
+		cache: storeCache{lru: lru},
+	}
+}
+
+func (store *CachedUserStore) Find(ctx context.Context, id string) (*User, error) {
+	key := userCacheKey(id)
+	if value, ok := store.cache.get(ctx, key); ok {
+		if user, ok := value.(*User); ok {
+			return copyUser(user), nil
+		}
+		return nil, ErrNotFound
+	}
+
+	generation := store.cache.generation()
+	user, err := store.store.Find(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		store.cache.setMissing(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.cache.set(ctx, key, copyUser(user), generation)
+	return user, nil
+}
+
+// findByIndex looks up the id of a user by username or email in the cache, and loads the user by id.
+// A cached id is only used when the user still has the looked up username or email.
+func (store *CachedUserStore) findByIndex(ctx context.Context, key string, matches func(*User) bool,
+	find func(context.Context) (*User, error)) (*User, error) {
+	if value, ok := store.cache.get(ctx, key); ok {
+		id, ok := value.(string)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		if user, err := store.Find(ctx, id); err == nil && matches(user) {
+			return user, nil
+		}
+	}
+
+	generation := store.cache.generation()
+	user, err := find(ctx)
+	if errors.Is(err, ErrNotFound) {
+		store.cache.setMissing(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.cache.set(ctx, key, user.ID, generation)
+	store.cache.set(ctx, userCacheKey(user.ID), copyUser(user), generation)
+	return user, nil
+}
+
+func (store *CachedUserStore) FindByUsername(ctx context.Context, name string) (*User, error) {
+	return store.findByIndex(ctx, usernameCacheKey(name),
+		func(user *User) bool { return strings.EqualFold(user.Username, name) },
+		func(ctx context.Context) (*User, error) { return store.store.FindByUsername(ctx, name) })
+}
+
+func (store *CachedUserStore) FindByEmail(ctx context.Context, email string) (*User, error) {
+	return store.findByIndex(ctx, emailCacheKey(email),
+		func(user *User) bool { return strings.EqualFold(user.Email, email) },
+		func(ctx context.Context) (*User, error) { return store.store.FindByEmail(ctx, email) })
+}
+
+func (store *CachedUserStore) All(ctx context.Context) ([]User, error) {
+	return store.store.All(ctx)
+}
+
+func (store *CachedUserStore) List(ctx context.Context, query UserQuery) (UserList, error) {
+	return store.store.List(ctx, query)
+}
+
+func (store *CachedUserStore) FindDeletionDue(ctx context.Context, before time.Time) ([]User, error) {
+	return store.store.FindDeletionDue(ctx, before)
+}
+
+func (store *CachedUserStore) Save(ctx context.Context, user *User) error {
+	defer store.invalidate(ctx, user)
+	return store.store.Save(ctx, user)
+}
+
+func (store *CachedUserStore) Delete(ctx context.Context, user *User) error {
+	defer store.invalidate(ctx, user)
+	return store.store.Delete(ctx, user)
+}
+
+// invalidate removes the user from the caches. Stale username and email entries are
+// detected by findByIndex, so only the new ones need to be removed.
+func (store *CachedUserStore) invalidate(ctx context.Context, user *User) {
+	store.cache.invalidate(ctx, userCacheKey(user.ID), usernameCacheKey(user.Username), emailCacheKey(user.Email))
+}
+
+/**********************************
+***  Cached Session Store       ***
+***********************************/
+
+// CachedSessionStore is a read-through cache in front of a SessionStore. Changing a session
+// also invalidates the cached user, since users are cached together with their sessions.
+type CachedSessionStore struct {
+	store SessionStore
+	cache storeCache
+}
+
+// NewCachedSessionStore wraps store with the per-request cache and the LRU cache, which may be nil
+func NewCachedSessionStore(store SessionStore, lru *LRUCache) *CachedSessionStore {
+	return &CachedSessionStore{
+		store: store,
+		cache: storeCache{lru: lru},
+	}
+}
+
+func (store *CachedSessionStore) Find(ctx context.Context, id string) (*Session, error) {
+	key := sessionCacheKey(id)
+	if value, ok := store.cache.get(ctx, key); ok {
+		if session, ok := value.(Session); ok {
+			return &session, nil
+		}
+		return nil, ErrNotFound
+	}
+
+	generation := store.cache.generation()
+	session, err := store.store.Find(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		store.cache.setMissing(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.cache.set(ctx, key, *session, generation)
+	return session, nil
+}
+
+func (store *CachedSessionStore) FindByUser(ctx context.Context, userid string) ([]Session, error) {
+	return store.store.FindByUser(ctx, userid)
+}
+
+func (store *CachedSessionStore) FindByUsers(ctx context.Context, userids []string) (map[string][]Session, error) {
+	return store.store.FindByUsers(ctx, userids)
+}
+
+func (store *CachedSessionStore) Save(ctx context.Context, session *Session) error {
+	defer store.invalidate(ctx, session)
+	return store.store.Save(ctx, session)
+}
+
+func (store *CachedSessionStore) Delete(ctx context.Context, session *Session) error {
+	defer store.invalidate(ctx, session)
+	return store.store.Delete(ctx, session)
+}
+
+// DeleteExpired purges the whole LRU cache if any session was removed, since the cached users
+// of the removed sessions aren't known
+func (store *CachedSessionStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	n, err := store.store.DeleteExpired(ctx, before)
+	if n > 0 {
+		store.cache.invalidateAll(ctx)
+	}
+	return n, err
+}
+
+// CountActive isn't cached, the count changes with every login
+func (store *CachedSessionStore) CountActive(ctx context.Context, now time.Time) (int, error) {
+	return store.store.CountActive(ctx, now)
+}
+
+func (store *CachedSessionStore) invalidate(ctx context.Context, session *Session) {
+	store.cache.invalidate(ctx, sessionCacheKey(session.ID), userCacheKey(session.UserID))
+}
+
+/**********************************
+***  Cached UserConfig Store    ***
+***********************************/
+
+// CachedUserConfigStore is a read-through cache in front of a UserConfigStore
+type CachedUserConfigStore struct {
+	store UserConfigStore
+	cache storeCache
+}
+
+// NewCachedUserConfigStore wraps store with the per-request cache and the LRU cache, which may be nil
+func NewCachedUserConfigStore(store UserConfigStore, lru *LRUCache) *CachedUserConfigStore {
+	return &CachedUserConfigStore{
+		store: store,
+		cache: storeCache{lru: lru},
+	}
+}
+
+func (store *CachedUserConfigStore) Find(ctx context.Context, userid string) (*UserConfig, error) {
+	key := userConfigCacheKey(userid)
+	if value, ok := store.cache.get(ctx, key); ok {
+		if userconfig, ok := value.(UserConfig); ok {
+			return &userconfig, nil
+		}
+		return nil, ErrNotFound
+	}
+
+	generation := store.cache.generation()
+	userconfig, err := store.store.Find(ctx, userid)
+	if errors.Is(err, ErrNotFound) {
+		store.cache.setMissing(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.cache.set(ctx, key, *userconfig, generation)
+	return userconfig, nil
+}
+
+// FindByUsers returns the cached userconfigs and looks up the others with a single call of the store
+func (store *CachedUserConfigStore) FindByUsers(ctx context.Context, userids []string) (map[string]UserConfig, error) {
+	userconfigs := map[string]UserConfig{}
+	var missing []string
+	for _, userid := range userids {
+		value, ok := store.cache.get(ctx, userConfigCacheKey(userid))
+		if !ok {
+			missing = append(missing, userid)
+			continue
+		}
+		if userconfig, ok := value.(UserConfig); ok {
+			userconfigs[userid] = userconfig
+		}
+	}
+	if len(missing) == 0 {
+		return userconfigs, nil
+	}
+
+	generation := store.cache.generation()
+	found, err := store.store.FindByUsers(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, userid := range missing {
+		userconfig, ok := found[userid]
+		if !ok {
+			store.cache.setMissing(ctx, userConfigCacheKey(userid))
+			continue
+		}
+		store.cache.set(ctx, userConfigCacheKey(userid), userconfig, generation)
+		userconfigs[userid] = userconfig
+	}
+	return userconfigs, nil
+}
+
+func (store *CachedUserConfigStore) Save(ctx context.Context, userconfig *UserConfig) error {
+	defer store.cache.invalidate(ctx, userConfigCacheKey(userconfig.UserID))
+	return store.store.Save(ctx, userconfig)
+}
+
+func (store *CachedUserConfigStore) Delete(ctx context.Context, userconfig *UserConfig) error {
+	defer store.cache.invalidate(ctx, userConfigCacheKey(userconfig.UserID))
+	return store.store.Delete(ctx, userconfig)
+}
+
+/**********************************
+***  Cached Transactor          ***
+***********************************/
+
+// CachedTransactor wraps a Transactor, so changes made inside of transactions invalidate the caches.
+// Lookups inside of a transaction always read from the transaction.
+type CachedTransactor struct {
+	transactor Transactor
+	lru        *LRUCache
+}
+
+// NewCachedTransactor wraps transactor to invalidate the LRU cache, which may be nil
+func NewCachedTransactor(transactor Transactor, lru *LRUCache) *CachedTransactor {
+	return &CachedTransactor{
+		transactor: transactor,
+		lru:        lru,
+	}
+}
+
+// Begin starts a new transaction of the wrapped Transactor
+func (t *CachedTransactor) Begin(ctx context.Context) (Tx, error) {
+	tx, err := t.transactor.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTx{Tx: tx, ctx: ctx, cache: storeCache{lru: t.lru}}, nil
+}
+
+// cachedTx records the cache keys of all changes and invalidates them again after the commit,
+// so no value read by a concurrent request before the commit stays in the cache
+type cachedTx struct {
+	Tx
+	ctx   context.Context
+	cache storeCache
+	mu    sync.Mutex
+	keys  []string
+	all   bool // set when the changed keys aren't known
+}
+
+func (tx *cachedTx) invalidate(ctx context.Context, keys ...string) {
+	tx.mu.Lock()
+	tx.keys = append(tx.keys, keys...)
+	tx.mu.Unlock()
+	tx.cache.invalidate(ctx, keys...)
+}
+
+func (tx *cachedTx) Users() UserStore {
+	return txUserStore{UserStore: tx.Tx.Users(), tx: tx}
+}
+
+func (tx *cachedTx) Sessions() SessionStore {
+	return txSessionStore{SessionStore: tx.Tx.Sessions(), tx: tx}
+}
+
+func (tx *cachedTx) UserConfigs() UserConfigStore {
+	return txUserConfigStore{UserConfigStore: tx.Tx.UserConfigs(), tx: tx}
+}
+
+func (tx *cachedTx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.all {
+		tx.cache.invalidateAll(tx.ctx)
+	} else {
+		tx.cache.invalidate(tx.ctx, tx.keys...)
+	}
+	return err
+}
+
+type txUserStore struct {
+	UserStore
+	tx *cachedTx
+}
+
+func (store txUserStore) Save(ctx context.Context, user *User) error {
+	defer store.tx.invalidate(ctx, userCacheKey(user.ID), usernameCacheKey(user.Username), emailCacheKey(user.Email))
+	return store.UserStore.Save(ctx, user)
+}
+
+func (store txUserStore) Delete(ctx context.Context, user *User) error {
+	defer store.tx.invalidate(ctx, userCacheKey(user.ID), usernameCacheKey(user.Username), emailCacheKey(user.Email))
+	return store.UserStore.Delete(ctx, user)
+}
+
+type txSessionStore struct {
+	SessionStore
+	tx *cachedTx
+}
+
+func (store txSessionStore) Save(ctx context.Context, session *Session) error {
+	defer store.tx.invalidate(ctx, sessionCacheKey(session.ID), userCacheKey(session.UserID))
+	return store.SessionStore.Save(ctx, session)
+}
+
+func (store txSessionStore) Delete(ctx context.Context, session *Session) error {
+	defer store.tx.invalidate(ctx, sessionCacheKey(session.ID), userCacheKey(session.UserID))
+	return store.SessionStore.Delete(ctx, session)
+}
+
+func (store txSessionStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	n, err := store.SessionStore.DeleteExpired(ctx, before)
+	if n > 0 {
+		store.tx.mu.Lock()
+		store.tx.all = true
+		store.tx.mu.Unlock()
+		store.tx.cache.invalidateAll(ctx)
+	}
+	return n, err
+}
+
+type txUserConfigStore struct {
+	UserConfigStore
+	tx *cachedTx
+}
+
+func (store txUserConfigStore) Save(ctx context.Context, userconfig *UserConfig) error {
+	defer store.tx.invalidate(ctx, userConfigCacheKey(userconfig.UserID))
+	return store.UserConfigStore.Save(ctx, userconfig)
+}
+
+func (store txUserConfigStore) Delete(ctx context.Context, userconfig *UserConfig) error {
+	defer store.tx.invalidate(ctx, userConfigCacheKey(userconfig.UserID))
+	return store.UserConfigStore.Delete(ctx, userconfig)
+}
+
+// SetupCache wraps the global stores and the GlobalTransactor with the caching stores.
+// The process-wide LRU cache is only used if cfg.Size is set.
+func SetupCache(cfg CacheConfig) {
+	var lru *LRUCache
+	if cfg.Size > 0 {
+		lru = NewLRUCache(cfg.Size, cfg.TTL)
+	}
+
+	GlobalUserStore = NewCachedUserStore(GlobalUserStore, lru)
+	GlobalSessionStore = NewCachedSessionStore(GlobalSessionStore, lru)
+	GlobalUserConfigStore = NewCachedUserConfigStore(GlobalUserConfigStore, lru)
+	GlobalTransactor = NewCachedTransactor(GlobalTransactor, lru)
+}
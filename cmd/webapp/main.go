@@ -1,51 +1,134 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"github.com/julienschmidt/httprouter"
+	"fmt"
 	"github.com/snafuprinzip/webapp"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"time"
 )
 
 //const Debug = true
 
-// NewRouter creates a new http router
-func NewRouter() *httprouter.Router {
-	router := httprouter.New()
+// shutdownTimeout is the time running requests get to finish when the server is stopped
+const shutdownTimeout = 10 * time.Second
+
+// NewRouter creates a new http router, which records the routes of the requests for the metrics
+func NewRouter() *webapp.Router {
+	router := webapp.NewRouter()
 	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	// routers are chained, so a route with another method may be handled by one of the following routers
+	router.HandleMethodNotAllowed = false
 	return router
 }
 
-// SetupDataBackend initializes the data backend, either a postgres db or local yaml files in the data directory
+// storeFiles returns the paths of the yaml files used by the filesystem storage backend
+func storeFiles() (users, userconfigs, sessions, jobruns, webhooks string) {
+	return path.Join(webapp.Config.DataDirectory, "users.yaml"),
+		path.Join(webapp.Config.DataDirectory, "userconfigs.yaml"),
+		path.Join(webapp.Config.DataDirectory, "sessions.yaml"),
+		path.Join(webapp.Config.DataDirectory, "jobruns.yaml"),
+		path.Join(webapp.Config.DataDirectory, "webhooks.yaml")
+}
+
+// SetupDataBackend initializes the data backend, either a postgres or mysql db, local yaml files in the data directory,
+// an embedded bolt database or memory only
 func SetupDataBackend() {
 	// setup Global user store
 	log.Println("Setting up db connectors...")
 	if webapp.Config.DBConnector == "" || webapp.Config.DBConnector == "files" {
 		// DBConnector isn't set or set to files, so we use the filesystem storage backend
 		// and write yaml files to the data directory
-		userstore, err := webapp.NewFileUserStore(path.Join(webapp.Config.DataDirectory, "users.yaml"))
+		usersfile, userconfigsfile, sessionsfile, jobrunsfile, webhooksfile := storeFiles()
+
+		userstore, err := webapp.NewFileUserStore(usersfile)
 		if err != nil {
 			log.Fatalf("Error creating user store: %s\n", err)
 		}
 		webapp.GlobalUserStore = userstore
 
-		userconfigstore, err := webapp.NewFileUserConfigStore(path.Join(webapp.Config.DataDirectory, "userconfigs.yaml"))
+		userconfigstore, err := webapp.NewFileUserConfigStore(userconfigsfile)
 		if err != nil {
 			log.Fatalf("Error creating userconfigs store: %s\n", err)
 		}
 		webapp.GlobalUserConfigStore = userconfigstore
 
-		sessionstore, err := webapp.NewFileSessionStore(path.Join(webapp.Config.DataDirectory, "sessions.yaml"))
+		sessionstore, err := webapp.NewFileSessionStore(sessionsfile)
 		if err != nil {
 			log.Fatalf("Error creating session store: %s\n", err)
 		}
 		webapp.GlobalSessionStore = sessionstore
+
+		webapp.GlobalTransactor = webapp.NewFileTransactor(userstore, sessionstore, userconfigstore)
+
+		jobrunstore, err := webapp.NewFileJobRunStore(jobrunsfile)
+		if err != nil {
+			log.Fatalf("Error creating job run store: %s\n", err)
+		}
+		webapp.GlobalJobRunStore = jobrunstore
+
+		webhookstore, err := webapp.NewFileWebhookStore(webhooksfile)
+		if err != nil {
+			log.Fatalf("Error creating webhook store: %s\n", err)
+		}
+		webapp.GlobalWebhookStore = webhookstore
+	} else if webapp.Config.DBConnector == "memory" {
+		// DBConnector is set to memory, so we keep all data in memory only, optionally
+		// starting with the contents of a seed file
+		userstore, sessionstore, userconfigstore, err := webapp.NewMemoryStores(webapp.Config.SeedFile)
+		if err != nil {
+			log.Fatalf("Error creating memory stores: %s\n", err)
+		}
+		webapp.GlobalUserStore = userstore
+		webapp.GlobalUserConfigStore = userconfigstore
+		webapp.GlobalSessionStore = sessionstore
+
+		webapp.GlobalTransactor = webapp.NewMemoryTransactor(userstore, sessionstore, userconfigstore)
+		webapp.GlobalJobRunStore = webapp.NewMemoryJobRunStore()
+		webapp.GlobalWebhookStore = webapp.NewMemoryWebhookStore()
+	} else if boltfile, ok := strings.CutPrefix(webapp.Config.DBConnector, "bolt"); ok {
+		// DBConnector is set to bolt or bolt:<path>, so we use an embedded bolt database file,
+		// by default webapp.db in the data directory
+		boltfile = strings.TrimPrefix(boltfile, ":")
+		if boltfile == "" {
+			boltfile = path.Join(webapp.Config.DataDirectory, "webapp.db")
+		}
+		db, err := webapp.NewBoltDB(boltfile)
+		if err != nil {
+			log.Fatalf("Error opening bolt database: %s\n", err)
+		}
+		webapp.GlobalBoltDB = db
+
+		webapp.GlobalUserStore = webapp.NewBoltUserStore(db)
+		webapp.GlobalUserConfigStore = webapp.NewBoltUserConfigStore(db)
+		webapp.GlobalSessionStore = webapp.NewBoltSessionStore(db)
+		webapp.GlobalTransactor = webapp.NewBoltTransactor(db)
+		webapp.GlobalJobRunStore = webapp.NewBoltJobRunStore(db)
+		webapp.GlobalWebhookStore = webapp.NewBoltWebhookStore(db)
+	} else if strings.HasPrefix(webapp.Config.DBConnector, "mysql://") {
+		// DBConnector is a mysql:// DSN, so we use a MySQL or MariaDB database
+		db, err := webapp.NewMySQLDB(webapp.Config.DBConnector, webapp.Config.Database)
+		if err != nil {
+			log.Fatalf("Error creating new Database: %s\n", err)
+		}
+		webapp.GlobalMySQLDB = db
+
+		webapp.GlobalUserStore = webapp.NewMySQLUserStore()
+		webapp.GlobalUserConfigStore = webapp.NewMySQLUserConfigStore()
+		webapp.GlobalSessionStore = webapp.NewMySQLSessionStore()
+		webapp.GlobalTransactor = webapp.NewMySQLTransactor(db)
+		webapp.GlobalJobRunStore = webapp.NewMySQLJobRunStore()
+		webapp.GlobalWebhookStore = webapp.NewMySQLWebhookStore()
+		webapp.GlobalJobLocker = webapp.NewMySQLJobLocker(db)
 	} else { // DBConnector is set, so we use the database backend
 		// setup database
-		db, err := webapp.NewPostgresDB(webapp.Config.DBConnector)
+		db, err := webapp.NewPostgresDB(webapp.Config.DBConnector, webapp.Config.Database)
 		//defer db.Close() --- cannot close in this func or database calls outside will be against a closed db
 
 		if err != nil {
@@ -56,7 +139,38 @@ func SetupDataBackend() {
 		webapp.GlobalUserStore = webapp.NewDBUserStore()
 		webapp.GlobalUserConfigStore = webapp.NewDBUserConfigStore()
 		webapp.GlobalSessionStore = webapp.NewDBSessionStore()
+		webapp.GlobalTransactor = webapp.NewDBTransactor(db)
+		webapp.GlobalJobRunStore = webapp.NewDBJobRunStore()
+		webapp.GlobalWebhookStore = webapp.NewDBWebhookStore()
+		webapp.GlobalJobLocker = webapp.NewPostgresJobLocker(db)
+	}
+}
+
+// CloseDataBackend closes the database of the data backend, if there is one
+func CloseDataBackend() {
+	if webapp.GlobalPostgresDB != nil {
+		webapp.GlobalPostgresDB.Close()
+	}
+	if webapp.GlobalMySQLDB != nil {
+		webapp.GlobalMySQLDB.Close()
+	}
+	if webapp.GlobalBoltDB != nil {
+		webapp.GlobalBoltDB.Close()
+	}
+}
+
+// Rekey re-encrypts the data files of the filesystem storage backend with the primary encryption key.
+// The server must not be running while the files are rewritten.
+func Rekey() {
+	usersfile, userconfigsfile, sessionsfile, jobrunsfile, webhooksfile := storeFiles()
+	if err := webapp.Rekey(usersfile, userconfigsfile, sessionsfile, jobrunsfile, webhooksfile); err != nil {
+		log.Fatalf("Error re-encrypting data files: %s\n", err)
+	}
+	if webapp.GlobalKeyRing == nil {
+		log.Println("No encryption key configured, data files have been decrypted")
+		return
 	}
+	log.Println("Data files have been encrypted with the primary key")
 }
 
 func main() {
@@ -64,6 +178,11 @@ func main() {
 
 	// get command line arguments
 	flag.StringVar(&configfile, "config", "./config/config.yaml", "Path to configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [rekey]\n\n"+
+			"Commands:\n  rekey\tre-encrypt the data files with the current primary encryption key\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// read configuration from configfile
@@ -74,16 +193,51 @@ func main() {
 		}
 	}
 
+	// load encryption keys for the data files
+	if err := webapp.SetupEncryption(); err != nil {
+		log.Fatalf("Error loading encryption keys: %s\n", err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "rekey":
+		Rekey()
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	webapp.NewApp("WebApp")
 	defer webapp.Logfile.Close()
+	defer webapp.Shutdown()
 
 	// Create Data Stores
 	SetupDataBackend()
-	defer webapp.GlobalPostgresDB.Close()
+	defer CloseDataBackend()
+	if err := webapp.SetupMetrics(webapp.Config.Metrics); err != nil {
+		log.Fatalf("Error setting up metrics: %s\n", err)
+	}
+	webapp.SetupCache(webapp.Config.Cache)
+	webapp.SetupEvents()
+	if err := webapp.SetupMail(webapp.Config.Mail); err != nil {
+		log.Fatalf("Error setting up mail: %s\n", err)
+	}
 	webapp.Logln(webapp.InfoLevel, "Backend Storages created")
 
 	// Create Admin account if needed
-	webapp.CreateAdminAccount()
+	webapp.CreateAdminAccount(context.Background())
+
+	// schedule the background jobs
+	for _, job := range []webapp.Job{
+		webapp.SessionReaperJob(webapp.Config.SessionReapInterval),
+		webapp.UserPurgerJob(),
+		webapp.WebhookRetryJob(),
+	} {
+		if err := webapp.GlobalScheduler.Add(job); err != nil {
+			log.Fatalf("Error scheduling job: %s\n", err)
+		}
+	}
 
 	// setup the public multiplexer
 	log.Println("Setting up routers...")
@@ -94,11 +248,27 @@ func main() {
 		router.GET("/register", webapp.HandleUserNew)
 		router.POST("/register", webapp.HandleUserCreate)
 	}
+	router.GET("/password/:token", webapp.HandlePasswordEdit)
+	router.POST("/password/:token", webapp.HandlePasswordUpdate)
 	router.GET("/login", webapp.HandleSessionNew)
 	router.POST("/login", webapp.HandleSessionCreate)
+	router.GET("/api/v1/openapi.json", webapp.HandleOpenAPIv1)
+	router.GET("/metrics", webapp.HandleMetrics)
 	router.ServeFiles("/assets/*filepath", http.Dir("assets/"))
 	router.ServeFiles("/3rdparty/*filepath", http.Dir("3rdparty/"))
 
+	// set up the mux for the SCIM provisioning, authenticated with the bearer token of the scim config
+	scimRouter := NewRouter()
+	scimRouter.NotFound = http.HandlerFunc(webapp.HandleSCIMNotFound)
+	scimRouter.GET("/scim/v2/ServiceProviderConfig", webapp.HandleSCIMServiceProviderConfig)
+	scimRouter.GET("/scim/v2/ResourceTypes", webapp.HandleSCIMResourceTypes)
+	scimRouter.GET("/scim/v2/Users", webapp.HandleSCIMUsersGET)
+	scimRouter.POST("/scim/v2/Users", webapp.HandleSCIMUserPOST)
+	scimRouter.GET("/scim/v2/Users/:id", webapp.HandleSCIMUserGET)
+	scimRouter.PUT("/scim/v2/Users/:id", webapp.HandleSCIMUserPUT)
+	scimRouter.PATCH("/scim/v2/Users/:id", webapp.HandleSCIMUserPATCH)
+	scimRouter.DELETE("/scim/v2/Users/:id", webapp.HandleSCIMUserDELETE)
+
 	// set up the mux for authenticated users
 	secureRouter := NewRouter()
 	secureRouter.GET("/signout", webapp.HandleSessionDestroy)
@@ -109,22 +279,84 @@ func main() {
 	secureRouter.GET("/settings", webapp.HandleUserConfigEdit)
 	secureRouter.POST("/settings", webapp.HandleUserConfigUpdate)
 	secureRouter.GET("/api/v1/settings", webapp.HandleUserConfigGETv1)
+	secureRouter.GET("/api/v1/users/:id", webapp.HandleUserGETv1)
+	secureRouter.PUT("/api/v1/users/:id", webapp.HandleUserPUTv1)
+	secureRouter.PATCH("/api/v1/users/:id", webapp.HandleUserPATCHv1)
+
+	// all kinds of the v2 API are served by the same handlers, the kinds check the access to their objects
+	webapp.RegisterAPIKind(webapp.UserAPIKind())
+	webapp.RegisterAPIKind(webapp.UserConfigAPIKind())
+	secureRouter.GET("/api/v2/:resource", webapp.HandleObjectsGETv2)
+	secureRouter.POST("/api/v2/:resource", webapp.HandleObjectPOSTv2)
+	secureRouter.GET("/api/v2/:resource/:name", webapp.HandleObjectGETv2)
+	secureRouter.PUT("/api/v2/:resource/:name", webapp.HandleObjectPUTv2)
+	secureRouter.PATCH("/api/v2/:resource/:name", webapp.HandleObjectPATCHv2)
+	secureRouter.DELETE("/api/v2/:resource/:name", webapp.HandleObjectDELETEv2)
+
+	// the GraphQL resolvers check the access like the handlers of the REST API
+	secureRouter.GET("/api/graphql", webapp.HandleGraphQL)
+	secureRouter.POST("/api/graphql", webapp.HandleGraphQL)
 
 	adminRouter := NewRouter()
 	adminRouter.GET("/users", webapp.HandleUsersIndex)
+	adminRouter.GET("/jobs", webapp.HandleJobsIndex)
+	adminRouter.GET("/import", webapp.HandleUsersImport)
+	adminRouter.POST("/import", webapp.HandleUsersImportUpload)
+	adminRouter.GET("/webhooks", webapp.HandleWebhooksIndex)
+	adminRouter.POST("/webhooks", webapp.HandleWebhookCreate)
+	adminRouter.GET("/webhooks/:id", webapp.HandleWebhookShow)
+	adminRouter.POST("/webhooks/:id/delete", webapp.HandleWebhookDelete)
+	adminRouter.POST("/webhooks/:id/deliveries/:delivery", webapp.HandleWebhookRedeliver)
 	adminRouter.GET("/api/v1/users", webapp.HandleUsersGETv1)
+	adminRouter.POST("/api/v1/users", webapp.HandleUserPOSTv1)
+	adminRouter.DELETE("/api/v1/users", webapp.HandleUsersDELETEv1)
+	adminRouter.POST("/api/v1/users/:id/restore", webapp.HandleUserRestorev1)
 	adminRouter.DELETE("/api/v1/users/:id", webapp.HandleUserDELETEv1)
 	adminRouter.GET("/api/v1/settings/:id", webapp.HandleUserConfigGETv1)
 
+	// custom methods like :import can't be registered with httprouter next to the resource
+	customMethodRouter := webapp.NewCustomMethodRouter()
+	customMethodRouter.POST("/api/v1/users:import", webapp.HandleUsersImportv1)
+
+	// limit the requests before they're handled
+	ratelimiter, err := webapp.NewRateLimiter(webapp.Config.RateLimit)
+	if err != nil {
+		log.Fatalf("Error setting up rate limiting: %s\n", err)
+	}
+
 	// add middleware handlers
 	middleware := webapp.Middleware{}
+	middleware.Add(ratelimiter)
 	middleware.Add(router)
+	middleware.Add(http.HandlerFunc(webapp.RequireSCIMToken))
+	middleware.Add(scimRouter)
 	middleware.Add(http.HandlerFunc(webapp.RequireLogin))
 	middleware.Add(secureRouter)
 	middleware.Add(http.HandlerFunc(webapp.RequireAdmin))
 	middleware.Add(adminRouter)
+	middleware.Add(customMethodRouter)
 
 	// listen and serve
 	webapp.Logln(webapp.InfoLevel, "starting listener on address", webapp.Config.BindAddress)
-	webapp.Logln(webapp.FatalLevel, http.ListenAndServe(webapp.Config.BindAddress, middleware))
+	server := &http.Server{
+		Addr:    webapp.Config.BindAddress,
+		Handler: middleware,
+	}
+	go func() {
+		// the app context is cancelled on SIGINT or SIGTERM
+		<-webapp.AppContext.Done()
+		webapp.Logln(webapp.InfoLevel, "shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			webapp.Logln(webapp.ErrorLevel, "Unable to shut down listener:", err)
+		}
+	}()
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		webapp.Logln(webapp.FatalLevel, err)
+	}
+
+	// wait for the background jobs and webhook deliveries before the stores are closed
+	webapp.GlobalScheduler.Wait()
+	webapp.WaitWebhookDeliveries()
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"os"
+	"time"
 )
 
 type ConfigStruct struct {
@@ -13,6 +14,111 @@ type ConfigStruct struct {
 	LogDirectory     string   `yaml:"logDirectory"`
 	LogLevel         Loglevel `yaml:"logLevel"`
 	OpenRegistration bool     `yaml:"openRegistration"`
+
+	// EncryptionKeyFile contains the base64 encoded keys for the file stores, one per line, the first one
+	// is used for encryption. Overridden by the WEBAPP_ENCRYPTION_KEY environment variable.
+	EncryptionKeyFile string `yaml:"encryptionKeyFile,omitempty"`
+	// SeedFile is loaded into the stores on startup when DBConnector is set to memory
+	SeedFile string `yaml:"seedFile,omitempty"`
+	// Database configures TLS and the connection pool of the database backends
+	Database DatabaseConfig `yaml:"database,omitempty"`
+	// SessionReapInterval is the interval in which expired sessions are removed, e.g. 30m, defaults to 1h
+	SessionReapInterval time.Duration `yaml:"sessionReapInterval,omitempty"`
+	// Jobs overrides the schedules of the background jobs by job name, either a cron expression like "0 3 * * *",
+	// an interval like "@every 30m" or "off" to disable the job
+	Jobs map[string]string `yaml:"jobs,omitempty"`
+	// Cache configures the process-wide cache in front of the stores
+	Cache CacheConfig `yaml:"cache,omitempty"`
+	// DeletionGracePeriods are the default grace periods of deletions by kind, e.g. User: 72h.
+	// Kinds without a grace period are deleted immediately unless the request sets gracePeriodSeconds.
+	DeletionGracePeriods map[string]time.Duration `yaml:"deletionGracePeriods,omitempty"`
+	// Mail configures the SMTP server for the invitation and password reset mails
+	Mail MailConfig `yaml:"mail,omitempty"`
+	// SCIM configures the provisioning of users by identity providers under /scim/v2
+	SCIM SCIMConfig `yaml:"scim,omitempty"`
+	// RateLimit configures the rate limiting of the requests
+	RateLimit RateLimitConfig `yaml:"rateLimit,omitempty"`
+	// Metrics restricts the access to the Prometheus metrics under /metrics
+	Metrics MetricsConfig `yaml:"metrics,omitempty"`
+}
+
+// MetricsConfig contains the access settings of the metrics endpoint. Scrapers need either the token or
+// an address of the allowed networks, without both the metrics aren't served to anyone.
+type MetricsConfig struct {
+	// Token is the bearer token of the scrapers, overridden by the WEBAPP_METRICS_TOKEN environment variable
+	Token string `yaml:"token,omitempty"`
+	// AllowedNetworks are the IPs or CIDR ranges which may scrape without token, e.g. 127.0.0.1 or 10.0.0.0/8
+	AllowedNetworks []string `yaml:"allowedNetworks,omitempty"`
+}
+
+// RateLimitConfig configures the token buckets limiting the requests of the clients
+type RateLimitConfig struct {
+	// Disabled turns the rate limiting off, e.g. if a reverse proxy limits the requests
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Store keeps the buckets, memory (default) for each instance on its own or postgres to share them
+	// between the instances of the application in the postgres database of dbConnector
+	Store string `yaml:"store,omitempty"`
+	// TrustedProxies are the IPs or CIDR ranges of reverse proxies whose X-Forwarded-For header is used
+	// for the client IP, e.g. 10.0.0.0/8
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+	// Policies limit the requests per route, the default policies limit logins, the API and SCIM
+	Policies []RateLimitPolicy `yaml:"policies,omitempty"`
+}
+
+// SCIMConfig contains the settings of the SCIM provisioning endpoint
+type SCIMConfig struct {
+	// Token is the bearer token of the SCIM clients, overridden by the WEBAPP_SCIM_TOKEN environment variable.
+	// SCIM requests are refused without one.
+	Token string `yaml:"token,omitempty"`
+	// DisabledRetention is the time users deactivated with SCIM are kept before they're deleted, e.g. 720h,
+	// defaults to the deletion grace period of users or 30 days
+	DisabledRetention time.Duration `yaml:"disabledRetention,omitempty"`
+}
+
+// MailConfig contains the SMTP settings of the mails sent by the application. Without a host the mails are
+// written to the log instead.
+type MailConfig struct {
+	Host     string `yaml:"host,omitempty"`
+	Port     int    `yaml:"port,omitempty"` // defaults to 587
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	From     string `yaml:"from,omitempty"` // sender address of the mails
+
+	// BaseURL is the external URL of the application used in the links of the mails,
+	// e.g. https://webapp.example.com, defaults to the URL of the request
+	BaseURL string `yaml:"baseURL,omitempty"`
+	// TokenKeyFile contains the base64 encoded key signing the password links of the mails. Overridden by the
+	// WEBAPP_TOKEN_KEY environment variable. Without one a random key is used and the links become invalid
+	// when the application is restarted.
+	TokenKeyFile string `yaml:"tokenKeyFile,omitempty"`
+	// TokenTTL is the time the password links are valid, e.g. 24h, defaults to 72h
+	TokenTTL time.Duration `yaml:"tokenTTL,omitempty"`
+}
+
+// CacheConfig configures the process-wide LRU cache of the stores. It should only be enabled if a single
+// instance of the application writes to the storage backend, otherwise changes of other instances become
+// visible after the TTL at the latest.
+type CacheConfig struct {
+	Size int           `yaml:"size,omitempty"` // maximum number of cached entries, 0 disables the cache
+	TTL  time.Duration `yaml:"ttl,omitempty"`  // e.g. 1m, 0 means entries only expire when they are changed
+}
+
+// DatabaseConfig contains the connection settings of the database backends. Settings given in the
+// dbConnector DSN take precedence over the ones configured here.
+type DatabaseConfig struct {
+	SSLMode     string `yaml:"sslMode,omitempty"`     // disable, require, verify-ca or verify-full, defaults to disable
+	SSLRootCert string `yaml:"sslRootCert,omitempty"` // path to the CA certificate of the server
+	SSLCert     string `yaml:"sslCert,omitempty"`     // path to the client certificate
+	SSLKey      string `yaml:"sslKey,omitempty"`      // path to the private key of the client certificate
+
+	MaxOpenConns     int           `yaml:"maxOpenConns,omitempty"`     // 0 means unlimited
+	MaxIdleConns     int           `yaml:"maxIdleConns,omitempty"`     // 0 keeps the default of 2
+	ConnMaxLifetime  time.Duration `yaml:"connMaxLifetime,omitempty"`  // e.g. 30m, 0 means connections are reused forever
+	ConnMaxIdleTime  time.Duration `yaml:"connMaxIdleTime,omitempty"`  // e.g. 5m, 0 means idle connections are kept
+	StatementTimeout time.Duration `yaml:"statementTimeout,omitempty"` // e.g. 30s, 0 means no timeout
+
+	// ConnectRetries is the number of times the first connection is retried with exponential backoff, defaults to 5
+	ConnectRetries int `yaml:"connectRetries,omitempty"`
 }
 
 var (
@@ -0,0 +1,342 @@
+package webapp
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API responses are encoded in the format requested with the format url parameter, e.g. ?format=csv,
+// or negotiated with the Accept header of the request. JSON is used if the client accepts anything.
+
+// responseFormat encodes API responses in one media type
+type responseFormat struct {
+	Name       string   // value of the format url parameter
+	MediaType  string   // content type of the response
+	MediaTypes []string // accepted media types, the first one is MediaType
+	Encode     func(w io.Writer, v interface{}) error
+}
+
+// responseFormats are the supported formats in order of preference
+var responseFormats = []responseFormat{
+	{Name: "json", MediaType: "application/json", MediaTypes: []string{"application/json"}, Encode: encodeJSON},
+	{Name: "yaml", MediaType: "text/yaml", MediaTypes: []string{"text/yaml", "application/yaml", "application/x-yaml"}, Encode: encodeYAML},
+	{Name: "xml", MediaType: "application/xml", MediaTypes: []string{"application/xml", "text/xml"}, Encode: encodeXML},
+	{Name: "csv", MediaType: "text/csv", MediaTypes: []string{"text/csv"}, Encode: encodeCSV},
+}
+
+var errNotAcceptable = errors.New("not acceptable")
+
+// writeResponse writes v with the given status code in the negotiated format.
+// If no supported format is acceptable, or v can't be represented in it, 406 Not Acceptable is returned.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeNotAcceptable(w, r, err)
+		return
+	}
+
+	// encode into a buffer first, so encoding errors can still change the status code
+	var body bytes.Buffer
+	if err := format.Encode(&body, v); err != nil {
+		writeNotAcceptable(w, r, fmt.Errorf("%w: the resource can't be represented as %s: %s", errNotAcceptable, format.Name, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", format.MediaType)
+	if format.Name == "csv" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s.csv", path.Base(r.URL.Path)))
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(body.Bytes()); err != nil {
+		Logln(DebugLevel, "Unable to write response:", err)
+	}
+}
+
+// writeNotAcceptable writes the 406 error listing the supported media types
+func writeNotAcceptable(w http.ResponseWriter, r *http.Request, err error) {
+	var mediaTypes []string
+	for _, format := range responseFormats {
+		mediaTypes = append(mediaTypes, format.MediaType)
+	}
+	writeAPIError(w, r, http.StatusNotAcceptable, codeNotAcceptable, fmt.Sprintf("%s, supported media types are %s", err, strings.Join(mediaTypes, ", ")))
+}
+
+// negotiateFormat returns the format given by the format url parameter, or else the supported format
+// with the highest quality in the Accept header. Formats of equal quality are chosen in the order of
+// the header.
+func negotiateFormat(r *http.Request) (*responseFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for i := range responseFormats {
+			if responseFormats[i].Name == name {
+				return &responseFormats[i], nil
+			}
+		}
+		return nil, fmt.Errorf("%w: unknown format %q", errNotAcceptable, name)
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return &responseFormats[0], nil
+	}
+
+	var best *responseFormat
+	bestQuality, bestPosition := 0.0, 0
+	ranges := parseAccept(accept)
+	for i := range responseFormats {
+		quality, position := acceptQuality(ranges, responseFormats[i].MediaTypes)
+		if quality > bestQuality || quality == bestQuality && quality > 0 && position < bestPosition {
+			best, bestQuality, bestPosition = &responseFormats[i], quality, position
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("%w: %s", errNotAcceptable, accept)
+	}
+	return best, nil
+}
+
+// acceptRange is a media range of an Accept header with its quality
+type acceptRange struct {
+	MediaType string
+	Quality   float64
+}
+
+// parseAccept splits an Accept header into its media ranges. Ranges without a valid q parameter
+// have the quality 1.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := acceptRange{
+			MediaType: strings.ToLower(strings.TrimSpace(params[0])),
+			Quality:   1,
+		}
+		if mediaRange.MediaType == "" {
+			continue
+		}
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && quality >= 0 && quality <= 1 {
+				mediaRange.Quality = quality
+			}
+		}
+		ranges = append(ranges, mediaRange)
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of the most specific media range matching one of the media types,
+// together with the position of the range in the header
+func acceptQuality(ranges []acceptRange, mediaTypes []string) (float64, int) {
+	quality, position, specificity := 0.0, len(ranges), -1
+	for _, mediaType := range mediaTypes {
+		mainType, _, _ := strings.Cut(mediaType, "/")
+		for i, mediaRange := range ranges {
+			rangeSpecificity := -1
+			switch mediaRange.MediaType {
+			case mediaType:
+				rangeSpecificity = 2
+			case mainType + "/*":
+				rangeSpecificity = 1
+			case "*/*", "*":
+				rangeSpecificity = 0
+			default:
+				continue
+			}
+			if rangeSpecificity > specificity || rangeSpecificity == specificity && mediaRange.Quality > quality {
+				quality, position, specificity = mediaRange.Quality, i, rangeSpecificity
+			}
+		}
+	}
+	return quality, position
+}
+
+/**********************************
+***  Encoders                   ***
+***********************************/
+
+func encodeJSON(w io.Writer, v interface{}) error {
+	writer := json.NewEncoder(w)
+	writer.SetIndent("", "    ")
+	return writer.Encode(v)
+}
+
+// encodeYAML converts v to YAML through its JSON representation, so both use the same field names
+func encodeYAML(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// JSON is valid YAML, the node keeps the order of the fields
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+
+	writer := yaml.NewEncoder(w)
+	writer.SetIndent(2)
+	if err := writer.Encode(&node); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// blockStyle removes the flow style and quotes of the parsed JSON from the node and its children.
+// Strings which would be read as another type stay quoted.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// encodeXML encodes v with an XML declaration. The elements of slices are wrapped in a list element,
+// since an XML document has a single root element.
+func encodeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	writer := xml.NewEncoder(w)
+	writer.Indent("", "    ")
+	if value := reflect.ValueOf(v); value.Kind() == reflect.Slice {
+		list := xml.StartElement{Name: xml.Name{Local: "list"}}
+		if err := writer.EncodeToken(list); err != nil {
+			return err
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := writer.Encode(value.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		if err := writer.EncodeToken(list.End()); err != nil {
+			return err
+		}
+	} else if err := writer.Encode(v); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// csvMarshaler is implemented by types with their own representation in a CSV cell
+type csvMarshaler interface {
+	MarshalCSV() string
+}
+
+// encodeCSV writes a struct or a slice of structs as CSV with a header row. The columns are named by the
+// csv tags of the fields or otherwise by their json names, fields tagged with csv:"-" are left out.
+// Slices are written as one value per line of the cell.
+func encodeCSV(w io.Writer, v interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	rows := []reflect.Value{value}
+	if value.Kind() == reflect.Slice {
+		rows = nil
+		for i := 0; i < value.Len(); i++ {
+			rows = append(rows, reflect.Indirect(value.Index(i)))
+		}
+	}
+
+	structType := value.Type()
+	if value.Kind() == reflect.Slice {
+		structType = structType.Elem()
+		if structType.Kind() == reflect.Pointer {
+			structType = structType.Elem()
+		}
+	}
+	if structType.Kind() != reflect.Struct || structType == timeType {
+		return fmt.Errorf("%s isn't a struct or a list of structs", structType)
+	}
+
+	var header []string
+	var fields []int
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("csv")
+		if name == "" {
+			name, _, _ = strings.Cut(field.Tag.Get("json"), ",")
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		header = append(header, name)
+		fields = append(fields, i)
+	}
+
+	writer := csv.NewWriter(w)
+	records := [][]string{header}
+	for _, row := range rows {
+		record := make([]string, len(fields))
+		for i, field := range fields {
+			record[i] = csvValue(row.Field(field))
+		}
+		records = append(records, record)
+	}
+	return writer.WriteAll(records)
+}
+
+// csvValue formats a single cell of a CSV row
+func csvValue(value reflect.Value) string {
+	if value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+	if marshaler, ok := value.Interface().(csvMarshaler); ok {
+		return marshaler.MarshalCSV()
+	}
+	if t, ok := value.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339)
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return value.String()
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return fmt.Sprint(value.Interface())
+	case reflect.Slice, reflect.Array:
+		var lines []string
+		for i := 0; i < value.Len(); i++ {
+			lines = append(lines, csvValue(value.Index(i)))
+		}
+		return strings.Join(lines, "\n")
+	case reflect.Map:
+		var lines []string
+		for _, key := range value.MapKeys() {
+			lines = append(lines, fmt.Sprintf("%v=%s", key.Interface(), csvValue(value.MapIndex(key))))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	default:
+		data, _ := json.Marshal(value.Interface())
+		return string(data)
+	}
+}
@@ -0,0 +1,181 @@
+package webapp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EncryptionKeyEnv is the environment variable holding the encryption keys of the file stores.
+// It takes precedence over the key file configured in Config.EncryptionKeyFile.
+const EncryptionKeyEnv = "WEBAPP_ENCRYPTION_KEY"
+
+// encryptedFileMagic marks the beginning of an encrypted store file
+var encryptedFileMagic = []byte("WEBAPPENC1")
+
+const keyIDLength = 8
+
+var (
+	errNoMatchingKey    = errors.New("no encryption key matches the key id of the file")
+	errEncryptedNoKey   = errors.New("file is encrypted, but no encryption key is configured")
+	errInvalidEncrypted = errors.New("encrypted file is truncated")
+)
+
+// KeyRing holds the AES-256 keys used to encrypt the file stores. The first key is the primary key
+// used for encryption, the others are only used to decrypt files written before a key rotation.
+type KeyRing struct {
+	keys []encryptionKey
+}
+
+type encryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// GlobalKeyRing contains the encryption keys of the file stores, files are written unencrypted if nil
+var GlobalKeyRing *KeyRing
+
+// SetupEncryption loads the encryption keys from the environment or the configured key file.
+// Encryption stays disabled when neither is set.
+func SetupEncryption() error {
+	keys := os.Getenv(EncryptionKeyEnv)
+	if keys == "" && Config.EncryptionKeyFile != "" {
+		contents, err := os.ReadFile(Config.EncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+		keys = string(contents)
+	}
+	if strings.TrimSpace(keys) == "" {
+		GlobalKeyRing = nil
+		return nil
+	}
+
+	ring, err := NewKeyRing(strings.FieldsFunc(keys, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}))
+	if err != nil {
+		return err
+	}
+	GlobalKeyRing = ring
+	return nil
+}
+
+// NewKeyRing creates a KeyRing from base64 encoded 32 byte keys, the first key becomes the primary key
+func NewKeyRing(encodedKeys []string) (*KeyRing, error) {
+	ring := &KeyRing{}
+	for _, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid encryption key: expected 32 bytes, got %d", len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(key)
+		ring.keys = append(ring.keys, encryptionKey{id: sum[:keyIDLength], aead: aead})
+	}
+	if len(ring.keys) == 0 {
+		return nil, errors.New("no encryption key given")
+	}
+	return ring, nil
+}
+
+// Seal encrypts the plaintext with the primary key.
+// The result contains a header, the id of the key, the nonce and the authenticated ciphertext.
+func (ring *KeyRing) Seal(plaintext []byte) ([]byte, error) {
+	key := ring.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(encryptedFileMagic)+keyIDLength+len(nonce)+len(plaintext)+key.aead.Overhead())
+	out = append(out, encryptedFileMagic...)
+	out = append(out, key.id...)
+	out = append(out, nonce...)
+	header := append([]byte(nil), out...)
+	return key.aead.Seal(out, nonce, plaintext, header), nil
+}
+
+// Open decrypts data written by Seal with the key it has been encrypted with
+func (ring *KeyRing) Open(data []byte) ([]byte, error) {
+	if len(data) < len(encryptedFileMagic)+keyIDLength {
+		return nil, errInvalidEncrypted
+	}
+	id := data[len(encryptedFileMagic) : len(encryptedFileMagic)+keyIDLength]
+
+	for _, key := range ring.keys {
+		if !bytes.Equal(key.id, id) {
+			continue
+		}
+		headerLength := len(encryptedFileMagic) + keyIDLength + key.aead.NonceSize()
+		if len(data) < headerLength {
+			return nil, errInvalidEncrypted
+		}
+		nonce := data[len(encryptedFileMagic)+keyIDLength : headerLength]
+		return key.aead.Open(nil, nonce, data[headerLength:], data[:headerLength])
+	}
+	return nil, errNoMatchingKey
+}
+
+// IsEncrypted checks if the data has been written by KeyRing.Seal
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedFileMagic)
+}
+
+// readStoreFile reads a store file and decrypts it if needed. Unencrypted files are returned as they are,
+// so existing plaintext files keep working and get encrypted on the next write.
+func readStoreFile(filename string) ([]byte, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(contents) {
+		return contents, nil
+	}
+	if GlobalKeyRing == nil {
+		return nil, fmt.Errorf("%s: %w", filename, errEncryptedNoKey)
+	}
+
+	contents, err = GlobalKeyRing.Open(contents)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s: %w", filename, err)
+	}
+	return contents, nil
+}
+
+// Rekey rewrites the given store files encrypted with the primary key of the GlobalKeyRing, or unencrypted if
+// no keys are configured. Files which don't exist are skipped.
+// To rotate keys, add the new key in front of the old ones, rekey the files and remove the old keys afterwards.
+func Rekey(filenames ...string) error {
+	files := map[string][]byte{}
+	for _, filename := range filenames {
+		contents, err := readStoreFile(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		files[filename] = contents
+	}
+	return writeFiles(files)
+}
@@ -0,0 +1,299 @@
+package webapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKey returns a base64 encoded encryption key consisting of the given byte
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func newTestKeyRing(t *testing.T, keys ...string) *KeyRing {
+	t.Helper()
+
+	ring, err := NewKeyRing(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+// useKeyRing replaces GlobalKeyRing for the test
+func useKeyRing(t *testing.T, ring *KeyRing) {
+	t.Helper()
+
+	previous := GlobalKeyRing
+	GlobalKeyRing = ring
+	t.Cleanup(func() { GlobalKeyRing = previous })
+}
+
+func TestNewKeyRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		wantErr bool
+	}{
+		{name: "single key", keys: []string{testKey(1)}},
+		{name: "rotated keys", keys: []string{testKey(2), testKey(1)}},
+		{name: "no keys", keys: nil, wantErr: true},
+		{name: "invalid base64", keys: []string{"not base64!"}, wantErr: true},
+		{name: "short key", keys: []string{base64.StdEncoding.EncodeToString(make([]byte, 16))}, wantErr: true},
+		{name: "invalid second key", keys: []string{testKey(1), "x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyRing(tt.keys); (err != nil) != tt.wantErr {
+				t.Errorf("NewKeyRing() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyRingSealOpen(t *testing.T) {
+	plaintext := []byte("users:\n  usr_1:\n    username: bob\n")
+	headerLength := len(encryptedFileMagic) + keyIDLength
+
+	tests := []struct {
+		name     string
+		sealKeys []string
+		openKeys []string
+		modify   func(data []byte) []byte
+		wantErr  error // nil for a successful round trip, errAny for any error
+	}{
+		{name: "round trip", sealKeys: []string{testKey(1)}, openKeys: []string{testKey(1)}},
+		{name: "rotated key", sealKeys: []string{testKey(1)}, openKeys: []string{testKey(2), testKey(1)}},
+		{name: "primary of rotated keys", sealKeys: []string{testKey(2), testKey(1)}, openKeys: []string{testKey(2)}},
+		{name: "rotated out key", sealKeys: []string{testKey(1)}, openKeys: []string{testKey(2)}, wantErr: errNoMatchingKey},
+		{
+			name:     "truncated header",
+			sealKeys: []string{testKey(1)},
+			openKeys: []string{testKey(1)},
+			modify:   func(data []byte) []byte { return data[:headerLength-1] },
+			wantErr:  errInvalidEncrypted,
+		},
+		{
+			name:     "truncated nonce",
+			sealKeys: []string{testKey(1)},
+			openKeys: []string{testKey(1)},
+			modify:   func(data []byte) []byte { return data[:headerLength+4] },
+			wantErr:  errInvalidEncrypted,
+		},
+		{
+			name:     "truncated ciphertext",
+			sealKeys: []string{testKey(1)},
+			openKeys: []string{testKey(1)},
+			modify:   func(data []byte) []byte { return data[:len(data)-1] },
+			wantErr:  errAny,
+		},
+		{
+			name:     "tampered ciphertext",
+			sealKeys: []string{testKey(1)},
+			openKeys: []string{testKey(1)},
+			modify:   func(data []byte) []byte { data[len(data)-20] ^= 1; return data },
+			wantErr:  errAny,
+		},
+		{
+			name:     "tampered nonce",
+			sealKeys: []string{testKey(1)},
+			openKeys: []string{testKey(1)},
+			modify:   func(data []byte) []byte { data[headerLength] ^= 1; return data },
+			wantErr:  errAny,
+		},
+		{
+			name:     "tampered key id",
+			sealKeys: []string{testKey(1)},
+			openKeys: []string{testKey(1)},
+			modify:   func(data []byte) []byte { data[len(encryptedFileMagic)] ^= 1; return data },
+			wantErr:  errNoMatchingKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := newTestKeyRing(t, tt.sealKeys...).Seal(plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsEncrypted(sealed) {
+				t.Fatal("sealed data isn't recognized as encrypted")
+			}
+			if bytes.Contains(sealed, plaintext) {
+				t.Fatal("sealed data contains the plaintext")
+			}
+			if tt.modify != nil {
+				sealed = tt.modify(sealed)
+			}
+
+			opened, err := newTestKeyRing(t, tt.openKeys...).Open(sealed)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Open() error = %v", err)
+			case tt.wantErr == nil && !bytes.Equal(opened, plaintext):
+				t.Errorf("Open() = %q, want %q", opened, plaintext)
+			case tt.wantErr == errAny && err == nil:
+				t.Error("Open() succeeded, want an error")
+			case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Errorf("Open() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// errAny is expected by tests accepting any error
+var errAny = errors.New("any error")
+
+func TestKeyRingSealUsesNewNonces(t *testing.T) {
+	ring := newTestKeyRing(t, testKey(1))
+	first, err := ring.Seal([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ring.Seal([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Error("sealing the same data twice returned the same ciphertext")
+	}
+}
+
+func TestReadStoreFile(t *testing.T) {
+	plaintext := []byte("users: {}\n")
+	sealed, err := newTestKeyRing(t, testKey(1)).Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		contents []byte
+		keys     []string // no GlobalKeyRing if empty
+		wantErr  error
+	}{
+		{name: "plaintext without keys", contents: plaintext},
+		{name: "plaintext with keys", contents: plaintext, keys: []string{testKey(1)}},
+		{name: "encrypted", contents: sealed, keys: []string{testKey(1)}},
+		{name: "encrypted with rotated key", contents: sealed, keys: []string{testKey(2), testKey(1)}},
+		{name: "encrypted without keys", contents: sealed, wantErr: errEncryptedNoKey},
+		{name: "encrypted with wrong key", contents: sealed, keys: []string{testKey(2)}, wantErr: errNoMatchingKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ring *KeyRing
+			if len(tt.keys) > 0 {
+				ring = newTestKeyRing(t, tt.keys...)
+			}
+			useKeyRing(t, ring)
+
+			filename := filepath.Join(t.TempDir(), "users.yaml")
+			if err := os.WriteFile(filename, tt.contents, 0600); err != nil {
+				t.Fatal(err)
+			}
+			contents, err := readStoreFile(filename)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("readStoreFile() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(contents, plaintext) {
+				t.Errorf("readStoreFile() = %q, want %q", contents, plaintext)
+			}
+		})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "users.yaml")
+	missing := filepath.Join(dir, "missing.yaml")
+	plaintext := []byte("users: {}\n")
+	if err := os.WriteFile(filename, plaintext, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// rekey keeps a plaintext file without keys, encrypts it with the primary key and rotates it to a new key
+	for _, keys := range [][]string{nil, {testKey(1)}, {testKey(2), testKey(1)}} {
+		var ring *KeyRing
+		if keys != nil {
+			ring = newTestKeyRing(t, keys...)
+		}
+		useKeyRing(t, ring)
+
+		if err := Rekey(filename, missing); err != nil {
+			t.Fatalf("Rekey() with %d keys: %v", len(keys), err)
+		}
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsEncrypted(contents) != (ring != nil) {
+			t.Fatalf("Rekey() with %d keys: encrypted = %v", len(keys), IsEncrypted(contents))
+		}
+		if ring != nil {
+			// the file must be readable with the primary key alone, so the old keys can be removed
+			if contents, err = newTestKeyRing(t, keys[0]).Open(contents); err != nil {
+				t.Fatalf("Rekey() with %d keys: file can't be opened with the primary key: %v", len(keys), err)
+			}
+		}
+		if !bytes.Equal(contents, plaintext) {
+			t.Errorf("Rekey() with %d keys: contents = %q, want %q", len(keys), contents, plaintext)
+		}
+		if _, err := os.Stat(missing); !os.IsNotExist(err) {
+			t.Errorf("Rekey() created the missing file: %v", err)
+		}
+	}
+}
+
+func TestFileStoreEncryptsPlaintextOnSave(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "users.yaml")
+	useKeyRing(t, nil)
+
+	store, err := NewFileUserStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, &User{ID: "usr_1", Username: "alice", Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := os.ReadFile(filename); err != nil || IsEncrypted(contents) {
+		t.Fatalf("file written without keys: encrypted = %v, error = %v", IsEncrypted(contents), err)
+	}
+
+	// the plaintext file is loaded with keys and encrypted by the next save
+	useKeyRing(t, newTestKeyRing(t, testKey(1)))
+	store, err = NewFileUserStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, &User{ID: "usr_2", Username: "bob", Email: "bob@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(contents) || bytes.Contains(contents, []byte("alice")) {
+		t.Fatal("file isn't encrypted after saving with keys")
+	}
+
+	store, err = NewFileUserStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"usr_1", "usr_2"} {
+		if _, err := store.Find(ctx, id); err != nil {
+			t.Errorf("Find(%s) after reloading the encrypted file: %v", id, err)
+		}
+	}
+}
@@ -2,10 +2,41 @@ package webapp
 
 import (
 	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
 )
 
 type ValidationError error
 
+// Sentinel errors returned by the storage backends. Callers should compare with errors.Is,
+// since backends may wrap them with additional detail.
+var (
+	// ErrNotFound is returned when the requested entity does not exist in the store
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write would violate a uniqueness constraint of the store
+	ErrConflict = errors.New("conflict")
+	// ErrVersionConflict is returned when an entity is saved with another version than the stored one,
+	// because it has been changed since it was read. It wraps ErrConflict.
+	ErrVersionConflict = fmt.Errorf("%w: the version has changed", ErrConflict)
+)
+
+// logRequestError logs an unexpected error of a request. Errors after the client has closed the connection
+// or the request has timed out aren't logged, since they are caused by the aborted request.
+func logRequestError(r *http.Request, msg string, err error) {
+	if r.Context().Err() != nil {
+		return
+	}
+	log.Println(msg, err)
+}
+
+// writeInternalError logs an unexpected error of a page request and answers it with 500 Internal Server Error
+func writeInternalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	logRequestError(r, msg, err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
 var (
 	errNoUsername = map[string]ValidationError{
 		"en": ValidationError(errors.New("you must supply a username")),
@@ -27,6 +58,10 @@ var (
 		"en": ValidationError(errors.New("username is already taken")),
 		"de": ValidationError(errors.New("der Benutzername ist bereits vergeben")),
 	}
+	errUserIDExists = map[string]ValidationError{
+		"en": ValidationError(errors.New("a user with this id already exists")),
+		"de": ValidationError(errors.New("ein Benutzer mit dieser ID existiert bereits")),
+	}
 	errEmailExists = map[string]ValidationError{
 		"en": ValidationError(errors.New("an account has already been registered with that email address")),
 		"de": ValidationError(errors.New("ein Konto mit der E-Mail Adresse existiert bereits")),
@@ -40,8 +75,89 @@ var (
 		"en": ValidationError(errors.New("passwords didn't match")),
 		"de": ValidationError(errors.New("die Passw&ouml;rter stimmen nicht &uuml;berein")),
 	}
+	errNoCurrentPassword = map[string]ValidationError{
+		"en": ValidationError(errors.New("you must supply your current password to change it")),
+		"de": ValidationError(errors.New("sie m&uuml;ssen Ihr aktuelles Passwort angeben, um es zu &auml;ndern")),
+	}
+
+	errPasswordLinkInvalid = map[string]ValidationError{
+		"en": ValidationError(errors.New("the link is invalid or has expired, please ask for a new one")),
+		"de": ValidationError(errors.New("der Link ist ungültig oder abgelaufen, bitte fordern Sie einen neuen an")),
+	}
+
+	errWebhookURLInvalid = map[string]ValidationError{
+		"en": ValidationError(errors.New("the URL must be an absolute http or https URL")),
+		"de": ValidationError(errors.New("die URL muss eine absolute http- oder https-URL sein")),
+	}
+	errWebhookEventUnknown = map[string]ValidationError{
+		"en": ValidationError(errors.New("unknown event type")),
+		"de": ValidationError(errors.New("unbekannter Ereignistyp")),
+	}
+
+	errLanguageUnknown = map[string]ValidationError{
+		"en": ValidationError(errors.New("there are no translations for this language")),
+		"de": ValidationError(errors.New("f&uuml;r diese Sprache gibt es keine &Uuml;bersetzungen")),
+	}
+
+	errModifiedConcurrently = map[string]ValidationError{
+		"en": ValidationError(errors.New("the data has been changed by someone else in the meantime, please check the current data and save again")),
+		"de": ValidationError(errors.New("die Daten wurden inzwischen von jemand anderem geändert, bitte prüfen Sie die aktuellen Daten und speichern Sie erneut")),
+	}
 )
 
+// validationInfo describes the field a validation error refers to, its code for API clients and its translations
+type validationInfo struct {
+	Field        string
+	Code         string
+	Translations map[string]ValidationError
+}
+
+// validationInfos maps the validation errors in all languages to their description
+var validationInfos = map[error]validationInfo{}
+
+func init() {
+	for _, info := range []validationInfo{
+		{Field: "username", Code: "required", Translations: errNoUsername},
+		{Field: "id", Code: "taken", Translations: errUserIDExists},
+		{Field: "username", Code: "taken", Translations: errUsernameExists},
+		{Field: "email", Code: "required", Translations: errNoEmail},
+		{Field: "email", Code: "taken", Translations: errEmailExists},
+		{Field: "password", Code: "required", Translations: errNoPassword},
+		{Field: "password", Code: "too_short", Translations: errPasswordTooShort},
+		{Field: "password", Code: "incorrect", Translations: errCredentialsIncorrect},
+		{Field: "currentPassword", Code: "incorrect", Translations: errPasswordIncorrect},
+		{Field: "currentPassword", Code: "required", Translations: errNoCurrentPassword},
+		{Field: "url", Code: "invalid", Translations: errWebhookURLInvalid},
+		{Field: "events", Code: "unknown", Translations: errWebhookEventUnknown},
+		{Field: "language", Code: "unknown", Translations: errLanguageUnknown},
+	} {
+		for _, err := range info.Translations {
+			validationInfos[err] = info
+		}
+	}
+}
+
+// ValidationField returns the name of the field a validation error refers to. It returns false if err
+// isn't one of the validation errors.
+func ValidationField(err error) (string, bool) {
+	info, ok := validationInfos[err]
+	return info.Field, ok
+}
+
+// validationFieldError returns the FieldError of a validation error with its message in the given language,
+// or in the language of err if there's no translation
+func validationFieldError(err error, lang string) (FieldError, bool) {
+	info, ok := validationInfos[err]
+	if !ok {
+		return FieldError{}, false
+	}
+	if translation, ok := info.Translations[lang]; ok {
+		err = translation
+	}
+	// the messages are written for the html templates
+	return FieldError{Field: info.Field, Code: info.Code, Message: html.UnescapeString(err.Error())}, true
+}
+
 func IsValidationError(err error) bool {
 	_, ok := err.(ValidationError)
 	return ok
@@ -0,0 +1,485 @@
+package webapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every change of the user, session and user config stores is published as an Event on the GlobalEventBus,
+// once the change has been written, or for changes inside of a transaction, once it has been committed.
+// Each event gets the next resource version of the bus, so watchers can resume a stream after the last
+// event they received, as long as it's still in the history of the bus. The history is kept in memory,
+// so after a restart of the application watchers have to list the resources again.
+
+// Event types
+const (
+	EventAdded    = "ADDED"
+	EventModified = "MODIFIED"
+	EventDeleted  = "DELETED"
+	// EventExpired reports the sessions removed by DeleteExpired, its object is an ExpiredSessions
+	EventExpired = "EXPIRED"
+	// EventBookmark is sent periodically by watch streams with the resource version of the last event
+	EventBookmark = "BOOKMARK"
+)
+
+// Kinds of the event objects
+const (
+	KindUser       = "User"
+	KindSession    = "Session"
+	KindUserConfig = "UserConfig"
+)
+
+// Event describes a change of a stored object
+type Event struct {
+	Type            string      `json:"type"`
+	Kind            string      `json:"kind"`
+	ResourceVersion uint64      `json:"resourceVersion"`
+	Object          interface{} `json:"object,omitempty"`
+}
+
+// ExpiredSessions is the object of an EventExpired, the removed sessions themselves aren't known
+type ExpiredSessions struct {
+	Before time.Time `json:"before"`
+	Count  int       `json:"count"`
+}
+
+const (
+	// eventHistory is the number of events kept to resume watches
+	eventHistory = 1000
+	// eventBuffer is the number of events buffered for each subscriber, slower subscribers are dropped
+	eventBuffer = 100
+	// watchBookmarkInterval is the interval of the bookmark events, which also keep idle connections open
+	watchBookmarkInterval = 30 * time.Second
+)
+
+var errResourceVersionExpired = errors.New("resource version is too old, list the resources again and watch from there")
+
+// EventBus distributes the change events to its subscribers. Its resource versions start at the current
+// time in microseconds, so versions of an earlier run of the application are detected as expired.
+type EventBus struct {
+	mu          sync.Mutex
+	version     uint64
+	history     []Event
+	subscribers map[*eventSubscriber]struct{}
+}
+
+type eventSubscriber struct {
+	kind   string
+	events chan Event
+}
+
+// GlobalEventBus receives the events of the global stores
+var GlobalEventBus = NewEventBus()
+
+// NewEventBus creates an EventBus without any events
+func NewEventBus() *EventBus {
+	return &EventBus{
+		version:     uint64(time.Now().UnixMicro()),
+		subscribers: map[*eventSubscriber]struct{}{},
+	}
+}
+
+// Publish sends an event with the next resource version to all subscribers of the kind.
+// A subscriber whose buffer is full is dropped by closing its channel, so it can resume with a new watch.
+func (b *EventBus) Publish(kind, eventType string, object interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.version++
+	event := Event{
+		Type:            eventType,
+		Kind:            kind,
+		ResourceVersion: b.version,
+		Object:          object,
+	}
+
+	if len(b.history) == eventHistory {
+		copy(b.history, b.history[1:])
+		b.history = b.history[:eventHistory-1]
+	}
+	b.history = append(b.history, event)
+
+	for subscriber := range b.subscribers {
+		if subscriber.kind != "" && subscriber.kind != kind {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			Logf(WarningLevel, "Dropping slow subscriber of %s events\n", kind)
+			delete(b.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+}
+
+// ResourceVersion returns the resource version of the latest event
+func (b *EventBus) ResourceVersion() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.version
+}
+
+// Subscribe returns a channel receiving the events of kind, or of all kinds if kind is empty.
+// If resourceVersion is set, the events after it are replayed first. errResourceVersionExpired is returned
+// if some of them are no longer in the history. The channel is closed by calling cancel.
+func (b *EventBus) Subscribe(kind string, resourceVersion uint64) (<-chan Event, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []Event
+	if resourceVersion > 0 {
+		// the oldest event in the history must directly follow the resource version
+		oldest := b.version + 1
+		if len(b.history) > 0 {
+			oldest = b.history[0].ResourceVersion
+		}
+		if resourceVersion > b.version || resourceVersion+1 < oldest {
+			return nil, nil, errResourceVersionExpired
+		}
+		for _, event := range b.history {
+			if event.ResourceVersion > resourceVersion && (kind == "" || event.Kind == kind) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	subscriber := &eventSubscriber{
+		kind:   kind,
+		events: make(chan Event, eventBuffer+len(replay)),
+	}
+	for _, event := range replay {
+		subscriber.events <- event
+	}
+	b.subscribers[subscriber] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[subscriber]; ok {
+			delete(b.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+	return subscriber.events, cancel, nil
+}
+
+// publishFunc publishes an event, either directly on the bus or when a transaction is committed
+type publishFunc func(kind, eventType string, object interface{})
+
+// savedEventType returns the type of the event for saving an object by its version after the save,
+// which is 1 for new objects, so the object doesn't have to be looked up before
+func savedEventType(version int64) string {
+	if version == 1 {
+		return EventAdded
+	}
+	return EventModified
+}
+
+/**********************************
+***  Event User Store           ***
+***********************************/
+
+// EventUserStore publishes the changes of a UserStore. The users are published without their password hash.
+type EventUserStore struct {
+	UserStore
+	publish publishFunc
+}
+
+// NewEventUserStore wraps store to publish its changes on bus
+func NewEventUserStore(store UserStore, bus *EventBus) *EventUserStore {
+	return &EventUserStore{
+		UserStore: store,
+		publish:   bus.Publish,
+	}
+}
+
+func (store *EventUserStore) Save(ctx context.Context, user *User) error {
+	if err := store.UserStore.Save(ctx, user); err != nil {
+		return err
+	}
+	store.publish(KindUser, savedEventType(user.Version), userResponse(*user))
+	return nil
+}
+
+func (store *EventUserStore) Delete(ctx context.Context, user *User) error {
+	if err := store.UserStore.Delete(ctx, user); err != nil {
+		return err
+	}
+	store.publish(KindUser, EventDeleted, userResponse(*user))
+	return nil
+}
+
+/**********************************
+***  Event Session Store        ***
+***********************************/
+
+// EventSessionStore publishes the changes of a SessionStore
+type EventSessionStore struct {
+	SessionStore
+	publish publishFunc
+}
+
+// NewEventSessionStore wraps store to publish its changes on bus
+func NewEventSessionStore(store SessionStore, bus *EventBus) *EventSessionStore {
+	return &EventSessionStore{
+		SessionStore: store,
+		publish:      bus.Publish,
+	}
+}
+
+// Save publishes the session as added, since sessions are only saved when they are created
+func (store *EventSessionStore) Save(ctx context.Context, session *Session) error {
+	if err := store.SessionStore.Save(ctx, session); err != nil {
+		return err
+	}
+	store.publish(KindSession, EventAdded, *session)
+	return nil
+}
+
+func (store *EventSessionStore) Delete(ctx context.Context, session *Session) error {
+	if err := store.SessionStore.Delete(ctx, session); err != nil {
+		return err
+	}
+	store.publish(KindSession, EventDeleted, *session)
+	return nil
+}
+
+func (store *EventSessionStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	n, err := store.SessionStore.DeleteExpired(ctx, before)
+	if n > 0 {
+		store.publish(KindSession, EventExpired, ExpiredSessions{Before: before, Count: n})
+	}
+	return n, err
+}
+
+/**********************************
+***  Event UserConfig Store     ***
+***********************************/
+
+// EventUserConfigStore publishes the changes of a UserConfigStore
+type EventUserConfigStore struct {
+	UserConfigStore
+	publish publishFunc
+}
+
+// NewEventUserConfigStore wraps store to publish its changes on bus
+func NewEventUserConfigStore(store UserConfigStore, bus *EventBus) *EventUserConfigStore {
+	return &EventUserConfigStore{
+		UserConfigStore: store,
+		publish:         bus.Publish,
+	}
+}
+
+func (store *EventUserConfigStore) Save(ctx context.Context, userconfig *UserConfig) error {
+	if err := store.UserConfigStore.Save(ctx, userconfig); err != nil {
+		return err
+	}
+	store.publish(KindUserConfig, savedEventType(userconfig.Version), *userconfig)
+	return nil
+}
+
+func (store *EventUserConfigStore) Delete(ctx context.Context, userconfig *UserConfig) error {
+	if err := store.UserConfigStore.Delete(ctx, userconfig); err != nil {
+		return err
+	}
+	store.publish(KindUserConfig, EventDeleted, *userconfig)
+	return nil
+}
+
+/**********************************
+***  Event Transactor           ***
+***********************************/
+
+// EventTransactor wraps a Transactor, so the changes made inside of a transaction are published
+// after it has been committed and dropped when it's rolled back
+type EventTransactor struct {
+	transactor Transactor
+	bus        *EventBus
+}
+
+// NewEventTransactor wraps transactor to publish the changes of its transactions on bus
+func NewEventTransactor(transactor Transactor, bus *EventBus) *EventTransactor {
+	return &EventTransactor{
+		transactor: transactor,
+		bus:        bus,
+	}
+}
+
+// Begin starts a new transaction of the wrapped Transactor
+func (t *EventTransactor) Begin(ctx context.Context) (Tx, error) {
+	tx, err := t.transactor.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &eventTx{Tx: tx, bus: t.bus}, nil
+}
+
+// eventTx collects the events of a transaction until it's committed
+type eventTx struct {
+	Tx
+	bus    *EventBus
+	mu     sync.Mutex
+	events []Event
+}
+
+func (tx *eventTx) record(kind, eventType string, object interface{}) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.events = append(tx.events, Event{Type: eventType, Kind: kind, Object: object})
+}
+
+func (tx *eventTx) Users() UserStore {
+	return &EventUserStore{UserStore: tx.Tx.Users(), publish: tx.record}
+}
+
+func (tx *eventTx) Sessions() SessionStore {
+	return &EventSessionStore{SessionStore: tx.Tx.Sessions(), publish: tx.record}
+}
+
+func (tx *eventTx) UserConfigs() UserConfigStore {
+	return &EventUserConfigStore{UserConfigStore: tx.Tx.UserConfigs(), publish: tx.record}
+}
+
+func (tx *eventTx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	for _, event := range tx.events {
+		tx.bus.Publish(event.Kind, event.Type, event.Object)
+	}
+	tx.events = nil
+	return nil
+}
+
+// SetupEvents wraps the global stores and the GlobalTransactor to publish their changes on the GlobalEventBus
+func SetupEvents() {
+	GlobalUserStore = NewEventUserStore(GlobalUserStore, GlobalEventBus)
+	GlobalSessionStore = NewEventSessionStore(GlobalSessionStore, GlobalEventBus)
+	GlobalUserConfigStore = NewEventUserConfigStore(GlobalUserConfigStore, GlobalEventBus)
+	GlobalTransactor = NewEventTransactor(GlobalTransactor, GlobalEventBus)
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// watchRequested checks the watch url parameter of a list request
+func watchRequested(r *http.Request) bool {
+	watch, _ := strconv.ParseBool(r.URL.Query().Get("watch"))
+	return watch
+}
+
+// serveWatch streams the events of kind until the client disconnects or the application shuts down.
+// The events are sent as Server-Sent Events if the client accepts text/event-stream and as newline-delimited
+// JSON otherwise. A stream resumes after the resourceVersion url parameter or the Last-Event-ID header
+// sent by reconnecting EventSources, and ends after timeoutSeconds if given. If convert is set, the objects
+// of the events are replaced with the values it returns.
+func serveWatch(w http.ResponseWriter, r *http.Request, kind string, convert func(interface{}) interface{}) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, r, http.StatusInternalServerError, codeInternalError, "streaming is not supported")
+		return
+	}
+
+	eventStream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	since := r.URL.Query().Get("resourceVersion")
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		since = lastEventID
+	}
+	var resourceVersion uint64
+	if since != "" {
+		var err error
+		if resourceVersion, err = strconv.ParseUint(since, 10, 64); err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid resource version %q", since))
+			return
+		}
+	}
+
+	ctx := r.Context()
+	if timeout := r.URL.Query().Get("timeoutSeconds"); timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds <= 0 {
+			writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid timeout %q", timeout))
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+		defer cancel()
+	}
+
+	// events between reading the version and subscribing are delivered, so the bookmark may only be older
+	last := resourceVersion
+	if last == 0 {
+		last = GlobalEventBus.ResourceVersion()
+	}
+	events, cancel, err := GlobalEventBus.Subscribe(kind, resourceVersion)
+	if errors.Is(err, errResourceVersionExpired) {
+		writeAPIError(w, r, http.StatusGone, codeGone, err.Error())
+		return
+	}
+	defer cancel()
+
+	if eventStream {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable the response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	bookmarks := time.NewTicker(watchBookmarkInterval)
+	defer bookmarks.Stop()
+	for {
+		var event Event
+		select {
+		case <-ctx.Done():
+			return
+		case <-AppContext.Done():
+			return
+		case <-bookmarks.C:
+			event = Event{Type: EventBookmark, Kind: kind, ResourceVersion: last}
+		case event, ok = <-events:
+			if !ok {
+				// dropped by the bus, the client has to resume with a new watch
+				return
+			}
+			last = event.ResourceVersion
+			if convert != nil {
+				event.Object = convert(event.Object)
+			}
+		}
+
+		if err := writeEvent(w, event, eventStream); err != nil {
+			Logln(DebugLevel, "Watch stream closed:", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a single event of a watch stream
+func writeEvent(w http.ResponseWriter, event Event, eventStream bool) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if eventStream {
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ResourceVersion, data)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", data)
+	}
+	return err
+}
@@ -3,15 +3,26 @@ module github.com/snafuprinzip/webapp
 go 1.20
 
 require (
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/graph-gophers/graphql-go v1.5.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.8
 	github.com/nicksnyder/go-i18n/v2 v2.2.1
+	github.com/prometheus/client_golang v1.19.1
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.7.0
+	golang.org/x/text v0.14.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/ovh/go-ovh v1.4.3 // indirect
-	golang.org/x/text v0.8.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 )
@@ -0,0 +1,404 @@
+package webapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// The GraphQL endpoint answers read-only queries over the users with their sessions and settings. It applies
+// the access rules of the REST API: users can only query themselves, the admin can query and list all users.
+// The sessions and settings of the users in a result are loaded with one call of the stores for all of them
+// instead of one call per user, and the nesting depth of queries is limited.
+
+// graphqlMaxDepth is the maximum nesting depth of the fields of a query
+const graphqlMaxDepth = 7
+
+const graphqlSchemaDefinition = `
+schema {
+	query: Query
+}
+
+scalar Time
+
+type Query {
+	"The logged in user"
+	me: User!
+	"The user with the given id, users can only query themselves"
+	user(id: ID!): User
+	"The users matching the search, only for the admin. Sort by id, username or email, prefixed with - for descending order."
+	users(first: Int, after: String, search: String, sort: String): UserConnection
+}
+
+"A page of users"
+type UserConnection {
+	"Number of matching users on all pages"
+	totalCount: Int!
+	nodes: [User!]!
+	pageInfo: PageInfo!
+}
+
+type PageInfo {
+	"Cursor to pass as after to get the next page"
+	endCursor: String
+	hasNextPage: Boolean!
+}
+
+type User {
+	id: ID!
+	username: String!
+	email: String!
+	"Set while the user is terminating, the user is deleted after this time"
+	deletionTimestamp: Time
+	version: Int!
+	sessions: [Session!]!
+	settings: UserConfig!
+}
+
+type Session {
+	id: ID!
+	expiry: Time!
+	user: User!
+}
+
+type UserConfig {
+	language: String!
+	darkMode: Boolean!
+	version: Int!
+	user: User!
+}
+`
+
+// graphqlSchema executes the queries with a graphqlResolver
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaDefinition, &graphqlResolver{},
+	graphql.UseStringDescriptions(), graphql.MaxDepth(graphqlMaxDepth))
+
+// GraphQLRequest is the body of a GraphQL request
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	// Extensions are sent by some clients, e.g. for persisted queries, and are ignored
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// graphqlRequestKey is the context key of the HTTP request of a query, which the resolvers check the access with
+type graphqlRequestKey struct{}
+
+// graphqlHTTPRequest returns the HTTP request of a query
+func graphqlHTTPRequest(ctx context.Context) *http.Request {
+	return ctx.Value(graphqlRequestKey{}).(*http.Request)
+}
+
+// graphqlError is an error of a resolver with the code of the matching API error in its extensions
+type graphqlError struct {
+	message string
+	code    string
+}
+
+func (e graphqlError) Error() string {
+	return e.message
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+// graphqlErrorFor translates err into a graphqlError like writeAPIErrorFor, the details of unexpected errors
+// are only logged
+func graphqlErrorFor(err error) error {
+	switch {
+	case errors.Is(err, errForbidden):
+		return graphqlError{message: err.Error(), code: codeForbidden}
+	case errors.Is(err, ErrNotFound):
+		return graphqlError{message: err.Error(), code: codeNotFound}
+	case errors.Is(err, errInvalidQuery):
+		return graphqlError{message: err.Error(), code: codeBadRequest}
+	}
+	log.Println("GraphQL query failed:", err)
+	return graphqlError{message: "an internal error occurred", code: codeInternalError}
+}
+
+/****************************************
+***  Resolvers                        ***
+*****************************************/
+
+// graphqlResolver resolves the fields of the Query type
+type graphqlResolver struct{}
+
+func (*graphqlResolver) Me(ctx context.Context) (*userResolver, error) {
+	user := RequestUser(graphqlHTTPRequest(ctx))
+	if user == nil {
+		return nil, graphqlErrorFor(fmt.Errorf("%w: not logged in", errForbidden))
+	}
+	return newUserResolvers([]User{*user})[0], nil
+}
+
+func (*graphqlResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	user, err := authorizedUser(graphqlHTTPRequest(ctx), string(args.ID))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlErrorFor(err)
+	}
+	return newUserResolvers([]User{*user})[0], nil
+}
+
+func (*graphqlResolver) Users(ctx context.Context, args struct {
+	First  *int32
+	After  *string
+	Search *string
+	Sort   *string
+}) (*userConnectionResolver, error) {
+	if !IsAdmin(graphqlHTTPRequest(ctx)) {
+		return nil, graphqlErrorFor(fmt.Errorf("%w: only the admin can list the users", errForbidden))
+	}
+
+	// the arguments are read like the url parameters of the REST API
+	values := url.Values{}
+	if args.First != nil {
+		values.Set("limit", strconv.Itoa(int(*args.First)))
+	}
+	if args.After != nil {
+		values.Set("cursor", *args.After)
+	}
+	if args.Search != nil {
+		values.Set("q", *args.Search)
+	}
+	if args.Sort != nil {
+		values.Set("sort", *args.Sort)
+	}
+	query, err := ParseUserQuery(values, defaultUserListLimit)
+	if err != nil {
+		return nil, graphqlErrorFor(err)
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultUserListLimit
+	}
+
+	list, err := GlobalUserStore.List(ctx, query)
+	if err != nil {
+		return nil, graphqlErrorFor(err)
+	}
+	return &userConnectionResolver{list: list, nodes: newUserResolvers(list.Users)}, nil
+}
+
+// userConnectionResolver resolves a page of users
+type userConnectionResolver struct {
+	list  UserList
+	nodes []*userResolver
+}
+
+func (c *userConnectionResolver) TotalCount() int32 {
+	return int32(c.list.Total)
+}
+
+func (c *userConnectionResolver) Nodes() []*userResolver {
+	return c.nodes
+}
+
+func (c *userConnectionResolver) PageInfo() *pageInfoResolver {
+	return &pageInfoResolver{list: c.list}
+}
+
+// pageInfoResolver resolves the cursor of the page following a page of users
+type pageInfoResolver struct {
+	list UserList
+}
+
+func (p *pageInfoResolver) EndCursor() *string {
+	if p.list.Continue == "" {
+		return nil
+	}
+	return &p.list.Continue
+}
+
+func (p *pageInfoResolver) HasNextPage() bool {
+	return p.list.Continue != ""
+}
+
+// graphqlBatch loads the sessions and settings of all users of a result together, on the first access to
+// the sessions or settings of one of them. The fields of the users may be resolved concurrently.
+type graphqlBatch struct {
+	userids []string
+
+	sessionsOnce sync.Once
+	sessions     map[string][]Session
+	sessionsErr  error
+
+	settingsOnce sync.Once
+	settings     map[string]UserConfig
+	settingsErr  error
+}
+
+// Sessions returns the sessions of a user of the batch
+func (b *graphqlBatch) Sessions(ctx context.Context, userid string) ([]Session, error) {
+	b.sessionsOnce.Do(func() {
+		b.sessions, b.sessionsErr = GlobalSessionStore.FindByUsers(ctx, b.userids)
+	})
+	return b.sessions[userid], b.sessionsErr
+}
+
+// Settings returns the settings of a user of the batch, or the default settings if they have none
+func (b *graphqlBatch) Settings(ctx context.Context, userid string) (UserConfig, error) {
+	b.settingsOnce.Do(func() {
+		b.settings, b.settingsErr = GlobalUserConfigStore.FindByUsers(ctx, b.userids)
+	})
+	userconfig, ok := b.settings[userid]
+	if !ok {
+		userconfig, _ = NewUserConfig(userid, "en", false)
+	}
+	return userconfig, b.settingsErr
+}
+
+// userResolver resolves a user, the users of the same result share their batch
+type userResolver struct {
+	user  User
+	batch *graphqlBatch
+}
+
+// newUserResolvers returns the resolvers of users loaded together
+func newUserResolvers(users []User) []*userResolver {
+	batch := &graphqlBatch{}
+	resolvers := make([]*userResolver, 0, len(users))
+	for _, user := range users {
+		batch.userids = append(batch.userids, user.ID)
+		resolvers = append(resolvers, &userResolver{user: user, batch: batch})
+	}
+	return resolvers
+}
+
+func (u *userResolver) ID() graphql.ID {
+	return graphql.ID(u.user.ID)
+}
+
+func (u *userResolver) Username() string {
+	return u.user.Username
+}
+
+func (u *userResolver) Email() string {
+	return u.user.Email
+}
+
+func (u *userResolver) DeletionTimestamp() *graphql.Time {
+	if u.user.DeletionTimestamp == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *u.user.DeletionTimestamp}
+}
+
+func (u *userResolver) Version() int32 {
+	return int32(u.user.Version)
+}
+
+func (u *userResolver) Sessions(ctx context.Context) ([]*sessionResolver, error) {
+	sessions, err := u.batch.Sessions(ctx, u.user.ID)
+	if err != nil {
+		return nil, graphqlErrorFor(err)
+	}
+	resolvers := make([]*sessionResolver, 0, len(sessions))
+	for _, session := range sessions {
+		resolvers = append(resolvers, &sessionResolver{session: session, user: u})
+	}
+	return resolvers, nil
+}
+
+func (u *userResolver) Settings(ctx context.Context) (*userConfigResolver, error) {
+	userconfig, err := u.batch.Settings(ctx, u.user.ID)
+	if err != nil {
+		return nil, graphqlErrorFor(err)
+	}
+	return &userConfigResolver{userconfig: userconfig, user: u}, nil
+}
+
+// sessionResolver resolves a session of a user
+type sessionResolver struct {
+	session Session
+	user    *userResolver
+}
+
+func (s *sessionResolver) ID() graphql.ID {
+	return graphql.ID(s.session.ID)
+}
+
+func (s *sessionResolver) Expiry() graphql.Time {
+	return graphql.Time{Time: s.session.Expiry}
+}
+
+func (s *sessionResolver) User() *userResolver {
+	return s.user
+}
+
+// userConfigResolver resolves the settings of a user
+type userConfigResolver struct {
+	userconfig UserConfig
+	user       *userResolver
+}
+
+func (c *userConfigResolver) Language() string {
+	return c.userconfig.Language
+}
+
+func (c *userConfigResolver) DarkMode() bool {
+	return c.userconfig.DarkMode
+}
+
+func (c *userConfigResolver) Version() int32 {
+	return int32(c.userconfig.Version)
+}
+
+func (c *userConfigResolver) User() *userResolver {
+	return c.user
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// HandleGraphQL executes a GraphQL query from the JSON body of a POST request or from the query, operationName
+// and variables url parameters of a GET request. Failed queries are answered with 200 OK and the errors in the
+// response like successful ones, only invalid requests fail with an APIError.
+// (GET, POST /api/graphql)
+func HandleGraphQL(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req GraphQLRequest
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeAPIError(w, r, http.StatusBadRequest, codeInvalidJSON, "variables: "+err.Error())
+				return
+			}
+		}
+	} else if err := decodeJSON(r, &req); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	if req.Query == "" {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, "the query is missing")
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphqlRequestKey{}, r)
+	response := graphqlSchema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		Logln(DebugLevel, "Unable to write response:", err)
+	}
+}
@@ -16,17 +16,36 @@ var bundle *i18n.Bundle
 func LookupTranslation(r *http.Request, msgid string) string {
 	lang := r.FormValue("lang")
 	accept := r.Header.Get("Accept-Language")
-	prefs := GetLanguage("", r, nil)
+	prefs := GetLanguage(r.Context(), "", r, nil)
 	localizer := i18n.NewLocalizer(bundle, lang, prefs, accept)
 
 	res, _ := localizer.Localize(&i18n.LocalizeConfig{MessageID: msgid})
 	return res
 }
 
+// LookupTranslationWithLanguage returns the translation of msgid like LookupTranslation together with the
+// language it was found in. Without a translation it returns an empty string and "en".
+func LookupTranslationWithLanguage(r *http.Request, msgid string) (string, string) {
+	if bundle == nil {
+		return "", "en"
+	}
+	lang := r.FormValue("lang")
+	accept := r.Header.Get("Accept-Language")
+	prefs := GetLanguage(r.Context(), "", r, nil)
+	localizer := i18n.NewLocalizer(bundle, lang, prefs, accept)
+
+	res, tag, err := localizer.LocalizeWithTag(&i18n.LocalizeConfig{MessageID: msgid})
+	if err != nil {
+		return "", "en"
+	}
+	base, _ := tag.Base()
+	return res, base.String()
+}
+
 func LookupTranslationWithData(r *http.Request, msgid string, data map[string]interface{}, count int) string {
 	lang := r.FormValue("lang")
 	accept := r.Header.Get("Accept-Language")
-	prefs := GetLanguage("", r, nil)
+	prefs := GetLanguage(r.Context(), "", r, nil)
 	localizer := i18n.NewLocalizer(bundle, lang, prefs, accept)
 
 	res, _ := localizer.Localize(&i18n.LocalizeConfig{
@@ -40,10 +59,25 @@ func LookupTranslationWithData(r *http.Request, msgid string, data map[string]in
 	return res
 }
 
+// LookupTranslationInLanguage returns the translation of msgid in the given language independent of a request,
+// e.g. for mails
+func LookupTranslationInLanguage(lang, msgid string, data map[string]interface{}) string {
+	localizer := i18n.NewLocalizer(bundle, lang)
+
+	res, _ := localizer.Localize(&i18n.LocalizeConfig{
+		MessageID: msgid,
+		DefaultMessage: &i18n.Message{
+			ID: msgid,
+		},
+		TemplateData: data,
+	})
+	return res
+}
+
 func LookupComplexTranslation(r *http.Request, msgid string, data map[string]interface{}, count int, funcs template.FuncMap) string {
 	lang := r.FormValue("lang")
 	accept := r.Header.Get("Accept-Language")
-	prefs := GetLanguage("", r, nil)
+	prefs := GetLanguage(r.Context(), "", r, nil)
 	localizer := i18n.NewLocalizer(bundle, lang, prefs, accept)
 
 	res, _ := localizer.Localize(&i18n.LocalizeConfig{
@@ -0,0 +1,452 @@
+package webapp
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Users are imported in the formats of the export. Columns and fields of the export which can't be set,
+// like the sessions, are ignored, so an export can be imported again. Imported users never get a password,
+// new users are invited by mail to choose one instead.
+
+// maxImportSize limits the size of the imported files
+const maxImportSize = 10 << 20
+
+// ImportOptions control how the users are imported
+type ImportOptions struct {
+	// DryRun only validates the users and reports what would be done
+	DryRun bool `json:"dryRun"`
+	// Upsert updates the existing users matched by id, username or email instead of rejecting them
+	Upsert bool `json:"upsert"`
+	// ResetPasswords sends the updated users a mail to choose a new password
+	ResetPasswords bool `json:"resetPasswords"`
+}
+
+// Results of an imported user
+const (
+	importCreated   = "created"
+	importUpdated   = "updated"
+	importUnchanged = "unchanged"
+	importFailed    = "failed"
+)
+
+// Mails sent to imported users
+const (
+	importMailInvitation    = "invitation"
+	importMailPasswordReset = "passwordReset"
+)
+
+// ImportResult is the result of a single user of an import
+type ImportResult struct {
+	Row      int    `json:"row"`    // position of the user in the input, starting with 1
+	Status   string `json:"status"` // created, updated, unchanged or failed
+	ID       string `json:"id,omitempty"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// Mail is the mail sent, or to be sent in a dry run, either invitation or passwordReset
+	Mail      string       `json:"mail,omitempty"`
+	MailError string       `json:"mailError,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// ImportReport lists the results of all users of an import
+type ImportReport struct {
+	DryRun    bool           `json:"dryRun"`
+	Upsert    bool           `json:"upsert"`
+	Created   int            `json:"created"`
+	Updated   int            `json:"updated"`
+	Unchanged int            `json:"unchanged"`
+	Failed    int            `json:"failed"`
+	Rows      []ImportResult `json:"rows"`
+}
+
+// importRow is a user of the import, the id is optional
+type importRow struct {
+	ID       string `json:"id" yaml:"id" xml:"ID"`
+	Username string `json:"username" yaml:"username" xml:"Username"`
+	Email    string `json:"email" yaml:"email" xml:"Email"`
+}
+
+var errInvalidImport = errors.New("invalid import")
+
+// ImportUsers validates the users with NewUser or, when they are updated, UpdateUser and saves them one by one,
+// so a failed user doesn't stop the import. New users get an invitation mail with a link to base to choose
+// their password. The errors of the report are written in the given language.
+func ImportUsers(ctx context.Context, rows []importRow, options ImportOptions, base, lang string) ImportReport {
+	report := ImportReport{DryRun: options.DryRun, Upsert: options.Upsert}
+	// usernames, email addresses and ids of the previous rows, so duplicates are found in a dry run as well
+	seen := map[string]bool{}
+
+	for i, row := range rows {
+		result := importUser(ctx, row, options, base, lang, seen)
+		result.Row = i + 1
+		if result.Status != importFailed {
+			seen["id:"+result.ID] = true
+			seen["username:"+result.Username] = true
+			seen["email:"+result.Email] = true
+		}
+
+		switch result.Status {
+		case importCreated:
+			report.Created++
+		case importUpdated:
+			report.Updated++
+		case importUnchanged:
+			report.Unchanged++
+		default:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+	return report
+}
+
+// importUser imports a single user and returns its result
+func importUser(ctx context.Context, row importRow, options ImportOptions, base, lang string, seen map[string]bool) ImportResult {
+	row.ID = strings.TrimSpace(row.ID)
+	row.Username = strings.TrimSpace(row.Username)
+	row.Email = strings.TrimSpace(row.Email)
+	result := ImportResult{ID: row.ID, Username: row.Username, Email: row.Email}
+
+	failed := func(errs ...error) ImportResult {
+		result.Status = importFailed
+		for _, err := range errs {
+			result.Errors = append(result.Errors, importFieldError(err, lang))
+		}
+		return result
+	}
+
+	// duplicates within the import
+	var duplicates []error
+	if row.ID != "" && seen["id:"+row.ID] {
+		duplicates = append(duplicates, errUserIDExists[lang])
+	}
+	if seen["username:"+row.Username] {
+		duplicates = append(duplicates, errUsernameExists[lang])
+	}
+	if seen["email:"+row.Email] {
+		duplicates = append(duplicates, errEmailExists[lang])
+	}
+	if len(duplicates) > 0 {
+		return failed(duplicates...)
+	}
+
+	existing, err := findImportedUser(ctx, row)
+	if err != nil {
+		return failed(err)
+	}
+
+	if existing == nil {
+		// the random password is never used, the user chooses one with the link of the invitation
+		user, err := NewUser(ctx, row.Username, row.Email, GenerateRandomPassword(32))
+		if err != nil {
+			return failed(err)
+		}
+		if row.ID != "" {
+			user.ID = row.ID
+		}
+		result.Status = importCreated
+		result.Mail = importMailInvitation
+		if options.DryRun {
+			return result
+		}
+
+		if err := GlobalUserStore.Save(ctx, &user); err != nil {
+			return failed(err)
+		}
+		result.ID = user.ID
+		PublishWebhookEvent(ctx, WebhookUserCreated, webhookUser(user))
+		if err := SendInvitation(ctx, &user, base); err != nil {
+			log.Println("Unable to send invitation to", user.ID, ":", err)
+			result.MailError = err.Error()
+		}
+		return result
+	}
+
+	result.ID = existing.ID
+	if !options.Upsert {
+		if existing.ID == row.ID {
+			return failed(errUserIDExists[lang])
+		}
+		// NewUser reports which of username and email address are taken
+		_, err := NewUser(ctx, row.Username, row.Email, GenerateRandomPassword(32))
+		return failed(err)
+	}
+
+	// without passwords UpdateUser only validates and changes the username and email address
+	user := *existing
+	updated, err := UpdateUser(ctx, &user, row.Username, row.Email, "", "", false)
+	if err != nil {
+		return failed(err)
+	}
+	result.Status = importUnchanged
+	if updated.Username != existing.Username || updated.Email != existing.Email {
+		result.Status = importUpdated
+	}
+	if options.ResetPasswords {
+		result.Mail = importMailPasswordReset
+	}
+	if options.DryRun {
+		return result
+	}
+
+	if result.Status == importUpdated {
+		if err := GlobalUserStore.Save(ctx, &updated); err != nil {
+			return failed(err)
+		}
+		PublishWebhookEvent(ctx, WebhookUserUpdated, webhookUser(updated))
+	}
+	if options.ResetPasswords {
+		if err := SendPasswordReset(ctx, &updated, base); err != nil {
+			log.Println("Unable to send password reset to", updated.ID, ":", err)
+			result.MailError = err.Error()
+		}
+	}
+	return result
+}
+
+// findImportedUser returns the existing user matching the id of the row, or else its username or
+// email address. It returns nil if there is none.
+func findImportedUser(ctx context.Context, row importRow) (*User, error) {
+	// a new id is kept for the created user, so rows with an id are only matched by it
+	lookups := []func() (*User, error){
+		func() (*User, error) { return GlobalUserStore.Find(ctx, row.ID) },
+	}
+	if row.ID == "" {
+		lookups = []func() (*User, error){
+			func() (*User, error) { return GlobalUserStore.FindByUsername(ctx, row.Username) },
+			func() (*User, error) { return GlobalUserStore.FindByEmail(ctx, row.Email) },
+		}
+	}
+
+	for _, lookup := range lookups {
+		user, err := lookup()
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// importFieldError returns the FieldError of a failed user in the given language
+func importFieldError(err error, lang string) FieldError {
+	if fieldError, ok := validationFieldError(err, lang); ok {
+		return fieldError
+	}
+	code := codeInternalError
+	if errors.Is(err, ErrConflict) {
+		code = codeConflict
+	}
+	return FieldError{Code: code, Message: err.Error()}
+}
+
+// importFormat returns the format of the media type of an imported file
+func importFormat(mediaType string) (*responseFormat, error) {
+	var mediaTypes []string
+	for i, format := range responseFormats {
+		for _, formatMediaType := range format.MediaTypes {
+			if formatMediaType == mediaType {
+				return &responseFormats[i], nil
+			}
+		}
+		mediaTypes = append(mediaTypes, format.MediaType)
+	}
+	return nil, fmt.Errorf("%w: expected %s", errUnsupportedMediaType, strings.Join(mediaTypes, ", "))
+}
+
+// decodeImport reads the users of an import in the format with the given name
+func decodeImport(format string, body io.Reader) ([]importRow, error) {
+	var rows []importRow
+	var err error
+	switch format {
+	case "json":
+		err = json.NewDecoder(body).Decode(&rows)
+	case "yaml":
+		err = yaml.NewDecoder(body).Decode(&rows)
+	case "xml":
+		var list struct {
+			Users []importRow `xml:"User"`
+		}
+		err = xml.NewDecoder(body).Decode(&list)
+		rows = list.Users
+	case "csv":
+		rows, err = decodeImportCSV(body)
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", errInvalidImport, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidImport, err)
+	}
+	return rows, nil
+}
+
+// decodeImportCSV reads the users of a CSV file with a header row. The columns are matched with the
+// column names of the export or the json names of the fields, ignoring case.
+func decodeImportCSV(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"username", "email"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the column %s is missing", required)
+		}
+	}
+	cell := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	var rows []importRow
+	for _, record := range records[1:] {
+		rows = append(rows, importRow{
+			ID:       cell(record, "id"),
+			Username: cell(record, "username"),
+			Email:    cell(record, "email"),
+		})
+	}
+	return rows, nil
+}
+
+// importOptions reads the import options from the url parameters
+func importOptions(r *http.Request) (ImportOptions, error) {
+	var options ImportOptions
+	for name, option := range map[string]*bool{
+		"dryRun":         &options.DryRun,
+		"upsert":         &options.Upsert,
+		"resetPasswords": &options.ResetPasswords,
+	} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, fmt.Errorf("%w: %s must be true or false", errInvalidImport, name)
+		}
+		*option = enabled
+	}
+	return options, nil
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// HandleUsersImport shows the page to upload a file of users to import
+// (GET /import)
+func HandleUsersImport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	RenderTemplate(w, r, "users/import", map[string]interface{}{
+		"Pagetitle": "ImportUsers",
+		"Options":   ImportOptions{DryRun: true},
+	})
+}
+
+// HandleUsersImportUpload imports the users of the uploaded file and shows the report. The format is
+// taken from the extension of the file unless it's selected in the form.
+// (POST /import)
+func HandleUsersImportUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lang := GetLanguage(r.Context(), "", r, nil)
+	render := func(options ImportOptions, report *ImportReport, err error) {
+		data := map[string]interface{}{
+			"Pagetitle": "ImportUsers",
+			"Options":   options,
+			"Report":    report,
+		}
+		if err != nil {
+			data["Error"] = err.Error()
+		}
+		RenderTemplate(w, r, "users/import", data)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil {
+		render(ImportOptions{DryRun: true}, nil, err)
+		return
+	}
+	// unchecked checkboxes aren't sent
+	options := ImportOptions{
+		DryRun:         r.FormValue("dryRun") != "",
+		Upsert:         r.FormValue("upsert") != "",
+		ResetPasswords: r.FormValue("resetPasswords") != "",
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		render(options, nil, err)
+		return
+	}
+	defer file.Close()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(path.Ext(header.Filename)), ".")
+		if format == "yml" {
+			format = "yaml"
+		}
+	}
+	rows, err := decodeImport(format, file)
+	if err != nil {
+		render(options, nil, err)
+		return
+	}
+
+	report := ImportUsers(r.Context(), rows, options, baseURL(r), lang)
+	render(options, &report, nil)
+}
+
+// HandleUsersImportv1 imports the users of the body, which has one of the media types of the export.
+// The options are given as url parameters. The report lists the result of every user, the import
+// doesn't fail as a whole if single users can't be imported.
+// (POST /api/v1/users:import?dryRun=&upsert=&resetPasswords=)
+func HandleUsersImportv1(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format, err := importFormat(mediaType)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	options, err := importOptions(r)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	rows, err := decodeImport(format.Name, io.LimitReader(r.Body, maxImportSize))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	_, lang := LookupTranslationWithLanguage(r, apiErrorMessages[codeValidationFailed])
+	report := ImportUsers(r.Context(), rows, options, baseURL(r), lang)
+	writeResponse(w, r, http.StatusOK, report)
+}
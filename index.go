@@ -1,15 +1,29 @@
 package webapp
 
 import (
+	"context"
 	"github.com/julienschmidt/httprouter"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 )
 
 var appName string
 
+// AppContext is cancelled when the application receives SIGINT or SIGTERM or Shutdown is called.
+// The listener and the background jobs stop when it is done.
+var AppContext = context.Background()
+
+var stopApp context.CancelFunc = func() {}
+
+// Shutdown cancels the AppContext
+func Shutdown() {
+	stopApp()
+}
+
 func NewApp(name string) {
 	appName = name
 
@@ -27,6 +41,10 @@ func NewApp(name string) {
 
 	log.Println("Setting up logging...")
 	SetupLogging()
+
+	// the scheduler is running from the start, jobs are added once their stores are set up
+	AppContext, stopApp = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	GlobalScheduler = NewScheduler(AppContext)
 }
 
 func HandleHome(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -0,0 +1,422 @@
+package webapp
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobRun is the record of a single run of a scheduled job
+type JobRun struct {
+	ID       string    `json:"id" yaml:"id"`
+	Job      string    `json:"job" yaml:"job"`
+	Started  time.Time `json:"started" yaml:"started"`
+	Finished time.Time `json:"finished" yaml:"finished"`
+	Result   string    `json:"result,omitempty" yaml:"result,omitempty"`
+	Error    string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+const jobRunIDLength = 20
+
+// jobRunHistory is the number of runs kept per job, older runs are removed when a new run is saved
+const jobRunHistory = 100
+
+// Duration returns how long the run took
+func (run JobRun) Duration() time.Duration {
+	return run.Finished.Sub(run.Started)
+}
+
+// JobRunStore is an abstraction interface to allow multiple data sources to save the run history of the jobs to.
+// List returns the latest runs of a job, newest first.
+type JobRunStore interface {
+	Save(context.Context, *JobRun) error
+	List(ctx context.Context, job string, limit int) ([]JobRun, error)
+}
+
+// GlobalJobRunStore is the Global Database of job runs
+var GlobalJobRunStore JobRunStore
+
+/**********************************
+***  Memory JobRun Store        ***
+***********************************/
+
+// MemoryJobRunStore is a thread-safe implementation of JobRunStore which keeps the job runs in memory
+type MemoryJobRunStore struct {
+	mu      sync.RWMutex
+	persist func() error // called after every change while the store is still locked
+	Runs    map[string][]JobRun
+}
+
+// NewMemoryJobRunStore creates a new, empty MemoryJobRunStore
+func NewMemoryJobRunStore() *MemoryJobRunStore {
+	return &MemoryJobRunStore{
+		Runs: map[string][]JobRun{},
+	}
+}
+
+func (store *MemoryJobRunStore) Save(_ context.Context, run *JobRun) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous := store.Runs[run.Job]
+	runs := append(append([]JobRun(nil), previous...), *run)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	if len(runs) > jobRunHistory {
+		runs = runs[len(runs)-jobRunHistory:]
+	}
+	store.Runs[run.Job] = runs
+
+	if err := store.changed(); err != nil {
+		store.Runs[run.Job] = previous
+		return err
+	}
+	return nil
+}
+
+func (store *MemoryJobRunStore) List(_ context.Context, job string, limit int) ([]JobRun, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var runs []JobRun
+	for i := len(store.Runs[job]) - 1; i >= 0 && (limit <= 0 || len(runs) < limit); i-- {
+		runs = append(runs, store.Runs[job][i])
+	}
+	return runs, nil
+}
+
+// changed calls the persist hook of the store if there is one
+func (store *MemoryJobRunStore) changed() error {
+	if store.persist == nil {
+		return nil
+	}
+	return store.persist()
+}
+
+/**********************************
+***  File JobRun Store          ***
+***********************************/
+
+// FileJobRunStore is an implementation of JobRunStore to save the job runs to the filesystem.
+// It keeps all runs in memory and rewrites the file after every change.
+type FileJobRunStore struct {
+	*MemoryJobRunStore
+	filename string
+}
+
+func NewFileJobRunStore(name string) (*FileJobRunStore, error) {
+	store := &FileJobRunStore{
+		MemoryJobRunStore: NewMemoryJobRunStore(),
+		filename:          name,
+	}
+	store.MemoryJobRunStore.persist = store.persist
+
+	contents, err := readStoreFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(contents, store.MemoryJobRunStore)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// persist writes all job runs to the store's file
+func (store *FileJobRunStore) persist() error {
+	contents, err := yaml.Marshal(store.MemoryJobRunStore)
+	if err != nil {
+		return err
+	}
+	return writeFiles(map[string][]byte{store.filename: contents})
+}
+
+/**********************************
+***  Bolt JobRun Store          ***
+***********************************/
+
+// BoltJobRunStore is an implementation of JobRunStore to save the job runs in an embedded bolt database.
+// Runs are stored under the key "<job>\x00<start time>\x00<id>", so the runs of a job are sorted by start time.
+type BoltJobRunStore struct {
+	boltStore
+}
+
+// NewBoltJobRunStore creates a BoltJobRunStore on the given database
+func NewBoltJobRunStore(db *bolt.DB) JobRunStore {
+	return &BoltJobRunStore{boltStore{db: db}}
+}
+
+func (store *BoltJobRunStore) Save(_ context.Context, run *JobRun) error {
+	return store.update(func(tx *bolt.Tx) error {
+		key := []byte(fmt.Sprintf("%s\x00%020d\x00%s", run.Job, run.Started.UnixNano(), run.ID))
+		if err := boltPut(tx, boltJobRunsBucket, key, run); err != nil {
+			return err
+		}
+
+		// remove the oldest runs beyond the history limit
+		var keys [][]byte
+		prefix := []byte(run.Job + "\x00")
+		cursor := tx.Bucket(boltJobRunsBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for len(keys) > jobRunHistory {
+			if err := tx.Bucket(boltJobRunsBucket).Delete(keys[0]); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		return nil
+	})
+}
+
+func (store *BoltJobRunStore) List(_ context.Context, job string, limit int) ([]JobRun, error) {
+	var runs []JobRun
+	err := store.view(func(tx *bolt.Tx) error {
+		prefix := []byte(job + "\x00")
+		// the first key after all runs of the job
+		end := job + "\x01"
+
+		cursor := tx.Bucket(boltJobRunsBucket).Cursor()
+		k, data := cursor.Seek([]byte(end))
+		if k == nil {
+			k, data = cursor.Last()
+		} else {
+			k, data = cursor.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && (limit <= 0 || len(runs) < limit); k, data = cursor.Prev() {
+			run := JobRun{}
+			if err := json.Unmarshal(data, &run); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	return runs, err
+}
+
+/**********************************
+***  DB JobRun Store            ***
+***********************************/
+
+// DBJobRunStore is an implementation of JobRunStore to save the job runs in the database
+type DBJobRunStore struct {
+	db dbExecutor
+}
+
+func NewDBJobRunStore() JobRunStore {
+	_, err := GlobalPostgresDB.Exec(`
+CREATE TABLE IF NOT EXISTS jobruns (
+  id varchar(255) NOT NULL DEFAULT '',
+  job varchar(255) NOT NULL DEFAULT '',
+  started timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  finished timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  result text NOT NULL DEFAULT '',
+  error text NOT NULL DEFAULT '',
+  PRIMARY KEY (id)
+);
+`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create jobruns table in database: %s\n", err)
+	}
+
+	_, err = GlobalPostgresDB.Exec(`
+CREATE INDEX IF NOT EXISTS job_started_idx ON jobruns( job, started );`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create job index in jobruns table of the database: %s\n", err)
+	}
+
+	return &DBJobRunStore{
+		db: GlobalPostgresDB,
+	}
+}
+
+func (store DBJobRunStore) Save(ctx context.Context, run *JobRun) error {
+	_, err := store.db.ExecContext(
+		ctx,
+		`
+	INSERT INTO jobruns
+	    (id, job, started, finished, result, error)
+	    VALUES ($1, $2, $3, $4, $5, $6)`,
+		run.ID,
+		run.Job,
+		run.Started,
+		run.Finished,
+		run.Result,
+		run.Error,
+	)
+	if err != nil {
+		return dbError(err)
+	}
+
+	// remove the oldest runs beyond the history limit
+	_, err = store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM jobruns
+		WHERE job = $1 AND id NOT IN (
+			SELECT id FROM jobruns WHERE job = $1 ORDER BY started DESC LIMIT $2
+		)`,
+		run.Job,
+		jobRunHistory,
+	)
+	return dbError(err)
+}
+
+func (store DBJobRunStore) List(ctx context.Context, job string, limit int) ([]JobRun, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, job, started, finished, result, error
+		FROM jobruns
+		WHERE job = $1
+		ORDER BY started DESC
+		LIMIT $2`,
+		job,
+		sql.NullInt64{Int64: int64(limit), Valid: limit > 0},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanJobRuns(rows)
+}
+
+// scanJobRuns reads the job runs from a query result
+func scanJobRuns(rows *sql.Rows) ([]JobRun, error) {
+	var runs []JobRun
+	for rows.Next() {
+		run := JobRun{}
+		err := rows.Scan(
+			&run.ID,
+			&run.Job,
+			&run.Started,
+			&run.Finished,
+			&run.Result,
+			&run.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+/**********************************
+***  MySQL JobRun Store         ***
+***********************************/
+
+// MySQLJobRunStore is an implementation of JobRunStore to save the job runs in a MySQL or MariaDB database
+type MySQLJobRunStore struct {
+	db dbExecutor
+}
+
+func NewMySQLJobRunStore() JobRunStore {
+	_, err := GlobalMySQLDB.Exec(`
+CREATE TABLE IF NOT EXISTS jobruns (
+  id varchar(255) NOT NULL DEFAULT '',
+  job varchar(255) NOT NULL DEFAULT '',
+  started datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  finished datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  result text NOT NULL,
+  error text NOT NULL,
+  PRIMARY KEY (id),
+  KEY job_started_idx (job, started)
+) DEFAULT CHARSET=utf8mb4;
+`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create jobruns table in database: %s\n", err)
+	}
+
+	return &MySQLJobRunStore{
+		db: GlobalMySQLDB,
+	}
+}
+
+func (store MySQLJobRunStore) Save(ctx context.Context, run *JobRun) error {
+	_, err := store.db.ExecContext(
+		ctx,
+		`
+	INSERT INTO jobruns
+	    (id, job, started, finished, result, error)
+	    VALUES (?, ?, ?, ?, ?, ?)`,
+		run.ID,
+		run.Job,
+		run.Started.UTC(),
+		run.Finished.UTC(),
+		run.Result,
+		run.Error,
+	)
+	if err != nil {
+		return mysqlError(err)
+	}
+
+	// remove the oldest runs beyond the history limit. MySQL doesn't support LIMIT in IN subqueries
+	// and deleting from a table selected in a subquery, so the oldest kept run is looked up first.
+	var oldest time.Time
+	err = store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT started FROM jobruns
+		WHERE job = ?
+		ORDER BY started DESC
+		LIMIT 1 OFFSET ?`,
+		run.Job,
+		jobRunHistory-1,
+	).Scan(&oldest)
+	if err != nil {
+		if err = mysqlError(err); errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	_, err = store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM jobruns
+		WHERE job = ? AND started < ?`,
+		run.Job,
+		oldest,
+	)
+	return mysqlError(err)
+}
+
+func (store MySQLJobRunStore) List(ctx context.Context, job string, limit int) ([]JobRun, error) {
+	if limit <= 0 {
+		limit = jobRunHistory
+	}
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, job, started, finished, result, error
+		FROM jobruns
+		WHERE job = ?
+		ORDER BY started DESC
+		LIMIT ?`,
+		job,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanJobRuns(rows)
+}
@@ -0,0 +1,100 @@
+package webapp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// Mail is a plain text mail to a single recipient
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends mails, e.g. the invitations of imported users
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// GlobalMailer sends the mails of the application, see SetupMail
+var GlobalMailer Mailer = LogMailer{}
+
+// SetupMail sets up the GlobalMailer with the configured SMTP server and loads the key of the password links.
+// Without a host the mails are only written to the log.
+func SetupMail(config MailConfig) error {
+	if err := setupTokenKey(config.TokenKeyFile); err != nil {
+		return err
+	}
+	if config.Host == "" {
+		GlobalMailer = LogMailer{}
+		return nil
+	}
+	GlobalMailer = &SMTPMailer{Config: config}
+	return nil
+}
+
+// LogMailer writes the mails to the log instead of sending them, e.g. for development
+type LogMailer struct{}
+
+// Send logs the mail
+func (LogMailer) Send(_ context.Context, mail Mail) error {
+	Logf(InfoLevel, "Mail to %s: %s\n%s\n", mail.To, mail.Subject, mail.Body)
+	return nil
+}
+
+// SMTPMailer sends the mails through an SMTP server, using STARTTLS if the server supports it
+type SMTPMailer struct {
+	Config MailConfig
+}
+
+// Send sends the mail to the SMTP server
+func (mailer *SMTPMailer) Send(_ context.Context, mail Mail) error {
+	port := mailer.Config.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(mailer.Config.Host, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if mailer.Config.Username != "" {
+		auth = smtp.PlainAuth("", mailer.Config.Username, mailer.Config.Password, mailer.Config.Host)
+	}
+
+	message, err := mailer.message(mail)
+	if err != nil {
+		return err
+	}
+	if err := smtp.SendMail(addr, auth, mailer.Config.From, []string{mail.To}, message); err != nil {
+		return fmt.Errorf("unable to send mail to %s: %w", mail.To, err)
+	}
+	return nil
+}
+
+// message formats the mail with its headers, the body is encoded as quoted-printable UTF-8
+func (mailer *SMTPMailer) message(mail Mail) ([]byte, error) {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", mailer.Config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&message)
+	if _, err := writer.Write([]byte(mail.Body)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
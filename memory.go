@@ -0,0 +1,73 @@
+package webapp
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+// MemorySeed is the content of a seed file, which fills the memory stores on startup
+type MemorySeed struct {
+	Users       []SeedUser   `yaml:"users"`
+	Sessions    []Session    `yaml:"sessions"`
+	UserConfigs []UserConfig `yaml:"userconfigs"`
+}
+
+// SeedUser is a user in a seed file. Instead of a hashed password it may contain a plaintext password,
+// which is hashed when the seed file is loaded.
+type SeedUser struct {
+	User     `yaml:",inline"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// NewMemoryStores creates the memory stores and fills them with the contents of the seed file, if given
+func NewMemoryStores(seedfile string) (*MemoryUserStore, *MemorySessionStore, *MemoryUserConfigStore, error) {
+	users := NewMemoryUserStore()
+	sessions := NewMemorySessionStore()
+	userconfigs := NewMemoryUserConfigStore()
+	users.sessions = sessions
+
+	if seedfile == "" {
+		return users, sessions, userconfigs, nil
+	}
+
+	contents, err := os.ReadFile(seedfile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	seed := MemorySeed{}
+	if err := yaml.Unmarshal(contents, &seed); err != nil {
+		return nil, nil, nil, err
+	}
+
+	ctx := context.Background()
+	for _, seeded := range seed.Users {
+		user := seeded.User
+		if user.ID == "" {
+			user.ID = GenerateID("usr", userIDLength)
+		}
+		if seeded.Password != "" {
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(seeded.Password), hashCost)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			user.HashedPassword = string(hashedPassword)
+		}
+		if err := users.Save(ctx, &user); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for _, session := range seed.Sessions {
+		if err := sessions.Save(ctx, &session); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for _, userconfig := range seed.UserConfigs {
+		if err := userconfigs.Save(ctx, &userconfig); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return users, sessions, userconfigs, nil
+}
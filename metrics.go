@@ -0,0 +1,576 @@
+package webapp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The metrics are served in the Prometheus text format under /metrics. The HTTP requests are counted by the
+// route of the Router handling them, the operations of the stores by their backend and method. Only scrapers
+// with the configured bearer token or from the allowed networks get the metrics.
+
+// MetricsTokenEnv is the environment variable holding the bearer token of the scrapers.
+// It takes precedence over the token configured in Config.Metrics.Token.
+const MetricsTokenEnv = "WEBAPP_METRICS_TOKEN"
+
+// metricsSessionsTimeout limits the time counting the active sessions may take during a scrape
+const metricsSessionsTimeout = 5 * time.Second
+
+// unmatchedRoute is the route label of requests answered before a router matched them,
+// e.g. by RequireLogin or with 404 Not Found
+const unmatchedRoute = "none"
+
+// metricsRegistry holds the metrics of the application and the Go runtime
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webapp",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of handled HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webapp",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle the HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "webapp",
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Number of HTTP requests being handled.",
+	})
+	storeOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "webapp",
+		Subsystem: "store",
+		Name:      "operation_duration_seconds",
+		Help:      "Time taken by the operations of the stores by backend, store and method.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"backend", "store", "method"})
+	storeOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webapp",
+		Subsystem: "store",
+		Name:      "operation_errors_total",
+		Help:      "Number of failed operations of the stores by backend, store and method, not counting objects that weren't found.",
+	}, []string{"backend", "store", "method"})
+	loginsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "webapp",
+		Name:      "logins_total",
+		Help:      "Number of logins by result, success or failure.",
+	}, []string{"result"})
+	activeSessions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "webapp",
+		Name:      "sessions_active",
+		Help:      "Number of unexpired sessions of logged in users.",
+	}, countActiveSessions)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		storeOperationDuration,
+		storeOperationErrors,
+		loginsTotal,
+		activeSessions,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	// report both results of the logins from the start
+	loginsTotal.WithLabelValues("success")
+	loginsTotal.WithLabelValues("failure")
+}
+
+// metricsNetworks are the networks allowed to scrape the metrics without token
+var metricsNetworks []netip.Prefix
+
+// SetupMetrics reads the access settings of the metrics endpoint and wraps the global stores and the
+// GlobalTransactor to measure their operations. It must be called before the stores are wrapped by
+// SetupCache, so the operations of the backend are measured instead of the cache.
+func SetupMetrics(cfg MetricsConfig) error {
+	networks, err := parseNetworks(cfg.AllowedNetworks)
+	if err != nil {
+		return fmt.Errorf("invalid allowed networks of the metrics: %w", err)
+	}
+	metricsNetworks = networks
+
+	backend := storageBackend(Config.DBConnector)
+	GlobalUserStore = NewMetricsUserStore(GlobalUserStore, backend)
+	GlobalSessionStore = NewMetricsSessionStore(GlobalSessionStore, backend)
+	GlobalUserConfigStore = NewMetricsUserConfigStore(GlobalUserConfigStore, backend)
+	GlobalJobRunStore = NewMetricsJobRunStore(GlobalJobRunStore, backend)
+	GlobalWebhookStore = NewMetricsWebhookStore(GlobalWebhookStore, backend)
+	GlobalTransactor = NewMetricsTransactor(GlobalTransactor, backend)
+	return nil
+}
+
+// storageBackend returns the name of the storage backend of a dbConnector
+func storageBackend(dbConnector string) string {
+	switch {
+	case dbConnector == "" || dbConnector == "files":
+		return "files"
+	case dbConnector == "memory":
+		return "memory"
+	case strings.HasPrefix(dbConnector, "bolt"):
+		return "bolt"
+	case strings.HasPrefix(dbConnector, "mysql://"):
+		return "mysql"
+	}
+	return "postgres"
+}
+
+// metricsToken returns the bearer token of the scrapers
+func metricsToken() string {
+	if token := os.Getenv(MetricsTokenEnv); token != "" {
+		return token
+	}
+	return Config.Metrics.Token
+}
+
+// countActiveSessions returns the number of active sessions for the sessions_active gauge
+func countActiveSessions() float64 {
+	if GlobalSessionStore == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsSessionsTimeout)
+	defer cancel()
+	count, err := GlobalSessionStore.CountActive(ctx, time.Now())
+	if err != nil {
+		log.Println("Unable to count the active sessions:", err)
+		return math.NaN()
+	}
+	return float64(count)
+}
+
+// countLogin counts a successful or failed login
+func countLogin(success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	loginsTotal.WithLabelValues(result).Inc()
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// HandleMetrics serves the metrics to scrapers with the bearer token or from one of the allowed networks.
+// The address of the connection is checked, so scrapers must not connect through a proxy.
+// (GET /metrics)
+func HandleMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !metricsAllowed(r) {
+		http.Error(w, LookupTranslation(r, "ErrorForbidden"), http.StatusForbidden)
+		return
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// metricsAllowed reports if the request has the bearer token or comes from an allowed network
+func metricsAllowed(r *http.Request) bool {
+	if token := metricsToken(); token != "" {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(given)), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && containsAddr(metricsNetworks, addr)
+}
+
+/****************************************
+***  HTTP Metrics                     ***
+*****************************************/
+
+// requestRouteKey is the context key of the route of a request
+type requestRouteKey struct{}
+
+// requestRoute holds the route of a request, which is set by the Router handling it
+type requestRoute struct {
+	route string
+}
+
+// withRequestRoute returns a context to record the route of a request in
+func withRequestRoute(ctx context.Context) (context.Context, *requestRoute) {
+	route := &requestRoute{route: unmatchedRoute}
+	return context.WithValue(ctx, requestRouteKey{}, route), route
+}
+
+// setRequestRoute records the route of a request handled by a router
+func setRequestRoute(r *http.Request, route string) {
+	if holder, ok := r.Context().Value(requestRouteKey{}).(*requestRoute); ok {
+		holder.route = route
+	}
+}
+
+// observeRequest counts a request handled by the Middleware and records its duration
+func observeRequest(r *http.Request, w *MiddlewareResponseWriter, route *requestRoute, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	httpRequestsTotal.WithLabelValues(route.route, r.Method, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(route.route, r.Method).Observe(time.Since(start).Seconds())
+}
+
+// Router is an httprouter.Router which records the routes of the requests it handles for the metrics
+type Router struct {
+	*httprouter.Router
+}
+
+// NewRouter creates a new Router
+func NewRouter() *Router {
+	return &Router{Router: httprouter.New()}
+}
+
+// Handle registers the handle for the method and path
+func (router *Router) Handle(method, path string, handle httprouter.Handle) {
+	router.Router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		setRequestRoute(r, path)
+		handle(w, r, ps)
+	})
+}
+
+// GET registers the handle for GET requests of the path
+func (router *Router) GET(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodGet, path, handle)
+}
+
+// POST registers the handle for POST requests of the path
+func (router *Router) POST(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodPost, path, handle)
+}
+
+// PUT registers the handle for PUT requests of the path
+func (router *Router) PUT(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodPut, path, handle)
+}
+
+// PATCH registers the handle for PATCH requests of the path
+func (router *Router) PATCH(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodPatch, path, handle)
+}
+
+// DELETE registers the handle for DELETE requests of the path
+func (router *Router) DELETE(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodDelete, path, handle)
+}
+
+// ServeFiles serves the files of root like httprouter.Router.ServeFiles, the path must end with /*filepath
+func (router *Router) ServeFiles(path string, root http.FileSystem) {
+	if !strings.HasSuffix(path, "/*filepath") {
+		panic("path must end with /*filepath in path '" + path + "'")
+	}
+	fileServer := http.FileServer(root)
+	router.GET(path, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		r.URL.Path = ps.ByName("filepath")
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+/****************************************
+***  Store Metrics                    ***
+*****************************************/
+
+// storeMetrics records the operations of a store of a backend
+type storeMetrics struct {
+	backend string
+	store   string
+}
+
+// observe records the duration of an operation and counts it if it failed. It's deferred with a pointer
+// to the error the operation returns.
+func (m storeMetrics) observe(method string, start time.Time, err *error) {
+	storeOperationDuration.WithLabelValues(m.backend, m.store, method).Observe(time.Since(start).Seconds())
+	if *err != nil && !errors.Is(*err, ErrNotFound) {
+		storeOperationErrors.WithLabelValues(m.backend, m.store, method).Inc()
+	}
+}
+
+// MetricsUserStore records the operations of a UserStore
+type MetricsUserStore struct {
+	UserStore
+	storeMetrics
+}
+
+// NewMetricsUserStore wraps store to record its operations with the backend label
+func NewMetricsUserStore(store UserStore, backend string) *MetricsUserStore {
+	return &MetricsUserStore{
+		UserStore:    store,
+		storeMetrics: storeMetrics{backend: backend, store: "users"},
+	}
+}
+
+func (store *MetricsUserStore) Find(ctx context.Context, id string) (user *User, err error) {
+	defer store.observe("Find", time.Now(), &err)
+	return store.UserStore.Find(ctx, id)
+}
+
+func (store *MetricsUserStore) All(ctx context.Context) (users []User, err error) {
+	defer store.observe("All", time.Now(), &err)
+	return store.UserStore.All(ctx)
+}
+
+func (store *MetricsUserStore) List(ctx context.Context, query UserQuery) (list UserList, err error) {
+	defer store.observe("List", time.Now(), &err)
+	return store.UserStore.List(ctx, query)
+}
+
+func (store *MetricsUserStore) FindByEmail(ctx context.Context, email string) (user *User, err error) {
+	defer store.observe("FindByEmail", time.Now(), &err)
+	return store.UserStore.FindByEmail(ctx, email)
+}
+
+func (store *MetricsUserStore) FindByUsername(ctx context.Context, username string) (user *User, err error) {
+	defer store.observe("FindByUsername", time.Now(), &err)
+	return store.UserStore.FindByUsername(ctx, username)
+}
+
+func (store *MetricsUserStore) FindDeletionDue(ctx context.Context, before time.Time) (users []User, err error) {
+	defer store.observe("FindDeletionDue", time.Now(), &err)
+	return store.UserStore.FindDeletionDue(ctx, before)
+}
+
+func (store *MetricsUserStore) Save(ctx context.Context, user *User) (err error) {
+	defer store.observe("Save", time.Now(), &err)
+	return store.UserStore.Save(ctx, user)
+}
+
+func (store *MetricsUserStore) Delete(ctx context.Context, user *User) (err error) {
+	defer store.observe("Delete", time.Now(), &err)
+	return store.UserStore.Delete(ctx, user)
+}
+
+// MetricsSessionStore records the operations of a SessionStore
+type MetricsSessionStore struct {
+	SessionStore
+	storeMetrics
+}
+
+// NewMetricsSessionStore wraps store to record its operations with the backend label
+func NewMetricsSessionStore(store SessionStore, backend string) *MetricsSessionStore {
+	return &MetricsSessionStore{
+		SessionStore: store,
+		storeMetrics: storeMetrics{backend: backend, store: "sessions"},
+	}
+}
+
+func (store *MetricsSessionStore) Find(ctx context.Context, id string) (session *Session, err error) {
+	defer store.observe("Find", time.Now(), &err)
+	return store.SessionStore.Find(ctx, id)
+}
+
+func (store *MetricsSessionStore) FindByUser(ctx context.Context, userid string) (sessions []Session, err error) {
+	defer store.observe("FindByUser", time.Now(), &err)
+	return store.SessionStore.FindByUser(ctx, userid)
+}
+
+func (store *MetricsSessionStore) FindByUsers(ctx context.Context, userids []string) (sessions map[string][]Session, err error) {
+	defer store.observe("FindByUsers", time.Now(), &err)
+	return store.SessionStore.FindByUsers(ctx, userids)
+}
+
+func (store *MetricsSessionStore) Save(ctx context.Context, session *Session) (err error) {
+	defer store.observe("Save", time.Now(), &err)
+	return store.SessionStore.Save(ctx, session)
+}
+
+func (store *MetricsSessionStore) Delete(ctx context.Context, session *Session) (err error) {
+	defer store.observe("Delete", time.Now(), &err)
+	return store.SessionStore.Delete(ctx, session)
+}
+
+func (store *MetricsSessionStore) DeleteExpired(ctx context.Context, before time.Time) (n int, err error) {
+	defer store.observe("DeleteExpired", time.Now(), &err)
+	return store.SessionStore.DeleteExpired(ctx, before)
+}
+
+func (store *MetricsSessionStore) CountActive(ctx context.Context, now time.Time) (n int, err error) {
+	defer store.observe("CountActive", time.Now(), &err)
+	return store.SessionStore.CountActive(ctx, now)
+}
+
+// MetricsUserConfigStore records the operations of a UserConfigStore
+type MetricsUserConfigStore struct {
+	UserConfigStore
+	storeMetrics
+}
+
+// NewMetricsUserConfigStore wraps store to record its operations with the backend label
+func NewMetricsUserConfigStore(store UserConfigStore, backend string) *MetricsUserConfigStore {
+	return &MetricsUserConfigStore{
+		UserConfigStore: store,
+		storeMetrics:    storeMetrics{backend: backend, store: "userconfigs"},
+	}
+}
+
+func (store *MetricsUserConfigStore) Find(ctx context.Context, userid string) (userconfig *UserConfig, err error) {
+	defer store.observe("Find", time.Now(), &err)
+	return store.UserConfigStore.Find(ctx, userid)
+}
+
+func (store *MetricsUserConfigStore) FindByUsers(ctx context.Context, userids []string) (userconfigs map[string]UserConfig, err error) {
+	defer store.observe("FindByUsers", time.Now(), &err)
+	return store.UserConfigStore.FindByUsers(ctx, userids)
+}
+
+func (store *MetricsUserConfigStore) Save(ctx context.Context, userconfig *UserConfig) (err error) {
+	defer store.observe("Save", time.Now(), &err)
+	return store.UserConfigStore.Save(ctx, userconfig)
+}
+
+func (store *MetricsUserConfigStore) Delete(ctx context.Context, userconfig *UserConfig) (err error) {
+	defer store.observe("Delete", time.Now(), &err)
+	return store.UserConfigStore.Delete(ctx, userconfig)
+}
+
+// MetricsJobRunStore records the operations of a JobRunStore
+type MetricsJobRunStore struct {
+	JobRunStore
+	storeMetrics
+}
+
+// NewMetricsJobRunStore wraps store to record its operations with the backend label
+func NewMetricsJobRunStore(store JobRunStore, backend string) *MetricsJobRunStore {
+	return &MetricsJobRunStore{
+		JobRunStore:  store,
+		storeMetrics: storeMetrics{backend: backend, store: "jobruns"},
+	}
+}
+
+func (store *MetricsJobRunStore) Save(ctx context.Context, run *JobRun) (err error) {
+	defer store.observe("Save", time.Now(), &err)
+	return store.JobRunStore.Save(ctx, run)
+}
+
+func (store *MetricsJobRunStore) List(ctx context.Context, job string, limit int) (runs []JobRun, err error) {
+	defer store.observe("List", time.Now(), &err)
+	return store.JobRunStore.List(ctx, job, limit)
+}
+
+// MetricsWebhookStore records the operations of a WebhookStore
+type MetricsWebhookStore struct {
+	WebhookStore
+	storeMetrics
+}
+
+// NewMetricsWebhookStore wraps store to record its operations with the backend label
+func NewMetricsWebhookStore(store WebhookStore, backend string) *MetricsWebhookStore {
+	return &MetricsWebhookStore{
+		WebhookStore: store,
+		storeMetrics: storeMetrics{backend: backend, store: "webhooks"},
+	}
+}
+
+func (store *MetricsWebhookStore) All(ctx context.Context) (webhooks []Webhook, err error) {
+	defer store.observe("All", time.Now(), &err)
+	return store.WebhookStore.All(ctx)
+}
+
+func (store *MetricsWebhookStore) Find(ctx context.Context, id string) (webhook *Webhook, err error) {
+	defer store.observe("Find", time.Now(), &err)
+	return store.WebhookStore.Find(ctx, id)
+}
+
+func (store *MetricsWebhookStore) Save(ctx context.Context, webhook *Webhook) (err error) {
+	defer store.observe("Save", time.Now(), &err)
+	return store.WebhookStore.Save(ctx, webhook)
+}
+
+func (store *MetricsWebhookStore) Delete(ctx context.Context, webhook *Webhook) (err error) {
+	defer store.observe("Delete", time.Now(), &err)
+	return store.WebhookStore.Delete(ctx, webhook)
+}
+
+func (store *MetricsWebhookStore) SaveDelivery(ctx context.Context, delivery *WebhookDelivery) (err error) {
+	defer store.observe("SaveDelivery", time.Now(), &err)
+	return store.WebhookStore.SaveDelivery(ctx, delivery)
+}
+
+func (store *MetricsWebhookStore) FindDelivery(ctx context.Context, id string) (delivery *WebhookDelivery, err error) {
+	defer store.observe("FindDelivery", time.Now(), &err)
+	return store.WebhookStore.FindDelivery(ctx, id)
+}
+
+func (store *MetricsWebhookStore) Deliveries(ctx context.Context, webhookID string, limit int) (deliveries []WebhookDelivery, err error) {
+	defer store.observe("Deliveries", time.Now(), &err)
+	return store.WebhookStore.Deliveries(ctx, webhookID, limit)
+}
+
+func (store *MetricsWebhookStore) DeliveriesDue(ctx context.Context, before time.Time) (deliveries []WebhookDelivery, err error) {
+	defer store.observe("DeliveriesDue", time.Now(), &err)
+	return store.WebhookStore.DeliveriesDue(ctx, before)
+}
+
+// MetricsTransactor records the transactions of a Transactor and the operations of the stores within them
+type MetricsTransactor struct {
+	Transactor
+	storeMetrics
+}
+
+// NewMetricsTransactor wraps transactor to record its transactions with the backend label
+func NewMetricsTransactor(transactor Transactor, backend string) *MetricsTransactor {
+	return &MetricsTransactor{
+		Transactor:   transactor,
+		storeMetrics: storeMetrics{backend: backend, store: "transactions"},
+	}
+}
+
+func (t *MetricsTransactor) Begin(ctx context.Context) (_ Tx, err error) {
+	defer t.observe("Begin", time.Now(), &err)
+	tx, err := t.Transactor.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsTx{Tx: tx, storeMetrics: t.storeMetrics}, nil
+}
+
+// metricsTx records the operations of a transaction. Rollbacks aren't recorded, since every transaction is
+// rolled back after its commit by WithTx.
+type metricsTx struct {
+	Tx
+	storeMetrics
+}
+
+func (tx *metricsTx) Users() UserStore {
+	return NewMetricsUserStore(tx.Tx.Users(), tx.backend)
+}
+
+func (tx *metricsTx) Sessions() SessionStore {
+	return NewMetricsSessionStore(tx.Tx.Sessions(), tx.backend)
+}
+
+func (tx *metricsTx) UserConfigs() UserConfigStore {
+	return NewMetricsUserConfigStore(tx.Tx.UserConfigs(), tx.backend)
+}
+
+func (tx *metricsTx) Commit() (err error) {
+	defer tx.observe("Commit", time.Now(), &err)
+	return tx.Tx.Commit()
+}
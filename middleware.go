@@ -1,15 +1,20 @@
 package webapp
 
-import "net/http"
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"time"
+)
 
 // Middleware is a chain of sequential http Handlers
 type Middleware []http.Handler
 
 // MiddlewareResponseWriter is a specialized Version of the http.ResponseWriter that marks if
-// a Handler in the middleware chain has written to it
+// a Handler in the middleware chain has written to it and remembers the status code for the metrics
 type MiddlewareResponseWriter struct {
 	http.ResponseWriter
 	written bool
+	status  int
 }
 
 // Add appends a new Handler at the end of the middleware chain
@@ -23,6 +28,13 @@ func (m *Middleware) Add(handler http.Handler) {
 func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Wrap the supplied ResponseWriter
 	mw := NewMiddlewareResponseWriter(w)
+	// Share the store lookups between all handlers of the request and record its route for the metrics
+	ctx, route := withRequestRoute(WithRequestCache(r.Context()))
+	r = r.WithContext(ctx)
+
+	httpRequestsInFlight.Inc()
+	defer httpRequestsInFlight.Dec()
+	defer observeRequest(r, mw, route, time.Now())
 
 	// Loop through all of the registered handlers
 	for _, handler := range m {
@@ -35,7 +47,11 @@ func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	// If no handlers wrote to the response, it’s a 404
-	http.NotFound(w, r)
+	if isAPIRequest(r) {
+		writeAPIError(mw, r, http.StatusNotFound, codeNotFound, "")
+		return
+	}
+	http.NotFound(mw, r)
 }
 
 // NewMiddlewareResponseWriter creates a new MiddlewareResponseWriter instance
@@ -48,11 +64,53 @@ func NewMiddlewareResponseWriter(w http.ResponseWriter) *MiddlewareResponseWrite
 // Write writes into the MiddlewareResponseWriter and returns the number of bytes written
 func (w *MiddlewareResponseWriter) Write(bytes []byte) (int, error) {
 	w.written = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
 	return w.ResponseWriter.Write(bytes)
 }
 
+// Flush sends the buffered data to the client, so handlers can stream their responses
+func (w *MiddlewareResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // WriteHeader writes a return code into the header of the MiddlewareResponseWriter
 func (w *MiddlewareResponseWriter) WriteHeader(code int) {
 	w.written = true
+	if w.status == 0 {
+		w.status = code
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
+
+// CustomMethodRouter routes the paths of custom methods like /api/v1/users:import, which httprouter would read
+// as a parameter of the path. Only exact paths are matched.
+type CustomMethodRouter struct {
+	routes map[string]httprouter.Handle
+}
+
+// NewCustomMethodRouter creates a new router for custom methods
+func NewCustomMethodRouter() *CustomMethodRouter {
+	return &CustomMethodRouter{routes: map[string]httprouter.Handle{}}
+}
+
+// Handle registers the handle for the method and path
+func (router *CustomMethodRouter) Handle(method, path string, handle httprouter.Handle) {
+	router.routes[method+" "+path] = handle
+}
+
+// POST registers the handle for POST requests of the path
+func (router *CustomMethodRouter) POST(path string, handle httprouter.Handle) {
+	router.Handle(http.MethodPost, path, handle)
+}
+
+// ServeHTTP calls the handle of the request's method and path, if there is one
+func (router *CustomMethodRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handle, ok := router.routes[r.Method+" "+r.URL.Path]; ok {
+		setRequestRoute(r, r.URL.Path)
+		handle(w, r, nil)
+	}
+}
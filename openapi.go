@@ -0,0 +1,757 @@
+package webapp
+
+import (
+	"github.com/graph-gophers/graphql-go"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OpenAPI 3 document of the API is generated from the operations listed in apiOperations. The schemas
+// of the request and response bodies are derived from the Go types with reflection, so they follow the
+// json tags of the types: fields with omitempty are optional, pointers are nullable.
+
+// OpenAPI is an OpenAPI 3 document, limited to the parts used to describe this API
+type OpenAPI struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"` // by path and lower case method
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+// OpenAPIInfo describes the API
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// OpenAPIComponents contains the schemas referenced by the operations and the authentication scheme
+type OpenAPIComponents struct {
+	Schemas         map[string]*OpenAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]*OpenAPISecurityScheme `json:"securitySchemes"`
+}
+
+// OpenAPISecurityScheme describes how requests are authenticated
+type OpenAPISecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenAPIOperation describes a single method of a path
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security"`
+}
+
+// OpenAPIParameter describes a path or query parameter
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIRequestBody describes the body of a request by media type
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse describes a response of an operation
+type OpenAPIResponse struct {
+	Description string                       `json:"description"`
+	Headers     map[string]*OpenAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIHeader describes a response header
+type OpenAPIHeader struct {
+	Description string         `json:"description,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIMediaType contains the schema of a body
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPISchema is a JSON schema as used by OpenAPI 3.0
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []interface{}             `json:"enum,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+// apiOperation is an operation of the API together with its method, path and the types of its bodies
+type apiOperation struct {
+	Method       string
+	Path         string // in httprouter syntax, e.g. /api/v1/users/:id
+	ID           string
+	Summary      string
+	Description  string
+	Access       string // public, user or admin
+	Parameters   []OpenAPIParameter
+	Request      interface{} // value of the JSON request body type, nil without a body
+	RequestTypes []string    // media types of the request body, defaults to application/json
+	Responses    []apiResponse
+}
+
+// apiResponse is a response of an operation with the value of its body type, nil without a body
+type apiResponse struct {
+	Status      int
+	Description string
+	Body        interface{}
+	Headers     []string
+	MediaTypes  []string    // defaults to all response formats for successful responses, application/problem+json for errors
+	Watch       interface{} // body of a watch, streamed as application/x-ndjson or text/event-stream
+}
+
+// apiAccess are the descriptions of the access levels of the operations
+var apiAccess = map[string]string{
+	"public": "No authentication required.",
+	"user":   "Requires a session, users can only access their own data unless they are the admin.",
+	"admin":  "Requires the session of the admin.",
+}
+
+// apiHeaders are the response headers used by the operations
+var apiHeaders = map[string]*OpenAPIHeader{
+	"Location":           {Description: "URL of the created resource", Schema: &OpenAPISchema{Type: "string"}},
+	"X-Total-Count":      {Description: "Number of matching resources on all pages", Schema: &OpenAPISchema{Type: "integer"}},
+	"Link":               {Description: "URL of the next page with rel=\"next\"", Schema: &OpenAPISchema{Type: "string"}},
+	"X-Resource-Version": {Description: "Resource version to watch for changes from", Schema: &OpenAPISchema{Type: "string"}},
+	"ETag":               {Description: "Entity tag of the version of the resource", Schema: &OpenAPISchema{Type: "string"}},
+}
+
+// parameters used by the operations
+var (
+	formatParameter = OpenAPIParameter{Name: "format", In: "query",
+		Description: "Response format json, yaml, xml or csv, overrides the Accept header",
+		Schema:      &OpenAPISchema{Type: "string", Enum: []interface{}{"json", "yaml", "xml", "csv"}}}
+	idParameter = OpenAPIParameter{Name: "id", In: "path", Required: true, Description: "ID of the user",
+		Schema: &OpenAPISchema{Type: "string"}}
+	ifMatchParameter = OpenAPIParameter{Name: "If-Match", In: "header",
+		Description: "Only change the resource if it still has one of these entity tags",
+		Schema:      &OpenAPISchema{Type: "string"}}
+	gracePeriodParameter = OpenAPIParameter{Name: "gracePeriodSeconds", In: "query",
+		Description: "Seconds until the deletion, 0 deletes immediately, defaults to the configured grace period",
+		Schema:      &OpenAPISchema{Type: "integer", Format: "int64"}}
+	userQueryParameters = []OpenAPIParameter{
+		{Name: "q", In: "query", Description: "Search in username and email", Schema: &OpenAPISchema{Type: "string"}},
+		{Name: "sort", In: "query", Description: "Sort field id, username or email, prefixed with - for descending order",
+			Schema: &OpenAPISchema{Type: "string"}},
+		{Name: "limit", In: "query", Description: "Page size, all users are returned without a limit",
+			Schema: &OpenAPISchema{Type: "integer"}},
+		{Name: "cursor", In: "query", Description: "Cursor of the page from the Link header", Schema: &OpenAPISchema{Type: "string"}},
+	}
+	watchParameters = []OpenAPIParameter{
+		{Name: "watch", In: "query", Description: "Stream the changes instead of listing the resources",
+			Schema: &OpenAPISchema{Type: "boolean"}},
+		{Name: "resourceVersion", In: "query", Description: "Resume a watch after this version",
+			Schema: &OpenAPISchema{Type: "string"}},
+		{Name: "timeoutSeconds", In: "query", Description: "End a watch after this time",
+			Schema: &OpenAPISchema{Type: "integer"}},
+	}
+	resourceParameter = OpenAPIParameter{Name: "resource", In: "path", Required: true,
+		Description: "Plural name of the kind, users or settings", Schema: &OpenAPISchema{Type: "string"}}
+	nameParameter = OpenAPIParameter{Name: "name", In: "path", Required: true,
+		Description: "Name of the object, the id of its user for users and settings", Schema: &OpenAPISchema{Type: "string"}}
+	objectListParameters = []OpenAPIParameter{
+		resourceParameter,
+		{Name: "limit", In: "query", Description: "Page size, all objects are returned without a limit",
+			Schema: &OpenAPISchema{Type: "integer"}},
+		{Name: "continue", In: "query", Description: "Token of the next page from the list metadata",
+			Schema: &OpenAPISchema{Type: "string"}},
+		userQueryParameters[0],
+		userQueryParameters[1],
+	}
+)
+
+// apiOperations lists all operations of the API, every route below /api/ has to be described here
+var apiOperations = []apiOperation{
+	{
+		Method:  http.MethodGet,
+		Path:    "/api/v1/openapi.json",
+		ID:      "getOpenAPI",
+		Summary: "OpenAPI document of the API",
+		Access:  "public",
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "This document", Body: map[string]interface{}{},
+				MediaTypes: []string{"application/json", "text/yaml"}},
+		},
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/api/v1/settings",
+		ID:      "getOwnUserConfig",
+		Summary: "Settings of the current user",
+		Access:  "user",
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The settings", Body: UserConfig{}, Headers: []string{"ETag"}},
+			{Status: http.StatusInternalServerError, Description: "The settings couldn't be read"},
+		},
+	},
+	{
+		Method:     http.MethodGet,
+		Path:       "/api/v1/settings/:id",
+		ID:         "getUserConfig",
+		Summary:    "Settings of a user",
+		Access:     "admin",
+		Parameters: []OpenAPIParameter{idParameter},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The settings", Body: UserConfig{}, Headers: []string{"ETag"}},
+			{Status: http.StatusInternalServerError, Description: "The settings couldn't be read"},
+		},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/api/v1/users",
+		ID:          "listUsers",
+		Summary:     "List or watch the users",
+		Description: "With watch=true the changes of the users are streamed as Server-Sent Events or newline-delimited JSON.",
+		Access:      "admin",
+		Parameters:  append(append([]OpenAPIParameter{}, userQueryParameters...), watchParameters...),
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The page of users", Body: []User{},
+				Headers: []string{"X-Total-Count", "Link", "X-Resource-Version"},
+				Watch:   Event{}},
+			{Status: http.StatusBadRequest, Description: "Invalid query parameters", Body: APIError{}},
+			{Status: http.StatusGone, Description: "The resource version of the watch has expired", Body: APIError{}},
+		},
+	},
+	{
+		Method:  http.MethodPost,
+		Path:    "/api/v1/users",
+		ID:      "createUser",
+		Summary: "Create a user",
+		Access:  "admin",
+		Request: userRequest{},
+		Responses: []apiResponse{
+			{Status: http.StatusCreated, Description: "The created user", Body: User{}, Headers: []string{"Location", "ETag"}},
+			{Status: http.StatusBadRequest, Description: "Invalid JSON body", Body: APIError{}},
+			{Status: http.StatusConflict, Description: "Username or email already taken", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The body isn't JSON", Body: APIError{}},
+			{Status: http.StatusUnprocessableEntity, Description: "Validation failed", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/v1/users:import",
+		ID:          "importUsers",
+		Summary:     "Import users",
+		Description: "Imports the users of a file in one of the export formats. New users get an invitation mail to choose their password, existing users are only updated with upsert=true. Users are imported one by one, the report lists the result of each of them.",
+		Access:      "admin",
+		Parameters: []OpenAPIParameter{
+			{Name: "dryRun", In: "query", Description: "Only validate the users and report what would be done",
+				Schema: &OpenAPISchema{Type: "boolean"}},
+			{Name: "upsert", In: "query", Description: "Update existing users matched by id, username or email",
+				Schema: &OpenAPISchema{Type: "boolean"}},
+			{Name: "resetPasswords", In: "query", Description: "Send the updated users a mail to choose a new password",
+				Schema: &OpenAPISchema{Type: "boolean"}},
+		},
+		Request:      []importRow{},
+		RequestTypes: []string{"application/json", "text/yaml", "application/xml", "text/csv"},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The result of every user", Body: ImportReport{}},
+			{Status: http.StatusBadRequest, Description: "The file or the options are invalid", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The format of the file isn't supported", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodDelete,
+		Path:        "/api/v1/users",
+		ID:          "deleteUsers",
+		Summary:     "Delete the selected users",
+		Description: "The users are selected with id parameters or the search parameter q. The admin is never deleted.",
+		Access:      "admin",
+		Parameters: []OpenAPIParameter{
+			{Name: "id", In: "query", Description: "IDs of the users to delete",
+				Schema: &OpenAPISchema{Type: "array", Items: &OpenAPISchema{Type: "string"}}},
+			userQueryParameters[0],
+			gracePeriodParameter,
+		},
+		Request: DeleteOptions{},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The deleted or terminating users", Body: []User{}},
+			{Status: http.StatusBadRequest, Description: "No users selected or invalid delete options", Body: APIError{}},
+		},
+	},
+	{
+		Method:     http.MethodGet,
+		Path:       "/api/v1/users/:id",
+		ID:         "getUser",
+		Summary:    "Get a user",
+		Access:     "user",
+		Parameters: []OpenAPIParameter{idParameter},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The user", Body: User{}, Headers: []string{"ETag"}},
+			{Status: http.StatusForbidden, Description: "Access to another user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such user", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodPut,
+		Path:        "/api/v1/users/:id",
+		ID:          "replaceUser",
+		Summary:     "Replace or create a user",
+		Description: "Users have to confirm a new password with their current password. Only the admin can create users.",
+		Access:      "user",
+		Parameters:  []OpenAPIParameter{idParameter, ifMatchParameter},
+		Request:     userRequest{},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The updated user", Body: User{}, Headers: []string{"ETag"}},
+			{Status: http.StatusCreated, Description: "The created user", Body: User{}, Headers: []string{"Location", "ETag"}},
+			{Status: http.StatusBadRequest, Description: "Invalid JSON body", Body: APIError{}},
+			{Status: http.StatusForbidden, Description: "Access to another user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such user", Body: APIError{}},
+			{Status: http.StatusConflict, Description: "The user has been changed since the version of the body", Body: APIError{}},
+			{Status: http.StatusPreconditionFailed, Description: "The user doesn't match the If-Match header", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The body isn't JSON", Body: APIError{}},
+			{Status: http.StatusUnprocessableEntity, Description: "Validation failed", Body: APIError{}},
+		},
+	},
+	{
+		Method:       http.MethodPatch,
+		Path:         "/api/v1/users/:id",
+		ID:           "patchUser",
+		Summary:      "Modify a user with a JSON merge patch",
+		Access:       "user",
+		Parameters:   []OpenAPIParameter{idParameter, ifMatchParameter},
+		Request:      userRequest{},
+		RequestTypes: []string{"application/merge-patch+json"},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The updated user", Body: User{}, Headers: []string{"ETag"}},
+			{Status: http.StatusBadRequest, Description: "Invalid JSON body", Body: APIError{}},
+			{Status: http.StatusForbidden, Description: "Access to another user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such user", Body: APIError{}},
+			{Status: http.StatusConflict, Description: "The user has been changed since the version of the patch", Body: APIError{}},
+			{Status: http.StatusPreconditionFailed, Description: "The user doesn't match the If-Match header", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The body isn't a merge patch", Body: APIError{}},
+			{Status: http.StatusUnprocessableEntity, Description: "Validation failed", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodDelete,
+		Path:        "/api/v1/users/:id",
+		ID:          "deleteUser",
+		Summary:     "Delete a user",
+		Description: "With a grace period the user is terminating and can be restored until it's purged.",
+		Access:      "admin",
+		Parameters:  []OpenAPIParameter{idParameter, gracePeriodParameter, ifMatchParameter},
+		Request:     DeleteOptions{},
+		Responses: []apiResponse{
+			{Status: http.StatusAccepted, Description: "The terminating user", Body: User{}, Headers: []string{"ETag"}},
+			{Status: http.StatusNoContent, Description: "The user has been deleted"},
+			{Status: http.StatusBadRequest, Description: "Invalid delete options", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such user", Body: APIError{}},
+			{Status: http.StatusPreconditionFailed, Description: "The user doesn't match the If-Match header", Body: APIError{}},
+		},
+	},
+	{
+		Method:     http.MethodPost,
+		Path:       "/api/v1/users/:id/restore",
+		ID:         "restoreUser",
+		Summary:    "Restore a terminating user",
+		Access:     "admin",
+		Parameters: []OpenAPIParameter{idParameter},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The restored user", Body: User{}, Headers: []string{"ETag"}},
+			{Status: http.StatusNotFound, Description: "No such user", Body: APIError{}},
+			{Status: http.StatusConflict, Description: "The user isn't terminating", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/api/v2/:resource",
+		ID:          "listObjects",
+		Summary:     "List or watch the objects of a kind",
+		Description: "Only the admin lists all users and settings, other users get their own settings. The users can be searched and sorted with q and sort. With watch=true the changes of the objects are streamed as Server-Sent Events or newline-delimited JSON, this is reserved for the admin.",
+		Access:      "user",
+		Parameters:  append(append([]OpenAPIParameter{}, objectListParameters...), watchParameters...),
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The page of objects", Body: ObjectList{}, Watch: Event{}},
+			{Status: http.StatusBadRequest, Description: "Invalid query parameters", Body: APIError{}},
+			{Status: http.StatusForbidden, Description: "The objects can only be listed or watched by the admin", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such kind", Body: APIError{}},
+			{Status: http.StatusMethodNotAllowed, Description: "The kind can't be listed", Body: APIError{}},
+			{Status: http.StatusGone, Description: "The resource version of the watch has expired", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/v2/:resource",
+		ID:          "createObject",
+		Summary:     "Create an object",
+		Description: "Without metadata.name a name is generated. Only the admin can create users, settings can't be created.",
+		Access:      "user",
+		Parameters:  []OpenAPIParameter{resourceParameter},
+		Request:     Object{},
+		Responses: []apiResponse{
+			{Status: http.StatusCreated, Description: "The created object", Body: Object{}, Headers: []string{"Location", "ETag"}},
+			{Status: http.StatusBadRequest, Description: "Invalid JSON body or object", Body: APIError{}},
+			{Status: http.StatusForbidden, Description: "The object can't be created by the user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such kind", Body: APIError{}},
+			{Status: http.StatusMethodNotAllowed, Description: "The kind can't be created", Body: APIError{}},
+			{Status: http.StatusConflict, Description: "Unique fields already taken", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The body isn't JSON", Body: APIError{}},
+			{Status: http.StatusUnprocessableEntity, Description: "Validation failed", Body: APIError{}},
+		},
+	},
+	{
+		Method:     http.MethodGet,
+		Path:       "/api/v2/:resource/:name",
+		ID:         "getObject",
+		Summary:    "Get an object",
+		Access:     "user",
+		Parameters: []OpenAPIParameter{resourceParameter, nameParameter},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The object", Body: Object{}, Headers: []string{"ETag"}},
+			{Status: http.StatusForbidden, Description: "Access to an object of another user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such kind or object", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodPut,
+		Path:        "/api/v2/:resource/:name",
+		ID:          "replaceObject",
+		Summary:     "Replace or create an object",
+		Description: "The spec of the object is replaced, its status is ignored. Objects which don't exist are created if the kind supports it. Users have to confirm a new password with their current password.",
+		Access:      "user",
+		Parameters:  []OpenAPIParameter{resourceParameter, nameParameter, ifMatchParameter},
+		Request:     Object{},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The updated object", Body: Object{}, Headers: []string{"ETag"}},
+			{Status: http.StatusCreated, Description: "The created object", Body: Object{}, Headers: []string{"Location", "ETag"}},
+			{Status: http.StatusBadRequest, Description: "Invalid JSON body or object", Body: APIError{}},
+			{Status: http.StatusForbidden, Description: "Access to an object of another user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such kind or object", Body: APIError{}},
+			{Status: http.StatusMethodNotAllowed, Description: "The kind can't be changed", Body: APIError{}},
+			{Status: http.StatusConflict, Description: "The object has been changed since the resource version of the body", Body: APIError{}},
+			{Status: http.StatusPreconditionFailed, Description: "The object doesn't match the If-Match header", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The body isn't JSON", Body: APIError{}},
+			{Status: http.StatusUnprocessableEntity, Description: "Validation failed", Body: APIError{}},
+		},
+	},
+	{
+		Method:       http.MethodPatch,
+		Path:         "/api/v2/:resource/:name",
+		ID:           "patchObject",
+		Summary:      "Modify an object with a JSON merge patch",
+		Access:       "user",
+		Parameters:   []OpenAPIParameter{resourceParameter, nameParameter, ifMatchParameter},
+		Request:      Object{},
+		RequestTypes: []string{"application/merge-patch+json"},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The updated object", Body: Object{}, Headers: []string{"ETag"}},
+			{Status: http.StatusBadRequest, Description: "Invalid JSON body or object", Body: APIError{}},
+			{Status: http.StatusForbidden, Description: "Access to an object of another user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such kind or object", Body: APIError{}},
+			{Status: http.StatusMethodNotAllowed, Description: "The kind can't be changed", Body: APIError{}},
+			{Status: http.StatusConflict, Description: "The object has been changed since the resource version of the patch", Body: APIError{}},
+			{Status: http.StatusPreconditionFailed, Description: "The object doesn't match the If-Match header", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The body isn't a merge patch", Body: APIError{}},
+			{Status: http.StatusUnprocessableEntity, Description: "Validation failed", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodDelete,
+		Path:        "/api/v2/:resource/:name",
+		ID:          "deleteObject",
+		Summary:     "Delete an object",
+		Description: "With a grace period the object is terminating. Users can delete their own account, the admin account can't be deleted. Settings can't be deleted.",
+		Access:      "user",
+		Parameters:  []OpenAPIParameter{resourceParameter, nameParameter, gracePeriodParameter, ifMatchParameter},
+		Request:     DeleteOptions{},
+		Responses: []apiResponse{
+			{Status: http.StatusAccepted, Description: "The terminating object", Body: Object{}, Headers: []string{"ETag"}},
+			{Status: http.StatusNoContent, Description: "The object has been deleted"},
+			{Status: http.StatusBadRequest, Description: "Invalid delete options", Body: APIError{}},
+			{Status: http.StatusForbidden, Description: "The object can't be deleted by the user", Body: APIError{}},
+			{Status: http.StatusNotFound, Description: "No such kind or object", Body: APIError{}},
+			{Status: http.StatusMethodNotAllowed, Description: "The kind can't be deleted", Body: APIError{}},
+			{Status: http.StatusPreconditionFailed, Description: "The object doesn't match the If-Match header", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/api/graphql",
+		ID:          "queryGraphQL",
+		Summary:     "Execute a GraphQL query",
+		Description: "Queries the users with their sessions and settings. Users can only query themselves, only the admin can list the users. Errors of the query are returned in the response with 200 OK.",
+		Access:      "user",
+		Parameters: []OpenAPIParameter{
+			{Name: "query", In: "query", Required: true, Description: "The GraphQL query", Schema: &OpenAPISchema{Type: "string"}},
+			{Name: "operationName", In: "query", Description: "Operation of the query to execute", Schema: &OpenAPISchema{Type: "string"}},
+			{Name: "variables", In: "query", Description: "JSON object with the variables of the query", Schema: &OpenAPISchema{Type: "string"}},
+		},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The data and errors of the query", Body: graphql.Response{}, MediaTypes: []string{"application/json"}},
+			{Status: http.StatusBadRequest, Description: "The query or its variables are missing or invalid", Body: APIError{}},
+		},
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/api/graphql",
+		ID:          "postGraphQL",
+		Summary:     "Execute a GraphQL query",
+		Description: "Like GET /api/graphql with the query in the JSON body.",
+		Access:      "user",
+		Request:     GraphQLRequest{},
+		Responses: []apiResponse{
+			{Status: http.StatusOK, Description: "The data and errors of the query", Body: graphql.Response{}, MediaTypes: []string{"application/json"}},
+			{Status: http.StatusBadRequest, Description: "Invalid JSON body or the query is missing", Body: APIError{}},
+			{Status: http.StatusUnsupportedMediaType, Description: "The body isn't JSON", Body: APIError{}},
+		},
+	},
+}
+
+// OpenAPISpec generates the OpenAPI document of all apiOperations
+func OpenAPISpec() *OpenAPI {
+	spec := &OpenAPI{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:       appName + " API",
+			Description: "Conventions: doc/api-conventions.md",
+			Version:     "v1",
+		},
+		Paths: map[string]map[string]*OpenAPIOperation{},
+		Components: OpenAPIComponents{
+			Schemas: map[string]*OpenAPISchema{},
+			SecuritySchemes: map[string]*OpenAPISecurityScheme{
+				"session": {
+					Type:        "apiKey",
+					In:          "cookie",
+					Name:        appName,
+					Description: "Session cookie set by logging in at /login",
+				},
+			},
+		},
+	}
+	schemas := spec.Components.Schemas
+
+	for _, op := range apiOperations {
+		path := OpenAPIPath(op.Path)
+		if spec.Paths[path] == nil {
+			spec.Paths[path] = map[string]*OpenAPIOperation{}
+		}
+
+		operation := &OpenAPIOperation{
+			OperationID: op.ID,
+			Summary:     op.Summary,
+			Description: strings.TrimSpace(op.Description + " " + apiAccess[op.Access]),
+			Tags:        []string{apiTag(op.Path)},
+			Parameters:  op.Parameters,
+			Responses:   map[string]*OpenAPIResponse{},
+			Security:    []map[string][]string{{"session": {}}},
+		}
+		if op.Access == "public" {
+			operation.Security = []map[string][]string{}
+		}
+
+		if op.Request != nil {
+			mediaTypes := op.RequestTypes
+			if len(mediaTypes) == 0 {
+				mediaTypes = []string{"application/json"}
+			}
+			schema := schemaFor(reflect.TypeOf(op.Request), schemas)
+			operation.RequestBody = &OpenAPIRequestBody{
+				Required: op.Method != http.MethodDelete,
+				Content:  map[string]*OpenAPIMediaType{},
+			}
+			for _, mediaType := range mediaTypes {
+				operation.RequestBody.Content[mediaType] = &OpenAPIMediaType{Schema: schema}
+			}
+		}
+
+		// responses with a body are encoded in the negotiated format
+		negotiated := false
+		for _, resp := range op.Responses {
+			response := &OpenAPIResponse{Description: resp.Description}
+			for _, header := range resp.Headers {
+				if response.Headers == nil {
+					response.Headers = map[string]*OpenAPIHeader{}
+				}
+				response.Headers[header] = apiHeaders[header]
+			}
+			if resp.Body != nil {
+				mediaTypes := resp.MediaTypes
+				if len(mediaTypes) == 0 && resp.Status < http.StatusBadRequest {
+					negotiated = true
+					for _, format := range responseFormats {
+						mediaTypes = append(mediaTypes, format.MediaType)
+					}
+				} else if len(mediaTypes) == 0 {
+					mediaTypes = []string{"application/problem+json"}
+				} else if len(mediaTypes) > 1 {
+					negotiated = true
+				}
+				schema := schemaFor(reflect.TypeOf(resp.Body), schemas)
+				response.Content = map[string]*OpenAPIMediaType{}
+				for _, mediaType := range mediaTypes {
+					response.Content[mediaType] = &OpenAPIMediaType{Schema: schema}
+				}
+			}
+			if resp.Watch != nil {
+				schema := schemaFor(reflect.TypeOf(resp.Watch), schemas)
+				response.Content["application/x-ndjson"] = &OpenAPIMediaType{Schema: schema}
+				response.Content["text/event-stream"] = &OpenAPIMediaType{Schema: schema}
+			}
+			operation.Responses[strconv.Itoa(resp.Status)] = response
+		}
+		if negotiated {
+			operation.Parameters = append(append([]OpenAPIParameter{}, operation.Parameters...), formatParameter)
+			addErrorResponse(operation, http.StatusNotAcceptable, "None of the accepted media types is supported", schemas)
+		}
+		// failures of RequireLogin and RequireAdmin
+		if op.Access != "public" {
+			addErrorResponse(operation, http.StatusUnauthorized, "Not logged in", schemas)
+		}
+		if op.Access == "admin" {
+			addErrorResponse(operation, http.StatusForbidden, "Not logged in as the admin", schemas)
+		}
+		// failures of the RateLimiter
+		addErrorResponse(operation, http.StatusTooManyRequests, "Too many requests, retry after the time in the Retry-After header", schemas)
+
+		spec.Paths[path][strings.ToLower(op.Method)] = operation
+	}
+	return spec
+}
+
+// addErrorResponse adds an APIError response with the status code to the operation, unless it already has one
+func addErrorResponse(operation *OpenAPIOperation, status int, description string, schemas map[string]*OpenAPISchema) {
+	if operation.Responses[strconv.Itoa(status)] != nil {
+		return
+	}
+	operation.Responses[strconv.Itoa(status)] = &OpenAPIResponse{
+		Description: description,
+		Content: map[string]*OpenAPIMediaType{
+			"application/problem+json": {Schema: schemaFor(reflect.TypeOf(APIError{}), schemas)},
+		},
+	}
+}
+
+// apiTag groups the operations by the first path segment after the version, e.g. users. The generic
+// operations of the v2 API are grouped by their version, unversioned endpoints like graphql by their name.
+func apiTag(route string) string {
+	version, route, found := strings.Cut(strings.TrimPrefix(route, "/api/"), "/")
+	resource, _, _ := strings.Cut(route, "/")
+	if !found || strings.HasPrefix(resource, ":") {
+		return version
+	}
+	// custom methods like users:import belong to their resource
+	resource, _, _ = strings.Cut(resource, ":")
+	return strings.TrimSuffix(resource, ".json")
+}
+
+// OpenAPIPath converts a route of the httprouter to an OpenAPI path, e.g. /users/:id to /users/{id}
+func OpenAPIPath(route string) string {
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the schema of a Go type. Named structs are added to the schemas and referenced.
+func schemaFor(t reflect.Type, schemas map[string]*OpenAPISchema) *OpenAPISchema {
+	switch {
+	case t == timeType:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := schemaFor(t.Elem(), schemas)
+		if schema.Ref != "" {
+			return schema
+		}
+		schema.Nullable = true
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &OpenAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &OpenAPISchema{Type: "number"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &OpenAPISchema{Type: "array", Items: schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		return structSchema(t, schemas)
+	default:
+		// interface{} fields may hold any value
+		return &OpenAPISchema{}
+	}
+}
+
+// structSchema adds the schema of a named struct to the schemas and returns a reference to it.
+// Fields without omitempty are required.
+func structSchema(t reflect.Type, schemas map[string]*OpenAPISchema) *OpenAPISchema {
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	ref := &OpenAPISchema{Ref: "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+
+	schema := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+	// added before the fields, so recursive types end up referencing themselves
+	schemas[name] = schema
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		fieldName, options, _ := strings.Cut(tag, ",")
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+
+		schema.Properties[fieldName] = schemaFor(field.Type, schemas)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, fieldName)
+		}
+	}
+	return ref
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// HandleOpenAPIv1 returns the OpenAPI document of the API
+// (GET /api/v1/openapi.json)
+func HandleOpenAPIv1(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeResponse(w, r, http.StatusOK, OpenAPISpec())
+}
@@ -0,0 +1,74 @@
+package webapp
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// registeredAPIRoutes returns the method and path of all routes below /api/ registered in cmd/webapp/main.go
+func registeredAPIRoutes(t *testing.T) map[string]bool {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "cmd/webapp/main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := map[string]bool{}
+	ast.Inspect(file, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		selector, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		switch selector.Sel.Name {
+		case "GET", "POST", "PUT", "PATCH", "DELETE":
+		default:
+			return true
+		}
+		literal, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || literal.Kind != token.STRING {
+			return true
+		}
+		path, err := strconv.Unquote(literal.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(path, "/api/") {
+			routes[selector.Sel.Name+" "+OpenAPIPath(path)] = true
+		}
+		return true
+	})
+	return routes
+}
+
+func TestOpenAPISpecContainsAllRoutes(t *testing.T) {
+	routes := registeredAPIRoutes(t)
+	if len(routes) == 0 {
+		t.Fatal("no API routes found in cmd/webapp/main.go")
+	}
+
+	spec := OpenAPISpec()
+	for route := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+			t.Errorf("route %s is missing from the OpenAPI spec", route)
+		}
+	}
+
+	// and the other way round, the spec shouldn't describe routes which don't exist
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if route := strings.ToUpper(method) + " " + path; !routes[route] {
+				t.Errorf("route %s of the OpenAPI spec isn't registered", route)
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package webapp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users choose their password with the link of an invitation or password reset mail, so passwords are never
+// sent in plaintext. The links contain a signed token of the user, which becomes invalid once the user
+// has been changed, e.g. by setting the password.
+
+// TokenKeyEnv is the environment variable holding the key signing the password tokens.
+// It takes precedence over the key file configured in Config.Mail.TokenKeyFile.
+const TokenKeyEnv = "WEBAPP_TOKEN_KEY"
+
+// defaultTokenTTL is the time a password token is valid unless Config.Mail.TokenTTL is set
+const defaultTokenTTL = 72 * time.Hour
+
+// tokenKey signs the password tokens, a random key until setupTokenKey loads the configured one
+var tokenKey = randomTokenKey()
+
+var errPasswordTokenInvalid = errors.New("invalid password token")
+
+// randomTokenKey returns a new random key for the password tokens
+func randomTokenKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		Logf(FatalLevel, "Unable to read random numbers: %s\n", err)
+	}
+	return key
+}
+
+// setupTokenKey loads the key of the password tokens from the environment or the key file
+func setupTokenKey(filename string) error {
+	encoded := os.Getenv(TokenKeyEnv)
+	if encoded == "" && filename != "" {
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		encoded = string(contents)
+	}
+	if strings.TrimSpace(encoded) == "" {
+		Logln(InfoLevel, "No token key configured, password links become invalid when the application is restarted")
+		tokenKey = randomTokenKey()
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return fmt.Errorf("invalid token key: %w", err)
+	}
+	if len(key) < 32 {
+		return fmt.Errorf("invalid token key: expected at least 32 bytes, got %d", len(key))
+	}
+	tokenKey = key
+	return nil
+}
+
+// PasswordToken returns a token allowing to set the password of the user until it expires or the user is changed
+func PasswordToken(user *User) string {
+	ttl := Config.Mail.TokenTTL
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	id := base64.RawURLEncoding.EncodeToString([]byte(user.ID))
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return id + "." + expires + "." + passwordTokenSignature(user, expires)
+}
+
+// passwordTokenSignature signs the token with the current version and password of the user
+func passwordTokenSignature(user *User, expires string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", user.ID, expires, user.Version, user.HashedPassword)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// passwordTokenUser returns the user of a valid password token
+func passwordTokenUser(ctx context.Context, token string) (*User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errPasswordTokenInvalid
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errPasswordTokenInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, errPasswordTokenInvalid
+	}
+
+	user, err := GlobalUserStore.Find(ctx, string(id))
+	if errors.Is(err, ErrNotFound) {
+		return nil, errPasswordTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(passwordTokenSignature(user, parts[1]))) || user.Terminating() {
+		return nil, errPasswordTokenInvalid
+	}
+	return user, nil
+}
+
+// baseURL returns the external URL of the application for the links of mails
+func baseURL(r *http.Request) string {
+	if Config.Mail.BaseURL != "" {
+		return strings.TrimSuffix(Config.Mail.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// SendInvitation sends a new user the link to choose a password
+func SendInvitation(ctx context.Context, user *User, base string) error {
+	return sendPasswordMail(ctx, user, base, "MailInvitation")
+}
+
+// SendPasswordReset sends a user the link to choose a new password
+func SendPasswordReset(ctx context.Context, user *User, base string) error {
+	return sendPasswordMail(ctx, user, base, "MailPasswordReset")
+}
+
+// sendPasswordMail sends the mail with the password link in the language of the user. The subject and
+// body are the translations of the message id with the suffixes Subject and Body.
+func sendPasswordMail(ctx context.Context, user *User, base, msgid string) error {
+	lang := GetLanguage(ctx, user.ID, nil, nil)
+	data := map[string]interface{}{
+		"AppName":  appName,
+		"Username": user.Username,
+		"Link":     base + "/password/" + PasswordToken(user),
+	}
+	return GlobalMailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: LookupTranslationInLanguage(lang, msgid+"Subject", data),
+		Body:    LookupTranslationInLanguage(lang, msgid+"Body", data),
+	})
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// HandlePasswordEdit shows the page to choose a password with the token of an invitation or
+// password reset mail
+// (GET /password/:token)
+func HandlePasswordEdit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, err := passwordTokenUser(r.Context(), params.ByName("token"))
+	if err != nil {
+		renderPasswordTokenInvalid(w, r, err)
+		return
+	}
+
+	RenderTemplate(w, r, "passwords/edit", map[string]interface{}{
+		"Pagetitle": "SetPassword",
+		"User":      user,
+		"Token":     params.ByName("token"),
+	})
+}
+
+// HandlePasswordUpdate sets the password of the user of the token, which can't be used again afterwards
+// (POST /password/:token)
+func HandlePasswordUpdate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
+
+	user, err := passwordTokenUser(ctx, params.ByName("token"))
+	if err != nil {
+		renderPasswordTokenInvalid(w, r, err)
+		return
+	}
+
+	lang := GetLanguage(ctx, user.ID, r, params)
+	password := r.FormValue("password")
+	var validationError error
+	switch {
+	case password == "":
+		validationError = errNoPassword[lang]
+	case len(password) < passwordLength:
+		validationError = errPasswordTooShort[lang]
+	case password != r.FormValue("passwordConfirmation"):
+		validationError = errPasswordIncorrect[lang]
+	}
+	if validationError != nil {
+		RenderTemplate(w, r, "passwords/edit", map[string]interface{}{
+			"Pagetitle": "SetPassword",
+			"User":      user,
+			"Token":     params.ByName("token"),
+			"Error":     validationError.Error(),
+		})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
+	if err != nil {
+		log.Println("Unable to hash password:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user.HashedPassword = string(hashedPassword)
+	err = GlobalUserStore.Save(ctx, user)
+	if errors.Is(err, ErrVersionConflict) {
+		// the token has been used concurrently
+		renderPasswordTokenInvalid(w, r, errPasswordTokenInvalid)
+		return
+	}
+	if err != nil {
+		log.Println("Unable to save user", user.ID, ":", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	PublishWebhookEvent(ctx, WebhookUserUpdated, webhookUser(*user))
+
+	http.Redirect(w, r, "/login?flash=Password+set", http.StatusFound)
+}
+
+// renderPasswordTokenInvalid shows the password page with the message that the link can't be used anymore
+func renderPasswordTokenInvalid(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, errPasswordTokenInvalid) {
+		log.Println("Unable to check password token:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	lang := GetLanguage(r.Context(), "", r, nil)
+	RenderTemplate(w, r, "passwords/edit", map[string]interface{}{
+		"Pagetitle": "SetPassword",
+		"Error":     errPasswordLinkInvalid[lang].Error(),
+	})
+}
@@ -1,16 +1,231 @@
 package webapp
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var GlobalPostgresDB *sql.DB // MySQL Database
+var GlobalPostgresDB *sql.DB // Postgres Database
 
-func NewPostgresDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", dsn+"?sslmode=disable")
+// dbExecutor is implemented by both *sql.DB and *sql.Tx, so the DB stores work inside and outside of transactions
+type dbExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// pqUniqueViolation is the postgres error code for a violated unique constraint
+const pqUniqueViolation = "23505"
+
+// defaultConnectRetries is the number of connection retries when DatabaseConfig.ConnectRetries isn't set
+const defaultConnectRetries = 5
+
+// maxConnectBackoff limits the wait time between two connection attempts
+const maxConnectBackoff = 30 * time.Second
+
+// NewPostgresDB connects to the postgres database of the dsn, using the TLS, timeout and pool settings of cfg
+func NewPostgresDB(dsn string, cfg DatabaseConfig) (*sql.DB, error) {
+	dsn, err := postgresDSN(dsn, cfg)
 	if err != nil {
 		return nil, err
 	}
-	return db, db.Ping()
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db, cfg)
+	return db, pingDB(db, cfg.ConnectRetries)
+}
+
+// postgresDSN adds the configured TLS and timeout settings to the dsn, unless the dsn already sets them.
+// Both URL (postgres://...) and key/value (host=... dbname=...) DSNs are supported.
+func postgresDSN(dsn string, cfg DatabaseConfig) (string, error) {
+	sslmode := cfg.SSLMode
+	if sslmode == "" {
+		// keep the former default, so existing installations without TLS keep working
+		sslmode = "disable"
+	}
+	params := [][2]string{
+		{"sslmode", sslmode},
+		{"sslrootcert", cfg.SSLRootCert},
+		{"sslcert", cfg.SSLCert},
+		{"sslkey", cfg.SSLKey},
+	}
+	if cfg.StatementTimeout > 0 {
+		// unknown parameters are sent to the server as run-time parameters by lib/pq
+		params = append(params, [2]string{"statement_timeout", strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)})
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		for _, param := range params {
+			if param[1] != "" && !query.Has(param[0]) {
+				query.Set(param[0], param[1])
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	for _, param := range params {
+		if param[1] == "" || regexp.MustCompile(`(^|\s)`+param[0]+`\s*=`).MatchString(dsn) {
+			continue
+		}
+		dsn = strings.TrimSpace(dsn + " " + param[0] + "=" + pqQuoter.Replace(param[1]))
+	}
+	return dsn, nil
+}
+
+// pqQuoter quotes a value of a key/value DSN
+var pqQuoter = strings.NewReplacer(`\`, `\\`, `'`, `\'`, ` `, `\ `)
+
+// configurePool applies the connection pool settings of cfg to the database
+func configurePool(db *sql.DB, cfg DatabaseConfig) {
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+}
+
+// pingDB checks the connection to the database. Failed attempts are retried with exponential backoff,
+// so the application can be started before the database is ready.
+func pingDB(db *sql.DB, retries int) error {
+	if retries <= 0 {
+		retries = defaultConnectRetries
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil || attempt > retries {
+			return err
+		}
+
+		Logf(WarningLevel, "Unable to connect to database (attempt %d of %d), retrying in %s: %s\n", attempt, retries+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// likeEscaper escapes the wildcard characters of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// dbError translates database specific errors into the sentinel errors of the storage backends
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation {
+		return fmt.Errorf("%w: %s", ErrConflict, pqErr.Message)
+	}
+	return err
+}
+
+// dbAffected returns ErrNotFound if a statement didn't affect any rows
+func dbAffected(res sql.Result, err error) error {
+	if err != nil {
+		return dbError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// nullTime converts an optional time to a nullable UTC column value
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// timePtr converts a nullable column value to an optional time
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+/**********************************
+***  DB Transactor              ***
+***********************************/
+
+// DBTransactor implements transactions for the DB stores with database transactions
+type DBTransactor struct {
+	db *sql.DB
+}
+
+// NewDBTransactor creates a DBTransactor for the given database
+func NewDBTransactor(db *sql.DB) *DBTransactor {
+	return &DBTransactor{
+		db: db,
+	}
+}
+
+// Begin starts a new database transaction
+func (t *DBTransactor) Begin(ctx context.Context) (Tx, error) {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{tx: tx}, nil
+}
+
+type dbTx struct {
+	tx *sql.Tx
+}
+
+func (t *dbTx) Users() UserStore {
+	return &DBUserStore{db: t.tx}
+}
+
+func (t *dbTx) Sessions() SessionStore {
+	return &DBSessionStore{db: t.tx}
+}
+
+func (t *dbTx) UserConfigs() UserConfigStore {
+	return &DBUserConfigStore{db: t.tx}
+}
+
+func (t *dbTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *dbTx) Rollback() error {
+	err := t.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
 }
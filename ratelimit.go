@@ -0,0 +1,481 @@
+package webapp
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are limited with token buckets. Every policy matching a request takes a token from the bucket of
+// the request's key, e.g. the client IP. A bucket holds up to Limit tokens and is refilled evenly within
+// Period, so clients can send a burst of Limit requests and Limit requests per Period in the long run.
+// The buckets are stored as the time at which they are full again, which is enough to derive the tokens
+// left and turns taking a token into a single update of the stores.
+
+// Keys of the rate limit policies
+const (
+	RateLimitKeyIP    = "ip"
+	RateLimitKeyUser  = "user"
+	RateLimitKeyToken = "token"
+)
+
+// rateLimitSweepInterval is the interval in which the stores remove full buckets
+const rateLimitSweepInterval = time.Minute
+
+// defaultRateLimitPolicies are used unless policies are configured
+var defaultRateLimitPolicies = []RateLimitPolicy{
+	{
+		Name:    "login",
+		Methods: []string{http.MethodPost},
+		Paths:   []string{"/login", "/register", "/password/*"},
+		Key:     RateLimitKeyIP,
+		Limit:   10,
+		Period:  time.Minute,
+	},
+	{
+		Name:   "api",
+		Paths:  []string{"/api/*"},
+		Key:    RateLimitKeyUser,
+		Limit:  600,
+		Period: time.Minute,
+	},
+	{
+		Name:   "scim",
+		Paths:  []string{"/scim/*"},
+		Key:    RateLimitKeyToken,
+		Limit:  600,
+		Period: time.Minute,
+	},
+}
+
+var errInvalidRateLimitPolicy = errors.New("invalid rate limit policy")
+
+// RateLimitPolicy limits the requests to some routes per key
+type RateLimitPolicy struct {
+	// Name identifies the buckets of the policy and must be unique
+	Name string `yaml:"name"`
+	// Methods are the request methods the policy applies to, e.g. [POST], all methods if empty
+	Methods []string `yaml:"methods,omitempty"`
+	// Paths are the paths the policy applies to, either exact paths or prefixes ending with *, e.g. /api/*
+	Paths []string `yaml:"paths"`
+	// Key is what the requests are counted by: ip (default), user or token for the bearer token of the
+	// request. Requests without a logged in user or token are counted by their IP.
+	Key string `yaml:"key,omitempty"`
+	// Limit is the number of requests per period, which may also be sent at once
+	Limit int `yaml:"limit"`
+	// Period is the time the bucket takes to refill, e.g. 1m
+	Period time.Duration `yaml:"period"`
+}
+
+// validate checks the settings of the policy and sets the default key
+func (p *RateLimitPolicy) validate() error {
+	switch {
+	case p.Name == "":
+		return fmt.Errorf("%w: the name is missing", errInvalidRateLimitPolicy)
+	case len(p.Paths) == 0:
+		return fmt.Errorf("%w %s: no paths", errInvalidRateLimitPolicy, p.Name)
+	case p.Limit <= 0 || p.Period <= 0:
+		return fmt.Errorf("%w %s: limit and period must be positive", errInvalidRateLimitPolicy, p.Name)
+	case p.interval() <= 0:
+		// the bucket couldn't be refilled by whole nanoseconds
+		return fmt.Errorf("%w %s: limit %d is too high for period %s", errInvalidRateLimitPolicy, p.Name, p.Limit, p.Period)
+	}
+	switch p.Key {
+	case "":
+		p.Key = RateLimitKeyIP
+	case RateLimitKeyIP, RateLimitKeyUser, RateLimitKeyToken:
+	default:
+		return fmt.Errorf("%w %s: unknown key %q", errInvalidRateLimitPolicy, p.Name, p.Key)
+	}
+	return nil
+}
+
+// matches reports if the policy applies to the request
+func (p *RateLimitPolicy) matches(r *http.Request) bool {
+	if len(p.Methods) > 0 {
+		found := false
+		for _, method := range p.Methods {
+			found = found || strings.EqualFold(method, r.Method)
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, pattern := range p.Paths {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+		if pattern == r.URL.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// interval is the time in which the bucket of the policy is refilled by one token
+func (p *RateLimitPolicy) interval() time.Duration {
+	return p.Period / time.Duration(p.Limit)
+}
+
+/****************************************
+***  Rate Limiter                     ***
+*****************************************/
+
+// RateLimiter is a handler of the Middleware chain answering requests exceeding the limit of one of the
+// policies with 429 Too Many Requests. The state of the most restrictive policy is sent in the RateLimit-*
+// headers of the responses. Requests are let through if the store fails.
+type RateLimiter struct {
+	policies []RateLimitPolicy
+	store    RateLimitStore
+	proxies  []netip.Prefix
+}
+
+// NewRateLimiter creates the rate limiter of the configuration. The default policies are used unless
+// policies are configured, a disabled rate limiter lets all requests through.
+func NewRateLimiter(cfg RateLimitConfig) (*RateLimiter, error) {
+	limiter := &RateLimiter{}
+	if cfg.Disabled {
+		return limiter, nil
+	}
+
+	policies := cfg.Policies
+	if len(policies) == 0 {
+		policies = defaultRateLimitPolicies
+	}
+	names := map[string]bool{}
+	for _, policy := range policies {
+		if err := policy.validate(); err != nil {
+			return nil, err
+		}
+		if names[policy.Name] {
+			return nil, fmt.Errorf("%w %s: duplicate name", errInvalidRateLimitPolicy, policy.Name)
+		}
+		names[policy.Name] = true
+		limiter.policies = append(limiter.policies, policy)
+	}
+
+	proxies, err := parseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	limiter.proxies = proxies
+
+	switch cfg.Store {
+	case "", "memory":
+		limiter.store = NewMemoryRateLimitStore()
+	case "postgres":
+		if GlobalPostgresDB == nil {
+			return nil, errors.New("the postgres rate limit store requires the postgres database backend")
+		}
+		store, err := NewPostgresRateLimitStore(GlobalPostgresDB)
+		if err != nil {
+			return nil, err
+		}
+		limiter.store = store
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.Store)
+	}
+	return limiter, nil
+}
+
+// rateLimitStatus is the state of the bucket of a policy after a request
+type rateLimitStatus struct {
+	policy  *RateLimitPolicy
+	full    time.Time
+	allowed bool
+}
+
+// remaining returns the number of tokens left in the bucket
+func (s rateLimitStatus) remaining(now time.Time) int {
+	remaining := int((s.policy.Period - s.full.Sub(now)) / s.policy.interval())
+	if remaining < 0 {
+		return 0
+	}
+	if remaining > s.policy.Limit {
+		return s.policy.Limit
+	}
+	return remaining
+}
+
+// ServeHTTP takes a token from the buckets of the policies matching the request and answers it with
+// 429 Too Many Requests if one of them is empty
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var status *rateLimitStatus
+	for i := range l.policies {
+		policy := &l.policies[i]
+		if !policy.matches(r) {
+			continue
+		}
+
+		key := policy.Name + ":" + l.requestKey(r, policy.Key)
+		full, allowed, err := l.store.Take(r.Context(), key, policy.Limit, policy.Period)
+		if err != nil {
+			logRequestError(r, "Unable to check the rate limit of "+key+":", err)
+			continue
+		}
+
+		now := time.Now()
+		current := rateLimitStatus{policy: policy, full: full, allowed: allowed}
+		if status == nil || !allowed || current.remaining(now) < status.remaining(now) {
+			status = &current
+		}
+		if !allowed {
+			// don't take tokens of the other policies for a refused request
+			break
+		}
+	}
+	if status == nil {
+		return
+	}
+
+	now := time.Now()
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(status.policy.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(status.remaining(now)))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(status.full.Sub(now))))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", status.policy.Limit, ceilSeconds(status.policy.Period)))
+	if status.allowed {
+		return
+	}
+
+	// the next token is available once the bucket is one interval less than full
+	retry := status.full.Sub(now) - status.policy.Period + status.policy.interval()
+	if retry < time.Second {
+		retry = time.Second
+	}
+	header.Set("Retry-After", strconv.Itoa(ceilSeconds(retry)))
+	switch {
+	case isAPIRequest(r):
+		writeAPIError(w, r, http.StatusTooManyRequests, codeTooManyRequests, "rate limit "+status.policy.Name+" exceeded")
+	case strings.HasPrefix(r.URL.Path, "/scim/"):
+		writeSCIMError(w, http.StatusTooManyRequests, "", "rate limit "+status.policy.Name+" exceeded")
+	default:
+		http.Error(w, LookupTranslation(r, "ErrorTooManyRequests"), http.StatusTooManyRequests)
+	}
+}
+
+// requestKey returns the key of the request the policy counts it by
+func (l *RateLimiter) requestKey(r *http.Request, key string) string {
+	switch key {
+	case RateLimitKeyUser:
+		if user := RequestUser(r); user != nil {
+			return "user:" + user.ID
+		}
+	case RateLimitKeyToken:
+		// only a hash of the token is stored
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+			sum := sha256.Sum256([]byte(token))
+			return "token:" + hex.EncodeToString(sum[:16])
+		}
+	}
+	return "ip:" + l.clientIP(r)
+}
+
+// clientIP returns the IP of the client. Requests of trusted proxies are attributed to the last address of
+// their X-Forwarded-For header that isn't a trusted proxy itself.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !l.trusted(addr) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// trusted reports if the address belongs to one of the trusted proxies
+func (l *RateLimiter) trusted(addr netip.Addr) bool {
+	return containsAddr(l.proxies, addr)
+}
+
+// parseNetworks parses a list of IPs and CIDR ranges, e.g. 127.0.0.1 or 10.0.0.0/8
+func parseNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(network)
+			if addrErr != nil {
+				return nil, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports if the address belongs to one of the networks
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+/****************************************
+***  Rate Limit Stores                ***
+*****************************************/
+
+// RateLimitStore keeps the token buckets of the rate limiter
+type RateLimitStore interface {
+	// Take takes a token from the bucket of the key, which holds up to limit tokens and is refilled within
+	// period. It returns the time at which the bucket is full again and false if the bucket was empty.
+	Take(ctx context.Context, key string, limit int, period time.Duration) (time.Time, bool, error)
+}
+
+// takeToken takes a token from a bucket that is full at the given time and returns the time it's full
+// again afterwards, or false if the bucket is empty
+func takeToken(full, now time.Time, limit int, period time.Duration) (time.Time, bool) {
+	if full.Before(now) {
+		full = now
+	}
+	next := full.Add(period / time.Duration(limit))
+	if next.After(now.Add(period)) {
+		return full, false
+	}
+	return next, true
+}
+
+// MemoryRateLimitStore is a thread-safe implementation of RateLimitStore which keeps the buckets in memory,
+// so each instance of the application limits the requests on its own
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]time.Time // time at which the bucket is full again by key
+	swept   time.Time
+}
+
+// NewMemoryRateLimitStore creates a new MemoryRateLimitStore with full buckets
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: map[string]time.Time{},
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit int, period time.Duration) (time.Time, bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) >= rateLimitSweepInterval {
+		for key, full := range s.buckets {
+			if !full.After(now) {
+				delete(s.buckets, key)
+			}
+		}
+		s.swept = now
+	}
+
+	full, ok := takeToken(s.buckets[key], now, limit, period)
+	if ok {
+		s.buckets[key] = full
+	}
+	return full, ok, nil
+}
+
+// PostgresRateLimitStore is an implementation of RateLimitStore which keeps the buckets in the postgres
+// database, so the instances of the application share them
+type PostgresRateLimitStore struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// NewPostgresRateLimitStore creates a PostgresRateLimitStore on the given database
+func NewPostgresRateLimitStore(db *sql.DB) (*PostgresRateLimitStore, error) {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS rate_limits (
+  key varchar(255) NOT NULL,
+  full_at timestamp NOT NULL,
+  PRIMARY KEY (key)
+);
+CREATE INDEX IF NOT EXISTS rate_limits_full_at_idx ON rate_limits( full_at );`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create rate_limits table in database: %w", err)
+	}
+	return &PostgresRateLimitStore{
+		db: db,
+	}, nil
+}
+
+// Take updates the bucket with a single statement, which only changes it if a token is left. Otherwise the
+// bucket is read to report the time it's full again.
+func (s *PostgresRateLimitStore) Take(ctx context.Context, key string, limit int, period time.Duration) (time.Time, bool, error) {
+	now := time.Now().UTC()
+	s.sweep(ctx, now)
+
+	var full time.Time
+	err := s.db.QueryRowContext(
+		ctx,
+		`
+		INSERT INTO rate_limits (key, full_at)
+		VALUES ($1, $2::timestamp + $3::bigint * interval '1 microsecond')
+		ON CONFLICT (key) DO UPDATE
+		SET full_at = GREATEST(rate_limits.full_at, $2::timestamp) + $3::bigint * interval '1 microsecond'
+		WHERE GREATEST(rate_limits.full_at, $2::timestamp) + $3::bigint * interval '1 microsecond' <= $4::timestamp
+		RETURNING full_at`,
+		key, now, (period / time.Duration(limit)).Microseconds(), now.Add(period),
+	).Scan(&full)
+	if err == nil {
+		return full, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `SELECT full_at FROM rate_limits WHERE key = $1`, key).Scan(&full)
+	return full, false, err
+}
+
+// sweep removes the full buckets once per rateLimitSweepInterval
+func (s *PostgresRateLimitStore) sweep(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.swept) < rateLimitSweepInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.swept = now
+	s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE full_at <= $1`, now)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println("Unable to remove full rate limit buckets:", err)
+	}
+}
@@ -0,0 +1,198 @@
+package webapp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitPolicyValidate(t *testing.T) {
+	valid := func(modify func(p *RateLimitPolicy)) RateLimitPolicy {
+		p := RateLimitPolicy{Name: "test", Paths: []string{"/login"}, Limit: 10, Period: time.Minute}
+		modify(&p)
+		return p
+	}
+	tests := []struct {
+		name    string
+		policy  RateLimitPolicy
+		wantErr bool
+	}{
+		{name: "valid", policy: valid(func(p *RateLimitPolicy) {})},
+		{name: "user key", policy: valid(func(p *RateLimitPolicy) { p.Key = RateLimitKeyUser })},
+		{name: "one token per nanosecond", policy: valid(func(p *RateLimitPolicy) { p.Limit, p.Period = 1000, 1000 })},
+		{name: "missing name", policy: valid(func(p *RateLimitPolicy) { p.Name = "" }), wantErr: true},
+		{name: "no paths", policy: valid(func(p *RateLimitPolicy) { p.Paths = nil }), wantErr: true},
+		{name: "zero limit", policy: valid(func(p *RateLimitPolicy) { p.Limit = 0 }), wantErr: true},
+		{name: "negative period", policy: valid(func(p *RateLimitPolicy) { p.Period = -time.Second }), wantErr: true},
+		{name: "limit above period", policy: valid(func(p *RateLimitPolicy) { p.Limit, p.Period = 1001, 1000 }), wantErr: true},
+		{name: "unknown key", policy: valid(func(p *RateLimitPolicy) { p.Key = "session" }), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errInvalidRateLimitPolicy) {
+				t.Errorf("validate() error = %v, want %v", err, errInvalidRateLimitPolicy)
+			}
+			if err == nil && tt.policy.Key == "" {
+				t.Error("validate() didn't set the default key")
+			}
+		})
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	const limit = 4
+	period := time.Minute
+	interval := period / limit
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		taken    int           // tokens taken at now from a full bucket
+		after    time.Duration // time passed after taking them
+		want     int           // tokens that can be taken afterwards
+		wantFull time.Duration // time after taking them at which the bucket is full again
+	}{
+		{name: "burst up to the limit", taken: 0, want: limit, wantFull: period},
+		{name: "empty bucket", taken: limit, want: 0, wantFull: period},
+		{name: "partially refilled", taken: limit, after: interval, want: 1, wantFull: period},
+		{name: "almost one token", taken: limit, after: interval - time.Nanosecond, want: 0},
+		{name: "half refilled", taken: limit, after: 2 * interval, want: 2, wantFull: period},
+		{name: "refilled", taken: limit, after: period, want: limit, wantFull: period},
+		{name: "refill doesn't exceed the limit", taken: 1, after: 10 * period, want: limit, wantFull: period},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var full time.Time
+			for i := 0; i < tt.taken; i++ {
+				var ok bool
+				if full, ok = takeToken(full, now, limit, period); !ok {
+					t.Fatalf("token %d of a full bucket refused", i+1)
+				}
+			}
+
+			at := now.Add(tt.after)
+			got := 0
+			for ; got <= limit; got++ {
+				next, ok := takeToken(full, at, limit, period)
+				if !ok {
+					if !next.Equal(full) {
+						t.Errorf("refused take changed the bucket from %s to %s", full, next)
+					}
+					break
+				}
+				full = next
+			}
+			if got != tt.want {
+				t.Errorf("took %d tokens, want %d", got, tt.want)
+			}
+			if wantFull := at.Add(tt.wantFull); tt.want > 0 && !full.Equal(wantFull) {
+				t.Errorf("bucket full at %s, want %s", full, wantFull)
+			}
+		})
+	}
+}
+
+func TestRateLimitStatusRemaining(t *testing.T) {
+	policy := &RateLimitPolicy{Limit: 4, Period: time.Minute}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		full time.Duration // time until the bucket is full, relative to now
+		want int
+	}{
+		{full: -time.Second, want: 4},
+		{full: 0, want: 4},
+		{full: 15 * time.Second, want: 3},
+		{full: 14 * time.Second, want: 3},
+		{full: 16 * time.Second, want: 2},
+		{full: time.Minute, want: 0},
+		{full: 2 * time.Minute, want: 0},
+	}
+	for _, tt := range tests {
+		status := rateLimitStatus{policy: policy, full: now.Add(tt.full)}
+		if got := status.remaining(now); got != tt.want {
+			t.Errorf("remaining() with full in %s = %d, want %d", tt.full, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterServeHTTP(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimitConfig{Policies: []RateLimitPolicy{{
+		Name:   "api",
+		Paths:  []string{"/api/*"},
+		Limit:  3,
+		Period: time.Minute,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		limiter.ServeHTTP(w, r)
+		return w
+	}
+
+	// a burst of up to the limit is allowed, every request takes a token for 20s
+	for i, want := range []struct{ remaining, reset string }{{"2", "20"}, {"1", "40"}, {"0", "60"}} {
+		w := serve("/api/v1/users", "192.0.2.1:1234")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+		for header, value := range map[string]string{
+			"RateLimit-Limit":     "3",
+			"RateLimit-Remaining": want.remaining,
+			"RateLimit-Reset":     want.reset,
+			"RateLimit-Policy":    "3;w=60",
+			"Retry-After":         "",
+		} {
+			if got := w.Header().Get(header); got != value {
+				t.Errorf("request %d: %s = %q, want %q", i+1, header, got, value)
+			}
+		}
+	}
+
+	// the next request is refused until the first token is refilled
+	w := serve("/api/v1/users", "192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "20" {
+		t.Errorf("Retry-After = %q, want %q", got, "20")
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining = %q, want %q", got, "0")
+	}
+
+	// other clients and routes without a policy aren't limited
+	if w := serve("/api/v1/users", "192.0.2.2:1234"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "2" {
+		t.Errorf("other client: status = %d, RateLimit-Remaining = %q", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+	if w := serve("/", "192.0.2.1:1234"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("unlimited route: status = %d, RateLimit-Limit = %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestCeilSeconds(t *testing.T) {
+	for d, want := range map[time.Duration]int{
+		-time.Second:                   0,
+		0:                              0,
+		time.Nanosecond:                1,
+		time.Second:                    1,
+		time.Second + time.Nanosecond:  2,
+		time.Minute - time.Millisecond: 60,
+		time.Minute:                    60,
+	} {
+		if got := ceilSeconds(d); got != want {
+			t.Errorf("ceilSeconds(%s) = %d, want %d", d, got, want)
+		}
+	}
+}
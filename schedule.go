@@ -0,0 +1,203 @@
+package webapp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule calculates the run times of a job
+type Schedule interface {
+	// Next returns the first run time after t
+	Next(t time.Time) time.Time
+	String() string
+}
+
+// ParseSchedule parses either a cron expression with the five fields minute, hour, day of month, month and
+// day of week, one of the macros @yearly, @monthly, @weekly, @daily and @hourly or an interval like "@every 30m"
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if interval, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q: interval must be positive", spec)
+		}
+		return Every(d), nil
+	}
+	return ParseCron(spec)
+}
+
+/**********************************
+***  Interval Schedule          ***
+***********************************/
+
+// IntervalSchedule runs a job in a fixed interval
+type IntervalSchedule struct {
+	Interval time.Duration
+}
+
+// Every returns a schedule running a job every interval
+func Every(interval time.Duration) IntervalSchedule {
+	return IntervalSchedule{Interval: interval}
+}
+
+func (s IntervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.Interval)
+}
+
+func (s IntervalSchedule) String() string {
+	return "@every " + s.Interval.String()
+}
+
+/**********************************
+***  Cron Schedule              ***
+***********************************/
+
+// CronSchedule runs a job at the times matching a cron expression, in the local time zone
+type CronSchedule struct {
+	spec                                   string
+	minutes, hours, days, months, weekdays uint64 // bit sets of the matching values
+	anyDay, anyWeekday                     bool
+}
+
+// cronMacros are the supported shortcuts for common cron expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression with the five fields minute, hour, day of month, month and day of week.
+// Each field is either *, a value, a range like 1-5 or a list of these separated by commas, optionally
+// followed by a step like */15. Sunday is 0 or 7.
+func ParseCron(spec string) (*CronSchedule, error) {
+	expression := spec
+	if macro, ok := cronMacros[spec]; ok {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	// like in cron, a day field starting with * isn't ored with the other one, even with a step like */2
+	schedule := &CronSchedule{
+		spec:       spec,
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&schedule.minutes, 0, 59},
+		{&schedule.hours, 0, 23},
+		{&schedule.days, 1, 31},
+		{&schedule.months, 1, 12},
+		{&schedule.weekdays, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", spec, err)
+		}
+		*field.bits = bits
+	}
+
+	// 7 is an alias for sunday
+	if schedule.weekdays&(1<<7) != 0 {
+		schedule.weekdays |= 1
+	}
+	return schedule, nil
+}
+
+// parseCronField returns the bit set of the values matched by a field of a cron expression
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		valueRange, stepValue, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepValue)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepValue)
+			}
+		}
+
+		first, last := min, max
+		if valueRange != "*" {
+			from, to, isRange := strings.Cut(valueRange, "-")
+			var err error
+			if first, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", from)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return 0, fmt.Errorf("value %q out of range %d-%d", valueRange, min, max)
+		}
+
+		for value := first; value <= last; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after t matching the cron expression
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a matching time exists within a few years for every valid expression, except e.g. the 31st of February
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchesDay checks the day of month and day of week fields. If both are restricted, i.e. don't start
+// with *, a day matches if either of them matches, like in cron. Otherwise it has to match both.
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+func (s *CronSchedule) String() string {
+	return s.spec
+}
@@ -0,0 +1,97 @@
+package webapp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "* * * * *"},
+		{spec: "*/15 0-6,22-23 1,15 */3 1-5"},
+		{spec: "1,2,5-10/2 * * * *"},
+		{spec: "0 0 * * 7"},
+		{spec: "@hourly"},
+		{spec: "@yearly"},
+		{spec: "@every 30m"},
+		{spec: " @every 1h30m "},
+		{spec: "", wantErr: true},
+		{spec: "* * * *", wantErr: true},
+		{spec: "* * * * * *", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "* 24 * * *", wantErr: true},
+		{spec: "* * 0 * *", wantErr: true},
+		{spec: "* * 32 * *", wantErr: true},
+		{spec: "* * * 13 *", wantErr: true},
+		{spec: "* * * * 8", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "a * * * *", wantErr: true},
+		{spec: "1-a * * * *", wantErr: true},
+		{spec: "@sometimes", wantErr: true},
+		{spec: "@every 0s", wantErr: true},
+		{spec: "@every -1m", wantErr: true},
+		{spec: "@every soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSchedule(tt.spec); (err != nil) != tt.wantErr {
+			t.Errorf("ParseSchedule(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", date(2024, 1, 1, 10, 7), date(2024, 1, 1, 10, 8)},
+		{"seconds are truncated", "* * * * *", date(2024, 1, 1, 10, 7).Add(59 * time.Second), date(2024, 1, 1, 10, 8)},
+		{"minute step", "*/15 * * * *", date(2024, 1, 1, 10, 7), date(2024, 1, 1, 10, 15)},
+		{"exact match is skipped", "0 12 * * *", date(2024, 1, 1, 12, 0), date(2024, 1, 2, 12, 0)},
+		{"hour range", "30 9-17 * * *", date(2024, 1, 1, 17, 45), date(2024, 1, 2, 9, 30)},
+		{"list with step", "0 0 1,10-20/5 * *", date(2024, 1, 11, 0, 0), date(2024, 1, 15, 0, 0)},
+		{"month rollover", "0 0 * * *", date(2024, 1, 31, 12, 0), date(2024, 2, 1, 0, 0)},
+		{"year rollover", "30 8 1 * *", date(2024, 12, 15, 0, 0), date(2025, 1, 1, 8, 30)},
+		{"short month is skipped", "0 0 31 * *", date(2024, 4, 15, 0, 0), date(2024, 5, 31, 0, 0)},
+		{"leap day", "0 0 29 2 *", date(2024, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		{"month restriction", "0 0 1 */3 *", date(2024, 2, 10, 0, 0), date(2024, 4, 1, 0, 0)},
+		{"weekday", "0 0 * * 1", date(2024, 7, 2, 0, 0), date(2024, 7, 8, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", date(2024, 9, 2, 0, 0), date(2024, 9, 8, 0, 0)},
+		{"weekday range", "0 9 * * 1-5", date(2024, 9, 6, 10, 0), date(2024, 9, 9, 9, 0)},
+		{"day or weekday, weekday first", "0 0 13 * 5", date(2024, 9, 1, 0, 0), date(2024, 9, 6, 0, 0)},
+		{"day or weekday, day first", "0 0 1 * 1", date(2024, 7, 30, 0, 0), date(2024, 8, 1, 0, 0)},
+		{"day or weekday, both", "0 0 13 * 5", date(2024, 9, 10, 0, 0), date(2024, 9, 13, 0, 0)},
+		{"day with star step and weekday", "0 0 */2 * 1", date(2024, 7, 2, 0, 0), date(2024, 7, 15, 0, 0)},
+		{"day and weekday with star step", "0 0 15 * */2", date(2024, 7, 2, 0, 0), date(2024, 8, 15, 0, 0)},
+		{"day step without weekday", "0 0 */10 * *", date(2024, 1, 22, 0, 0), date(2024, 1, 31, 0, 0)},
+		{"macro", "@monthly", date(2024, 1, 31, 10, 0), date(2024, 2, 1, 0, 0)},
+		{"impossible date", "0 0 31 2 *", date(2024, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("ParseCron(%q).Next(%s) = %s, want %s", tt.spec, tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntervalScheduleNext(t *testing.T) {
+	from := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	if got, want := Every(90*time.Second).Next(from), from.Add(90*time.Second); !got.Equal(want) {
+		t.Errorf("Every(90s).Next(%s) = %s, want %s", from, got, want)
+	}
+}
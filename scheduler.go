@@ -0,0 +1,374 @@
+package webapp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobFunc is the work done by a job. The returned message is recorded in the run history.
+// The context is cancelled when the application shuts down.
+type JobFunc func(ctx context.Context) (string, error)
+
+// Job is a background task which is run by the Scheduler according to its Schedule
+type Job struct {
+	Name     string
+	Schedule Schedule
+	Run      JobFunc
+}
+
+// JobStatus describes a scheduled job and its latest runs
+type JobStatus struct {
+	Name     string
+	Schedule string
+	Next     time.Time
+	Running  bool
+	Runs     []JobRun
+}
+
+// jobStatusRuns is the number of runs shown per job on the jobs page
+const jobStatusRuns = 10
+
+// jobRecordTimeout limits the time to record a run, which may happen after the application context is cancelled
+const jobRecordTimeout = 5 * time.Second
+
+var errJobExists = errors.New("a job with this name has already been added")
+
+// Scheduler runs jobs in the background until its context is cancelled.
+// Runs are recorded in the GlobalJobRunStore and guarded by the GlobalJobLocker, so a job only runs once at
+// a time, even with multiple instances of the application on the same database.
+type Scheduler struct {
+	ctx  context.Context
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	jobs map[string]*scheduledJob
+}
+
+type scheduledJob struct {
+	Job
+	mu      sync.Mutex
+	next    time.Time
+	running bool
+}
+
+// GlobalScheduler runs the background jobs of the application, it is created by NewApp
+var GlobalScheduler *Scheduler
+
+// NewScheduler creates a Scheduler which stops all jobs when ctx is cancelled
+func NewScheduler(ctx context.Context) *Scheduler {
+	return &Scheduler{
+		ctx:  ctx,
+		jobs: map[string]*scheduledJob{},
+	}
+}
+
+// Add starts running the job. The schedule can be overridden with the job's name in Config.Jobs,
+// where the schedule "off" disables the job.
+func (s *Scheduler) Add(job Job) error {
+	if spec, ok := Config.Jobs[job.Name]; ok {
+		if spec == "off" {
+			Logf(InfoLevel, "Job %s is disabled\n", job.Name)
+			return nil
+		}
+		schedule, err := ParseSchedule(spec)
+		if err != nil {
+			return fmt.Errorf("job %s: %w", job.Name, err)
+		}
+		job.Schedule = schedule
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.jobs[job.Name]; exists {
+		return fmt.Errorf("job %s: %w", job.Name, errJobExists)
+	}
+
+	scheduled := &scheduledJob{Job: job, next: job.Schedule.Next(time.Now())}
+	s.jobs[job.Name] = scheduled
+
+	s.wg.Add(1)
+	go s.loop(scheduled)
+	Logf(InfoLevel, "Scheduled job %s (%s)\n", job.Name, job.Schedule)
+	return nil
+}
+
+// Wait blocks until all jobs have stopped after the context of the scheduler has been cancelled
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// loop runs the job at its scheduled times until the context of the scheduler is cancelled
+func (s *Scheduler) loop(job *scheduledJob) {
+	defer s.wg.Done()
+
+	for {
+		job.mu.Lock()
+		next := job.next
+		job.mu.Unlock()
+		if next.IsZero() {
+			Logf(WarningLevel, "Job %s has no further run time and has been stopped\n", job.Name)
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.run(job)
+
+		job.mu.Lock()
+		job.next = job.Schedule.Next(time.Now())
+		job.mu.Unlock()
+	}
+}
+
+// run runs the job once if its lock can be acquired and records the run
+func (s *Scheduler) run(job *scheduledJob) {
+	locker := GlobalJobLocker
+	if locker == nil {
+		locker = defaultJobLocker
+	}
+	unlock, ok, err := locker.TryLock(s.ctx, job.Name)
+	if err != nil {
+		log.Println("Unable to lock job", job.Name, err)
+		return
+	}
+	if !ok {
+		Logf(InfoLevel, "Job %s is already running, skipping this run\n", job.Name)
+		return
+	}
+	defer unlock()
+
+	job.mu.Lock()
+	job.running = true
+	job.mu.Unlock()
+	defer func() {
+		job.mu.Lock()
+		job.running = false
+		job.mu.Unlock()
+	}()
+
+	run := &JobRun{
+		ID:      GenerateID("run", jobRunIDLength),
+		Job:     job.Name,
+		Started: time.Now(),
+	}
+	run.Result, err = runJob(s.ctx, job.Run)
+	run.Finished = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+		log.Println("Job", job.Name, "failed:", err)
+	} else {
+		Logf(InfoLevel, "Job %s finished: %s\n", job.Name, run.Result)
+	}
+
+	if GlobalJobRunStore == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jobRecordTimeout)
+	defer cancel()
+	if err := GlobalJobRunStore.Save(ctx, run); err != nil {
+		log.Println("Unable to record run of job", job.Name, err)
+	}
+}
+
+// runJob calls fn and turns a panic into an error, so a failing job doesn't take down the application
+func runJob(ctx context.Context, fn JobFunc) (result string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return fn(ctx)
+}
+
+// Status returns the jobs of the scheduler sorted by name, each with its latest runs
+func (s *Scheduler) Status(ctx context.Context) ([]JobStatus, error) {
+	s.mu.Lock()
+	jobs := make([]*scheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	var statuses []JobStatus
+	for _, job := range jobs {
+		job.mu.Lock()
+		status := JobStatus{
+			Name:     job.Name,
+			Schedule: job.Schedule.String(),
+			Next:     job.next,
+			Running:  job.running,
+		}
+		job.mu.Unlock()
+
+		if GlobalJobRunStore != nil {
+			runs, err := GlobalJobRunStore.List(ctx, job.Name, jobStatusRuns)
+			if err != nil {
+				return nil, err
+			}
+			status.Runs = runs
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+/**********************************
+***  Job Lockers                ***
+***********************************/
+
+// JobLocker makes sure a job only runs once at a time
+type JobLocker interface {
+	// TryLock acquires the lock of the job if it's free and returns false if it's held by another run
+	TryLock(ctx context.Context, job string) (unlock func(), ok bool, err error)
+}
+
+// GlobalJobLocker guards the runs of the jobs, the in-process MemoryJobLocker is used if nil
+var GlobalJobLocker JobLocker
+
+var defaultJobLocker = NewMemoryJobLocker()
+
+// MemoryJobLocker locks jobs within the running process
+type MemoryJobLocker struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+// NewMemoryJobLocker creates a new MemoryJobLocker without any locked jobs
+func NewMemoryJobLocker() *MemoryJobLocker {
+	return &MemoryJobLocker{
+		locked: map[string]bool{},
+	}
+}
+
+func (l *MemoryJobLocker) TryLock(_ context.Context, job string) (func(), bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locked[job] {
+		return nil, false, nil
+	}
+	l.locked[job] = true
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.locked, job)
+	}, true, nil
+}
+
+// PostgresJobLocker locks jobs with postgres advisory locks, so a job only runs on one instance of the application
+type PostgresJobLocker struct {
+	db *sql.DB
+}
+
+// NewPostgresJobLocker creates a PostgresJobLocker on the given database
+func NewPostgresJobLocker(db *sql.DB) *PostgresJobLocker {
+	return &PostgresJobLocker{
+		db: db,
+	}
+}
+
+// TryLock acquires a session level advisory lock. The lock is bound to the connection,
+// so the connection is kept out of the pool until the lock is released.
+func (l *PostgresJobLocker) TryLock(ctx context.Context, job string) (func(), bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := jobLockKey(job)
+	var ok bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&ok)
+	if err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), jobRecordTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key); err != nil {
+			log.Println("Unable to release lock of job", job, err)
+		}
+		conn.Close()
+	}, true, nil
+}
+
+// jobLockKey derives the advisory lock key of a job from its name
+func jobLockKey(job string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte("webapp job " + job))
+	return int64(hash.Sum64())
+}
+
+// MySQLJobLocker locks jobs with MySQL named locks, so a job only runs on one instance of the application
+type MySQLJobLocker struct {
+	db *sql.DB
+}
+
+// NewMySQLJobLocker creates a MySQLJobLocker on the given database
+func NewMySQLJobLocker(db *sql.DB) *MySQLJobLocker {
+	return &MySQLJobLocker{
+		db: db,
+	}
+}
+
+// TryLock acquires a named lock, which like the postgres advisory locks is bound to the connection
+func (l *MySQLJobLocker) TryLock(ctx context.Context, job string) (func(), bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// lock names are limited to 64 characters
+	name := fmt.Sprintf("webapp.job.%x", jobLockKey(job))
+	var ok sql.NullInt64
+	err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 0)`, name).Scan(&ok)
+	if err != nil || ok.Int64 != 1 {
+		conn.Close()
+		return nil, false, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), jobRecordTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, name); err != nil {
+			log.Println("Unable to release lock of job", job, err)
+		}
+		conn.Close()
+	}, true, nil
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// HandleJobsIndex shows the scheduled jobs with their latest runs
+func HandleJobsIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	jobs, err := GlobalScheduler.Status(r.Context())
+	if err != nil {
+		log.Println("Unable to read from GlobalJobRunStore:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplate(w, r, "jobs/index", map[string]interface{}{
+		"Jobs":      jobs,
+		"Pagetitle": "ListJobs",
+	})
+}
@@ -0,0 +1,750 @@
+package webapp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity providers provision the users with SCIM 2.0 (RFC 7643 and 7644) under /scim/v2. The users are
+// mapped onto the User fields: userName is the username, the primary email the email address and active
+// is false while the user is terminating. Attributes the application doesn't store, like name or
+// externalId, are accepted but ignored. The requests are authenticated with the bearer token of the scim
+// config instead of a session.
+
+// SCIMTokenEnv is the environment variable holding the bearer token of the SCIM clients.
+// It takes precedence over the token configured in Config.SCIM.Token.
+const SCIMTokenEnv = "WEBAPP_SCIM_TOKEN"
+
+// SCIM schemas and message types
+const (
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema       = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+
+	scimMediaType = "application/scim+json"
+	scimEmailType = "work"
+)
+
+// scimType values of the SCIM errors
+const (
+	scimInvalidFilter = "invalidFilter"
+	scimInvalidSyntax = "invalidSyntax"
+	scimInvalidPath   = "invalidPath"
+	scimInvalidValue  = "invalidValue"
+	scimMutability    = "mutability"
+	scimUniqueness    = "uniqueness"
+)
+
+const (
+	defaultSCIMCount = 100
+	maxSCIMCount     = 500
+	// defaultSCIMDisabledRetention is the time deactivated users are kept if neither Config.SCIM.DisabledRetention
+	// nor a deletion grace period of users is configured
+	defaultSCIMDisabledRetention = 30 * 24 * time.Hour
+)
+
+var errSCIMMutability = errors.New("attribute can't be changed")
+
+// SCIMUser is the SCIM representation of a user
+type SCIMUser struct {
+	Schemas  []string    `json:"schemas"`
+	ID       string      `json:"id,omitempty"`
+	UserName string      `json:"userName"`
+	Emails   []SCIMEmail `json:"emails,omitempty"`
+	Active   *bool       `json:"active,omitempty"`
+	// Password is only accepted in requests, new users without a password get an invitation mail
+	Password string    `json:"password,omitempty"`
+	Meta     *SCIMMeta `json:"meta,omitempty"`
+}
+
+// SCIMEmail is an email address of a SCIMUser, users have a single primary work address
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMMeta contains the resource type, location and version of a SCIM resource
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+	Version      string `json:"version,omitempty"`
+}
+
+// SCIMListResponse is a page of SCIM resources, StartIndex is 1-based
+type SCIMListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// SCIMPatchRequest is the body of PATCH requests with the operations applied to a user in their order
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMPatchOperation adds, replaces or removes the attribute of the path. Without a path the value is an
+// object with the attributes to change.
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// SCIMError is the body of failed SCIM requests
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// scimUserState are the attributes of a user which can be changed with SCIM
+type scimUserState struct {
+	Username string
+	Email    string
+	Active   bool
+	Password string
+}
+
+// scimToken returns the bearer token of the SCIM clients, SCIM is disabled without one
+func scimToken() string {
+	if token := os.Getenv(SCIMTokenEnv); token != "" {
+		return token
+	}
+	return Config.SCIM.Token
+}
+
+// scimDisabledRetention returns the time a deactivated user is kept before it is deleted
+func scimDisabledRetention() time.Duration {
+	if Config.SCIM.DisabledRetention > 0 {
+		return Config.SCIM.DisabledRetention
+	}
+	if gracePeriod := Config.DeletionGracePeriods[KindUser]; gracePeriod > 0 {
+		return gracePeriod
+	}
+	return defaultSCIMDisabledRetention
+}
+
+// RequireSCIMToken checks the bearer token of the requests under /scim/, other requests pass.
+// All SCIM requests fail if no token is configured.
+func RequireSCIMToken(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/scim/") {
+		return
+	}
+	token := scimToken()
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(given)), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		writeSCIMError(w, http.StatusUnauthorized, "", "a valid bearer token is required")
+	}
+}
+
+// HandleSCIMNotFound answers the unknown routes under /scim/ with a SCIM error, other requests pass
+func HandleSCIMNotFound(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/scim/") {
+		writeSCIMError(w, http.StatusNotFound, "", "unknown resource "+r.URL.Path)
+	}
+}
+
+// newSCIMUser returns the SCIM representation of a user
+func newSCIMUser(r *http.Request, user *User) SCIMUser {
+	active := !user.Terminating()
+	return SCIMUser{
+		Schemas:  []string{scimUserSchema},
+		ID:       user.ID,
+		UserName: user.Username,
+		Emails:   []SCIMEmail{{Value: user.Email, Type: scimEmailType, Primary: true}},
+		Active:   &active,
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			Location:     baseURL(r) + "/scim/v2/Users/" + user.ID,
+			Version:      etag(user.Version),
+		},
+	}
+}
+
+// primaryEmail returns the primary email address of the user, or the first one if none is primary
+func (user SCIMUser) primaryEmail() string {
+	for _, email := range user.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(user.Emails) > 0 {
+		return user.Emails[0].Value
+	}
+	return ""
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// HandleSCIMUsersGET lists the users matching the filter parameter, starting with the user at startIndex
+// (GET /scim/v2/Users?filter=&startIndex=&count=)
+func HandleSCIMUsersGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
+	startIndex, err := scimIntParameter(r, "startIndex", 1)
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := scimIntParameter(r, "count", defaultSCIMCount)
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > maxSCIMCount {
+		count = maxSCIMCount
+	}
+
+	var users []User
+	total := 0
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		// without a filter the page is selected by the store
+		query := UserQuery{Limit: count, Offset: startIndex - 1, Sort: "id"}
+		if count == 0 {
+			// only the total is needed, but limit 0 selects all users
+			query.Offset = 0
+		}
+		list, err := GlobalUserStore.List(ctx, query)
+		if err != nil {
+			writeSCIMErrorFor(w, err)
+			return
+		}
+		total = list.Total
+		if count > 0 {
+			users = list.Users
+		}
+	} else {
+		matching, err := scimFilterUsers(r, filter)
+		if err != nil {
+			writeSCIMErrorFor(w, err)
+			return
+		}
+		total = len(matching)
+		if start := startIndex - 1; start < len(matching) {
+			users = matching[start:]
+		}
+		if len(users) > count {
+			users = users[:count]
+		}
+	}
+
+	resources := make([]SCIMUser, 0, len(users))
+	for i := range users {
+		resources = append(resources, newSCIMUser(r, &users[i]))
+	}
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// scimFilterUsers returns the users matching the filter sorted by id. Users are looked up by their
+// username directly, which is compared case-insensitively like the filter, other filters are applied to all users.
+func scimFilterUsers(r *http.Request, filter string) ([]User, error) {
+	ctx := r.Context()
+
+	if username, ok := scimFilterUsername(filter); ok {
+		user, err := GlobalUserStore.FindByUsername(ctx, username)
+		if errors.Is(err, ErrNotFound) || (err == nil && !strings.EqualFold(user.Username, username)) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []User{*user}, nil
+	}
+
+	match, err := ParseSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	users, err := GlobalUserStore.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matching []User
+	for i := range users {
+		if match(&users[i]) {
+			matching = append(matching, users[i])
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+	return matching, nil
+}
+
+// scimIntParameter reads an integer url parameter
+func scimIntParameter(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be a number", errInvalidQuery, name)
+	}
+	return n, nil
+}
+
+// HandleSCIMUserGET returns a user
+// (GET /scim/v2/Users/:id)
+func HandleSCIMUserGET(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, err := GlobalUserStore.Find(r.Context(), params.ByName("id"))
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(user.Version))
+	writeSCIM(w, http.StatusOK, newSCIMUser(r, user))
+}
+
+// HandleSCIMUserPOST creates a user. Without a password the user gets an invitation mail to choose one,
+// like the imported users.
+// (POST /scim/v2/Users)
+func HandleSCIMUserPOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
+	var req SCIMUser
+	if err := decodeSCIM(r, &req); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+
+	password := req.Password
+	if password == "" {
+		password = GenerateRandomPassword(32)
+	}
+	user, err := NewUser(ctx, req.UserName, req.primaryEmail(), password)
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if err := GlobalUserStore.Save(ctx, &user); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	PublishWebhookEvent(ctx, WebhookUserCreated, webhookUser(user))
+
+	if req.Password == "" {
+		if err := SendInvitation(ctx, &user, baseURL(r)); err != nil {
+			log.Println("Unable to send invitation to", user.ID, ":", err)
+		}
+	}
+	if req.Active != nil && !*req.Active {
+		if err := TerminateUser(ctx, &user, scimDisabledRetention()); err != nil {
+			writeSCIMErrorFor(w, err)
+			return
+		}
+		PublishWebhookEvent(ctx, WebhookUserDisabled, webhookUser(user))
+	}
+
+	scimUser := newSCIMUser(r, &user)
+	w.Header().Set("Location", scimUser.Meta.Location)
+	w.Header().Set("ETag", etag(user.Version))
+	writeSCIM(w, http.StatusCreated, scimUser)
+}
+
+// HandleSCIMUserPUT replaces the username, email address, active state and optionally the password of a user.
+// With an If-Match header the user is only changed if it still has the given entity tag.
+// (PUT /scim/v2/Users/:id)
+func HandleSCIMUserPUT(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, err := GlobalUserStore.Find(r.Context(), params.ByName("id"))
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if err := checkIfMatch(r, user.Version); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+
+	var req SCIMUser
+	if err := decodeSCIM(r, &req); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if req.ID != "" && req.ID != user.ID {
+		writeSCIMError(w, http.StatusBadRequest, scimMutability, "the id of a user can't be changed")
+		return
+	}
+
+	state := scimUserState{
+		Username: req.UserName,
+		Email:    req.primaryEmail(),
+		Active:   req.Active == nil || *req.Active,
+		Password: req.Password,
+	}
+	saveSCIMUser(w, r, user, state)
+}
+
+// HandleSCIMUserPATCH applies the add, replace and remove operations of the request to a user.
+// With an If-Match header the user is only changed if it still has the given entity tag.
+// (PATCH /scim/v2/Users/:id)
+func HandleSCIMUserPATCH(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, err := GlobalUserStore.Find(r.Context(), params.ByName("id"))
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if err := checkIfMatch(r, user.Version); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+
+	var req SCIMPatchRequest
+	if err := decodeSCIM(r, &req); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+
+	state := scimUserState{
+		Username: user.Username,
+		Email:    user.Email,
+		Active:   !user.Terminating(),
+	}
+	for _, operation := range req.Operations {
+		if err := state.apply(operation); err != nil {
+			writeSCIMErrorFor(w, err)
+			return
+		}
+	}
+	saveSCIMUser(w, r, user, state)
+}
+
+// saveSCIMUser validates the new state of a user with UpdateUser and saves it. Deactivating a user
+// terminates it, so it's deleted after scimDisabledRetention unless it's activated again.
+func saveSCIMUser(w http.ResponseWriter, r *http.Request, user *User, state scimUserState) {
+	ctx := r.Context()
+
+	if user.ID == "admin" && !state.Active {
+		writeSCIMError(w, http.StatusBadRequest, scimMutability, "the admin account can't be deactivated")
+		return
+	}
+
+	previous := *user
+	// without a password UpdateUser only changes the username and email address
+	updated, err := UpdateUser(ctx, user, state.Username, state.Email, "", state.Password, state.Password != "")
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	reactivated := state.Active && previous.Terminating()
+	if updated.Username != previous.Username || updated.Email != previous.Email || state.Password != "" || reactivated {
+		if reactivated {
+			updated.DeletionTimestamp = nil
+		}
+		if err := GlobalUserStore.Save(ctx, &updated); err != nil {
+			writeSCIMErrorFor(w, err)
+			return
+		}
+		PublishWebhookEvent(ctx, WebhookUserUpdated, webhookUser(updated))
+	}
+
+	if !state.Active && !previous.Terminating() {
+		if err := TerminateUser(ctx, &updated, scimDisabledRetention()); err != nil {
+			writeSCIMErrorFor(w, err)
+			return
+		}
+		PublishWebhookEvent(ctx, WebhookUserDisabled, webhookUser(updated))
+	}
+
+	w.Header().Set("ETag", etag(updated.Version))
+	writeSCIM(w, http.StatusOK, newSCIMUser(r, &updated))
+}
+
+// HandleSCIMUserDELETE deletes a user immediately together with its sessions and settings, like
+// HandleUserDELETEv1 without a grace period. The admin account is never deleted.
+// (DELETE /scim/v2/Users/:id)
+func HandleSCIMUserDELETE(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
+
+	user, err := GlobalUserStore.Find(ctx, params.ByName("id"))
+	if err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if user.ID == "admin" {
+		writeSCIMError(w, http.StatusBadRequest, scimMutability, "the admin account can't be deleted")
+		return
+	}
+	if err := checkIfMatch(r, user.Version); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	if err := TerminateUser(ctx, user, 0); err != nil {
+		writeSCIMErrorFor(w, err)
+		return
+	}
+	PublishWebhookEvent(ctx, WebhookUserDeleted, webhookUser(*user))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSCIMServiceProviderConfig describes the supported SCIM features
+// (GET /scim/v2/ServiceProviderConfig)
+func HandleSCIMServiceProviderConfig(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	supported := func(supported bool) map[string]interface{} {
+		return map[string]interface{}{"supported": supported}
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": maxSCIMCount},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(true),
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "Authentication with the bearer token of the scim config",
+			"primary":     true,
+		}},
+	})
+}
+
+// HandleSCIMResourceTypes lists the resource types provisioned with SCIM
+// (GET /scim/v2/ResourceTypes)
+func HandleSCIMResourceTypes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimListResponseSchema},
+		TotalResults: 1,
+		StartIndex:   1,
+		ItemsPerPage: 1,
+		Resources: []map[string]interface{}{{
+			"schemas":  []string{scimResourceTypeSchema},
+			"id":       "User",
+			"name":     "User",
+			"endpoint": "/Users",
+			"schema":   scimUserSchema,
+			"meta": SCIMMeta{
+				ResourceType: "ResourceType",
+				Location:     baseURL(r) + "/scim/v2/ResourceTypes/User",
+			},
+		}},
+	})
+}
+
+/****************************************
+***  Patch operations                 ***
+*****************************************/
+
+// apply applies a patch operation to the state of the user
+func (state *scimUserState) apply(operation SCIMPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("%w: unknown operation %s", errInvalidSCIMPatch, operation.Op)
+	}
+
+	if operation.Path == "" {
+		if op == "remove" {
+			return fmt.Errorf("%w: remove requires a path", errInvalidSCIMPatch)
+		}
+		var attributes map[string]json.RawMessage
+		if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+			return fmt.Errorf("%w: the value of an operation without path must be an object", errInvalidSCIMValue)
+		}
+		for path, value := range attributes {
+			if err := state.set(path, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if op == "remove" {
+		switch scimPatchAttribute(operation.Path) {
+		case "username", "emails", "active", "password":
+			return fmt.Errorf("%w: %s is required", errSCIMMutability, operation.Path)
+		}
+		return nil
+	}
+	return state.set(operation.Path, operation.Value)
+}
+
+// set changes the attribute of the path, attributes which aren't stored are ignored
+func (state *scimUserState) set(path string, value json.RawMessage) error {
+	switch scimPatchAttribute(path) {
+	case "username":
+		return scimStringValue(value, &state.Username)
+	case "password":
+		return scimStringValue(value, &state.Password)
+	case "emails":
+		// the path selects the address with a value path like emails[type eq "work"].value or it's
+		// the value of the address or the list of addresses
+		if strings.HasSuffix(strings.ToLower(path), ".value") {
+			return scimStringValue(value, &state.Email)
+		}
+		var emails []SCIMEmail
+		if err := json.Unmarshal(value, &emails); err != nil {
+			var email SCIMEmail
+			if err := json.Unmarshal(value, &email); err != nil {
+				return fmt.Errorf("%w: invalid emails", errInvalidSCIMValue)
+			}
+			emails = []SCIMEmail{email}
+		}
+		if email := (SCIMUser{Emails: emails}).primaryEmail(); email != "" {
+			state.Email = email
+		}
+		return nil
+	case "active":
+		// some identity providers send the boolean as a string
+		var active interface{}
+		if err := json.Unmarshal(value, &active); err != nil {
+			return fmt.Errorf("%w: invalid active", errInvalidSCIMValue)
+		}
+		switch active := active.(type) {
+		case bool:
+			state.Active = active
+		case string:
+			parsed, err := strconv.ParseBool(active)
+			if err != nil {
+				return fmt.Errorf("%w: invalid active", errInvalidSCIMValue)
+			}
+			state.Active = parsed
+		default:
+			return fmt.Errorf("%w: invalid active", errInvalidSCIMValue)
+		}
+		return nil
+	case "id":
+		return fmt.Errorf("%w: the id of a user can't be changed", errSCIMMutability)
+	}
+	return nil
+}
+
+// scimPatchAttribute returns the lower case name of the attribute a patch path refers to,
+// e.g. emails for emails[type eq "work"].value
+func scimPatchAttribute(path string) string {
+	name := scimAttributeName(path)
+	if i := strings.IndexAny(name, "[."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// scimStringValue decodes a string value of a patch operation
+func scimStringValue(value json.RawMessage, v *string) error {
+	if err := json.Unmarshal(value, v); err != nil {
+		return fmt.Errorf("%w: expected a string", errInvalidSCIMValue)
+	}
+	return nil
+}
+
+// scimFieldNames maps the fields of the validation errors to the SCIM attributes
+var scimFieldNames = map[string]string{
+	"username": "userName",
+	"email":    "emails",
+}
+
+var (
+	errInvalidSCIMPatch = errors.New("invalid patch")
+	errInvalidSCIMValue = errors.New("invalid value")
+)
+
+/****************************************
+***  Encoding                         ***
+*****************************************/
+
+// decodeSCIM decodes the JSON body of a SCIM request. Unlike decodeJSON unknown attributes are ignored,
+// identity providers send many attributes the application doesn't store.
+func decodeSCIM(r *http.Request, v interface{}) error {
+	if err := checkContentType(r, scimMediaType, "application/json"); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBodySize)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidJSON, err)
+	}
+	return nil
+}
+
+// writeSCIM writes v as SCIM JSON with the given status code
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimMediaType)
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(v); err != nil {
+		log.Println("Unable to write SCIM response:", err)
+	}
+}
+
+// writeSCIMError writes a SCIM error with the given status code, scimType and detail
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeSCIM(w, status, SCIMError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+// writeSCIMErrorFor translates err into the matching SCIM error like writeAPIErrorFor. Taken usernames and
+// email addresses are reported as 409 Conflict with the scimType uniqueness.
+func writeSCIMErrorFor(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnsupportedMediaType):
+		writeSCIMError(w, http.StatusUnsupportedMediaType, "", err.Error())
+	case errors.Is(err, errInvalidJSON):
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidSyntax, err.Error())
+	case errors.Is(err, errInvalidFilter):
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidFilter, err.Error())
+	case errors.Is(err, errInvalidQuery):
+		writeSCIMError(w, http.StatusBadRequest, "", err.Error())
+	case errors.Is(err, errInvalidSCIMPatch):
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidPath, err.Error())
+	case errors.Is(err, errInvalidSCIMValue):
+		writeSCIMError(w, http.StatusBadRequest, scimInvalidValue, err.Error())
+	case errors.Is(err, errSCIMMutability):
+		writeSCIMError(w, http.StatusBadRequest, scimMutability, err.Error())
+	case errors.Is(err, errPreconditionFailed), errors.Is(err, ErrVersionConflict):
+		writeSCIMError(w, http.StatusPreconditionFailed, "", err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeSCIMError(w, http.StatusNotFound, "", "the user doesn't exist")
+	case errors.Is(err, ErrConflict):
+		writeSCIMError(w, http.StatusConflict, scimUniqueness, err.Error())
+	default:
+		if info, ok := validationInfos[err]; ok {
+			status, scimType := http.StatusBadRequest, scimInvalidValue
+			if info.Code == "taken" {
+				status, scimType = http.StatusConflict, scimUniqueness
+			}
+			field, _ := validationFieldError(err, "en")
+			if name, ok := scimFieldNames[field.Field]; ok {
+				field.Field = name
+			}
+			writeSCIMError(w, status, scimType, field.Field+": "+field.Message)
+			return
+		}
+		log.Println("SCIM request failed:", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "")
+	}
+}
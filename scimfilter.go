@@ -0,0 +1,316 @@
+package webapp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SCIM filters (RFC 7644 section 3.4.2.2) select users by their attributes, e.g.
+// userName eq "bob" or (emails co "@example.com" and active eq true). The supported attributes are
+// id, userName, emails (with the sub-attributes value, type and primary) and active. The comparisons of
+// userName and emails are case-insensitive like the lookups of the UserStore.
+
+var errInvalidFilter = errors.New("invalid filter")
+
+// scimFilter reports if a user matches a parsed filter
+type scimFilter func(user *User) bool
+
+// scimAttributes are the filterable attributes of a user by their lower case names,
+// they return the values of the attribute and if it is compared case-exact
+var scimAttributes = map[string]func(user *User) ([]interface{}, bool){
+	"id":       func(user *User) ([]interface{}, bool) { return []interface{}{user.ID}, true },
+	"username": func(user *User) ([]interface{}, bool) { return []interface{}{user.Username}, false },
+	"emails": func(user *User) ([]interface{}, bool) {
+		return []interface{}{user.Email}, false
+	},
+	"emails.value": func(user *User) ([]interface{}, bool) { return []interface{}{user.Email}, false },
+	"emails.type":  func(user *User) ([]interface{}, bool) { return []interface{}{scimEmailType}, false },
+	"emails.primary": func(user *User) ([]interface{}, bool) {
+		return []interface{}{true}, true
+	},
+	"active": func(user *User) ([]interface{}, bool) { return []interface{}{!user.Terminating()}, true },
+}
+
+// scimUserSchemaPrefix may precede the attribute names of filters and patch paths
+const scimUserSchemaPrefix = scimUserSchema + ":"
+
+// ParseSCIMFilter parses a SCIM filter expression
+func ParseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := scimFilterTokens(filter)
+	if err != nil {
+		return nil, err
+	}
+	parser := &scimFilterParser{tokens: tokens}
+	match, err := parser.or("")
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %s", errInvalidFilter, parser.tokens[parser.pos])
+	}
+	return match, nil
+}
+
+// scimFilterUsername returns the username of a filter selecting a user by its username only,
+// so the user can be looked up with FindByUsername
+func scimFilterUsername(filter string) (string, bool) {
+	tokens, err := scimFilterTokens(filter)
+	if err != nil || len(tokens) != 3 || !strings.EqualFold(tokens[1], "eq") {
+		return "", false
+	}
+	if scimAttributeName(tokens[0]) != "username" {
+		return "", false
+	}
+	var username string
+	if err := json.Unmarshal([]byte(tokens[2]), &username); err != nil {
+		return "", false
+	}
+	return username, true
+}
+
+// scimFilterTokens splits a filter into attribute paths, operators, JSON values and brackets
+func scimFilterTokens(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("()[]", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("%w: unterminated string", errInvalidFilter)
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && strings.IndexByte(" \t()[]\"", filter[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty filter", errInvalidFilter)
+	}
+	return tokens, nil
+}
+
+// scimAttributeName returns the lower case name of an attribute path without the schema of the user
+func scimAttributeName(path string) string {
+	if len(path) > len(scimUserSchemaPrefix) && strings.EqualFold(path[:len(scimUserSchemaPrefix)], scimUserSchemaPrefix) {
+		path = path[len(scimUserSchemaPrefix):]
+	}
+	return strings.ToLower(path)
+}
+
+// scimFilterParser is a recursive descent parser of the filter grammar, "not" binds stronger than "and",
+// "and" stronger than "or"
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+// next returns the next token without consuming it, or "" at the end of the filter
+func (p *scimFilterParser) next() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// or parses expressions combined with "or". The parent is the attribute of an enclosing value path
+// like emails[...].
+func (p *scimFilterParser) or(parent string) (scimFilter, error) {
+	left, err := p.and(parent)
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.next(), "or") {
+		p.pos++
+		right, err := p.and(parent)
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(user *User) bool { return l(user) || right(user) }
+	}
+	return left, nil
+}
+
+// and parses expressions combined with "and"
+func (p *scimFilterParser) and(parent string) (scimFilter, error) {
+	left, err := p.not(parent)
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.next(), "and") {
+		p.pos++
+		right, err := p.not(parent)
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(user *User) bool { return l(user) && right(user) }
+	}
+	return left, nil
+}
+
+// not parses a negated or parenthesised expression or a single comparison
+func (p *scimFilterParser) not(parent string) (scimFilter, error) {
+	if strings.EqualFold(p.next(), "not") {
+		p.pos++
+		if p.next() != "(" {
+			return nil, fmt.Errorf("%w: expected ( after not", errInvalidFilter)
+		}
+		match, err := p.not(parent)
+		if err != nil {
+			return nil, err
+		}
+		return func(user *User) bool { return !match(user) }, nil
+	}
+
+	if p.next() == "(" {
+		p.pos++
+		match, err := p.or(parent)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("%w: missing )", errInvalidFilter)
+		}
+		p.pos++
+		return match, nil
+	}
+	return p.comparison(parent)
+}
+
+// comparison parses "attribute operator value", "attribute pr" or a value path "attribute[filter]"
+func (p *scimFilterParser) comparison(parent string) (scimFilter, error) {
+	path := p.next()
+	if path == "" || strings.IndexByte("()[]\"", path[0]) >= 0 {
+		return nil, fmt.Errorf("%w: expected an attribute", errInvalidFilter)
+	}
+	p.pos++
+
+	name := scimAttributeName(path)
+	if parent != "" {
+		name = parent + "." + name
+	}
+
+	if p.next() == "[" {
+		if parent != "" {
+			return nil, fmt.Errorf("%w: nested value paths aren't supported", errInvalidFilter)
+		}
+		p.pos++
+		match, err := p.or(name)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != "]" {
+			return nil, fmt.Errorf("%w: missing ]", errInvalidFilter)
+		}
+		p.pos++
+		return match, nil
+	}
+
+	attribute, ok := scimAttributes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown attribute %s", errInvalidFilter, path)
+	}
+
+	operator := strings.ToLower(p.next())
+	p.pos++
+	if operator == "pr" {
+		return func(user *User) bool {
+			values, _ := attribute(user)
+			for _, value := range values {
+				if value != "" {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	var operand interface{}
+	if err := json.Unmarshal([]byte(p.next()), &operand); err != nil {
+		return nil, fmt.Errorf("%w: invalid value %s", errInvalidFilter, p.next())
+	}
+	p.pos++
+
+	compare, ok := scimOperators[operator]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown operator %s", errInvalidFilter, operator)
+	}
+	return func(user *User) bool {
+		values, caseExact := attribute(user)
+		for _, value := range values {
+			if compare(value, operand, caseExact) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// scimOperators compare the value of an attribute with the value of a filter
+var scimOperators = map[string]func(value, operand interface{}, caseExact bool) bool{
+	"eq": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, func(a, b string) bool { return a == b })
+	},
+	"ne": func(value, operand interface{}, caseExact bool) bool {
+		return !scimCompare(value, operand, caseExact, func(a, b string) bool { return a == b })
+	},
+	"co": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, strings.Contains)
+	},
+	"sw": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, strings.HasPrefix)
+	},
+	"ew": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, strings.HasSuffix)
+	},
+	"gt": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, func(a, b string) bool { return a > b })
+	},
+	"ge": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, func(a, b string) bool { return a >= b })
+	},
+	"lt": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, func(a, b string) bool { return a < b })
+	},
+	"le": func(value, operand interface{}, caseExact bool) bool {
+		return scimCompare(value, operand, caseExact, func(a, b string) bool { return a <= b })
+	},
+}
+
+// scimCompare compares string values with the given function, boolean values only match if they're equal
+func scimCompare(value, operand interface{}, caseExact bool, compare func(a, b string) bool) bool {
+	switch value := value.(type) {
+	case string:
+		operand, ok := operand.(string)
+		if !ok {
+			return false
+		}
+		if !caseExact {
+			value, operand = strings.ToLower(value), strings.ToLower(operand)
+		}
+		return compare(value, operand)
+	case bool:
+		operand, ok := operand.(bool)
+		return ok && compare(fmt.Sprint(value), fmt.Sprint(operand)) && value == operand
+	}
+	return false
+}
@@ -1,13 +1,19 @@
 package webapp
 
 import (
-	"database/sql"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
 	"gopkg.in/yaml.v3"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -17,73 +23,108 @@ type Session struct {
 	Expiry time.Time `json:"expiry" yaml:"expiry"`
 }
 
+// MarshalCSV represents the session by its id in CSV exports
+func (s Session) MarshalCSV() string {
+	return s.ID
+}
+
 const (
 	sessionDuration = 3 * 24 * time.Hour
 	sessionIDLength = 20
 )
 
+// NewSession creates a new session and sets its cookie
 func NewSession(w http.ResponseWriter) *Session {
-	expiry := time.Now().Add(sessionDuration)
+	session := newSession()
+	setSessionCookie(w, session)
+	return session
+}
 
-	session := &Session{
+// newSession creates a new session without setting its cookie, e.g. until it has been saved
+func newSession() *Session {
+	return &Session{
 		ID:     GenerateID("sess", sessionIDLength),
-		Expiry: expiry,
+		Expiry: time.Now().Add(sessionDuration),
 	}
+}
 
+// setSessionCookie sets the cookie of the session on the response
+func setSessionCookie(w http.ResponseWriter, session *Session) {
 	cookie := http.Cookie{
 		Name:    appName,
 		Value:   session.ID,
-		Expires: expiry,
+		Expires: session.Expiry,
 	}
 
 	http.SetCookie(w, &cookie)
-	return session
 }
 
+// RequestSession returns the session of the request's cookie, or nil if there is none. Failures of the
+// session store are logged and treated like a missing session.
 func RequestSession(r *http.Request) *Session {
-	cookie, err := r.Cookie(appName)
+	session, err := requestSession(r)
 	if err != nil {
-		return nil
+		logRequestError(r, "Error accessing Global session store:", err)
 	}
+	return session
+}
 
-	session, err := GlobalSessionStore.Find(cookie.Value)
+// requestSession returns the session of the request's cookie, or nil if there is none
+func requestSession(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(appName)
 	if err != nil {
-		Logf(FatalLevel, "Error accessing Global session store: %s\n", err)
+		return nil, nil
 	}
 
-	if session == nil {
-		return nil
+	session, err := GlobalSessionStore.Find(r.Context(), cookie.Value)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	if session.Expired() {
-		err = GlobalSessionStore.Delete(session)
-		if err != nil {
-			log.Println("Unable to delete session from global session store:", err)
+		err = GlobalSessionStore.Delete(r.Context(), session)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			logRequestError(r, "Unable to delete session from global session store:", err)
 		}
-		return nil
+		return nil, nil
 	}
 
-	return session
+	return session, nil
 }
 
 func (s *Session) Expired() bool {
 	return s.Expiry.Before(time.Now())
 }
 
+// RequestUser returns the logged in user of the request, or nil if the user isn't logged in. Failures of
+// the stores are logged and treated like a user who isn't logged in.
 func RequestUser(r *http.Request) *User {
-	session := RequestSession(r)
+	user, err := requestUser(r)
+	if err != nil {
+		logRequestError(r, "Error accessing Global user store:", err)
+	}
+	return user
+}
+
+// requestUser returns the logged in user of the request, or nil if the user isn't logged in
+func requestUser(r *http.Request) (*User, error) {
+	session, err := requestSession(r)
 	if session == nil || session.UserID == "" {
-		return nil
+		return nil, err
 	}
 
-	user, err := GlobalUserStore.Find(session.UserID)
+	user, err := GlobalUserStore.Find(r.Context(), session.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
 	if err != nil {
-		if err != sql.ErrNoRows {
-			Logf(FatalLevel, "Error accessing Global user store: %s\n", err)
-		}
+		return nil, err
 	}
 
-	return user
+	return user, nil
 }
 
 // IsAdmin checks if the current user is logged in with an admin account
@@ -95,10 +136,25 @@ func IsAdmin(r *http.Request) bool {
 	return false
 }
 
-// RequireLogin checks if the user is logged in
+// RequireLogin checks if the user is logged in. Other users are redirected to the login page,
+// API requests fail with 401 Unauthorized. Requests fail with 500 Internal Server Error if the
+// stores can't be read.
 func RequireLogin(w http.ResponseWriter, r *http.Request) {
 	// Let request pass if user is found
-	if RequestUser(r) != nil {
+	user, err := requestUser(r)
+	if err != nil {
+		if isAPIRequest(r) {
+			writeAPIErrorFor(w, r, err)
+			return
+		}
+		writeInternalError(w, r, "Error accessing Global user store:", err)
+		return
+	}
+	if user != nil {
+		return
+	}
+	if isAPIRequest(r) {
+		writeAPIError(w, r, http.StatusUnauthorized, codeUnauthorized, "")
 		return
 	}
 
@@ -108,12 +164,17 @@ func RequireLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login?"+query.Encode(), http.StatusFound)
 }
 
-// RequireAdmin checks if the user is logged in with an admin account
+// RequireAdmin checks if the user is logged in with an admin account. Other users are redirected to the
+// main page, API requests fail with 403 Forbidden.
 func RequireAdmin(w http.ResponseWriter, r *http.Request) {
 	// Let request pass if admin user is found
 	if IsAdmin(r) {
 		return
 	}
+	if isAPIRequest(r) {
+		writeAPIError(w, r, http.StatusForbidden, codeForbidden, "")
+		return
+	}
 
 	query := url.Values{}
 	query.Add("next", url.QueryEscape(r.URL.String()))
@@ -136,9 +197,10 @@ func FindOrCreateSession(w http.ResponseWriter, r *http.Request) *Session {
 func HandleSessionDestroy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	session := RequestSession(r)
 	if session != nil {
-		err := GlobalSessionStore.Delete(session)
-		if err != nil {
-			Logf(FatalLevel, "Error deleting session from glocal session store: %s\n", err)
+		err := GlobalSessionStore.Delete(r.Context(), session)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			writeInternalError(w, r, "Error deleting session from global session store:", err)
+			return
 		}
 	}
 	RenderTemplate(w, r, "sessions/destroy", nil)
@@ -159,9 +221,10 @@ func HandleSessionCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 	next := r.FormValue("next")
 
 	// find user or show login form and error message
-	user, err := FindUser(username, password)
+	user, err := FindUser(r.Context(), username, password)
 	if err != nil {
 		if IsValidationError(err) {
+			countLogin(false)
 			RenderTemplate(w, r, "sessions/new", map[string]interface{}{
 				"Pagetitle": "Login",
 				"User":      user,
@@ -170,16 +233,19 @@ func HandleSessionCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 			})
 			return
 		}
-		Logf(FatalLevel, "Error finding user/password combination: %s\n", err)
+		writeInternalError(w, r, "Error finding user/password combination:", err)
+		return
 	}
 
 	// find an existing session for the now authenticated user or create a new one
 	session := FindOrCreateSession(w, r)
 	session.UserID = user.ID
-	err = GlobalSessionStore.Save(session)
+	err = GlobalSessionStore.Save(r.Context(), session)
 	if err != nil {
-		Logf(FatalLevel, "Error adding new session to Global session store: %s\n", err)
+		writeInternalError(w, r, "Error adding new session to Global session store:", err)
+		return
 	}
+	countLogin(true)
 
 	if next == "" {
 		next = "/"
@@ -192,31 +258,220 @@ func HandleSessionCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 ***  Storage Backends                 ***
 *****************************************/
 
+// SessionStore is an abstraction interface to allow multiple data sources to save sessions to.
+// Find returns ErrNotFound if no session with the given id exists.
+// DeleteExpired removes all sessions which expired before the given time and returns how many were removed.
+// CountActive returns the number of sessions of logged in users which expire after the given time.
 type SessionStore interface {
-	Find(string) (*Session, error)
-	FindByUser(string) ([]Session, error)
-	Save(*Session) error
-	Delete(*Session) error
+	Find(context.Context, string) (*Session, error)
+	FindByUser(context.Context, string) ([]Session, error)
+	FindByUsers(context.Context, []string) (map[string][]Session, error)
+	Save(context.Context, *Session) error
+	Delete(context.Context, *Session) error
+	DeleteExpired(context.Context, time.Time) (int, error)
+	CountActive(context.Context, time.Time) (int, error)
 }
 
 var GlobalSessionStore SessionStore // Session Database
 
+/**********************************
+***  Session Reaper             ***
+***********************************/
+
+// defaultSessionReapInterval is used when Config.SessionReapInterval isn't set
+const defaultSessionReapInterval = time.Hour
+
+// ReapSessions removes all expired sessions from the GlobalSessionStore and returns how many were removed
+func ReapSessions(ctx context.Context) (int, error) {
+	return GlobalSessionStore.DeleteExpired(ctx, time.Now())
+}
+
+// SessionReaperJob returns the job removing expired sessions every interval. Expired sessions are also
+// removed lazily by RequestSession, the job cleans up abandoned ones.
+func SessionReaperJob(interval time.Duration) Job {
+	if interval <= 0 {
+		interval = defaultSessionReapInterval
+	}
+	return Job{
+		Name:     "session-reaper",
+		Schedule: Every(interval),
+		Run: func(ctx context.Context) (string, error) {
+			n, err := ReapSessions(ctx)
+			return fmt.Sprintf("Removed %d expired sessions", n), err
+		},
+	}
+}
+
+/**********************************
+***  Memory Session Store       ***
+***********************************/
+
+// MemorySessionStore is a thread-safe implementation of SessionStore which keeps all sessions in memory
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	persist  func() error // called after every change while the store is still locked
+	Sessions map[string]Session
+}
+
+// NewMemorySessionStore creates a new, empty MemorySessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		Sessions: map[string]Session{},
+	}
+}
+
+func (s *MemorySessionStore) Find(_ context.Context, id string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, exists := s.Sessions[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return &session, nil
+}
+
+func (s *MemorySessionStore) FindByUser(_ context.Context, userid string) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []Session
+	for _, session := range s.Sessions {
+		if session.UserID == userid {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) FindByUsers(_ context.Context, userids []string) (map[string][]Session, error) {
+	wanted := map[string]bool{}
+	for _, userid := range userids {
+		wanted[userid] = true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := map[string][]Session{}
+	for _, session := range s.Sessions {
+		if wanted[session.UserID] {
+			sessions[session.UserID] = append(sessions[session.UserID], session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) Save(_ context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.Sessions[session.ID]
+	s.Sessions[session.ID] = *session
+
+	if err := s.changed(); err != nil {
+		if existed {
+			s.Sessions[session.ID] = previous
+		} else {
+			delete(s.Sessions, session.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(_ context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, exists := s.Sessions[session.ID]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(s.Sessions, session.ID)
+
+	if err := s.changed(); err != nil {
+		s.Sessions[session.ID] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) CountActive(_ context.Context, now time.Time) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, session := range s.Sessions {
+		if session.UserID != "" && session.Expiry.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemorySessionStore) DeleteExpired(_ context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := map[string]Session{}
+	for id, session := range s.Sessions {
+		if session.Expiry.Before(before) {
+			expired[id] = session
+			delete(s.Sessions, id)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if err := s.changed(); err != nil {
+		for id, session := range expired {
+			s.Sessions[id] = session
+		}
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// changed calls the persist hook of the store if there is one
+func (s *MemorySessionStore) changed() error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist()
+}
+
+// stage returns an unpersisted copy of the store for a transaction
+func (s *MemorySessionStore) stage() *MemorySessionStore {
+	staged := &MemorySessionStore{
+		Sessions: make(map[string]Session, len(s.Sessions)),
+	}
+	for id, session := range s.Sessions {
+		staged.Sessions[id] = session
+	}
+	return staged
+}
+
 /**********************************
 ***  File Session Store         ***
 ***********************************/
 
+// FileSessionStore is an implementation of SessionStore to save sessions to the filesystem.
+// It keeps all sessions in memory and rewrites the file after every change.
 type FileSessionStore struct {
+	*MemorySessionStore
 	filename string
-	Sessions map[string]Session
 }
 
 func NewFileSessionStore(name string) (*FileSessionStore, error) {
 	store := &FileSessionStore{
-		Sessions: map[string]Session{},
-		filename: name,
+		MemorySessionStore: NewMemorySessionStore(),
+		filename:           name,
 	}
+	store.MemorySessionStore.persist = store.persist
 
-	contents, err := os.ReadFile(name)
+	contents, err := readStoreFile(name)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return store, nil
@@ -224,50 +479,179 @@ func NewFileSessionStore(name string) (*FileSessionStore, error) {
 		return nil, err
 	}
 
-	err = yaml.Unmarshal(contents, store)
+	err = yaml.Unmarshal(contents, store.MemorySessionStore)
 	if err != nil {
 		return nil, err
 	}
 	return store, err
 }
 
-func (s *FileSessionStore) Find(id string) (*Session, error) {
-	session, exists := s.Sessions[id]
-	if !exists {
-		return nil, nil
+// persist writes all sessions to the store's file
+func (s *FileSessionStore) persist() error {
+	contents, err := yaml.Marshal(s.MemorySessionStore)
+	if err != nil {
+		return err
 	}
-	return &session, nil
+	return writeFiles(map[string][]byte{s.filename: contents})
 }
 
-func (s *FileSessionStore) FindByUser(userid string) ([]Session, error) {
-	var sessions []Session
-	for _, session := range s.Sessions {
-		Logf(ErrorLevel, "session.UserID (%s) == userid (%s)\n", session.UserID, userid)
-		if session.UserID == userid {
-			sessions = append(sessions, session)
-		}
-	}
-	return sessions, nil
+/**********************************
+***  Bolt Session Store         ***
+***********************************/
+
+// BoltSessionStore is an implementation of SessionStore to save sessions in an embedded bolt database.
+// The sessions of a user are indexed under the key "<userid>\x00<sessionid>".
+type BoltSessionStore struct {
+	boltStore
 }
 
-func (s *FileSessionStore) Save(session *Session) error {
-	s.Sessions[session.ID] = *session
-	contents, err := yaml.Marshal(s)
+// NewBoltSessionStore creates a BoltSessionStore on the given database
+func NewBoltSessionStore(db *bolt.DB) SessionStore {
+	return &BoltSessionStore{boltStore{db: db}}
+}
+
+func (s *BoltSessionStore) Find(_ context.Context, id string) (*Session, error) {
+	session := &Session{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltSessionsBucket, []byte(id), session)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return session, nil
+}
 
-	return os.WriteFile(s.filename, contents, 0660)
+func (s *BoltSessionStore) FindByUser(_ context.Context, userid string) ([]Session, error) {
+	var sessions []Session
+	err := s.view(func(tx *bolt.Tx) error {
+		byUser, err := boltFindSessionsByUsers(tx, []string{userid})
+		sessions = byUser[userid]
+		return err
+	})
+	return sessions, err
 }
 
-func (s *FileSessionStore) Delete(session *Session) error {
-	delete(s.Sessions, session.ID)
-	contents, err := yaml.Marshal(s)
-	if err != nil {
+func (s *BoltSessionStore) FindByUsers(_ context.Context, userids []string) (map[string][]Session, error) {
+	var sessions map[string][]Session
+	err := s.view(func(tx *bolt.Tx) (err error) {
+		sessions, err = boltFindSessionsByUsers(tx, userids)
 		return err
+	})
+	return sessions, err
+}
+
+func (s *BoltSessionStore) Save(_ context.Context, session *Session) error {
+	return s.update(func(tx *bolt.Tx) error {
+		byUser := tx.Bucket(boltSessionsByUserBucket)
+
+		// the session may have been moved to another user
+		previous := Session{}
+		err := boltGet(tx, boltSessionsBucket, []byte(session.ID), &previous)
+		if err == nil {
+			if err := byUser.Delete(boltSessionIndexKey(&previous)); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if err := byUser.Put(boltSessionIndexKey(session), nil); err != nil {
+			return err
+		}
+		return boltPut(tx, boltSessionsBucket, []byte(session.ID), session)
+	})
+}
+
+func (s *BoltSessionStore) Delete(_ context.Context, session *Session) error {
+	return s.update(func(tx *bolt.Tx) error {
+		stored := Session{}
+		if err := boltGet(tx, boltSessionsBucket, []byte(session.ID), &stored); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltSessionsByUserBucket).Delete(boltSessionIndexKey(&stored)); err != nil {
+			return err
+		}
+		return tx.Bucket(boltSessionsBucket).Delete([]byte(session.ID))
+	})
+}
+
+func (s *BoltSessionStore) CountActive(_ context.Context, now time.Time) (int, error) {
+	count := 0
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessionsBucket).ForEach(func(_, data []byte) error {
+			session := Session{}
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+			if session.UserID != "" && session.Expiry.After(now) {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+func (s *BoltSessionStore) DeleteExpired(_ context.Context, before time.Time) (int, error) {
+	var count int
+	err := s.update(func(tx *bolt.Tx) error {
+		// keys can't be deleted while iterating over the bucket with a cursor
+		var expired []Session
+		err := tx.Bucket(boltSessionsBucket).ForEach(func(_, data []byte) error {
+			session := Session{}
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+			if session.Expiry.Before(before) {
+				expired = append(expired, session)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range expired {
+			if err := tx.Bucket(boltSessionsByUserBucket).Delete(boltSessionIndexKey(&expired[i])); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltSessionsBucket).Delete([]byte(expired[i].ID)); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
+	return count, nil
+}
+
+// boltSessionIndexKey returns the key of the session in the sessions by user index
+func boltSessionIndexKey(session *Session) []byte {
+	return []byte(session.UserID + "\x00" + session.ID)
+}
 
-	return os.WriteFile(s.filename, contents, 0660)
+// boltFindSessionsByUsers returns the sessions of the given users, grouped by user id
+func boltFindSessionsByUsers(tx *bolt.Tx, userids []string) (map[string][]Session, error) {
+	sessions := map[string][]Session{}
+	cursor := tx.Bucket(boltSessionsByUserBucket).Cursor()
+	for _, userid := range userids {
+		prefix := []byte(userid + "\x00")
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			session := Session{}
+			err := boltGet(tx, boltSessionsBucket, k[len(prefix):], &session)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			sessions[userid] = append(sessions[userid], session)
+		}
+	}
+	return sessions, nil
 }
 
 /**********************************
@@ -275,7 +659,7 @@ func (s *FileSessionStore) Delete(session *Session) error {
 ***********************************/
 
 type DBSessionStore struct {
-	db *sql.DB
+	db dbExecutor
 }
 
 func NewDBSessionStore() SessionStore {
@@ -302,8 +686,9 @@ CREATE INDEX IF NOT EXISTS userid_idx ON sessions( userid );`)
 	}
 }
 
-func (store DBSessionStore) Save(session *Session) error {
-	_, err := store.db.Exec(
+func (store DBSessionStore) Save(ctx context.Context, session *Session) error {
+	_, err := store.db.ExecContext(
+		ctx,
 		`
 	INSERT INTO sessions
 	    (id, userid, expiry)
@@ -314,11 +699,12 @@ func (store DBSessionStore) Save(session *Session) error {
 		session.UserID,
 		session.Expiry,
 	)
-	return err
+	return dbError(err)
 }
 
-func (store DBSessionStore) Find(id string) (*Session, error) {
-	row := store.db.QueryRow(
+func (store DBSessionStore) Find(ctx context.Context, id string) (*Session, error) {
+	row := store.db.QueryRowContext(
+		ctx,
 		`
 		SELECT id, userid, expiry
 		FROM sessions
@@ -332,15 +718,15 @@ func (store DBSessionStore) Find(id string) (*Session, error) {
 		&session.UserID,
 		&session.Expiry,
 	)
-	// return nil and no error when the Scan returns no findings
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if err != nil {
+		return nil, dbError(err)
 	}
-	return &session, err
+	return &session, nil
 }
 
-func (store DBSessionStore) FindByUser(userid string) ([]Session, error) {
-	rows, err := store.db.Query(
+func (store DBSessionStore) FindByUser(ctx context.Context, userid string) ([]Session, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
 		`
 		SELECT id, userid, expiry
 		FROM sessions
@@ -351,6 +737,7 @@ func (store DBSessionStore) FindByUser(userid string) ([]Session, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var sessions []Session
 	for rows.Next() {
@@ -367,20 +754,233 @@ func (store DBSessionStore) FindByUser(userid string) ([]Session, error) {
 		sessions = append(sessions, session)
 	}
 
-	return sessions, nil
+	return sessions, rows.Err()
+}
+
+// FindByUsers returns the sessions of all given users, grouped by user id
+func (store DBSessionStore) FindByUsers(ctx context.Context, userids []string) (map[string][]Session, error) {
+	sessions := map[string][]Session{}
+	if len(userids) == 0 {
+		return sessions, nil
+	}
+
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, userid, expiry
+		FROM sessions
+		WHERE userid = ANY($1)
+		`,
+		pq.Array(userids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session := Session{}
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions[session.UserID] = append(sessions[session.UserID], session)
+	}
 
+	return sessions, rows.Err()
 }
 
-func (store DBSessionStore) Delete(session *Session) error {
-	row, err := store.db.Exec(
+func (store DBSessionStore) Delete(ctx context.Context, session *Session) error {
+	return dbAffected(store.db.ExecContext(
+		ctx,
 		`
 		DELETE FROM sessions
 		WHERE id = $1`,
 		session.ID,
+	))
+}
+
+func (store DBSessionStore) CountActive(ctx context.Context, now time.Time) (int, error) {
+	var count int
+	err := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT count(*)
+		FROM sessions
+		WHERE userid <> '' AND expiry > $1`,
+		now,
+	).Scan(&count)
+	return count, dbError(err)
+}
+
+func (store DBSessionStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	res, err := store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM sessions
+		WHERE expiry < $1`,
+		before,
 	)
 	if err != nil {
-		log.Println(row.RowsAffected())
+		return 0, dbError(err)
 	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+/**********************************
+***  MySQL Session Store        ***
+***********************************/
 
-	return err
+type MySQLSessionStore struct {
+	db dbExecutor
+}
+
+func NewMySQLSessionStore() SessionStore {
+	_, err := GlobalMySQLDB.Exec(`
+CREATE TABLE IF NOT EXISTS sessions (
+  id varchar(255) NOT NULL DEFAULT '',
+  userid varchar(255) NOT NULL DEFAULT '',
+  expiry datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (id),
+  KEY userid_idx (userid)
+) DEFAULT CHARSET=utf8mb4;
+`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create sessions table in database: %s\n", err)
+	}
+
+	return &MySQLSessionStore{
+		db: GlobalMySQLDB,
+	}
+}
+
+func (store MySQLSessionStore) Save(ctx context.Context, session *Session) error {
+	_, err := store.db.ExecContext(
+		ctx,
+		`
+	INSERT INTO sessions
+	    (id, userid, expiry)
+	    VALUES (?, ?, ?)
+	    ON DUPLICATE KEY UPDATE userid=VALUES(userid), expiry=VALUES(expiry)`,
+		session.ID,
+		session.UserID,
+		session.Expiry.UTC(),
+	)
+	return mysqlError(err)
+}
+
+func (store MySQLSessionStore) Find(ctx context.Context, id string) (*Session, error) {
+	row := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT id, userid, expiry
+		FROM sessions
+		WHERE id = ?`,
+		id,
+	)
+
+	session := Session{}
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.Expiry,
+	)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	return &session, nil
+}
+
+func (store MySQLSessionStore) FindByUser(ctx context.Context, userid string) ([]Session, error) {
+	sessions, err := store.FindByUsers(ctx, []string{userid})
+	if err != nil {
+		return nil, err
+	}
+	return sessions[userid], nil
+}
+
+// FindByUsers returns the sessions of all given users, grouped by user id
+func (store MySQLSessionStore) FindByUsers(ctx context.Context, userids []string) (map[string][]Session, error) {
+	sessions := map[string][]Session{}
+	if len(userids) == 0 {
+		return sessions, nil
+	}
+
+	args := make([]any, len(userids))
+	for i, userid := range userids {
+		args[i] = userid
+	}
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, userid, expiry
+		FROM sessions
+		WHERE userid IN (`+mysqlPlaceholders(len(userids))+`)
+		`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session := Session{}
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions[session.UserID] = append(sessions[session.UserID], session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (store MySQLSessionStore) Delete(ctx context.Context, session *Session) error {
+	return mysqlAffected(store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM sessions
+		WHERE id = ?`,
+		session.ID,
+	))
+}
+
+func (store MySQLSessionStore) CountActive(ctx context.Context, now time.Time) (int, error) {
+	var count int
+	err := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT count(*)
+		FROM sessions
+		WHERE userid <> '' AND expiry > ?`,
+		now.UTC(),
+	).Scan(&count)
+	return count, mysqlError(err)
+}
+
+func (store MySQLSessionStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	res, err := store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM sessions
+		WHERE expiry < ?`,
+		before.UTC(),
+	)
+	if err != nil {
+		return 0, mysqlError(err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
 }
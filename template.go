@@ -47,14 +47,14 @@ func RenderTemplate(w http.ResponseWriter, r *http.Request, name string, data ma
 
 	user := RequestUser(r)
 	if user != nil {
-		conf, _ = GlobalUserConfigStore.Find(RequestUser(r).ID)
+		conf, _ = GlobalUserConfigStore.Find(r.Context(), RequestUser(r).ID)
 		if conf != nil {
 			if conf.DarkMode {
 				darkmode = "dark"
 			}
 		}
 	}
-	lang := GetLanguage("", r, nil)
+	lang := GetLanguage(r.Context(), "", r, nil)
 
 	data["CurrentUser"] = RequestUser(r)
 	data["OpenRegistration"] = Config.OpenRegistration
@@ -0,0 +1,259 @@
+package webapp
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Tx is a unit of work across the user, session and user config stores. Changes made through the
+// stores of a Tx are either all committed or all rolled back, except for the files of the file stores,
+// see NewFileTransactor.
+type Tx interface {
+	Users() UserStore
+	Sessions() SessionStore
+	UserConfigs() UserConfigStore
+	Commit() error
+	Rollback() error
+}
+
+// Transactor starts transactions on a storage backend
+type Transactor interface {
+	Begin(context.Context) (Tx, error)
+}
+
+// GlobalTransactor starts transactions on the global stores
+var GlobalTransactor Transactor
+
+var errTxDone = errors.New("transaction has already been committed or rolled back")
+
+// WithTx runs fn inside a new transaction of the GlobalTransactor. The transaction is committed when fn
+// returns without error and rolled back otherwise.
+// fn must only use the stores of the given Tx, since the global stores may be locked until the transaction ends.
+func WithTx(ctx context.Context, fn func(Tx) error) error {
+	tx, err := GlobalTransactor.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	// rolling back a committed transaction is a no-op
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/**********************************
+***  Memory Transactor          ***
+***********************************/
+
+// MemoryTransactor implements transactions for the memory stores. A transaction locks all stores,
+// works on staged copies of their data and swaps them in on commit.
+type MemoryTransactor struct {
+	users       *MemoryUserStore
+	sessions    *MemorySessionStore
+	userconfigs *MemoryUserConfigStore
+	// write persists the staged data before it replaces the data of the stores
+	write func(users *MemoryUserStore, sessions *MemorySessionStore, userconfigs *MemoryUserConfigStore) error
+}
+
+// NewMemoryTransactor creates a MemoryTransactor for the given memory stores
+func NewMemoryTransactor(users *MemoryUserStore, sessions *MemorySessionStore, userconfigs *MemoryUserConfigStore) *MemoryTransactor {
+	return &MemoryTransactor{
+		users:       users,
+		sessions:    sessions,
+		userconfigs: userconfigs,
+	}
+}
+
+// NewFileTransactor creates a Transactor for the given file stores, which writes all files at once on commit.
+// The files are replaced one after another, so if the commit fails after some of them have been replaced,
+// the stores are reloaded from the files to match them again.
+func NewFileTransactor(users *FileUserStore, sessions *FileSessionStore, userconfigs *FileUserConfigStore) Transactor {
+	t := NewMemoryTransactor(users.MemoryUserStore, sessions.MemorySessionStore, userconfigs.MemoryUserConfigStore)
+	t.write = func(stagedUsers *MemoryUserStore, stagedSessions *MemorySessionStore, stagedUserconfigs *MemoryUserConfigStore) error {
+		files := map[string][]byte{}
+		for filename, data := range map[string]interface{}{
+			users.filename:       stagedUsers,
+			sessions.filename:    stagedSessions,
+			userconfigs.filename: stagedUserconfigs,
+		} {
+			contents, err := yaml.Marshal(data)
+			if err != nil {
+				return err
+			}
+			files[filename] = contents
+		}
+		err := writeFiles(files)
+		if err != nil {
+			if reloadErr := reloadFileStores(users, sessions, userconfigs); reloadErr != nil {
+				log.Println("Unable to reload the stores after a failed commit:", reloadErr)
+			}
+		}
+		return err
+	}
+	return t
+}
+
+// reloadFileStores replaces the data of the file stores with the contents of their files.
+// The caller has to hold the locks of the stores.
+func reloadFileStores(users *FileUserStore, sessions *FileSessionStore, userconfigs *FileUserConfigStore) error {
+	loadedUsers := NewMemoryUserStore()
+	loadedSessions := NewMemorySessionStore()
+	loadedUserconfigs := NewMemoryUserConfigStore()
+	for filename, store := range map[string]interface{}{
+		users.filename:       loadedUsers,
+		sessions.filename:    loadedSessions,
+		userconfigs.filename: loadedUserconfigs,
+	} {
+		contents, err := readStoreFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = yaml.Unmarshal(contents, store)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	users.Users = loadedUsers.Users
+	sessions.Sessions = loadedSessions.Sessions
+	userconfigs.UserConfigs = loadedUserconfigs.UserConfigs
+	return nil
+}
+
+// Begin locks the memory stores and starts a new transaction
+func (t *MemoryTransactor) Begin(_ context.Context) (Tx, error) {
+	// always lock in the same order to avoid deadlocks between transactions
+	t.users.mu.Lock()
+	t.sessions.mu.Lock()
+	t.userconfigs.mu.Lock()
+
+	sessions := t.sessions.stage()
+	return &memoryTx{
+		transactor:  t,
+		users:       t.users.stage(sessions),
+		sessions:    sessions,
+		userconfigs: t.userconfigs.stage(),
+	}, nil
+}
+
+type memoryTx struct {
+	once        sync.Once
+	transactor  *MemoryTransactor
+	users       *MemoryUserStore
+	sessions    *MemorySessionStore
+	userconfigs *MemoryUserConfigStore
+}
+
+func (tx *memoryTx) Users() UserStore {
+	return tx.users
+}
+
+func (tx *memoryTx) Sessions() SessionStore {
+	return tx.sessions
+}
+
+func (tx *memoryTx) UserConfigs() UserConfigStore {
+	return tx.userconfigs
+}
+
+// Commit replaces the data of all stores with the staged data and unlocks the stores. If persisting the
+// staged data fails, the data of the stores is kept, see NewFileTransactor for partially written files.
+func (tx *memoryTx) Commit() error {
+	err := errTxDone
+	tx.once.Do(func() {
+		defer tx.unlock()
+		t := tx.transactor
+
+		if t.write != nil {
+			if err = t.write(tx.users, tx.sessions, tx.userconfigs); err != nil {
+				return
+			}
+		}
+		err = nil
+
+		t.users.Users = tx.users.Users
+		t.sessions.Sessions = tx.sessions.Sessions
+		t.userconfigs.UserConfigs = tx.userconfigs.UserConfigs
+	})
+	return err
+}
+
+// Rollback discards the staged data and unlocks the stores
+func (tx *memoryTx) Rollback() error {
+	tx.once.Do(tx.unlock)
+	return nil
+}
+
+func (tx *memoryTx) unlock() {
+	tx.transactor.userconfigs.mu.Unlock()
+	tx.transactor.sessions.mu.Unlock()
+	tx.transactor.users.mu.Unlock()
+}
+
+// writeFiles replaces the given store files with new contents, encrypted if a GlobalKeyRing is configured.
+// All contents are written to temporary files first, which are then renamed to their destination, so a failed
+// write leaves the old files intact. The files are renamed one after another though, if a rename fails the
+// files renamed before it have already been replaced.
+func writeFiles(files map[string][]byte) error {
+	var filenames []string
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	temps := map[string]string{}
+	cleanup := func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}
+
+	for _, filename := range filenames {
+		temp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+		if err != nil {
+			cleanup()
+			return err
+		}
+		temps[filename] = temp.Name()
+
+		contents := files[filename]
+		if GlobalKeyRing != nil {
+			contents, err = GlobalKeyRing.Seal(contents)
+		}
+		if err == nil {
+			_, err = temp.Write(contents)
+		}
+		if err == nil {
+			err = temp.Sync()
+		}
+		if closeErr := temp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(temp.Name(), 0660)
+		}
+		if err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	for _, filename := range filenames {
+		if err := os.Rename(temps[filename], filename); err != nil {
+			cleanup()
+			return err
+		}
+		delete(temps, filename)
+	}
+	return nil
+}
@@ -1,27 +1,42 @@
 package webapp
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	bolt "go.etcd.io/bbolt"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // User contains the necessary data for a registered user of the web service
 type User struct {
-	ID             string    `json:"id" yaml:"id"`
-	Username       string    `json:"username" yaml:"username"`
-	Email          string    `json:"email" yaml:"email"`
-	HashedPassword string    `json:"hashedPassword,omitempty" yaml:"hashedPassword,omitempty"`
-	Sessions       []Session `json:"sessions" yaml:"sessions"`
+	ID             string    `json:"id" yaml:"id" csv:"ID"`
+	Username       string    `json:"username" yaml:"username" csv:"Username"`
+	Email          string    `json:"email" yaml:"email" csv:"Email"`
+	HashedPassword string    `json:"hashedPassword,omitempty" yaml:"hashedPassword,omitempty" xml:",omitempty" csv:"-"`
+	Sessions       []Session `json:"sessions" yaml:"sessions" csv:"Sessions"`
+	// DeletionTimestamp is set while the user is terminating, the user is purged after this time
+	DeletionTimestamp *time.Time `json:"deletionTimestamp,omitempty" yaml:"deletionTimestamp,omitempty" csv:"DeletionTimestamp"`
+	// Version is increased by every save, a user can only be saved with the version it has been read with
+	Version int64 `json:"version" yaml:"version" csv:"Version"`
+}
+
+// Terminating reports if the user has been deleted with a grace period and can still be restored
+func (u User) Terminating() bool {
+	return u.DeletionTimestamp != nil
 }
 
 const (
@@ -31,10 +46,10 @@ const (
 )
 
 // CreateAdminAccount creates a superuser account for the application administration if none exists yet
-func CreateAdminAccount() {
+func CreateAdminAccount(ctx context.Context) {
 	// Create admin user with random password if none exists
-	admin, err := GlobalUserStore.Find("admin")
-	if err != nil {
+	admin, err := GlobalUserStore.Find(ctx, "admin")
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		Logf(FatalLevel, "Unable to read from global user store: %s\n", err)
 	}
 
@@ -51,7 +66,7 @@ func CreateAdminAccount() {
 			HashedPassword: string(hashedPassword),
 			Username:       "admin",
 		}
-		err = GlobalUserStore.Save(admin)
+		err = GlobalUserStore.Save(ctx, admin)
 		if err != nil {
 			Logf(FatalLevel, "Unable to save admin password: %s\n", err)
 		}
@@ -61,14 +76,14 @@ func CreateAdminAccount() {
 }
 
 // NewUser creates a new User and encrypts his password
-func NewUser(username, email, password string) (User, error) {
+func NewUser(ctx context.Context, username, email, password string) (User, error) {
 	user := User{
 		ID:       GenerateID("usr", userIDLength),
 		Email:    email,
 		Username: username,
 	}
 
-	lang := GetLanguage(user.ID, nil, nil)
+	lang := GetLanguage(ctx, user.ID, nil, nil)
 
 	// check for empty form fields
 	if username == "" {
@@ -87,22 +102,22 @@ func NewUser(username, email, password string) (User, error) {
 	}
 
 	// check if username exists
-	existingUser, err := GlobalUserStore.FindByUsername(username)
-	if err != nil {
-		return user, err
-	}
-	if existingUser != nil {
+	_, err := GlobalUserStore.FindByUsername(ctx, username)
+	if err == nil {
 		return user, errUsernameExists[lang]
 	}
-
-	// check if email exists
-	existingUser, err = GlobalUserStore.FindByEmail(email)
-	if err != nil {
+	if !errors.Is(err, ErrNotFound) {
 		return user, err
 	}
-	if existingUser != nil {
+
+	// check if email exists
+	_, err = GlobalUserStore.FindByEmail(ctx, email)
+	if err == nil {
 		return user, errEmailExists[lang]
 	}
+	if !errors.Is(err, ErrNotFound) {
+		return user, err
+	}
 
 	// encrypt password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
@@ -112,22 +127,22 @@ func NewUser(username, email, password string) (User, error) {
 }
 
 // FindUser returns the user with the given username + password combination if found
-func FindUser(username, password string) (*User, error) {
+func FindUser(ctx context.Context, username, password string) (*User, error) {
 	// create dummy user to return username if login fails
 	out := &User{
 		Username: username,
 	}
 
 	// find user or return dummy with error message if it fails
-	existingUser, err := GlobalUserStore.FindByUsername(username)
+	existingUser, err := GlobalUserStore.FindByUsername(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		return out, errCredentialsIncorrect["en"]
+	}
 	if err != nil {
 		return out, err
 	}
-	if existingUser == nil {
-		return out, errCredentialsIncorrect["en"]
-	}
 
-	lang := GetLanguage(existingUser.ID, nil, nil)
+	lang := GetLanguage(ctx, existingUser.ID, nil, nil)
 
 	// compare user + password combination if user has been found before
 	if bcrypt.CompareHashAndPassword(
@@ -136,11 +151,16 @@ func FindUser(username, password string) (*User, error) {
 	) != nil {
 		return out, errCredentialsIncorrect[lang]
 	}
+
+	// terminating users can't log in until they are restored
+	if existingUser.Terminating() {
+		return out, errCredentialsIncorrect[lang]
+	}
 	return existingUser, nil
 }
 
 // UpdateUser updates the User's email address and, if the current password matches, the password
-func UpdateUser(user *User, username, email, currentPassword, newPassword string, admin bool) (User, error) {
+func UpdateUser(ctx context.Context, user *User, username, email, currentPassword, newPassword string, admin bool) (User, error) {
 	var lang string = "en"
 
 	// make a shallow copy of the user and set email
@@ -148,18 +168,35 @@ func UpdateUser(user *User, username, email, currentPassword, newPassword string
 	out.Username = username
 	out.Email = email
 
+	// check for empty form fields
+	if username == "" {
+		return out, errNoUsername[lang]
+	}
+	if email == "" {
+		return out, errNoEmail[lang]
+	}
+
 	// Check if email is already in use by another user
-	existingUser, err := GlobalUserStore.FindByEmail(email)
-	if err != nil {
+	existingUser, err := GlobalUserStore.FindByEmail(ctx, email)
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return out, err
 	}
 	if existingUser != nil {
-		lang = GetLanguage(existingUser.ID, nil, nil)
+		lang = GetLanguage(ctx, existingUser.ID, nil, nil)
 	}
 	if existingUser != nil && existingUser.ID != user.ID {
 		return out, errEmailExists[lang]
 	}
 
+	// Check if username is already in use by another user
+	existingUser, err = GlobalUserStore.FindByUsername(ctx, username)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return out, err
+	}
+	if existingUser != nil && existingUser.ID != user.ID {
+		return out, errUsernameExists[lang]
+	}
+
 	// update email address
 	user.Email = email
 	user.Username = username
@@ -193,6 +230,158 @@ func UpdateUser(user *User, username, email, currentPassword, newPassword string
 	//return out, err
 }
 
+// checkCurrentPassword requires API clients other than the admin to confirm a new password with the current
+// one. UpdateUser ignores the new password without the current one, since the form always sends both fields.
+func checkCurrentPassword(r *http.Request, user *User, currentPassword, newPassword string) error {
+	if IsAdmin(r) || newPassword == "" || currentPassword != "" {
+		return nil
+	}
+	return errNoCurrentPassword[GetLanguage(r.Context(), user.ID, nil, nil)]
+}
+
+// DeleteUser removes the user together with their sessions and user config in a single transaction
+func DeleteUser(ctx context.Context, user *User) error {
+	return WithTx(ctx, func(tx Tx) error {
+		return deleteUser(ctx, tx, user)
+	})
+}
+
+// deleteUser removes the user, their sessions and their user config using the stores of the transaction
+func deleteUser(ctx context.Context, tx Tx, user *User) error {
+	sessions, err := tx.Sessions().FindByUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		err := tx.Sessions().Delete(ctx, &session)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("unable to delete session %s: %w", session.ID, err)
+		}
+	}
+
+	userconf, err := tx.UserConfigs().Find(ctx, user.ID)
+	if err == nil {
+		err = tx.UserConfigs().Delete(ctx, userconf)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("unable to delete userconfig: %w", err)
+	}
+
+	return tx.Users().Delete(ctx, user)
+}
+
+// defaultUserPurgeInterval is the interval in which the users at the end of their grace period are purged
+const defaultUserPurgeInterval = time.Minute
+
+var errNotTerminating = fmt.Errorf("%w: the user isn't terminating", ErrConflict)
+
+// TerminateUser deletes the user after the grace period. Until then the user is terminating: the sessions of
+// the user are removed, logins are refused and the user can be restored with RestoreUser. A terminating user
+// keeps the earlier deletion time, so a shorter grace period speeds up the deletion but a longer one doesn't
+// delay it. Without a grace period the user is deleted immediately.
+func TerminateUser(ctx context.Context, user *User, gracePeriod time.Duration) error {
+	return WithTx(ctx, func(tx Tx) error {
+		return terminateUser(ctx, tx, user, gracePeriod)
+	})
+}
+
+// terminateUser marks the user as terminating or deletes it using the stores of the transaction
+func terminateUser(ctx context.Context, tx Tx, user *User, gracePeriod time.Duration) error {
+	if gracePeriod <= 0 {
+		return deleteUser(ctx, tx, user)
+	}
+
+	deletion := time.Now().Add(gracePeriod).UTC()
+	if user.Terminating() && !deletion.Before(*user.DeletionTimestamp) {
+		return nil
+	}
+
+	sessions, err := tx.Sessions().FindByUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		err := tx.Sessions().Delete(ctx, &session)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("unable to delete session %s: %w", session.ID, err)
+		}
+	}
+
+	user.DeletionTimestamp = &deletion
+	user.Sessions = nil
+	return tx.Users().Save(ctx, user)
+}
+
+// RestoreUser cancels the pending deletion of a terminating user
+func RestoreUser(ctx context.Context, user *User) error {
+	if !user.Terminating() {
+		return errNotTerminating
+	}
+	user.DeletionTimestamp = nil
+	return GlobalUserStore.Save(ctx, user)
+}
+
+// PurgeUsers deletes the users whose grace period has ended and returns how many were deleted
+func PurgeUsers(ctx context.Context) (int, error) {
+	users, err := GlobalUserStore.FindDeletionDue(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for i := range users {
+		user, err := purgeUser(ctx, users[i].ID)
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionConflict) {
+			continue
+		}
+		if err != nil {
+			return purged, fmt.Errorf("unable to purge user %s: %w", users[i].ID, err)
+		}
+		if user == nil {
+			continue
+		}
+		PublishWebhookEvent(ctx, WebhookUserDeleted, webhookUser(*user))
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeUser reads the user again and deletes it in a single transaction, unless it has been restored or
+// its deletion has been postponed since it was found due. It returns the deleted user, or nil if it was kept.
+func purgeUser(ctx context.Context, id string) (*User, error) {
+	var purged *User
+	err := WithTx(ctx, func(tx Tx) error {
+		user, err := tx.Users().Find(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !user.Terminating() || user.DeletionTimestamp.After(time.Now()) {
+			return nil
+		}
+		if err := deleteUser(ctx, tx, user); err != nil {
+			return err
+		}
+		purged = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// UserPurgerJob returns the job deleting the terminating users at the end of their grace period
+func UserPurgerJob() Job {
+	return Job{
+		Name:     "user-purger",
+		Schedule: Every(defaultUserPurgeInterval),
+		Run: func(ctx context.Context) (string, error) {
+			n, err := PurgeUsers(ctx)
+			return fmt.Sprintf("Purged %d deleted users", n), err
+		},
+	}
+}
+
 /****************************************
 ***  Handler                          ***
 *****************************************/
@@ -209,8 +398,11 @@ func HandleUserNew(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 // HandleUserCreate takes the form values from the registration page and creates a new user
 // (POST /registration)
 func HandleUserCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
 	// Create User
 	user, err := NewUser(
+		ctx,
 		r.FormValue("username"),
 		r.FormValue("email"),
 		r.FormValue("password"),
@@ -228,20 +420,32 @@ func HandleUserCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 		panic(err)
 	}
 
-	// save user
-	err = GlobalUserStore.Save(&user)
-	if err != nil {
-		Logf(FatalLevel, "Unable to save user info: %s\n", err)
-	}
-
-	// create a new session
-	session := NewSession(w)
+	// create a new session, its cookie is only set once it has been saved
+	session := newSession()
 	session.UserID = user.ID
 
-	err = GlobalSessionStore.Save(session)
+	// save user and session together
+	err = WithTx(ctx, func(tx Tx) error {
+		if err := tx.Users().Save(ctx, &user); err != nil {
+			return err
+		}
+		return tx.Sessions().Save(ctx, session)
+	})
+	// another user with the same username or email address has been saved since NewUser checked them
+	if errors.Is(err, ErrConflict) {
+		RenderTemplate(w, r, "users/new", map[string]interface{}{
+			"Pagetitle": "NewUser",
+			"Error":     userConflictError(ctx, &user, GetLanguage(ctx, "", r, nil)).Error(),
+			"User":      user,
+		})
+		return
+	}
 	if err != nil {
-		Logf(FatalLevel, "Unable to save session info: %s\n", err)
+		writeInternalError(w, r, "Unable to save user info:", err)
+		return
 	}
+	setSessionCookie(w, session)
+	PublishWebhookEvent(ctx, WebhookUserCreated, webhookUser(user))
 
 	// redirect back to / with status message
 	http.Redirect(w, r, "/?flash=User+created", http.StatusFound)
@@ -256,7 +460,7 @@ func HandleUserEdit(w http.ResponseWriter, r *http.Request, params httprouter.Pa
 	if uid == "" {
 		user = RequestUser(r)
 	} else {
-		user, err = GlobalUserStore.Find(uid)
+		user, err = GlobalUserStore.Find(r.Context(), uid)
 		if err != nil {
 			log.Println("User", uid, "not found:", err)
 			http.Redirect(w, r, "/?flash=user+not+found", http.StatusNotFound)
@@ -287,7 +491,7 @@ func HandleUserUpdate(w http.ResponseWriter, r *http.Request, params httprouter.
 	if uid == "" {
 		user = RequestUser(r)
 	} else {
-		user, err = GlobalUserStore.Find(uid)
+		user, err = GlobalUserStore.Find(r.Context(), uid)
 		if err != nil {
 			log.Println("User", uid, "not found:", err)
 			http.Redirect(w, r, "/?flash=user+not+found", http.StatusNotFound)
@@ -302,12 +506,18 @@ func HandleUserUpdate(w http.ResponseWriter, r *http.Request, params httprouter.
 		return
 	}
 
+	// the form contains the version the user was shown with, it has to be edited again if it changed since
+	if version := r.FormValue("version"); version != "" && version != strconv.FormatInt(user.Version, 10) {
+		renderUserModified(w, r, user)
+		return
+	}
+
 	username := r.FormValue("username")
 	email := r.FormValue("email")
 	currentPassword := r.FormValue("currentPassword")
 	newPassword := r.FormValue("newPassword")
 
-	u, err := UpdateUser(user, username, email, currentPassword, newPassword, currentUser.ID == "admin")
+	u, err := UpdateUser(r.Context(), user, username, email, currentPassword, newPassword, currentUser.ID == "admin")
 	user = &u
 	if err != nil {
 		if IsValidationError(err) {
@@ -319,271 +529,1119 @@ func HandleUserUpdate(w http.ResponseWriter, r *http.Request, params httprouter.
 			})
 			return
 		}
-		Logf(FatalLevel, "Error updating user: %s\n", err)
+		writeInternalError(w, r, "Error updating user:", err)
+		return
 	}
 
-	err = GlobalUserStore.Save(user)
+	err = GlobalUserStore.Save(r.Context(), user)
+	if errors.Is(err, ErrVersionConflict) {
+		current, err := GlobalUserStore.Find(r.Context(), user.ID)
+		if err != nil {
+			writeInternalError(w, r, "Unable to read the modified user from Global user store:", err)
+			return
+		}
+		renderUserModified(w, r, current)
+		return
+	}
+	// another user with the same username or email address has been saved since UpdateUser checked them
+	if errors.Is(err, ErrConflict) {
+		RenderTemplate(w, r, "users/edit", map[string]interface{}{
+			"Pagetitle": "EditUser",
+			"User":      user,
+			"Error":     userConflictError(r.Context(), user, GetLanguage(r.Context(), "", r, nil)).Error(),
+		})
+		return
+	}
 	if err != nil {
-		Logf(FatalLevel, "Error updating user in Global user store: %s\n", err)
+		writeInternalError(w, r, "Error updating user in Global user store:", err)
+		return
 	}
+	PublishWebhookEvent(r.Context(), WebhookUserUpdated, webhookUser(*user))
 
 	http.Redirect(w, r, "/users/"+user.ID+"?flash=user+updated", http.StatusFound)
 }
 
+// userConflictError returns the validation error of an ErrConflict from saving the user, which is caused
+// by another user with the same username or email address
+func userConflictError(ctx context.Context, user *User, lang string) ValidationError {
+	existing, err := GlobalUserStore.FindByUsername(ctx, user.Username)
+	if err == nil && existing.ID != user.ID {
+		return errUsernameExists[lang]
+	}
+	return errEmailExists[lang]
+}
+
+// renderUserModified shows the edit form again with the current data of a user which has been changed
+// by someone else while it was edited
+func renderUserModified(w http.ResponseWriter, r *http.Request, current *User) {
+	lang := GetLanguage(r.Context(), "", r, nil)
+	RenderTemplate(w, r, "users/edit", map[string]interface{}{
+		"Pagetitle": "EditUser",
+		"User":      current,
+		"Error":     errModifiedConcurrently[lang].Error(),
+	})
+}
+
+// HandleUsersIndex shows a page of the user list, sorted and filtered by the url parameters
+// (GET /users?cursor=&sort=&q=)
 func HandleUsersIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var users []User
-	var err error
+	var list UserList
 
 	user := RequestUser(r)
-	if user == nil {
+	if user == nil || user.ID != "admin" {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	if user.ID == "admin" {
-		users, err = GlobalUserStore.All()
-	} else {
-		w.WriteHeader(http.StatusForbidden)
+	query, err := ParseUserQuery(r.URL.Query(), defaultUserListLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	resourceVersion := GlobalEventBus.ResourceVersion()
+	list, err = GlobalUserStore.List(r.Context(), query)
 	if err != nil {
-		log.Println("Unable to read from GlobalUserStore:", err)
+		writeInternalError(w, r, "Unable to read from GlobalUserStore:", err)
+		return
+	}
+
+	// link back to the previous page unless we are on the first one
+	previous := ""
+	if query.Offset > 0 {
+		offset := query.Offset - query.Limit
+		if offset < 0 {
+			offset = 0
+		}
+		previous = EncodeCursor(offset)
 	}
 
 	RenderTemplate(w, r, "users/index", map[string]interface{}{
 		"Pagetitle": "ListUsers",
-		"Users":     users,
+		"Users":     list.Users,
+		"Total":     list.Total,
+		"Query":     query,
+		"Continue":  list.Continue,
+		"Previous":  previous,
+		// the page watches for changes of the users after this version
+		"ResourceVersion": resourceVersion,
 	})
 }
 
+// HandleUsersGETv1 returns the list of users. Without a limit parameter all users are returned,
+// otherwise the X-Total-Count header contains the number of matching users and the Link header
+// the url of the next page. The X-Resource-Version header contains the version to watch for changes from.
+// With watch=true the changes of the users are streamed instead, see serveWatch.
+// (GET /api/v1/users?limit=&cursor=&sort=&q=&watch=&resourceVersion=&timeoutSeconds=)
 func HandleUsersGETv1(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var users []User
-	var err error
+	var list UserList
 
 	user := RequestUser(r)
-	if user == nil {
-		w.WriteHeader(http.StatusForbidden)
+	if user == nil || user.ID != "admin" {
+		writeAPIError(w, r, http.StatusForbidden, codeForbidden, "")
 		return
 	}
 
-	if user.ID == "admin" {
-		users, err = GlobalUserStore.All()
-	} else {
-		w.WriteHeader(http.StatusForbidden)
+	if watchRequested(r) {
+		serveWatch(w, r, KindUser, nil)
 		return
 	}
+
+	query, err := ParseUserQuery(r.URL.Query(), 0)
 	if err != nil {
-		log.Println("Unable to read from GlobalUserStore:", err)
+		writeAPIErrorFor(w, r, err)
+		return
 	}
 
-	format := fmt.Sprint(r.URL.Query()["format"])
-	switch format {
-	case "[csv]":
-		var row []string
-		items := [][]string{
-			{"ID", "Username", "Email", "Sessions"},
-		}
-
-		w.Header().Set("Content-Type", "text/csv")
-		w.Header().Set("Content-Disposition", "attachment;filename=users.csv")
-		w.WriteHeader(http.StatusOK)
-		writer := csv.NewWriter(w)
-		users, _ = GlobalUserStore.All()
-		for _, u := range users {
-			var sessions []string
-			for _, s := range u.Sessions {
-				sessions = append(sessions, s.ID)
-			}
-			row = []string{u.ID, u.Username, u.Email, strings.Join(sessions, "\n")}
-			items = append(items, row)
-		}
-		if err := writer.WriteAll(items); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	case "[yaml]":
-		w.Header().Set("Content-Type", "text/yaml")
-		w.WriteHeader(http.StatusOK)
-		writer := yaml.NewEncoder(w)
-		if err := writer.Encode(users); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	case "[xml]":
-		w.Header().Set("Content-Type", "application/xml")
-		w.WriteHeader(http.StatusOK)
-		writer := xml.NewEncoder(w)
-		writer.Indent("", "    ")
-		if err := writer.Encode(users); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	case "[json]":
-		fallthrough
-	default:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		writer := json.NewEncoder(w)
-		writer.SetIndent("", "    ")
-		if err := writer.Encode(users); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// changes after this version may already be listed, watching from it replays them at worst
+	resourceVersion := GlobalEventBus.ResourceVersion()
+	list, err = GlobalUserStore.List(r.Context(), query)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
 	}
+	users := list.Users
+
+	w.Header().Set("X-Resource-Version", strconv.FormatUint(resourceVersion, 10))
+	w.Header().Set("X-Total-Count", strconv.Itoa(list.Total))
+	if list.Continue != "" {
+		next := r.URL.Query()
+		next.Set("cursor", list.Continue)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
+	}
+
+	writeResponse(w, r, http.StatusOK, users)
 }
 
+// HandleUserDELETEv1 deletes a user immediately or, with a grace period, marks the user as terminating
+// and returns it with its deletion timestamp. With an If-Match header the user is only deleted if it still
+// has the given entity tag.
+// (DELETE /api/v1/users/:id?gracePeriodSeconds=)
 func HandleUserDELETEv1(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	user, _ := GlobalUserStore.Find(params.ByName("id"))
-	if user == nil {
-		log.Println("No user found to delete")
-		w.WriteHeader(http.StatusNotFound)
+	ctx := r.Context()
+
+	gracePeriod, err := gracePeriod(r, KindUser)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	user, err := GlobalUserStore.Find(ctx, params.ByName("id"))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
 		return
 	}
 	if RequestUser(r).ID == user.ID || RequestUser(r).Username == "admin" {
-		for _, session := range user.Sessions {
-			err := GlobalSessionStore.Delete(&session)
-			if err != nil {
-				log.Println("Unable to delete session", session, ":", err)
-			}
-		}
-		userconf, _ := GlobalUserConfigStore.Find(user.ID)
-		if userconf != nil {
-			err := GlobalUserConfigStore.Delete(userconf)
-			if err != nil {
-				log.Println("Unable to delete user", user, ":", err)
-			}
+		if err := checkIfMatch(r, user.Version); err != nil {
+			writeAPIErrorFor(w, r, err)
+			return
 		}
-		err := GlobalUserStore.Delete(user)
+		err = TerminateUser(ctx, user, gracePeriod)
 		if err != nil {
 			log.Println("Unable to delete user", user, ":", err)
+			writeAPIErrorFor(w, r, err)
+			return
 		}
+		PublishWebhookEvent(ctx, userTerminationEvent(gracePeriod), webhookUser(*user))
 	} else {
 		log.Println("Access forbidden:", RequestUser(r).ID, "!=", user.ID, "|| admin !=", user.Username)
-		w.WriteHeader(http.StatusForbidden)
+		writeAPIError(w, r, http.StatusForbidden, codeForbidden, "")
+		return
+	}
+	if gracePeriod > 0 {
+		w.Header().Set("ETag", etag(user.Version))
+		writeResponse(w, r, http.StatusAccepted, userResponse(*user))
+		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-/****************************************
-***  Storage Backends                 ***
-*****************************************/
+// HandleUserRestorev1 cancels the pending deletion of a terminating user
+// (POST /api/v1/users/:id/restore)
+func HandleUserRestorev1(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
 
-// UserStore is an abstraction interface to allow multiple data sources to save user info to
-type UserStore interface {
-	Find(string) (*User, error)
-	All() ([]User, error)
-	FindByEmail(string) (*User, error)
-	FindByUsername(string) (*User, error)
-	Save(*User) error
-	Delete(*User) error
+	user, err := GlobalUserStore.Find(ctx, params.ByName("id"))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	if err := RestoreUser(ctx, user); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	PublishWebhookEvent(ctx, WebhookUserUpdated, webhookUser(*user))
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, r, http.StatusOK, userResponse(*user))
 }
 
-// GlobalUserStore is the Global Database of users
-var GlobalUserStore UserStore
-
-/**********************************
-***  File User Store            ***
-***********************************/
+// userRequest is the JSON body of the user API requests. The id and sessions of a user returned by the API
+// are accepted, so a user can be sent back after modification, but they can't be changed.
+type userRequest struct {
+	ID              string    `json:"id,omitempty"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email"`
+	Password        string    `json:"password,omitempty"`
+	CurrentPassword string    `json:"currentPassword,omitempty"`
+	Sessions        []Session `json:"sessions,omitempty"`
+	// the deletion timestamp is changed with DELETE and restore requests
+	DeletionTimestamp *time.Time `json:"deletionTimestamp,omitempty"`
+	// Version is optional, if it's given it has to match the version of the user
+	Version int64 `json:"version,omitempty"`
+}
 
-// FileUserStore is an implementation of UserStore to save user data to the filesystem
-type FileUserStore struct {
-	filename string
-	Users    map[string]User
+// userResponse returns the user without the password hash
+func userResponse(user User) User {
+	user.HashedPassword = ""
+	return user
 }
 
-// NewFileUserStore creates a new FileUserStore under the given filename
-func NewFileUserStore(filename string) (*FileUserStore, error) {
-	store := &FileUserStore{
-		Users:    map[string]User{},
-		filename: filename,
+// HandleUserPOSTv1 creates a new user from the JSON body
+// (POST /api/v1/users)
+func HandleUserPOSTv1(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
+	var req userRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
 	}
-	contents, err := os.ReadFile(filename)
+
+	user, err := NewUser(ctx, req.Username, req.Email, req.Password)
 	if err != nil {
-		// ignore error if it's a file does not exist error
-		if os.IsNotExist(err) {
-			return store, nil
-		}
-		return nil, err
+		writeAPIErrorFor(w, r, err)
+		return
 	}
-	err = yaml.Unmarshal(contents, store)
-	if err != nil {
-		return nil, err
+	if err := GlobalUserStore.Save(ctx, &user); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
 	}
-	return store, nil
-}
+	PublishWebhookEvent(ctx, WebhookUserCreated, webhookUser(user))
 
-// Save adds a new user and saves the GlobalUserStore to the Filesystem
-func (store FileUserStore) Save(user *User) error {
-	store.Users[user.ID] = *user
+	w.Header().Set("Location", "/api/v1/users/"+user.ID)
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, r, http.StatusCreated, userResponse(user))
+}
 
-	contents, err := yaml.Marshal(store)
+// requestedUser returns the user of the id parameter if the current user may access it,
+// otherwise the matching error has been written to the response
+func requestedUser(w http.ResponseWriter, r *http.Request, params httprouter.Params) (*User, bool) {
+	user, err := GlobalUserStore.Find(r.Context(), params.ByName("id"))
 	if err != nil {
-		return err
+		writeAPIErrorFor(w, r, err)
+		return nil, false
 	}
 
-	err = os.WriteFile(store.filename, contents, 0660)
-	if err != nil {
-		return err
+	currentUser := RequestUser(r)
+	if user.ID != currentUser.ID && currentUser.ID != "admin" {
+		log.Println("Access forbidden:", currentUser.ID, "!=", user.ID)
+		writeAPIError(w, r, http.StatusForbidden, codeForbidden, "")
+		return nil, false
 	}
-
-	return nil
+	return user, true
 }
 
-// All returns  a list of all users, except the HashedPassword field
-func (store FileUserStore) All() ([]User, error) {
-	var userlist []User
-	for _, v := range store.Users {
-		v.HashedPassword = ""
-		userlist = append(userlist, v)
+// HandleUserGETv1 returns a single user
+// (GET /api/v1/users/:id)
+func HandleUserGETv1(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, ok := requestedUser(w, r, params)
+	if !ok {
+		return
 	}
-	return userlist, nil
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, r, http.StatusOK, userResponse(*user))
 }
 
-// Find returns the user with the given id if found
-func (store FileUserStore) Find(id string) (*User, error) {
-	user, ok := store.Users[id]
-	if ok {
-		return &user, nil
+// HandleUserPUTv1 replaces the username, email and optionally the password of a user with the JSON body.
+// The admin can also create a user with the given id. With an If-Match header the user is only changed
+// if it still has the given entity tag.
+// (PUT /api/v1/users/:id)
+func HandleUserPUTv1(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
+
+	_, err := GlobalUserStore.Find(ctx, params.ByName("id"))
+	if errors.Is(err, ErrNotFound) && IsAdmin(r) {
+		// a missing user matches no entity tag
+		if r.Header.Get("If-Match") != "" {
+			writeAPIErrorFor(w, r, fmt.Errorf("%w: the user doesn't exist", errPreconditionFailed))
+			return
+		}
+
+		var req userRequest
+		if err := decodeJSON(r, &req); err != nil {
+			writeAPIErrorFor(w, r, err)
+			return
+		}
+
+		user, err := NewUser(ctx, req.Username, req.Email, req.Password)
+		if err != nil {
+			writeAPIErrorFor(w, r, err)
+			return
+		}
+		user.ID = params.ByName("id")
+		if err := GlobalUserStore.Save(ctx, &user); err != nil {
+			writeAPIErrorFor(w, r, err)
+			return
+		}
+		PublishWebhookEvent(ctx, WebhookUserCreated, webhookUser(user))
+
+		w.Header().Set("Location", "/api/v1/users/"+user.ID)
+		w.Header().Set("ETag", etag(user.Version))
+		writeResponse(w, r, http.StatusCreated, userResponse(user))
+		return
 	}
-	return nil, nil
-}
 
-// FindByUsername returns the user with the given Username if found
-func (store FileUserStore) FindByUsername(name string) (*User, error) {
-	if name == "" {
-		return nil, nil
+	user, ok := requestedUser(w, r, params)
+	if !ok {
+		return
+	}
+	if err := checkIfMatch(r, user.Version); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
 	}
 
-	for _, user := range store.Users {
-		if strings.ToLower(name) == strings.ToLower(user.Username) {
-			return &user, nil
-		}
+	var req userRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
 	}
-	return nil, nil
+	saveUserRequest(w, r, user, req)
 }
 
-// FindByEmail returns the user with the given email address if found
-func (store FileUserStore) FindByEmail(email string) (*User, error) {
-	if email == "" {
-		return nil, nil
+// HandleUserPATCHv1 modifies the fields of a user given in the JSON merge patch (RFC 7386) of the body.
+// With an If-Match header the user is only changed if it still has the given entity tag.
+// (PATCH /api/v1/users/:id)
+func HandleUserPATCHv1(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, ok := requestedUser(w, r, params)
+	if !ok {
+		return
 	}
-
+	if err := checkIfMatch(r, user.Version); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	var patch interface{}
+	if err := decodeJSON(r, &patch, "application/merge-patch+json"); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	// apply the patch to the modifiable fields of the user and decode the result like a PUT request
+	patched, err := json.Marshal(mergePatch(map[string]interface{}{
+		"username": user.Username,
+		"email":    user.Email,
+	}, patch))
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	var req userRequest
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeAPIErrorFor(w, r, fmt.Errorf("%w: %s", errInvalidJSON, err))
+		return
+	}
+	saveUserRequest(w, r, user, req)
+}
+
+// saveUserRequest validates the changes of a PUT or PATCH request with UpdateUser and saves the user.
+// The password is only changed if a new one is given, users have to confirm it with their current password.
+// A version in the request has to match the version of the user.
+func saveUserRequest(w http.ResponseWriter, r *http.Request, user *User, req userRequest) {
+	ctx := r.Context()
+
+	if req.Version != 0 && req.Version != user.Version {
+		writeAPIErrorFor(w, r, fmt.Errorf("%w: user %s has version %d", ErrVersionConflict, user.ID, user.Version))
+		return
+	}
+
+	if req.ID != "" && req.ID != user.ID {
+		writeAPIError(w, r, http.StatusUnprocessableEntity, codeValidationFailed, "",
+			FieldError{Field: "id", Code: "immutable", Message: "the id of a user can't be changed"})
+		return
+	}
+
+	if err := checkCurrentPassword(r, user, req.CurrentPassword, req.Password); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	// without a new password UpdateUser only changes the admin's password if it's called as a user
+	admin := IsAdmin(r) && req.Password != ""
+	updated, err := UpdateUser(ctx, user, req.Username, req.Email, req.CurrentPassword, req.Password, admin)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	if err := GlobalUserStore.Save(ctx, &updated); err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	PublishWebhookEvent(ctx, WebhookUserUpdated, webhookUser(updated))
+	w.Header().Set("ETag", etag(updated.Version))
+	writeResponse(w, r, http.StatusOK, userResponse(updated))
+}
+
+// HandleUsersDELETEv1 deletes the users given by id parameters or matching the search parameter q
+// together with their sessions and user configs in a single transaction. One of them must be given,
+// so all users can't be deleted by accident. The admin account is never deleted.
+// With a grace period the users are marked as terminating instead.
+// The deleted users are returned.
+// (DELETE /api/v1/users?id=&id=&q=&gracePeriodSeconds=)
+func HandleUsersDELETEv1(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
+	gracePeriod, err := gracePeriod(r, KindUser)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	ids := r.URL.Query()["id"]
+	if len(ids) == 0 && r.URL.Query().Get("q") == "" {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, "the users to delete must be selected with the id or q parameter")
+		return
+	}
+	query, err := ParseUserQuery(r.URL.Query(), 0)
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+
+	var users []User
+	if len(ids) > 0 {
+		for _, id := range ids {
+			user, err := GlobalUserStore.Find(ctx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				writeAPIErrorFor(w, r, err)
+				return
+			}
+			if query.Matches(user) {
+				users = append(users, *user)
+			}
+		}
+	} else {
+		list, err := GlobalUserStore.List(ctx, query)
+		if err != nil {
+			writeAPIErrorFor(w, r, err)
+			return
+		}
+		users = list.Users
+	}
+
+	deleted := []User{}
+	err = WithTx(ctx, func(tx Tx) error {
+		for i := range users {
+			if users[i].ID == "admin" {
+				continue
+			}
+			// listed users come without their password hash, which is kept while terminating
+			user, err := tx.Users().Find(ctx, users[i].ID)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := terminateUser(ctx, tx, user, gracePeriod); err != nil {
+				return err
+			}
+			deleted = append(deleted, userResponse(*user))
+		}
+		return nil
+	})
+	if err != nil {
+		writeAPIErrorFor(w, r, err)
+		return
+	}
+	for _, user := range deleted {
+		PublishWebhookEvent(ctx, userTerminationEvent(gracePeriod), webhookUser(user))
+	}
+	writeResponse(w, r, http.StatusOK, deleted)
+}
+
+/****************************************
+***  API v2 Kind                      ***
+*****************************************/
+
+// UserSpec is the spec of a User object of the v2 API. The passwords are only read from requests,
+// users have to confirm a new password with their current password.
+type UserSpec struct {
+	Username        string `json:"username" yaml:"username"`
+	Email           string `json:"email" yaml:"email"`
+	Password        string `json:"password,omitempty" yaml:"password,omitempty"`
+	CurrentPassword string `json:"currentPassword,omitempty" yaml:"currentPassword,omitempty"`
+}
+
+// UserStatus is the status of a User object of the v2 API
+type UserStatus struct {
+	Sessions int `json:"sessions" yaml:"sessions"`
+}
+
+// UserObject returns the User object of a user for the v2 API
+func UserObject(user User) Object {
+	object := NewObject(KindUser, user.ID, user.Version, UserSpec{Username: user.Username, Email: user.Email})
+	object.Metadata.DeletionTimestamp = user.DeletionTimestamp
+	object.Status = UserStatus{Sessions: len(user.Sessions)}
+	return object
+}
+
+// authorizedUser returns the user with the given id if the current user may access it
+func authorizedUser(r *http.Request, id string) (*User, error) {
+	user, err := GlobalUserStore.Find(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if currentUser := RequestUser(r); currentUser == nil || user.ID != currentUser.ID && currentUser.ID != "admin" {
+		return nil, fmt.Errorf("%w: access to user %s", errForbidden, id)
+	}
+	return user, nil
+}
+
+// UserAPIKind serves the users as User objects below /api/v2/users. Only the admin can list and create users,
+// users can read, change and delete their own account. The admin account can't be deleted.
+// The list accepts the q and sort parameters of the v1 API.
+func UserAPIKind() APIKind {
+	return APIKind{
+		Kind:    KindUser,
+		Plural:  "users",
+		NewSpec: func() interface{} { return &UserSpec{} },
+		Convert: func(value interface{}) (Object, bool) {
+			user, ok := value.(User)
+			return UserObject(user), ok
+		},
+		List: func(r *http.Request, options ListOptions) ([]Object, int, error) {
+			if !IsAdmin(r) {
+				return nil, 0, fmt.Errorf("%w: only the admin can list the users", errForbidden)
+			}
+			query, err := ParseUserQuery(options.Values, 0)
+			if err != nil {
+				return nil, 0, err
+			}
+			query.Limit, query.Offset = options.Limit, options.Offset
+
+			list, err := GlobalUserStore.List(r.Context(), query)
+			if err != nil {
+				return nil, 0, err
+			}
+			objects := make([]Object, 0, len(list.Users))
+			for _, user := range list.Users {
+				objects = append(objects, UserObject(user))
+			}
+			return objects, list.Total, nil
+		},
+		Get: func(r *http.Request, name string) (*Object, error) {
+			user, err := authorizedUser(r, name)
+			if err != nil {
+				return nil, err
+			}
+			object := UserObject(*user)
+			return &object, nil
+		},
+		Create: func(r *http.Request, object Object) (*Object, error) {
+			ctx := r.Context()
+			if !IsAdmin(r) {
+				return nil, fmt.Errorf("%w: only the admin can create users", errForbidden)
+			}
+			spec := object.Spec.(*UserSpec)
+
+			user, err := NewUser(ctx, spec.Username, spec.Email, spec.Password)
+			if err != nil {
+				return nil, err
+			}
+			if object.Metadata.Name != "" {
+				if _, err := GlobalUserStore.Find(ctx, object.Metadata.Name); err == nil {
+					return nil, errUserIDExists[GetLanguage(ctx, "", r, nil)]
+				}
+				user.ID = object.Metadata.Name
+			}
+			if err := GlobalUserStore.Save(ctx, &user); err != nil {
+				return nil, err
+			}
+			PublishWebhookEvent(ctx, WebhookUserCreated, webhookUser(user))
+
+			created := UserObject(user)
+			return &created, nil
+		},
+		Update: func(r *http.Request, object Object) (*Object, error) {
+			ctx := r.Context()
+			user, err := authorizedUser(r, object.Metadata.Name)
+			if err != nil {
+				return nil, err
+			}
+			if err := object.CheckVersion(user.Version); err != nil {
+				return nil, err
+			}
+			spec := object.Spec.(*UserSpec)
+			if err := checkCurrentPassword(r, user, spec.CurrentPassword, spec.Password); err != nil {
+				return nil, err
+			}
+
+			// without a new password UpdateUser only changes the admin's password if it's called as a user
+			admin := IsAdmin(r) && spec.Password != ""
+			updated, err := UpdateUser(ctx, user, spec.Username, spec.Email, spec.CurrentPassword, spec.Password, admin)
+			if err != nil {
+				return nil, err
+			}
+			if err := GlobalUserStore.Save(ctx, &updated); err != nil {
+				return nil, err
+			}
+			PublishWebhookEvent(ctx, WebhookUserUpdated, webhookUser(updated))
+
+			result := UserObject(updated)
+			return &result, nil
+		},
+		Delete: func(r *http.Request, name string, gracePeriod time.Duration) (*Object, error) {
+			ctx := r.Context()
+			user, err := authorizedUser(r, name)
+			if err != nil {
+				return nil, err
+			}
+			if user.ID == "admin" {
+				return nil, fmt.Errorf("%w: the admin account can't be deleted", errForbidden)
+			}
+			if err := TerminateUser(ctx, user, gracePeriod); err != nil {
+				return nil, err
+			}
+			PublishWebhookEvent(ctx, userTerminationEvent(gracePeriod), webhookUser(*user))
+
+			if gracePeriod == 0 {
+				return nil, nil
+			}
+			terminating := UserObject(*user)
+			return &terminating, nil
+		},
+	}
+}
+
+/****************************************
+***  Storage Backends                 ***
+*****************************************/
+
+// UserStore is an abstraction interface to allow multiple data sources to save user info to.
+// The Find functions return ErrNotFound if no matching user exists, Save returns ErrConflict if the
+// username or email address is already taken by another user. Usernames and email addresses are
+// compared case-insensitively.
+// FindDeletionDue returns the terminating users whose deletion timestamp is before the given time.
+// Like Save, Delete returns ErrVersionConflict if the stored user has another version than the given one.
+type UserStore interface {
+	Find(context.Context, string) (*User, error)
+	All(context.Context) ([]User, error)
+	List(context.Context, UserQuery) (UserList, error)
+	FindByEmail(context.Context, string) (*User, error)
+	FindByUsername(context.Context, string) (*User, error)
+	FindDeletionDue(context.Context, time.Time) ([]User, error)
+	Save(context.Context, *User) error
+	Delete(context.Context, *User) error
+}
+
+// GlobalUserStore is the Global Database of users
+var GlobalUserStore UserStore
+
+/**********************************
+***  Memory User Store          ***
+***********************************/
+
+// MemoryUserStore is a thread-safe implementation of UserStore which keeps all users in memory
+type MemoryUserStore struct {
+	mu       sync.RWMutex
+	sessions SessionStore // used to look up the sessions of listed users, GlobalSessionStore if nil
+	persist  func() error // called after every change while the store is still locked
+	Users    map[string]User
+}
+
+// NewMemoryUserStore creates a new, empty MemoryUserStore
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		Users: map[string]User{},
+	}
+}
+
+// Save adds or updates a user and increases its version
+func (store *MemoryUserStore) Save(_ context.Context, user *User) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, existed := store.Users[user.ID]
+	if existed && previous.Version != user.Version {
+		return fmt.Errorf("%w: user %s", ErrVersionConflict, user.ID)
+	}
+
+	// usernames and email addresses must be unique
+	for _, existing := range store.Users {
+		if existing.ID == user.ID {
+			continue
+		}
+		if strings.EqualFold(existing.Username, user.Username) {
+			return fmt.Errorf("%w: username %s already exists", ErrConflict, user.Username)
+		}
+		if strings.EqualFold(existing.Email, user.Email) {
+			return fmt.Errorf("%w: email %s already exists", ErrConflict, user.Email)
+		}
+	}
+
+	stored := *user
+	stored.Version++
+	store.Users[user.ID] = stored
+
+	if err := store.changed(); err != nil {
+		// keep memory and persisted data consistent
+		if existed {
+			store.Users[user.ID] = previous
+		} else {
+			delete(store.Users, user.ID)
+		}
+		return err
+	}
+	user.Version = stored.Version
+	return nil
+}
+
+// All returns  a list of all users, except the HashedPassword field
+func (store *MemoryUserStore) All(_ context.Context) ([]User, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var userlist []User
+	for _, v := range store.Users {
+		v.HashedPassword = ""
+		userlist = append(userlist, v)
+	}
+	return userlist, nil
+}
+
+// List returns the page of users selected by the query, except the HashedPassword field
+func (store *MemoryUserStore) List(ctx context.Context, query UserQuery) (UserList, error) {
+	users, err := store.All(ctx)
+	if err != nil {
+		return UserList{}, err
+	}
+	list := query.Apply(users)
+
+	var ids []string
+	for _, user := range list.Users {
+		ids = append(ids, user.ID)
+	}
+	sessionstore := store.sessions
+	if sessionstore == nil {
+		sessionstore = GlobalSessionStore
+	}
+	sessions, err := sessionstore.FindByUsers(ctx, ids)
+	if err != nil {
+		return list, err
+	}
+	for i := range list.Users {
+		list.Users[i].Sessions = sessions[list.Users[i].ID]
+	}
+	return list, nil
+}
+
+// Find returns the user with the given id if found
+func (store *MemoryUserStore) Find(_ context.Context, id string) (*User, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	user, ok := store.Users[id]
+	if ok {
+		return &user, nil
+	}
+	return nil, ErrNotFound
+}
+
+// FindByUsername returns the user with the given Username if found
+func (store *MemoryUserStore) FindByUsername(_ context.Context, name string) (*User, error) {
+	if name == "" {
+		return nil, ErrNotFound
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, user := range store.Users {
+		if strings.ToLower(name) == strings.ToLower(user.Username) {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// FindByEmail returns the user with the given email address if found
+func (store *MemoryUserStore) FindByEmail(_ context.Context, email string) (*User, error) {
+	if email == "" {
+		return nil, ErrNotFound
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	for _, user := range store.Users {
 		if strings.ToLower(email) == strings.ToLower(user.Email) {
 			return &user, nil
 		}
-	}
-	return nil, nil
+	}
+	return nil, ErrNotFound
+}
+
+// FindDeletionDue returns the terminating users whose deletion timestamp is before the given time
+func (store *MemoryUserStore) FindDeletionDue(_ context.Context, before time.Time) ([]User, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var users []User
+	for _, user := range store.Users {
+		if user.Terminating() && user.DeletionTimestamp.Before(before) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (store *MemoryUserStore) Delete(_ context.Context, user *User) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, ok := store.Users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if previous.Version != user.Version {
+		return fmt.Errorf("%w: user %s", ErrVersionConflict, user.ID)
+	}
+	delete(store.Users, user.ID)
+
+	if err := store.changed(); err != nil {
+		store.Users[user.ID] = previous
+		return err
+	}
+	return nil
+}
+
+// changed calls the persist hook of the store if there is one
+func (store *MemoryUserStore) changed() error {
+	if store.persist == nil {
+		return nil
+	}
+	return store.persist()
+}
+
+// stage returns an unpersisted copy of the store for a transaction
+func (store *MemoryUserStore) stage(sessions SessionStore) *MemoryUserStore {
+	staged := &MemoryUserStore{
+		Users:    make(map[string]User, len(store.Users)),
+		sessions: sessions,
+	}
+	for id, user := range store.Users {
+		staged.Users[id] = user
+	}
+	return staged
+}
+
+/**********************************
+***  File User Store            ***
+***********************************/
+
+// FileUserStore is an implementation of UserStore to save user data to the filesystem.
+// It keeps all users in memory and rewrites the file after every change.
+type FileUserStore struct {
+	*MemoryUserStore
+	filename string
+}
+
+// NewFileUserStore creates a new FileUserStore under the given filename
+func NewFileUserStore(filename string) (*FileUserStore, error) {
+	store := &FileUserStore{
+		MemoryUserStore: NewMemoryUserStore(),
+		filename:        filename,
+	}
+	store.MemoryUserStore.persist = store.persist
+
+	contents, err := readStoreFile(filename)
+	if err != nil {
+		// ignore error if it's a file does not exist error
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	err = yaml.Unmarshal(contents, store.MemoryUserStore)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// persist writes all users to the store's file
+func (store *FileUserStore) persist() error {
+	contents, err := yaml.Marshal(store.MemoryUserStore)
+	if err != nil {
+		return err
+	}
+	return writeFiles(map[string][]byte{store.filename: contents})
+}
+
+/**********************************
+***  Bolt User Store            ***
+***********************************/
+
+// BoltUserStore is an implementation of UserStore to save user data in an embedded bolt database.
+// Usernames and email addresses are kept in index buckets, so lookups don't scan all users.
+type BoltUserStore struct {
+	boltStore
+}
+
+// NewBoltUserStore creates a BoltUserStore on the given database
+func NewBoltUserStore(db *bolt.DB) UserStore {
+	return &BoltUserStore{boltStore{db: db}}
+}
+
+// Save adds or updates a user and its index entries and increases its version
+func (store *BoltUserStore) Save(_ context.Context, user *User) error {
+	stored := *user
+	err := store.update(func(tx *bolt.Tx) error {
+		usernames := tx.Bucket(boltUsernameIndexBucket)
+		emails := tx.Bucket(boltEmailIndexBucket)
+		username := []byte(strings.ToLower(user.Username))
+		email := []byte(strings.ToLower(user.Email))
+
+		// usernames and email addresses must be unique
+		if id := usernames.Get(username); id != nil && string(id) != user.ID {
+			return fmt.Errorf("%w: username %s already exists", ErrConflict, user.Username)
+		}
+		if id := emails.Get(email); id != nil && string(id) != user.ID {
+			return fmt.Errorf("%w: email %s already exists", ErrConflict, user.Email)
+		}
+
+		// remove index entries of a changed username or email address
+		previous := User{}
+		err := boltGet(tx, boltUsersBucket, []byte(user.ID), &previous)
+		if err == nil {
+			if previous.Version != user.Version {
+				return fmt.Errorf("%w: user %s", ErrVersionConflict, user.ID)
+			}
+			if err := usernames.Delete([]byte(strings.ToLower(previous.Username))); err != nil {
+				return err
+			}
+			if err := emails.Delete([]byte(strings.ToLower(previous.Email))); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if err := usernames.Put(username, []byte(user.ID)); err != nil {
+			return err
+		}
+		if err := emails.Put(email, []byte(user.ID)); err != nil {
+			return err
+		}
+
+		// sessions are kept in their own bucket
+		stored.Sessions = nil
+		stored.Version++
+		return boltPut(tx, boltUsersBucket, []byte(user.ID), &stored)
+	})
+	if err != nil {
+		return err
+	}
+	user.Version = stored.Version
+	return nil
+}
+
+// All returns  a list of all users, except the HashedPassword field
+func (store *BoltUserStore) All(_ context.Context) ([]User, error) {
+	var users []User
+	err := store.view(func(tx *bolt.Tx) error {
+		var ids []string
+		err := tx.Bucket(boltUsersBucket).ForEach(func(_, data []byte) error {
+			user := User{}
+			if err := json.Unmarshal(data, &user); err != nil {
+				return err
+			}
+			user.HashedPassword = ""
+			users = append(users, user)
+			ids = append(ids, user.ID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		sessions, err := boltFindSessionsByUsers(tx, ids)
+		if err != nil {
+			return err
+		}
+		for i := range users {
+			users[i].Sessions = sessions[users[i].ID]
+		}
+		return nil
+	})
+	return users, err
 }
 
-func (store FileUserStore) Delete(user *User) error {
-	delete(store.Users, user.ID)
-	contents, err := yaml.Marshal(store)
+// List returns the page of users selected by the query, except the HashedPassword field
+func (store *BoltUserStore) List(ctx context.Context, query UserQuery) (UserList, error) {
+	users, err := store.All(ctx)
 	if err != nil {
+		return UserList{}, err
+	}
+	return query.Apply(users), nil
+}
+
+// Find returns the user with the given id if found
+func (store *BoltUserStore) Find(_ context.Context, id string) (*User, error) {
+	var user *User
+	err := store.view(func(tx *bolt.Tx) (err error) {
+		user, err = boltFindUser(tx, []byte(id))
+		return err
+	})
+	return user, err
+}
+
+// FindByUsername returns the user with the given Username if found
+func (store *BoltUserStore) FindByUsername(_ context.Context, name string) (*User, error) {
+	return store.findByIndex(boltUsernameIndexBucket, name)
+}
+
+// FindByEmail returns the user with the given email address if found
+func (store *BoltUserStore) FindByEmail(_ context.Context, email string) (*User, error) {
+	return store.findByIndex(boltEmailIndexBucket, email)
+}
+
+// findByIndex looks up the user id in an index bucket and returns the user
+func (store *BoltUserStore) findByIndex(bucket []byte, value string) (*User, error) {
+	if value == "" {
+		return nil, ErrNotFound
+	}
+
+	var user *User
+	err := store.view(func(tx *bolt.Tx) (err error) {
+		id := tx.Bucket(bucket).Get([]byte(strings.ToLower(value)))
+		if id == nil {
+			return ErrNotFound
+		}
+		user, err = boltFindUser(tx, id)
 		return err
+	})
+	return user, err
+}
+
+// FindDeletionDue returns the terminating users whose deletion timestamp is before the given time
+func (store *BoltUserStore) FindDeletionDue(_ context.Context, before time.Time) ([]User, error) {
+	var users []User
+	err := store.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(_, data []byte) error {
+			user := User{}
+			if err := json.Unmarshal(data, &user); err != nil {
+				return err
+			}
+			if user.Terminating() && user.DeletionTimestamp.Before(before) {
+				users = append(users, user)
+			}
+			return nil
+		})
+	})
+	return users, err
+}
+
+// Delete removes the user and its index entries, if it still has the version of the given user
+func (store *BoltUserStore) Delete(_ context.Context, user *User) error {
+	return store.update(func(tx *bolt.Tx) error {
+		stored := User{}
+		if err := boltGet(tx, boltUsersBucket, []byte(user.ID), &stored); err != nil {
+			return err
+		}
+		if stored.Version != user.Version {
+			return fmt.Errorf("%w: user %s", ErrVersionConflict, user.ID)
+		}
+		if err := tx.Bucket(boltUsernameIndexBucket).Delete([]byte(strings.ToLower(stored.Username))); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltEmailIndexBucket).Delete([]byte(strings.ToLower(stored.Email))); err != nil {
+			return err
+		}
+		return tx.Bucket(boltUsersBucket).Delete([]byte(user.ID))
+	})
+}
+
+// boltFindUser returns the user with the given id together with its sessions
+func boltFindUser(tx *bolt.Tx, id []byte) (*User, error) {
+	user := User{}
+	if err := boltGet(tx, boltUsersBucket, id, &user); err != nil {
+		return nil, err
 	}
 
-	return os.WriteFile(store.filename, contents, 0660)
+	sessions, err := boltFindSessionsByUsers(tx, []string{user.ID})
+	if err != nil {
+		return nil, err
+	}
+	user.Sessions = sessions[user.ID]
+	return &user, nil
 }
 
 /**********************************
@@ -592,7 +1650,7 @@ func (store FileUserStore) Delete(user *User) error {
 
 // DBUserStore is an implementation of UserStore to save user data in the database
 type DBUserStore struct {
-	db *sql.DB
+	db dbExecutor
 }
 
 func NewDBUserStore() UserStore {
@@ -602,6 +1660,8 @@ CREATE TABLE IF NOT EXISTS users (
   username varchar(255) NOT NULL DEFAULT '',
   email varchar(255) NOT NULL DEFAULT '',
   password text NOT NULL,
+  deletion_timestamp timestamptz,
+  version bigint NOT NULL DEFAULT 0,
   PRIMARY KEY (id)
 );
 `)
@@ -609,14 +1669,33 @@ CREATE TABLE IF NOT EXISTS users (
 		Logf(FatalLevel, "Unable to create users table in database: %s\n", err)
 	}
 
+	// added to existing tables for the graceful deletion of users
+	_, err = GlobalPostgresDB.Exec(`
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_timestamp timestamptz;`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to add deletion timestamp to users table in database: %s\n", err)
+	}
+
+	// added to existing tables for optimistic concurrency
+	_, err = GlobalPostgresDB.Exec(`
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0;`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to add version to users table in database: %s\n", err)
+	}
+
+	// usernames and email addresses are unique regardless of their case, like in the other stores.
+	// The unique indexes replace the former plain ones, their creation fails if the table already
+	// contains duplicates, which have to be resolved by hand.
 	_, err = GlobalPostgresDB.Exec(`
-CREATE INDEX IF NOT EXISTS username_idx ON users( username );`)
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users( lower(username) );
+DROP INDEX IF EXISTS username_idx;`)
 	if err != nil {
 		Logf(FatalLevel, "Unable to create users table username index in database: %s\n", err)
 	}
 
 	_, err = GlobalPostgresDB.Exec(`
-CREATE INDEX IF NOT EXISTS email_idx ON users( email );`)
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users( lower(email) );
+DROP INDEX IF EXISTS email_idx;`)
 	if err != nil {
 		Logf(FatalLevel, "Unable to create users table email index in database: %s\n", err)
 	}
@@ -626,133 +1705,563 @@ CREATE INDEX IF NOT EXISTS email_idx ON users( email );`)
 	}
 }
 
-func (store DBUserStore) Save(user *User) error {
-	_, err := store.db.Exec(
+// Save adds or updates a user and increases its version. Existing users are only updated if they still
+// have the version of the given user.
+func (store DBUserStore) Save(ctx context.Context, user *User) error {
+	result, err := store.db.ExecContext(
+		ctx,
 		`
 	INSERT INTO users
-	    (id, username, email, password)
-	    VALUES ($1, $2, $3, $4)
+	    (id, username, email, password, deletion_timestamp, version)
+	    VALUES ($1, $2, $3, $4, $5, $6)
 	    	    ON CONFLICT (id)
-	    DO UPDATE SET id=$1, username=$2, email=$3, password=$4`,
+	    DO UPDATE SET id=$1, username=$2, email=$3, password=$4, deletion_timestamp=$5, version=$6
+	    WHERE users.version = $7`,
 		user.ID,
 		user.Username,
 		user.Email,
 		user.HashedPassword,
+		nullTime(user.DeletionTimestamp),
+		user.Version+1,
+		user.Version,
 	)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+	// the update is skipped for another version
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return fmt.Errorf("%w: user %s", ErrVersionConflict, user.ID)
+	}
+	user.Version++
+	return nil
 }
 
 // All returns  a list of all users, except the HashedPassword field
-func (store DBUserStore) All() ([]User, error) {
-	rows, err := store.db.Query(
+func (store DBUserStore) All(ctx context.Context) ([]User, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
 		`
-		SELECT id, username, email
+		SELECT id, username, email, deletion_timestamp, version
 		FROM users
 		`,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	return store.scanList(ctx, rows)
+}
+
+// List returns the page of users selected by the query, except the HashedPassword field
+func (store DBUserStore) List(ctx context.Context, query UserQuery) (UserList, error) {
+	list := UserList{}
+
+	search := "%" + likeEscaper.Replace(query.Search) + "%"
+	err := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT COUNT(*)
+		FROM users
+		WHERE username ILIKE $1 OR email ILIKE $1`,
+		search,
+	).Scan(&list.Total)
+	if err != nil {
+		return list, err
+	}
+
+	// the sort column is taken from a fixed list, so it can safely be formatted into the statement
+	column, ok := userSortFields[query.Sort]
+	if !ok {
+		column = "id"
+	}
+	direction := "ASC"
+	if query.Desc {
+		direction = "DESC"
+	}
+	limit := sql.NullInt64{Int64: int64(query.Limit), Valid: query.Limit > 0}
+
+	rows, err := store.db.QueryContext(
+		ctx,
+		fmt.Sprintf(`
+		SELECT id, username, email, deletion_timestamp, version
+		FROM users
+		WHERE username ILIKE $1 OR email ILIKE $1
+		ORDER BY %[1]s %[2]s, id %[2]s
+		LIMIT $2 OFFSET $3`, column, direction),
+		search,
+		limit,
+		query.Offset,
+	)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	list.Users, err = store.scanList(ctx, rows)
+	if err != nil {
+		return list, err
+	}
+	list.Continue = query.continueCursor(list.Total)
+	return list, nil
+}
 
+// scanList reads the users from a query result and loads their sessions with a single query
+func (store DBUserStore) scanList(ctx context.Context, rows *sql.Rows) ([]User, error) {
 	var users []User
+	var ids []string
 	for rows.Next() {
 		user := User{}
+		var deletion sql.NullTime
 		err := rows.Scan(
 			&user.ID,
 			&user.Username,
 			&user.Email,
+			&deletion,
+			&user.Version,
 		)
 		if err != nil {
 			return nil, err
 		}
-
-		user.Sessions, _ = GlobalSessionStore.FindByUser(user.ID)
+		user.DeletionTimestamp = timePtr(deletion)
 
 		users = append(users, user)
+		ids = append(ids, user.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
+	sessions, err := DBSessionStore{db: store.db}.FindByUsers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Sessions = sessions[users[i].ID]
+	}
 	return users, nil
 }
 
-func (store DBUserStore) Find(id string) (*User, error) {
-	row := store.db.QueryRow(
+func (store DBUserStore) Find(ctx context.Context, id string) (*User, error) {
+	row := store.db.QueryRowContext(
+		ctx,
 		`
-		SELECT id, username, email, password
+		SELECT id, username, email, password, deletion_timestamp, version
 		FROM users
 		WHERE id = $1`,
 		id,
 	)
+	return store.scan(ctx, row)
+}
+
+func (store DBUserStore) FindByUsername(ctx context.Context, name string) (*User, error) {
+	row := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT id, username, email, password, deletion_timestamp, version
+		FROM users
+		WHERE lower(username) = lower($1)`,
+		name,
+	)
+	return store.scan(ctx, row)
+}
+
+func (store DBUserStore) FindByEmail(ctx context.Context, email string) (*User, error) {
+	row := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT id, username, email, password, deletion_timestamp, version
+		FROM users
+		WHERE lower(email) = lower($1)`,
+		email,
+	)
+	return store.scan(ctx, row)
+}
 
+// scan reads a single user from the given row and adds the user's sessions
+func (store DBUserStore) scan(ctx context.Context, row *sql.Row) (*User, error) {
 	user := User{}
+	var deletion sql.NullTime
 	err := row.Scan(
 		&user.ID,
 		&user.Username,
 		&user.Email,
 		&user.HashedPassword,
+		&deletion,
+		&user.Version,
 	)
-	// return nil and no error when the Scan returns no findings
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if err != nil {
+		return nil, dbError(err)
+	}
+	user.DeletionTimestamp = timePtr(deletion)
+
+	user.Sessions, err = DBSessionStore{db: store.db}.FindByUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
 	}
-	user.Sessions, _ = GlobalSessionStore.FindByUser(user.ID)
-	return &user, err
+	return &user, nil
 }
 
-func (store DBUserStore) FindByUsername(name string) (*User, error) {
-	row := store.db.QueryRow(
+// FindDeletionDue returns the terminating users whose deletion timestamp is before the given time
+func (store DBUserStore) FindDeletionDue(ctx context.Context, before time.Time) ([]User, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
 		`
-		SELECT id, username, email, password
+		SELECT id, username, email, deletion_timestamp, version
 		FROM users
-		WHERE username = $1`,
-		name,
+		WHERE deletion_timestamp < $1`,
+		before,
 	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	user := User{}
-	err := row.Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.HashedPassword,
+	return store.scanList(ctx, rows)
+}
+
+// Delete removes the user, if it still has the version of the given user
+func (store DBUserStore) Delete(ctx context.Context, user *User) error {
+	err := dbAffected(store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM users
+		WHERE id = $1 AND version = $2`,
+		user.ID,
+		user.Version,
+	))
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	// the delete is skipped for another version
+	var version int64
+	err = store.db.QueryRowContext(ctx, `SELECT version FROM users WHERE id = $1`, user.ID).Scan(&version)
+	if err != nil {
+		return dbError(err)
+	}
+	return fmt.Errorf("%w: user %s", ErrVersionConflict, user.ID)
+}
+
+/**********************************
+***  MySQL User Store           ***
+***********************************/
+
+// MySQLUserStore is an implementation of UserStore to save user data in a MySQL or MariaDB database
+type MySQLUserStore struct {
+	db dbExecutor
+}
+
+// mysqlUserNameColumn is the definition of the username and email columns. Their collation makes the
+// comparisons and unique keys case-insensitive like in the other stores; it ignores accents as well.
+const mysqlUserNameColumn = "varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT ''"
+
+func NewMySQLUserStore() UserStore {
+	_, err := GlobalMySQLDB.Exec(`
+CREATE TABLE IF NOT EXISTS users (
+  id varchar(255) NOT NULL DEFAULT '',
+  username ` + mysqlUserNameColumn + `,
+  email ` + mysqlUserNameColumn + `,
+  password text NOT NULL,
+  deletion_timestamp datetime(6) NULL,
+  version bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (id),
+  UNIQUE KEY username_idx (username),
+  UNIQUE KEY email_idx (email)
+) DEFAULT CHARSET=utf8mb4;
+`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create users table in database: %s\n", err)
+	}
+
+	// the indexes of existing tables were neither unique nor case-insensitive
+	for _, column := range []string{"username", "email"} {
+		if err := mysqlUniqueIndex(GlobalMySQLDB, "users", column+"_idx", column, mysqlUserNameColumn); err != nil {
+			Logf(FatalLevel, "Unable to create users table %s index in database: %s\n", column, err)
+		}
+	}
+
+	// added to existing tables for the graceful deletion of users
+	err = mysqlAddColumn(GlobalMySQLDB, "users", "deletion_timestamp", "datetime(6) NULL")
+	if err != nil {
+		Logf(FatalLevel, "Unable to add deletion timestamp to users table in database: %s\n", err)
+	}
+
+	// added to existing tables for optimistic concurrency
+	err = mysqlAddColumn(GlobalMySQLDB, "users", "version", "bigint NOT NULL DEFAULT 0")
+	if err != nil {
+		Logf(FatalLevel, "Unable to add version to users table in database: %s\n", err)
+	}
+
+	return &MySQLUserStore{
+		db: GlobalMySQLDB,
+	}
+}
+
+// Save adds or updates a user and increases its version. Existing users are only updated if they still
+// have the version of the given user.
+func (store MySQLUserStore) Save(ctx context.Context, user *User) error {
+	// the update of an upsert can't be conditional in MySQL, so existing users are updated first
+	result, err := store.db.ExecContext(
+		ctx,
+		`
+	UPDATE users
+	    SET username=?, email=?, password=?, deletion_timestamp=?, version=?
+	    WHERE id=? AND version=?`,
+		user.Username,
+		user.Email,
+		user.HashedPassword,
+		nullTime(user.DeletionTimestamp),
+		user.Version+1,
+		user.ID,
+		user.Version,
+	)
+	if err != nil {
+		return mysqlError(err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		// the user doesn't exist yet or has another version
+		if err := mysqlVersionConflict(ctx, store.db, "users", "id", user.ID); err != nil {
+			return err
+		}
+		_, err = store.db.ExecContext(
+			ctx,
+			`
+	INSERT INTO users
+	    (id, username, email, password, deletion_timestamp, version)
+	    VALUES (?, ?, ?, ?, ?, ?)`,
+			user.ID,
+			user.Username,
+			user.Email,
+			user.HashedPassword,
+			nullTime(user.DeletionTimestamp),
+			user.Version+1,
+		)
+		if err != nil {
+			return mysqlError(err)
+		}
+	}
+	user.Version++
+	return nil
+}
+
+// All returns  a list of all users, except the HashedPassword field
+func (store MySQLUserStore) All(ctx context.Context) ([]User, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, username, email, deletion_timestamp, version
+		FROM users
+		`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return store.scanList(ctx, rows)
+}
+
+// List returns the page of users selected by the query, except the HashedPassword field.
+// LIKE is case insensitive with the default collations of MySQL and MariaDB.
+func (store MySQLUserStore) List(ctx context.Context, query UserQuery) (UserList, error) {
+	list := UserList{}
+
+	search := "%" + likeEscaper.Replace(query.Search) + "%"
+	err := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT COUNT(*)
+		FROM users
+		WHERE username LIKE ? OR email LIKE ?`,
+		search,
+		search,
+	).Scan(&list.Total)
+	if err != nil {
+		return list, err
+	}
+
+	// the sort column is taken from a fixed list, so it can safely be formatted into the statement
+	column, ok := userSortFields[query.Sort]
+	if !ok {
+		column = "id"
+	}
+	direction := "ASC"
+	if query.Desc {
+		direction = "DESC"
+	}
+	// MySQL doesn't support OFFSET without LIMIT
+	limit := uint64(math.MaxUint64)
+	if query.Limit > 0 {
+		limit = uint64(query.Limit)
+	}
+
+	rows, err := store.db.QueryContext(
+		ctx,
+		fmt.Sprintf(`
+		SELECT id, username, email, deletion_timestamp, version
+		FROM users
+		WHERE username LIKE ? OR email LIKE ?
+		ORDER BY %[1]s %[2]s, id %[2]s
+		LIMIT ? OFFSET ?`, column, direction),
+		search,
+		search,
+		limit,
+		query.Offset,
 	)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	list.Users, err = store.scanList(ctx, rows)
+	if err != nil {
+		return list, err
+	}
+	list.Continue = query.continueCursor(list.Total)
+	return list, nil
+}
+
+// scanList reads the users from a query result and loads their sessions with a single query
+func (store MySQLUserStore) scanList(ctx context.Context, rows *sql.Rows) ([]User, error) {
+	var users []User
+	var ids []string
+	for rows.Next() {
+		user := User{}
+		var deletion sql.NullTime
+		err := rows.Scan(
+			&user.ID,
+			&user.Username,
+			&user.Email,
+			&deletion,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		user.DeletionTimestamp = timePtr(deletion)
+
+		users = append(users, user)
+		ids = append(ids, user.ID)
 	}
-	user.Sessions, _ = GlobalSessionStore.FindByUser(user.ID)
-	return &user, err
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sessions, err := MySQLSessionStore{db: store.db}.FindByUsers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Sessions = sessions[users[i].ID]
+	}
+	return users, nil
 }
 
-func (store DBUserStore) FindByEmail(email string) (*User, error) {
-	row := store.db.QueryRow(
+func (store MySQLUserStore) Find(ctx context.Context, id string) (*User, error) {
+	row := store.db.QueryRowContext(
+		ctx,
 		`
-		SELECT id, username, email, password
+		SELECT id, username, email, password, deletion_timestamp, version
 		FROM users
-		WHERE email = $1`,
+		WHERE id = ?`,
+		id,
+	)
+	return store.scan(ctx, row)
+}
+
+func (store MySQLUserStore) FindByUsername(ctx context.Context, name string) (*User, error) {
+	row := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT id, username, email, password, deletion_timestamp, version
+		FROM users
+		WHERE username = ?`,
+		name,
+	)
+	return store.scan(ctx, row)
+}
+
+func (store MySQLUserStore) FindByEmail(ctx context.Context, email string) (*User, error) {
+	row := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT id, username, email, password, deletion_timestamp, version
+		FROM users
+		WHERE email = ?`,
 		email,
 	)
+	return store.scan(ctx, row)
+}
 
+// scan reads a single user from the given row and adds the user's sessions
+func (store MySQLUserStore) scan(ctx context.Context, row *sql.Row) (*User, error) {
 	user := User{}
+	var deletion sql.NullTime
 	err := row.Scan(
 		&user.ID,
 		&user.Username,
 		&user.Email,
 		&user.HashedPassword,
+		&deletion,
+		&user.Version,
+	)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	user.DeletionTimestamp = timePtr(deletion)
+
+	user.Sessions, err = MySQLSessionStore{db: store.db}.FindByUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindDeletionDue returns the terminating users whose deletion timestamp is before the given time
+func (store MySQLUserStore) FindDeletionDue(ctx context.Context, before time.Time) ([]User, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, username, email, deletion_timestamp, version
+		FROM users
+		WHERE deletion_timestamp < ?`,
+		before.UTC(),
 	)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if err != nil {
+		return nil, err
 	}
-	user.Sessions, _ = GlobalSessionStore.FindByUser(user.ID)
-	return &user, err
+	defer rows.Close()
+
+	return store.scanList(ctx, rows)
 }
 
-func (store DBUserStore) Delete(user *User) error {
-	row, err := store.db.Exec(
+// Delete removes the user, if it still has the version of the given user
+func (store MySQLUserStore) Delete(ctx context.Context, user *User) error {
+	err := mysqlAffected(store.db.ExecContext(
+		ctx,
 		`
 		DELETE FROM users
-		WHERE id = $1`,
+		WHERE id = ? AND version = ?`,
 		user.ID,
-	)
+		user.Version,
+	))
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	// the delete is skipped for another version
+	var version int64
+	err = store.db.QueryRowContext(ctx, `SELECT version FROM users WHERE id = ?`, user.ID).Scan(&version)
 	if err != nil {
-		log.Println(row.RowsAffected())
+		return mysqlError(err)
 	}
-	return err
+	return fmt.Errorf("%w: user %s", ErrVersionConflict, user.ID)
 }
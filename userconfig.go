@@ -1,19 +1,26 @@
 package webapp
 
 import (
-	"database/sql"
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
 	"gopkg.in/yaml.v3"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 )
 
 type UserConfig struct {
 	UserID   string `json:"userID" yaml:"userID"`
 	Language string `json:"language" yaml:"language"`
 	DarkMode bool   `json:"darkMode" yaml:"darkMode"`
+	// Version is increased by every save, a config can only be saved with the version it has been read with
+	Version int64 `json:"version" yaml:"version"`
 }
 
 // NewUserConfig creates a new UserConfig
@@ -28,20 +35,20 @@ func NewUserConfig(userid, language string, darkmode bool) (UserConfig, error) {
 }
 
 // FindUserConfig returns the user config with the given userid if found
-func FindUserConfig(userid string) (*UserConfig, error) {
+func FindUserConfig(ctx context.Context, userid string) (*UserConfig, error) {
 	// create dummy user to return username if login fails
 	out := &UserConfig{
 		UserID: userid,
 	}
 
 	// find user or return dummy with error message if it fails
-	existingUserConfig, err := GlobalUserConfigStore.Find(userid)
+	existingUserConfig, err := GlobalUserConfigStore.Find(ctx, userid)
+	if errors.Is(err, ErrNotFound) {
+		return out, nil
+	}
 	if err != nil {
 		return out, err
 	}
-	if existingUserConfig == nil {
-		return out, nil
-	}
 
 	return existingUserConfig, nil
 }
@@ -62,7 +69,7 @@ func UpdateUserConfig(userconfig *UserConfig, language string, darkmode bool) (U
 
 // GetLanguage returns the language from the lang url parameter, the users config for the given userid or from
 // the current request r or "en" if both are not found
-func GetLanguage(userid string, r *http.Request, params httprouter.Params) string {
+func GetLanguage(ctx context.Context, userid string, r *http.Request, params httprouter.Params) string {
 	// if lang is set with the url it takes precedence
 	lang := params.ByName("lang")
 	if lang != "" {
@@ -82,8 +89,8 @@ func GetLanguage(userid string, r *http.Request, params httprouter.Params) strin
 
 	// get user config
 	if uid != "" {
-		set, err := GlobalUserConfigStore.Find(uid)
-		if err != nil {
+		set, err := GlobalUserConfigStore.Find(ctx, uid)
+		if err != nil && !errors.Is(err, ErrNotFound) {
 			log.Println("Can't find userconfig of user", uid, "in global user config store:", err)
 		}
 		if set != nil {
@@ -105,9 +112,15 @@ func GetLanguage(userid string, r *http.Request, params httprouter.Params) strin
 // HandleUserConfigEdit shows the account information page to change email or password
 // (GET /account)
 func HandleUserConfigEdit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	userconfig, err := GlobalUserConfigStore.Find(params.ByName("userid"))
+	userid := params.ByName("userid")
+	if userid == "" {
+		userid = RequestUser(r).ID
+	}
+
+	userconfig, err := GlobalUserConfigStore.Find(r.Context(), userid)
 	if err != nil {
-		*userconfig, _ = NewUserConfig(params.ByName("userid"), "en", false)
+		conf, _ := NewUserConfig(userid, "en", false)
+		userconfig = &conf
 	}
 	RenderTemplate(w, r, "userconfigs/edit", map[string]interface{}{
 		"Pagetitle":  "EditSettings",
@@ -119,16 +132,31 @@ func HandleUserConfigEdit(w http.ResponseWriter, r *http.Request, params httprou
 // from the account information page
 // (POST /account)
 func HandleUserConfigUpdate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	user := RequestUser(r)
+	user, err := requestUser(r)
 	if user == nil {
-		Logln(FatalLevel, "User from session not found")
+		writeInternalError(w, r, "User from session not found:", err)
+		return
+	}
+
+	userid := params.ByName("userid")
+	if userid == "" {
+		userid = user.ID
 	}
 
-	currentUserconfig, err := GlobalUserConfigStore.Find(params.ByName("userid"))
-	if currentUserconfig == nil {
+	currentUserconfig, err := GlobalUserConfigStore.Find(r.Context(), userid)
+	if errors.Is(err, ErrNotFound) {
 		conf, _ := NewUserConfig(user.ID, "en", false)
 		currentUserconfig = &conf
+	} else if err != nil {
+		writeInternalError(w, r, "Error reading user config from Global user config store:", err)
+		return
+	}
+	// the form contains the version the settings were shown with, they have to be edited again if it changed since
+	if version := r.FormValue("version"); version != "" && version != strconv.FormatInt(currentUserconfig.Version, 10) {
+		renderUserConfigModified(w, r, currentUserconfig)
+		return
 	}
+
 	language := r.FormValue("language")
 	var darkmode bool
 
@@ -146,35 +174,176 @@ func HandleUserConfigUpdate(w http.ResponseWriter, r *http.Request, params httpr
 			})
 			return
 		}
-		Logf(FatalLevel, "Error updating user config: %s\n", err)
+		writeInternalError(w, r, "Error updating user config:", err)
+		return
 	}
 
-	err = GlobalUserConfigStore.Save(currentUserconfig)
+	err = GlobalUserConfigStore.Save(r.Context(), currentUserconfig)
+	if errors.Is(err, ErrVersionConflict) {
+		current, err := GlobalUserConfigStore.Find(r.Context(), currentUserconfig.UserID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		renderUserConfigModified(w, r, current)
+		return
+	}
 	if err != nil {
-		Logf(FatalLevel, "Error updating user config in Global user config store: %s\n", err)
+		writeInternalError(w, r, "Error updating user config in Global user config store:", err)
+		return
 	}
+	PublishWebhookEvent(r.Context(), WebhookSettingsUpdated, currentUserconfig)
 
 	http.Redirect(w, r, "/?flash=settings+updated", http.StatusFound)
 }
 
+// renderUserConfigModified shows the settings form again with the current settings, which have been changed
+// by someone else while they were edited
+func renderUserConfigModified(w http.ResponseWriter, r *http.Request, current *UserConfig) {
+	lang := GetLanguage(r.Context(), "", r, nil)
+	RenderTemplate(w, r, "userconfigs/edit", map[string]interface{}{
+		"Pagetitle":  "EditSettings",
+		"UserConfig": current,
+		"Error":      errModifiedConcurrently[lang].Error(),
+	})
+}
+
 func HandleUserConfigGETv1(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	userid := params.ByName("id")
 	if userid == "" {
 		userid = RequestUser(r).ID
 	}
 
-	userconfig, err := GlobalUserConfigStore.Find(userid)
+	userconfig, err := FindUserConfig(r.Context(), userid)
 	if err != nil {
-		*userconfig, _ = NewUserConfig(userid, "en", false)
+		log.Println("Unable to read from GlobalUserConfigStore:", err)
+		writeAPIErrorFor(w, r, err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	writer := json.NewEncoder(w)
-	writer.SetIndent("", "    ")
-	if err := writer.Encode(userconfig); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	w.Header().Set("ETag", etag(userconfig.Version))
+	writeResponse(w, r, http.StatusOK, userconfig)
+}
+
+/****************************************
+***  API v2 Kind                      ***
+*****************************************/
+
+// UserConfigSpec is the spec of a UserConfig object of the v2 API
+type UserConfigSpec struct {
+	Language string `json:"language" yaml:"language"`
+	DarkMode bool   `json:"darkMode" yaml:"darkMode"`
+}
+
+// UserConfigObject returns the UserConfig object of a user config for the v2 API, it's named by the user id
+func UserConfigObject(userconfig UserConfig) Object {
+	return NewObject(KindUserConfig, userconfig.UserID, userconfig.Version,
+		UserConfigSpec{Language: userconfig.Language, DarkMode: userconfig.DarkMode})
+}
+
+// supportedLanguage checks if there are translations for the language
+func supportedLanguage(lang string) bool {
+	if bundle == nil {
+		return lang == "en"
+	}
+	for _, tag := range bundle.LanguageTags() {
+		if base, _ := tag.Base(); base.String() == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizedUserConfig returns the config of the user with the given id if the current user may access it.
+// Users without a stored config get the default settings.
+func authorizedUserConfig(r *http.Request, id string) (*UserConfig, error) {
+	user, err := authorizedUser(r, id)
+	if err != nil {
+		return nil, err
+	}
+	userconfig, err := FindUserConfig(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if userconfig.Language == "" {
+		userconfig.Language = "en"
+	}
+	return userconfig, nil
+}
+
+// UserConfigAPIKind serves the settings of every user as UserConfig objects below /api/v2/settings.
+// The admin lists the settings of all users, other users only their own ones. The settings exist as long
+// as their user, so they can't be created or deleted.
+func UserConfigAPIKind() APIKind {
+	return APIKind{
+		Kind:    KindUserConfig,
+		Plural:  "settings",
+		NewSpec: func() interface{} { return &UserConfigSpec{} },
+		Convert: func(value interface{}) (Object, bool) {
+			userconfig, ok := value.(UserConfig)
+			return UserConfigObject(userconfig), ok
+		},
+		List: func(r *http.Request, options ListOptions) ([]Object, int, error) {
+			ctx := r.Context()
+			if !IsAdmin(r) {
+				userconfig, err := authorizedUserConfig(r, RequestUser(r).ID)
+				if err != nil || options.Offset > 0 {
+					return nil, 1, err
+				}
+				return []Object{UserConfigObject(*userconfig)}, 1, nil
+			}
+
+			list, err := GlobalUserStore.List(ctx, UserQuery{Limit: options.Limit, Offset: options.Offset, Sort: "id"})
+			if err != nil {
+				return nil, 0, err
+			}
+			objects := make([]Object, 0, len(list.Users))
+			for _, user := range list.Users {
+				userconfig, err := authorizedUserConfig(r, user.ID)
+				if errors.Is(err, ErrNotFound) {
+					// deleted after it was listed
+					continue
+				}
+				if err != nil {
+					return nil, 0, err
+				}
+				objects = append(objects, UserConfigObject(*userconfig))
+			}
+			return objects, list.Total, nil
+		},
+		Get: func(r *http.Request, name string) (*Object, error) {
+			userconfig, err := authorizedUserConfig(r, name)
+			if err != nil {
+				return nil, err
+			}
+			object := UserConfigObject(*userconfig)
+			return &object, nil
+		},
+		Update: func(r *http.Request, object Object) (*Object, error) {
+			ctx := r.Context()
+			userconfig, err := authorizedUserConfig(r, object.Metadata.Name)
+			if err != nil {
+				return nil, err
+			}
+			if err := object.CheckVersion(userconfig.Version); err != nil {
+				return nil, err
+			}
+			spec := object.Spec.(*UserConfigSpec)
+			if !supportedLanguage(spec.Language) {
+				return nil, errLanguageUnknown[GetLanguage(ctx, "", r, nil)]
+			}
+
+			if _, err := UpdateUserConfig(userconfig, spec.Language, spec.DarkMode); err != nil {
+				return nil, err
+			}
+			if err := GlobalUserConfigStore.Save(ctx, userconfig); err != nil {
+				return nil, err
+			}
+			PublishWebhookEvent(ctx, WebhookSettingsUpdated, userconfig)
+
+			result := UserConfigObject(*userconfig)
+			return &result, nil
+		},
 	}
 }
 
@@ -182,33 +351,154 @@ func HandleUserConfigGETv1(w http.ResponseWriter, r *http.Request, params httpro
 ***  Storage Backends                 ***
 *****************************************/
 
-// UserConfigStore is an abstraction interface to allow multiple data sources to save user info to
+// UserConfigStore is an abstraction interface to allow multiple data sources to save user info to.
+// Find returns ErrNotFound if the user has no stored config, FindByUsers leaves those users out.
 type UserConfigStore interface {
-	Find(string) (*UserConfig, error)
-	Save(*UserConfig) error
-	Delete(config *UserConfig) error
+	Find(context.Context, string) (*UserConfig, error)
+	FindByUsers(context.Context, []string) (map[string]UserConfig, error)
+	Save(context.Context, *UserConfig) error
+	Delete(ctx context.Context, config *UserConfig) error
 }
 
 // GlobalUserConfigStore is the Global Database of users
 var GlobalUserConfigStore UserConfigStore
 
+/**********************************
+***  Memory UserConfig Store    ***
+***********************************/
+
+// MemoryUserConfigStore is a thread-safe implementation of UserConfigStore which keeps all configs in memory
+type MemoryUserConfigStore struct {
+	mu          sync.RWMutex
+	persist     func() error // called after every change while the store is still locked
+	UserConfigs map[string]UserConfig
+}
+
+// NewMemoryUserConfigStore creates a new, empty MemoryUserConfigStore
+func NewMemoryUserConfigStore() *MemoryUserConfigStore {
+	return &MemoryUserConfigStore{
+		UserConfigs: map[string]UserConfig{},
+	}
+}
+
+// Save adds or updates a user config and increases its version
+func (store *MemoryUserConfigStore) Save(_ context.Context, userconfig *UserConfig) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, existed := store.UserConfigs[userconfig.UserID]
+	if existed && previous.Version != userconfig.Version {
+		return fmt.Errorf("%w: user config %s", ErrVersionConflict, userconfig.UserID)
+	}
+	stored := *userconfig
+	stored.Version++
+	store.UserConfigs[userconfig.UserID] = stored
+
+	if err := store.changed(); err != nil {
+		if existed {
+			store.UserConfigs[userconfig.UserID] = previous
+		} else {
+			delete(store.UserConfigs, userconfig.UserID)
+		}
+		return err
+	}
+	userconfig.Version = stored.Version
+	return nil
+}
+
+func (store *MemoryUserConfigStore) All(_ context.Context) ([]UserConfig, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var userlist []UserConfig
+	for _, v := range store.UserConfigs {
+		userlist = append(userlist, v)
+	}
+	return userlist, nil
+}
+
+// Find returns the userconfig with the given userid if found
+func (store *MemoryUserConfigStore) Find(_ context.Context, userid string) (*UserConfig, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	userconfig, ok := store.UserConfigs[userid]
+	if ok {
+		return &userconfig, nil
+	}
+	return nil, ErrNotFound
+}
+
+// FindByUsers returns the stored userconfigs of the given users by user id
+func (store *MemoryUserConfigStore) FindByUsers(_ context.Context, userids []string) (map[string]UserConfig, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	userconfigs := map[string]UserConfig{}
+	for _, userid := range userids {
+		if userconfig, ok := store.UserConfigs[userid]; ok {
+			userconfigs[userid] = userconfig
+		}
+	}
+	return userconfigs, nil
+}
+
+func (store *MemoryUserConfigStore) Delete(_ context.Context, userconf *UserConfig) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, ok := store.UserConfigs[userconf.UserID]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(store.UserConfigs, userconf.UserID)
+
+	if err := store.changed(); err != nil {
+		store.UserConfigs[userconf.UserID] = previous
+		return err
+	}
+	return nil
+}
+
+// changed calls the persist hook of the store if there is one
+func (store *MemoryUserConfigStore) changed() error {
+	if store.persist == nil {
+		return nil
+	}
+	return store.persist()
+}
+
+// stage returns an unpersisted copy of the store for a transaction
+func (store *MemoryUserConfigStore) stage() *MemoryUserConfigStore {
+	staged := &MemoryUserConfigStore{
+		UserConfigs: make(map[string]UserConfig, len(store.UserConfigs)),
+	}
+	for id, userconfig := range store.UserConfigs {
+		staged.UserConfigs[id] = userconfig
+	}
+	return staged
+}
+
 /**********************************
 ***  File UserConfig Store      ***
 ***********************************/
 
-// FileUserConfigStore is an implementation of UserConfigStore to save user data to the filesystem
+// FileUserConfigStore is an implementation of UserConfigStore to save user data to the filesystem.
+// It keeps all configs in memory and rewrites the file after every change.
 type FileUserConfigStore struct {
-	filename    string
-	UserConfigs map[string]UserConfig
+	*MemoryUserConfigStore
+	filename string
 }
 
 // NewFileUserConfigStore creates a new FileUserConfigStore under the given filename
 func NewFileUserConfigStore(filename string) (*FileUserConfigStore, error) {
 	store := &FileUserConfigStore{
-		UserConfigs: map[string]UserConfig{},
-		filename:    filename,
+		MemoryUserConfigStore: NewMemoryUserConfigStore(),
+		filename:              filename,
 	}
-	contents, err := os.ReadFile(filename)
+	store.MemoryUserConfigStore.persist = store.persist
+
+	contents, err := readStoreFile(filename)
 	if err != nil {
 		// ignore error if it's a file does not exist error
 		if os.IsNotExist(err) {
@@ -216,55 +506,98 @@ func NewFileUserConfigStore(filename string) (*FileUserConfigStore, error) {
 		}
 		return nil, err
 	}
-	err = yaml.Unmarshal(contents, store)
+	err = yaml.Unmarshal(contents, store.MemoryUserConfigStore)
 	if err != nil {
 		return nil, err
 	}
 	return store, nil
 }
 
-// Save adds a new user and saves the GlobalUserConfigStore to the Filesystem
-func (store FileUserConfigStore) Save(userconfig *UserConfig) error {
-	store.UserConfigs[userconfig.UserID] = *userconfig
-
-	contents, err := yaml.Marshal(store)
+// persist writes all user configs to the store's file
+func (store *FileUserConfigStore) persist() error {
+	contents, err := yaml.Marshal(store.MemoryUserConfigStore)
 	if err != nil {
 		return err
 	}
+	return writeFiles(map[string][]byte{store.filename: contents})
+}
 
-	err = os.WriteFile(store.filename, contents, 0660)
-	if err != nil {
-		return err
-	}
+/**********************************
+***  Bolt UserConfig Store      ***
+***********************************/
 
-	return nil
+// BoltUserConfigStore is an implementation of UserConfigStore to save user configs in an embedded bolt database
+type BoltUserConfigStore struct {
+	boltStore
 }
 
-func (store FileUserConfigStore) All() ([]UserConfig, error) {
-	var userlist []UserConfig
-	for _, v := range store.UserConfigs {
-		userlist = append(userlist, v)
-	}
-	return userlist, nil
+// NewBoltUserConfigStore creates a BoltUserConfigStore on the given database
+func NewBoltUserConfigStore(db *bolt.DB) UserConfigStore {
+	return &BoltUserConfigStore{boltStore{db: db}}
 }
 
-// Find returns the userconfig with the given userid if found
-func (store FileUserConfigStore) Find(userid string) (*UserConfig, error) {
-	userconfig, ok := store.UserConfigs[userid]
-	if ok {
-		return &userconfig, nil
+// Save adds or updates a user config and increases its version
+func (store *BoltUserConfigStore) Save(_ context.Context, userconfig *UserConfig) error {
+	stored := *userconfig
+	stored.Version++
+	err := store.update(func(tx *bolt.Tx) error {
+		previous := UserConfig{}
+		err := boltGet(tx, boltUserConfigsBucket, []byte(userconfig.UserID), &previous)
+		if err == nil && previous.Version != userconfig.Version {
+			return fmt.Errorf("%w: user config %s", ErrVersionConflict, userconfig.UserID)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return boltPut(tx, boltUserConfigsBucket, []byte(userconfig.UserID), &stored)
+	})
+	if err != nil {
+		return err
 	}
-	return nil, nil
+	userconfig.Version = stored.Version
+	return nil
 }
 
-func (store *FileUserConfigStore) Delete(userconf *UserConfig) error {
-	delete(store.UserConfigs, userconf.UserID)
-	contents, err := yaml.Marshal(store)
+// Find returns the userconfig with the given userid if found
+func (store *BoltUserConfigStore) Find(_ context.Context, userid string) (*UserConfig, error) {
+	userconfig := &UserConfig{}
+	err := store.view(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltUserConfigsBucket, []byte(userid), userconfig)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return userconfig, nil
+}
 
-	return os.WriteFile(store.filename, contents, 0660)
+// FindByUsers returns the stored userconfigs of the given users by user id
+func (store *BoltUserConfigStore) FindByUsers(_ context.Context, userids []string) (map[string]UserConfig, error) {
+	userconfigs := map[string]UserConfig{}
+	err := store.view(func(tx *bolt.Tx) error {
+		for _, userid := range userids {
+			userconfig := UserConfig{}
+			err := boltGet(tx, boltUserConfigsBucket, []byte(userid), &userconfig)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			userconfigs[userid] = userconfig
+		}
+		return nil
+	})
+	return userconfigs, err
+}
+
+func (store *BoltUserConfigStore) Delete(_ context.Context, userconfig *UserConfig) error {
+	return store.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUserConfigsBucket)
+		if bucket.Get([]byte(userconfig.UserID)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(userconfig.UserID))
+	})
 }
 
 /**********************************
@@ -273,7 +606,7 @@ func (store *FileUserConfigStore) Delete(userconf *UserConfig) error {
 
 // DBUserConfigStore is an implementation of UserConfigStore to save user data in the database
 type DBUserConfigStore struct {
-	db *sql.DB
+	db dbExecutor
 }
 
 func NewDBUserConfigStore() UserConfigStore {
@@ -282,6 +615,7 @@ CREATE TABLE IF NOT EXISTS userconfigs (
   userid varchar(255) NOT NULL DEFAULT '',
   language varchar(2) NOT NULL DEFAULT '',
   darkmode boolean NOT NULL DEFAULT FALSE,
+  version bigint NOT NULL DEFAULT 0,
   PRIMARY KEY (userid)
 );
 `)
@@ -289,29 +623,54 @@ CREATE TABLE IF NOT EXISTS userconfigs (
 		Logf(FatalLevel, "Unable to create userconfigs table in database: %s\n", err)
 	}
 
+	// added to existing tables for optimistic concurrency
+	_, err = GlobalPostgresDB.Exec(`
+ALTER TABLE userconfigs ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0;`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to add version to userconfigs table in database: %s\n", err)
+	}
+
 	return &DBUserConfigStore{
 		db: GlobalPostgresDB,
 	}
 }
 
-func (store DBUserConfigStore) Save(userconfig *UserConfig) error {
-	_, err := store.db.Exec(
+// Save adds or updates a user config and increases its version. Existing configs are only updated if they
+// still have the version of the given config.
+func (store DBUserConfigStore) Save(ctx context.Context, userconfig *UserConfig) error {
+	result, err := store.db.ExecContext(
+		ctx,
 		`
 	INSERT INTO userconfigs
-	    (userid, language, darkmode)
-	    VALUES ($1, $2, $3)
-	    ON CONFLICT (userid) DO UPDATE SET language=excluded.language, darkmode=excluded.darkmode`,
+	    (userid, language, darkmode, version)
+	    VALUES ($1, $2, $3, $4)
+	    ON CONFLICT (userid) DO UPDATE SET language=excluded.language, darkmode=excluded.darkmode,
+	        version=excluded.version
+	    WHERE userconfigs.version = $5`,
 		userconfig.UserID,
 		userconfig.Language,
 		userconfig.DarkMode,
+		userconfig.Version+1,
+		userconfig.Version,
 	)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+	// the update is skipped for another version
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return fmt.Errorf("%w: user config %s", ErrVersionConflict, userconfig.UserID)
+	}
+	userconfig.Version++
+	return nil
 }
 
-func (store DBUserConfigStore) Find(userid string) (*UserConfig, error) {
-	row := store.db.QueryRow(
+func (store DBUserConfigStore) Find(ctx context.Context, userid string) (*UserConfig, error) {
+	row := store.db.QueryRowContext(
+		ctx,
 		`
-		SELECT userid, language, darkmode
+		SELECT userid, language, darkmode, version
 		FROM userconfigs
 		WHERE userid = $1`,
 		userid,
@@ -322,23 +681,217 @@ func (store DBUserConfigStore) Find(userid string) (*UserConfig, error) {
 		&userconfig.UserID,
 		&userconfig.Language,
 		&userconfig.DarkMode,
+		&userconfig.Version,
 	)
-	// return nil and no error when the Scan returns no findings
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if err != nil {
+		return nil, dbError(err)
 	}
-	return &userconfig, err
+	return &userconfig, nil
 }
 
-func (store DBUserConfigStore) Delete(userconfig *UserConfig) error {
-	row, err := store.db.Exec(
+// FindByUsers returns the stored userconfigs of the given users by user id
+func (store DBUserConfigStore) FindByUsers(ctx context.Context, userids []string) (map[string]UserConfig, error) {
+	userconfigs := map[string]UserConfig{}
+	if len(userids) == 0 {
+		return userconfigs, nil
+	}
+
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT userid, language, darkmode, version
+		FROM userconfigs
+		WHERE userid = ANY($1)
+		`,
+		pq.Array(userids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		userconfig := UserConfig{}
+		err := rows.Scan(
+			&userconfig.UserID,
+			&userconfig.Language,
+			&userconfig.DarkMode,
+			&userconfig.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		userconfigs[userconfig.UserID] = userconfig
+	}
+
+	return userconfigs, rows.Err()
+}
+
+func (store DBUserConfigStore) Delete(ctx context.Context, userconfig *UserConfig) error {
+	return dbAffected(store.db.ExecContext(
+		ctx,
 		`
 		DELETE FROM userconfigs
 		WHERE userid = $1`,
 		userconfig.UserID,
+	))
+}
+
+/**********************************
+***  MySQL UserConfig Store     ***
+***********************************/
+
+// MySQLUserConfigStore is an implementation of UserConfigStore to save user data in a MySQL or MariaDB database
+type MySQLUserConfigStore struct {
+	db dbExecutor
+}
+
+func NewMySQLUserConfigStore() UserConfigStore {
+	_, err := GlobalMySQLDB.Exec(`
+CREATE TABLE IF NOT EXISTS userconfigs (
+  userid varchar(255) NOT NULL DEFAULT '',
+  language varchar(2) NOT NULL DEFAULT '',
+  darkmode boolean NOT NULL DEFAULT FALSE,
+  version bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (userid)
+) DEFAULT CHARSET=utf8mb4;
+`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create userconfigs table in database: %s\n", err)
+	}
+
+	// added to existing tables for optimistic concurrency
+	err = mysqlAddColumn(GlobalMySQLDB, "userconfigs", "version", "bigint NOT NULL DEFAULT 0")
+	if err != nil {
+		Logf(FatalLevel, "Unable to add version to userconfigs table in database: %s\n", err)
+	}
+
+	return &MySQLUserConfigStore{
+		db: GlobalMySQLDB,
+	}
+}
+
+// Save adds or updates a user config and increases its version. Existing configs are only updated if they
+// still have the version of the given config.
+func (store MySQLUserConfigStore) Save(ctx context.Context, userconfig *UserConfig) error {
+	// the update of an upsert can't be conditional in MySQL, so existing configs are updated first
+	result, err := store.db.ExecContext(
+		ctx,
+		`
+	UPDATE userconfigs
+	    SET language=?, darkmode=?, version=?
+	    WHERE userid=? AND version=?`,
+		userconfig.Language,
+		userconfig.DarkMode,
+		userconfig.Version+1,
+		userconfig.UserID,
+		userconfig.Version,
+	)
+	if err != nil {
+		return mysqlError(err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		// the config doesn't exist yet or has another version
+		if err := mysqlVersionConflict(ctx, store.db, "userconfigs", "userid", userconfig.UserID); err != nil {
+			return err
+		}
+		_, err = store.db.ExecContext(
+			ctx,
+			`
+	INSERT INTO userconfigs
+	    (userid, language, darkmode, version)
+	    VALUES (?, ?, ?, ?)`,
+			userconfig.UserID,
+			userconfig.Language,
+			userconfig.DarkMode,
+			userconfig.Version+1,
+		)
+		if err != nil {
+			return mysqlError(err)
+		}
+	}
+	userconfig.Version++
+	return nil
+}
+
+func (store MySQLUserConfigStore) Find(ctx context.Context, userid string) (*UserConfig, error) {
+	row := store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT userid, language, darkmode, version
+		FROM userconfigs
+		WHERE userid = ?`,
+		userid,
+	)
+
+	userconfig := UserConfig{}
+	err := row.Scan(
+		&userconfig.UserID,
+		&userconfig.Language,
+		&userconfig.DarkMode,
+		&userconfig.Version,
 	)
 	if err != nil {
-		log.Println(row)
+		return nil, mysqlError(err)
+	}
+	return &userconfig, nil
+}
+
+// FindByUsers returns the stored userconfigs of the given users by user id
+func (store MySQLUserConfigStore) FindByUsers(ctx context.Context, userids []string) (map[string]UserConfig, error) {
+	userconfigs := map[string]UserConfig{}
+	if len(userids) == 0 {
+		return userconfigs, nil
+	}
+
+	args := make([]any, len(userids))
+	for i, userid := range userids {
+		args[i] = userid
 	}
-	return err
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT userid, language, darkmode, version
+		FROM userconfigs
+		WHERE userid IN (`+mysqlPlaceholders(len(userids))+`)
+		`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		userconfig := UserConfig{}
+		err := rows.Scan(
+			&userconfig.UserID,
+			&userconfig.Language,
+			&userconfig.DarkMode,
+			&userconfig.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		userconfigs[userconfig.UserID] = userconfig
+	}
+
+	return userconfigs, rows.Err()
+}
+
+func (store MySQLUserConfigStore) Delete(ctx context.Context, userconfig *UserConfig) error {
+	return mysqlAffected(store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM userconfigs
+		WHERE userid = ?`,
+		userconfig.UserID,
+	))
 }
@@ -0,0 +1,172 @@
+package webapp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultUserListLimit = 50
+	maxUserListLimit     = 500
+)
+
+var (
+	errInvalidQuery  = errors.New("invalid query")
+	errInvalidCursor = fmt.Errorf("%w: invalid cursor", errInvalidQuery)
+)
+
+// userSortFields maps the sort fields accepted by UserQuery to their database columns
+var userSortFields = map[string]string{
+	"id":       "id",
+	"username": "username",
+	"email":    "email",
+}
+
+// UserQuery selects a filtered and sorted page of users from a UserStore
+type UserQuery struct {
+	Limit  int    // maximum number of users in the result, 0 returns all users
+	Offset int    // number of matching users to skip
+	Sort   string // field to sort by, one of id, username or email
+	Desc   bool   // sort in descending order
+	Search string // case-insensitive substring of the username or email address
+}
+
+// UserList is a page of users selected by a UserQuery
+type UserList struct {
+	Users    []User
+	Total    int    // number of users matching the query on all pages
+	Continue string // cursor for the next page, empty on the last page
+}
+
+// ParseUserQuery reads a UserQuery from the limit, cursor, sort and q url parameters.
+// A sort field prefixed with "-" sorts in descending order.
+func ParseUserQuery(values url.Values, defaultLimit int) (UserQuery, error) {
+	query := UserQuery{
+		Limit:  defaultLimit,
+		Sort:   "id",
+		Search: strings.TrimSpace(values.Get("q")),
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return query, fmt.Errorf("%w: invalid limit %s", errInvalidQuery, limit)
+		}
+		query.Limit = n
+	}
+	if query.Limit > maxUserListLimit {
+		query.Limit = maxUserListLimit
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		offset, err := DecodeCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+		query.Offset = offset
+	}
+
+	if field := values.Get("sort"); field != "" {
+		query.Desc = strings.HasPrefix(field, "-")
+		query.Sort = strings.TrimPrefix(field, "-")
+		if _, ok := userSortFields[query.Sort]; !ok {
+			return query, fmt.Errorf("%w: invalid sort field %s", errInvalidQuery, query.Sort)
+		}
+	}
+
+	return query, nil
+}
+
+// SortParam returns the sort url parameter of the query
+func (q UserQuery) SortParam() string {
+	if q.Desc {
+		return "-" + q.Sort
+	}
+	return q.Sort
+}
+
+// EncodeCursor returns the opaque cursor pointing at the given offset
+func EncodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+// DecodeCursor returns the offset of a cursor created with EncodeCursor
+func DecodeCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	offset, err := strconv.Atoi(string(b))
+	if err != nil || offset < 0 {
+		return 0, errInvalidCursor
+	}
+	return offset, nil
+}
+
+// continueCursor returns the cursor of the page following the query or an empty string
+// if the query already selected the last page
+func (q UserQuery) continueCursor(total int) string {
+	if q.Limit == 0 || q.Offset+q.Limit >= total {
+		return ""
+	}
+	return EncodeCursor(q.Offset + q.Limit)
+}
+
+// Matches checks if the username or email address of the user contains the search string
+func (q UserQuery) Matches(user *User) bool {
+	if q.Search == "" {
+		return true
+	}
+	search := strings.ToLower(q.Search)
+	return strings.Contains(strings.ToLower(user.Username), search) ||
+		strings.Contains(strings.ToLower(user.Email), search)
+}
+
+// Apply filters, sorts and pages a list of users in memory, for stores without a query language
+func (q UserQuery) Apply(users []User) UserList {
+	var matches []User
+	for _, user := range users {
+		if q.Matches(&user) {
+			matches = append(matches, user)
+		}
+	}
+
+	key := func(u *User) string {
+		switch q.Sort {
+		case "username":
+			return u.Username
+		case "email":
+			return u.Email
+		}
+		return u.ID
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := key(&matches[i]), key(&matches[j])
+		if a == b {
+			a, b = matches[i].ID, matches[j].ID
+		}
+		if q.Desc {
+			return a > b
+		}
+		return a < b
+	})
+
+	list := UserList{
+		Total:    len(matches),
+		Continue: q.continueCursor(len(matches)),
+	}
+	if q.Offset >= len(matches) {
+		return list
+	}
+	matches = matches[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matches) {
+		matches = matches[:q.Limit]
+	}
+	list.Users = matches
+	return list
+}
@@ -0,0 +1,1326 @@
+package webapp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhooks notify other systems of the changes of users and their settings. The handlers publish the events
+// with PublishWebhookEvent, which creates a delivery for every subscribed webhook and sends it in the
+// background. Each delivery is a POST request with a JSON body signed with the secret of the webhook.
+// Failed deliveries are retried with exponential backoff by the webhook-retrier job and logged with the
+// response status of their last attempt.
+
+// Webhook event types
+const (
+	WebhookUserCreated     = "user.created"
+	WebhookUserUpdated     = "user.updated"
+	WebhookUserDisabled    = "user.disabled" // the user has been deleted with a grace period
+	WebhookUserDeleted     = "user.deleted"
+	WebhookSettingsUpdated = "settings.updated"
+)
+
+// WebhookEvents are all event types a webhook can subscribe to
+var WebhookEvents = []string{
+	WebhookUserCreated,
+	WebhookUserUpdated,
+	WebhookUserDisabled,
+	WebhookUserDeleted,
+	WebhookSettingsUpdated,
+}
+
+// Webhook is the subscription of a URL to events
+type Webhook struct {
+	ID  string `json:"id" yaml:"id"`
+	URL string `json:"url" yaml:"url"`
+	// Events are the subscribed event types, all events are delivered if it's empty
+	Events []string `json:"events" yaml:"events"`
+	// Secret signs the deliveries, see signWebhook
+	Secret  string    `json:"secret" yaml:"secret"`
+	Created time.Time `json:"created" yaml:"created"`
+}
+
+// WebhookDelivery is the delivery of an event to a webhook together with the result of its last attempt
+type WebhookDelivery struct {
+	ID        string    `json:"id" yaml:"id"`
+	WebhookID string    `json:"webhookId" yaml:"webhookId"`
+	Event     string    `json:"event" yaml:"event"`
+	Payload   string    `json:"payload" yaml:"payload"` // JSON body of the request
+	Created   time.Time `json:"created" yaml:"created"`
+	Attempts  int       `json:"attempts" yaml:"attempts"`
+	// Attempted is the time of the last attempt
+	Attempted time.Time `json:"attempted" yaml:"attempted"`
+	// Status is the response status of the last attempt, 0 if there was no response
+	Status int    `json:"status" yaml:"status"`
+	Error  string `json:"error,omitempty" yaml:"error,omitempty"`
+	// NextAttempt is the time of the next retry, nil once the delivery succeeded or has been given up
+	NextAttempt *time.Time `json:"nextAttempt,omitempty" yaml:"nextAttempt,omitempty"`
+}
+
+// WebhookPayload is the JSON body of a delivery
+type WebhookPayload struct {
+	ID      string      `json:"id"` // id of the event, redeliveries have the same id
+	Event   string      `json:"event"`
+	Created time.Time   `json:"created"`
+	Object  interface{} `json:"object"`
+}
+
+const (
+	webhookIDLength         = 16
+	webhookSecretLength     = 32
+	webhookDeliveryIDLength = 20
+
+	// webhookDeliveryHistory is the number of deliveries kept per webhook, older ones are removed when a new
+	// delivery is saved
+	webhookDeliveryHistory = 100
+	// webhookTimeout limits a single delivery attempt
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts is the number of attempts before a delivery is given up
+	webhookMaxAttempts = 8
+	// webhookRetryBackoff is the time before the first retry, it doubles with every further attempt
+	webhookRetryBackoff = 30 * time.Second
+	// webhookRetryInterval is the default schedule of the webhook-retrier job
+	webhookRetryInterval = 30 * time.Second
+)
+
+// webhookClient sends the deliveries
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookDeliveries tracks the deliveries sent in the background, see WaitWebhookDeliveries
+var webhookDeliveries sync.WaitGroup
+
+// Subscribed checks if the webhook receives events of the given type
+func (webhook Webhook) Subscribed(event string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range webhook.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Succeeded reports if the last attempt of the delivery got a successful response
+func (delivery WebhookDelivery) Succeeded() bool {
+	return delivery.Status >= 200 && delivery.Status < 300
+}
+
+// NewWebhook validates the URL and the events of a new webhook, the errors are in the given language.
+// Without a secret a random one is generated.
+func NewWebhook(target string, events []string, secret, lang string) (Webhook, error) {
+	webhook := Webhook{
+		ID:      GenerateID("whk", webhookIDLength),
+		URL:     strings.TrimSpace(target),
+		Events:  events,
+		Secret:  secret,
+		Created: time.Now().UTC(),
+	}
+
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhook, errWebhookURLInvalid[lang]
+	}
+	for _, event := range events {
+		known := false
+		for _, webhookEvent := range WebhookEvents {
+			known = known || event == webhookEvent
+		}
+		if !known {
+			return webhook, errWebhookEventUnknown[lang]
+		}
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = GenerateID("whsec", webhookSecretLength)
+	}
+	return webhook, nil
+}
+
+// userTerminationEvent returns the event of deleting a user with the grace period, see TerminateUser
+func userTerminationEvent(gracePeriod time.Duration) string {
+	if gracePeriod > 0 {
+		return WebhookUserDisabled
+	}
+	return WebhookUserDeleted
+}
+
+// webhookUser returns the user as the object of a webhook event. Besides the password hash it leaves out
+// the sessions, whose ids are the session cookies of the user.
+func webhookUser(user User) User {
+	user = userResponse(user)
+	user.Sessions = nil
+	return user
+}
+
+// PublishWebhookEvent creates a delivery of the event for every subscribed webhook and sends them in the
+// background. Errors are only logged, so the event doesn't fail the request publishing it.
+func PublishWebhookEvent(ctx context.Context, event string, object interface{}) {
+	if GlobalWebhookStore == nil {
+		return
+	}
+	webhooks, err := GlobalWebhookStore.All(ctx)
+	if err != nil {
+		log.Println("Unable to read webhooks for", event, "event:", err)
+		return
+	}
+
+	payload := WebhookPayload{
+		ID:      GenerateID("evt", webhookDeliveryIDLength),
+		Event:   event,
+		Created: time.Now().UTC(),
+		Object:  object,
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Unable to encode", event, "event:", err)
+		return
+	}
+
+	for i := range webhooks {
+		if !webhooks[i].Subscribed(event) {
+			continue
+		}
+		delivery, err := newWebhookDelivery(ctx, webhooks[i].ID, event, string(data))
+		if err != nil {
+			log.Println("Unable to save delivery of", event, "event to webhook", webhooks[i].ID, ":", err)
+			continue
+		}
+
+		webhook := webhooks[i]
+		webhookDeliveries.Add(1)
+		go func() {
+			defer webhookDeliveries.Done()
+			attemptWebhookDelivery(AppContext, &webhook, delivery)
+		}()
+	}
+}
+
+// RedeliverWebhook sends the payload of a delivery again as a new delivery and returns it with the result
+// of its first attempt
+func RedeliverWebhook(ctx context.Context, webhook *Webhook, previous *WebhookDelivery) (*WebhookDelivery, error) {
+	delivery, err := newWebhookDelivery(ctx, webhook.ID, previous.Event, previous.Payload)
+	if err != nil {
+		return nil, err
+	}
+	attemptWebhookDelivery(ctx, webhook, delivery)
+	return delivery, nil
+}
+
+// WaitWebhookDeliveries waits for the deliveries sent in the background
+func WaitWebhookDeliveries() {
+	webhookDeliveries.Wait()
+}
+
+// newWebhookDelivery saves a new delivery. Its first retry is scheduled already, so the delivery is retried
+// if the application stops before the first attempt has been recorded.
+func newWebhookDelivery(ctx context.Context, webhookID, event, payload string) (*WebhookDelivery, error) {
+	now := time.Now().UTC()
+	retry := now.Add(webhookRetryBackoff)
+	delivery := &WebhookDelivery{
+		ID:          GenerateID("whd", webhookDeliveryIDLength),
+		WebhookID:   webhookID,
+		Event:       event,
+		Payload:     payload,
+		Created:     now,
+		NextAttempt: &retry,
+	}
+	return delivery, GlobalWebhookStore.SaveDelivery(ctx, delivery)
+}
+
+// attemptWebhookDelivery sends the delivery and records the result. Failed deliveries are scheduled for
+// a retry with exponential backoff until webhookMaxAttempts is reached.
+func attemptWebhookDelivery(ctx context.Context, webhook *Webhook, delivery *WebhookDelivery) {
+	delivery.Attempts++
+	delivery.Attempted = time.Now().UTC()
+	delivery.Status, delivery.Error = 0, ""
+
+	status, err := sendWebhook(ctx, webhook, delivery)
+	delivery.Status = status
+	switch {
+	case err == nil:
+		delivery.NextAttempt = nil
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Error = err.Error()
+		delivery.NextAttempt = nil
+	default:
+		delivery.Error = err.Error()
+		retry := delivery.Attempted.Add(webhookRetryBackoff << (delivery.Attempts - 1))
+		delivery.NextAttempt = &retry
+	}
+
+	// the result is recorded even if the application is shutting down
+	saveCtx, cancel := context.WithTimeout(context.Background(), jobRecordTimeout)
+	defer cancel()
+	if err := GlobalWebhookStore.SaveDelivery(saveCtx, delivery); err != nil {
+		log.Println("Unable to save webhook delivery", delivery.ID, ":", err)
+	}
+}
+
+// sendWebhook posts the payload of the delivery to the webhook and returns the response status.
+// Responses other than 2xx are returned as errors.
+func sendWebhook(ctx context.Context, webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", appName+"-Webhook")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// read a bit of the body, so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of the timestamp and the payload, separated by a dot.
+// Receivers check it with the secret of the webhook and reject old timestamps to prevent replays.
+func signWebhook(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RetryWebhookDeliveries sends the deliveries due for a retry and returns how many have been sent
+func RetryWebhookDeliveries(ctx context.Context) (int, error) {
+	deliveries, err := GlobalWebhookStore.DeliveriesDue(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for i := range deliveries {
+		if ctx.Err() != nil {
+			break
+		}
+		webhook, err := GlobalWebhookStore.Find(ctx, deliveries[i].WebhookID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return sent, err
+		}
+		attemptWebhookDelivery(ctx, webhook, &deliveries[i])
+		sent++
+	}
+	return sent, nil
+}
+
+// WebhookRetryJob returns the job retrying the failed webhook deliveries
+func WebhookRetryJob() Job {
+	return Job{
+		Name:     "webhook-retrier",
+		Schedule: Every(webhookRetryInterval),
+		Run: func(ctx context.Context) (string, error) {
+			n, err := RetryWebhookDeliveries(ctx)
+			return fmt.Sprintf("Retried %d webhook deliveries", n), err
+		},
+	}
+}
+
+/****************************************
+***  Handler                          ***
+*****************************************/
+
+// HandleWebhooksIndex lists the webhooks with the form to add a new one
+// (GET /webhooks)
+func HandleWebhooksIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	renderWebhooksIndex(w, r, &Webhook{}, nil)
+}
+
+// renderWebhooksIndex shows the webhooks page with the values and the error of the form
+func renderWebhooksIndex(w http.ResponseWriter, r *http.Request, webhook *Webhook, err error) {
+	webhooks, listErr := GlobalWebhookStore.All(r.Context())
+	if listErr != nil {
+		log.Println("Unable to read from GlobalWebhookStore:", listErr)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Pagetitle": "ListWebhooks",
+		"Webhooks":  webhooks,
+		"Webhook":   webhook,
+		"Events":    WebhookEvents,
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+	RenderTemplate(w, r, "webhooks/index", data)
+}
+
+// HandleWebhookCreate adds a webhook from the form of the webhooks page
+// (POST /webhooks)
+func HandleWebhookCreate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lang := GetLanguage(ctx, "", r, params)
+	webhook, err := NewWebhook(r.FormValue("url"), r.Form["events"], r.FormValue("secret"), lang)
+	if err != nil {
+		renderWebhooksIndex(w, r, &webhook, err)
+		return
+	}
+	if err := GlobalWebhookStore.Save(ctx, &webhook); err != nil {
+		log.Println("Unable to save webhook:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/webhooks/"+webhook.ID+"?flash=Webhook+created", http.StatusFound)
+}
+
+// HandleWebhookShow shows a webhook with the log of its latest deliveries
+// (GET /webhooks/:id)
+func HandleWebhookShow(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
+
+	webhook, err := GlobalWebhookStore.Find(ctx, params.ByName("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Redirect(w, r, "/webhooks?flash=webhook+not+found", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Println("Unable to read from GlobalWebhookStore:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	deliveries, err := GlobalWebhookStore.Deliveries(ctx, webhook.ID, webhookDeliveryHistory)
+	if err != nil {
+		log.Println("Unable to read from GlobalWebhookStore:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplate(w, r, "webhooks/show", map[string]interface{}{
+		"Pagetitle":  "ShowWebhook",
+		"Webhook":    webhook,
+		"Deliveries": deliveries,
+	})
+}
+
+// HandleWebhookDelete removes a webhook together with its deliveries
+// (POST /webhooks/:id/delete)
+func HandleWebhookDelete(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
+
+	webhook, err := GlobalWebhookStore.Find(ctx, params.ByName("id"))
+	if err == nil {
+		err = GlobalWebhookStore.Delete(ctx, webhook)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Println("Unable to delete webhook", params.ByName("id"), ":", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/webhooks?flash=Webhook+deleted", http.StatusFound)
+}
+
+// HandleWebhookRedeliver sends the payload of a delivery again and shows the webhook with the new delivery
+// (POST /webhooks/:id/deliveries/:delivery)
+func HandleWebhookRedeliver(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx := r.Context()
+
+	webhook, err := GlobalWebhookStore.Find(ctx, params.ByName("id"))
+	var delivery *WebhookDelivery
+	if err == nil {
+		delivery, err = GlobalWebhookStore.FindDelivery(ctx, params.ByName("delivery"))
+	}
+	if errors.Is(err, ErrNotFound) || err == nil && delivery.WebhookID != webhook.ID {
+		http.Redirect(w, r, "/webhooks?flash=delivery+not+found", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Println("Unable to read from GlobalWebhookStore:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	redelivery, err := RedeliverWebhook(ctx, webhook, delivery)
+	if err != nil {
+		log.Println("Unable to redeliver", delivery.ID, ":", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	flash := "Redelivered"
+	if !redelivery.Succeeded() {
+		flash = "Redelivery failed"
+	}
+	http.Redirect(w, r, "/webhooks/"+webhook.ID+"?flash="+url.QueryEscape(flash), http.StatusFound)
+}
+
+/**********************************
+***  Webhook Store              ***
+***********************************/
+
+// WebhookStore is an abstraction interface to allow multiple data sources to save the webhooks and their
+// deliveries to. Deleting a webhook deletes its deliveries. Deliveries returns the latest deliveries of a
+// webhook, newest first, DeliveriesDue the deliveries whose next attempt is before the given time.
+type WebhookStore interface {
+	All(context.Context) ([]Webhook, error)
+	Find(ctx context.Context, id string) (*Webhook, error)
+	Save(context.Context, *Webhook) error
+	Delete(context.Context, *Webhook) error
+	SaveDelivery(context.Context, *WebhookDelivery) error
+	FindDelivery(ctx context.Context, id string) (*WebhookDelivery, error)
+	Deliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error)
+	DeliveriesDue(ctx context.Context, before time.Time) ([]WebhookDelivery, error)
+}
+
+// GlobalWebhookStore is the Global Database of webhooks
+var GlobalWebhookStore WebhookStore
+
+/**********************************
+***  Memory Webhook Store       ***
+***********************************/
+
+// MemoryWebhookStore is a thread-safe implementation of WebhookStore which keeps the webhooks in memory
+type MemoryWebhookStore struct {
+	mu       sync.RWMutex
+	persist  func() error                 // called after every change while the store is still locked
+	Webhooks map[string]Webhook           `yaml:"webhooks"`
+	History  map[string][]WebhookDelivery `yaml:"deliveries"` // by webhook id, oldest first
+}
+
+// NewMemoryWebhookStore creates a new, empty MemoryWebhookStore
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{
+		Webhooks: map[string]Webhook{},
+		History:  map[string][]WebhookDelivery{},
+	}
+}
+
+func (store *MemoryWebhookStore) All(_ context.Context) ([]Webhook, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	webhooks := make([]Webhook, 0, len(store.Webhooks))
+	for _, webhook := range store.Webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Created.Before(webhooks[j].Created) })
+	return webhooks, nil
+}
+
+func (store *MemoryWebhookStore) Find(_ context.Context, id string) (*Webhook, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	webhook, ok := store.Webhooks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &webhook, nil
+}
+
+func (store *MemoryWebhookStore) Save(_ context.Context, webhook *Webhook) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, existed := store.Webhooks[webhook.ID]
+	store.Webhooks[webhook.ID] = *webhook
+	if err := store.changed(); err != nil {
+		if existed {
+			store.Webhooks[webhook.ID] = previous
+		} else {
+			delete(store.Webhooks, webhook.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (store *MemoryWebhookStore) Delete(_ context.Context, webhook *Webhook) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, ok := store.Webhooks[webhook.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	deliveries := store.History[webhook.ID]
+	delete(store.Webhooks, webhook.ID)
+	delete(store.History, webhook.ID)
+	if err := store.changed(); err != nil {
+		store.Webhooks[webhook.ID] = previous
+		store.History[webhook.ID] = deliveries
+		return err
+	}
+	return nil
+}
+
+func (store *MemoryWebhookStore) SaveDelivery(_ context.Context, delivery *WebhookDelivery) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous := store.History[delivery.WebhookID]
+	deliveries := make([]WebhookDelivery, 0, len(previous)+1)
+	replaced := false
+	for _, stored := range previous {
+		if stored.ID == delivery.ID {
+			stored, replaced = *delivery, true
+		}
+		deliveries = append(deliveries, stored)
+	}
+	if !replaced {
+		deliveries = append(deliveries, *delivery)
+	}
+	if len(deliveries) > webhookDeliveryHistory {
+		deliveries = deliveries[len(deliveries)-webhookDeliveryHistory:]
+	}
+	store.History[delivery.WebhookID] = deliveries
+
+	if err := store.changed(); err != nil {
+		store.History[delivery.WebhookID] = previous
+		return err
+	}
+	return nil
+}
+
+func (store *MemoryWebhookStore) FindDelivery(_ context.Context, id string) (*WebhookDelivery, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, deliveries := range store.History {
+		for _, delivery := range deliveries {
+			if delivery.ID == id {
+				return &delivery, nil
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (store *MemoryWebhookStore) Deliveries(_ context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var deliveries []WebhookDelivery
+	stored := store.History[webhookID]
+	for i := len(stored) - 1; i >= 0 && (limit <= 0 || len(deliveries) < limit); i-- {
+		deliveries = append(deliveries, stored[i])
+	}
+	return deliveries, nil
+}
+
+func (store *MemoryWebhookStore) DeliveriesDue(_ context.Context, before time.Time) ([]WebhookDelivery, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var due []WebhookDelivery
+	for _, deliveries := range store.History {
+		for _, delivery := range deliveries {
+			if delivery.NextAttempt != nil && delivery.NextAttempt.Before(before) {
+				due = append(due, delivery)
+			}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(*due[j].NextAttempt) })
+	return due, nil
+}
+
+// changed calls the persist hook of the store if there is one
+func (store *MemoryWebhookStore) changed() error {
+	if store.persist == nil {
+		return nil
+	}
+	return store.persist()
+}
+
+/**********************************
+***  File Webhook Store         ***
+***********************************/
+
+// FileWebhookStore is an implementation of WebhookStore to save the webhooks to the filesystem.
+// It keeps all webhooks and deliveries in memory and rewrites the file after every change.
+type FileWebhookStore struct {
+	*MemoryWebhookStore
+	filename string
+}
+
+func NewFileWebhookStore(name string) (*FileWebhookStore, error) {
+	store := &FileWebhookStore{
+		MemoryWebhookStore: NewMemoryWebhookStore(),
+		filename:           name,
+	}
+	store.MemoryWebhookStore.persist = store.persist
+
+	contents, err := readStoreFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(contents, store.MemoryWebhookStore)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// persist writes all webhooks and deliveries to the store's file
+func (store *FileWebhookStore) persist() error {
+	contents, err := yaml.Marshal(store.MemoryWebhookStore)
+	if err != nil {
+		return err
+	}
+	return writeFiles(map[string][]byte{store.filename: contents})
+}
+
+/**********************************
+***  Bolt Webhook Store         ***
+***********************************/
+
+// BoltWebhookStore is an implementation of WebhookStore to save the webhooks in an embedded bolt database.
+// Deliveries are stored under the key "<webhook id>\x00<created time>\x00<id>", so the deliveries of a
+// webhook are sorted by time, the delivery index maps the ids of the deliveries to their keys.
+type BoltWebhookStore struct {
+	boltStore
+}
+
+// NewBoltWebhookStore creates a BoltWebhookStore on the given database
+func NewBoltWebhookStore(db *bolt.DB) WebhookStore {
+	return &BoltWebhookStore{boltStore{db: db}}
+}
+
+func (store *BoltWebhookStore) All(_ context.Context) ([]Webhook, error) {
+	var webhooks []Webhook
+	err := store.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWebhooksBucket).ForEach(func(_, data []byte) error {
+			webhook := Webhook{}
+			if err := json.Unmarshal(data, &webhook); err != nil {
+				return err
+			}
+			webhooks = append(webhooks, webhook)
+			return nil
+		})
+	})
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Created.Before(webhooks[j].Created) })
+	return webhooks, err
+}
+
+func (store *BoltWebhookStore) Find(_ context.Context, id string) (*Webhook, error) {
+	webhook := &Webhook{}
+	err := store.view(func(tx *bolt.Tx) error {
+		return boltGet(tx, boltWebhooksBucket, []byte(id), webhook)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (store *BoltWebhookStore) Save(_ context.Context, webhook *Webhook) error {
+	return store.update(func(tx *bolt.Tx) error {
+		return boltPut(tx, boltWebhooksBucket, []byte(webhook.ID), webhook)
+	})
+}
+
+func (store *BoltWebhookStore) Delete(_ context.Context, webhook *Webhook) error {
+	return store.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltWebhooksBucket).Get([]byte(webhook.ID)) == nil {
+			return ErrNotFound
+		}
+		if err := tx.Bucket(boltWebhooksBucket).Delete([]byte(webhook.ID)); err != nil {
+			return err
+		}
+		keys := boltDeliveryKeys(tx, webhook.ID)
+		return boltDeleteDeliveries(tx, keys)
+	})
+}
+
+func (store *BoltWebhookStore) SaveDelivery(_ context.Context, delivery *WebhookDelivery) error {
+	return store.update(func(tx *bolt.Tx) error {
+		key := []byte(fmt.Sprintf("%s\x00%020d\x00%s", delivery.WebhookID, delivery.Created.UnixNano(), delivery.ID))
+		if err := boltPut(tx, boltWebhookDeliveriesBucket, key, delivery); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltWebhookDeliveryIndexBucket).Put([]byte(delivery.ID), key); err != nil {
+			return err
+		}
+
+		// remove the oldest deliveries beyond the history limit
+		keys := boltDeliveryKeys(tx, delivery.WebhookID)
+		if len(keys) > webhookDeliveryHistory {
+			return boltDeleteDeliveries(tx, keys[:len(keys)-webhookDeliveryHistory])
+		}
+		return nil
+	})
+}
+
+func (store *BoltWebhookStore) FindDelivery(_ context.Context, id string) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	err := store.view(func(tx *bolt.Tx) error {
+		key := tx.Bucket(boltWebhookDeliveryIndexBucket).Get([]byte(id))
+		if key == nil {
+			return ErrNotFound
+		}
+		return boltGet(tx, boltWebhookDeliveriesBucket, key, delivery)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (store *BoltWebhookStore) Deliveries(_ context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := store.view(func(tx *bolt.Tx) error {
+		keys := boltDeliveryKeys(tx, webhookID)
+		for i := len(keys) - 1; i >= 0 && (limit <= 0 || len(deliveries) < limit); i-- {
+			delivery := WebhookDelivery{}
+			if err := boltGet(tx, boltWebhookDeliveriesBucket, keys[i], &delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+func (store *BoltWebhookStore) DeliveriesDue(_ context.Context, before time.Time) ([]WebhookDelivery, error) {
+	var due []WebhookDelivery
+	err := store.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWebhookDeliveriesBucket).ForEach(func(_, data []byte) error {
+			delivery := WebhookDelivery{}
+			if err := json.Unmarshal(data, &delivery); err != nil {
+				return err
+			}
+			if delivery.NextAttempt != nil && delivery.NextAttempt.Before(before) {
+				due = append(due, delivery)
+			}
+			return nil
+		})
+	})
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(*due[j].NextAttempt) })
+	return due, err
+}
+
+// boltDeliveryKeys returns the keys of the deliveries of a webhook, oldest first
+func boltDeliveryKeys(tx *bolt.Tx, webhookID string) [][]byte {
+	var keys [][]byte
+	prefix := []byte(webhookID + "\x00")
+	cursor := tx.Bucket(boltWebhookDeliveriesBucket).Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return keys
+}
+
+// boltDeleteDeliveries removes the deliveries with the given keys together with their index entries
+func boltDeleteDeliveries(tx *bolt.Tx, keys [][]byte) error {
+	for _, key := range keys {
+		id := key[bytes.LastIndexByte(key, 0)+1:]
+		if err := tx.Bucket(boltWebhookDeliveryIndexBucket).Delete(id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltWebhookDeliveriesBucket).Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**********************************
+***  DB Webhook Store           ***
+***********************************/
+
+// DBWebhookStore is an implementation of WebhookStore to save the webhooks in the database.
+// The events of a webhook are stored as a comma separated list.
+type DBWebhookStore struct {
+	db dbExecutor
+}
+
+func NewDBWebhookStore() WebhookStore {
+	_, err := GlobalPostgresDB.Exec(`
+CREATE TABLE IF NOT EXISTS webhooks (
+  id varchar(255) NOT NULL DEFAULT '',
+  url text NOT NULL DEFAULT '',
+  events text NOT NULL DEFAULT '',
+  secret varchar(255) NOT NULL DEFAULT '',
+  created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id varchar(255) NOT NULL DEFAULT '',
+  webhook_id varchar(255) NOT NULL DEFAULT '' REFERENCES webhooks(id) ON DELETE CASCADE,
+  event varchar(255) NOT NULL DEFAULT '',
+  payload text NOT NULL DEFAULT '',
+  created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  attempts integer NOT NULL DEFAULT 0,
+  attempted timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  status integer NOT NULL DEFAULT 0,
+  error text NOT NULL DEFAULT '',
+  next_attempt timestamp,
+  PRIMARY KEY (id)
+);
+`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create webhook tables in database: %s\n", err)
+	}
+
+	_, err = GlobalPostgresDB.Exec(`
+CREATE INDEX IF NOT EXISTS webhook_created_idx ON webhook_deliveries( webhook_id, created );
+CREATE INDEX IF NOT EXISTS next_attempt_idx ON webhook_deliveries( next_attempt );`)
+	if err != nil {
+		Logf(FatalLevel, "Unable to create indexes of the webhook_deliveries table of the database: %s\n", err)
+	}
+
+	return &DBWebhookStore{
+		db: GlobalPostgresDB,
+	}
+}
+
+func (store DBWebhookStore) All(ctx context.Context) ([]Webhook, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, url, events, secret, created
+		FROM webhooks
+		ORDER BY created`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhooks(rows)
+}
+
+func (store DBWebhookStore) Find(ctx context.Context, id string) (*Webhook, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, url, events, secret, created
+		FROM webhooks
+		WHERE id = $1`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks, err := scanWebhooks(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, ErrNotFound
+	}
+	return &webhooks[0], nil
+}
+
+func (store DBWebhookStore) Save(ctx context.Context, webhook *Webhook) error {
+	_, err := store.db.ExecContext(
+		ctx,
+		`
+	INSERT INTO webhooks
+	    (id, url, events, secret, created)
+	    VALUES ($1, $2, $3, $4, $5)
+	    ON CONFLICT (id)
+	    DO UPDATE SET url=$2, events=$3, secret=$4`,
+		webhook.ID,
+		webhook.URL,
+		strings.Join(webhook.Events, ","),
+		webhook.Secret,
+		webhook.Created.UTC(),
+	)
+	return dbError(err)
+}
+
+func (store DBWebhookStore) Delete(ctx context.Context, webhook *Webhook) error {
+	// the deliveries are deleted by the foreign key
+	return dbAffected(store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM webhooks
+		WHERE id = $1`,
+		webhook.ID,
+	))
+}
+
+func (store DBWebhookStore) SaveDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	_, err := store.db.ExecContext(
+		ctx,
+		`
+	INSERT INTO webhook_deliveries
+	    (id, webhook_id, event, payload, created, attempts, attempted, status, error, next_attempt)
+	    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	    ON CONFLICT (id)
+	    DO UPDATE SET attempts=$6, attempted=$7, status=$8, error=$9, next_attempt=$10`,
+		delivery.ID,
+		delivery.WebhookID,
+		delivery.Event,
+		delivery.Payload,
+		delivery.Created.UTC(),
+		delivery.Attempts,
+		delivery.Attempted.UTC(),
+		delivery.Status,
+		delivery.Error,
+		nullTime(delivery.NextAttempt),
+	)
+	if err != nil {
+		return dbError(err)
+	}
+
+	// remove the oldest deliveries beyond the history limit
+	_, err = store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM webhook_deliveries
+		WHERE webhook_id = $1 AND id NOT IN (
+			SELECT id FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY created DESC LIMIT $2
+		)`,
+		delivery.WebhookID,
+		webhookDeliveryHistory,
+	)
+	return dbError(err)
+}
+
+func (store DBWebhookStore) FindDelivery(ctx context.Context, id string) (*WebhookDelivery, error) {
+	deliveries, err := store.queryDeliveries(ctx, "WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, ErrNotFound
+	}
+	return &deliveries[0], nil
+}
+
+func (store DBWebhookStore) Deliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	return store.queryDeliveries(
+		ctx,
+		"WHERE webhook_id = $1 ORDER BY created DESC LIMIT $2",
+		webhookID,
+		sql.NullInt64{Int64: int64(limit), Valid: limit > 0},
+	)
+}
+
+func (store DBWebhookStore) DeliveriesDue(ctx context.Context, before time.Time) ([]WebhookDelivery, error) {
+	return store.queryDeliveries(ctx, "WHERE next_attempt < $1 ORDER BY next_attempt", before.UTC())
+}
+
+// queryDeliveries selects the deliveries matching the condition
+func (store DBWebhookStore) queryDeliveries(ctx context.Context, condition string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, webhook_id, event, payload, created, attempts, attempted, status, error, next_attempt
+		FROM webhook_deliveries
+		`+condition,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+// scanWebhooks reads the webhooks from a query result
+func scanWebhooks(rows *sql.Rows) ([]Webhook, error) {
+	var webhooks []Webhook
+	for rows.Next() {
+		webhook := Webhook{}
+		var events string
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.URL,
+			&events,
+			&webhook.Secret,
+			&webhook.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if events != "" {
+			webhook.Events = strings.Split(events, ",")
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// scanWebhookDeliveries reads the webhook deliveries from a query result
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		delivery := WebhookDelivery{}
+		var nextAttempt sql.NullTime
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Created,
+			&delivery.Attempts,
+			&delivery.Attempted,
+			&delivery.Status,
+			&delivery.Error,
+			&nextAttempt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		delivery.NextAttempt = timePtr(nextAttempt)
+
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+/**********************************
+***  MySQL Webhook Store        ***
+***********************************/
+
+// MySQLWebhookStore is an implementation of WebhookStore to save the webhooks in a MySQL or MariaDB database
+type MySQLWebhookStore struct {
+	db dbExecutor
+}
+
+func NewMySQLWebhookStore() WebhookStore {
+	for _, statement := range []string{`
+CREATE TABLE IF NOT EXISTS webhooks (
+  id varchar(255) NOT NULL DEFAULT '',
+  url text NOT NULL,
+  events text NOT NULL,
+  secret varchar(255) NOT NULL DEFAULT '',
+  created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (id)
+) DEFAULT CHARSET=utf8mb4;
+`, `
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id varchar(255) NOT NULL DEFAULT '',
+  webhook_id varchar(255) NOT NULL DEFAULT '',
+  event varchar(255) NOT NULL DEFAULT '',
+  payload mediumtext NOT NULL,
+  created datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  attempts int NOT NULL DEFAULT 0,
+  attempted datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  status int NOT NULL DEFAULT 0,
+  error text NOT NULL,
+  next_attempt datetime(6) NULL,
+  PRIMARY KEY (id),
+  KEY webhook_created_idx (webhook_id, created),
+  KEY next_attempt_idx (next_attempt),
+  FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+) DEFAULT CHARSET=utf8mb4;
+`} {
+		if _, err := GlobalMySQLDB.Exec(statement); err != nil {
+			Logf(FatalLevel, "Unable to create webhook tables in database: %s\n", err)
+		}
+	}
+
+	return &MySQLWebhookStore{
+		db: GlobalMySQLDB,
+	}
+}
+
+func (store MySQLWebhookStore) All(ctx context.Context) ([]Webhook, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, url, events, secret, created
+		FROM webhooks
+		ORDER BY created`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhooks(rows)
+}
+
+func (store MySQLWebhookStore) Find(ctx context.Context, id string) (*Webhook, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, url, events, secret, created
+		FROM webhooks
+		WHERE id = ?`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks, err := scanWebhooks(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, ErrNotFound
+	}
+	return &webhooks[0], nil
+}
+
+func (store MySQLWebhookStore) Save(ctx context.Context, webhook *Webhook) error {
+	_, err := store.db.ExecContext(
+		ctx,
+		`
+	INSERT INTO webhooks
+	    (id, url, events, secret, created)
+	    VALUES (?, ?, ?, ?, ?)
+	    ON DUPLICATE KEY UPDATE url=VALUES(url), events=VALUES(events), secret=VALUES(secret)`,
+		webhook.ID,
+		webhook.URL,
+		strings.Join(webhook.Events, ","),
+		webhook.Secret,
+		webhook.Created.UTC(),
+	)
+	return mysqlError(err)
+}
+
+func (store MySQLWebhookStore) Delete(ctx context.Context, webhook *Webhook) error {
+	// the deliveries are deleted by the foreign key
+	return mysqlAffected(store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM webhooks
+		WHERE id = ?`,
+		webhook.ID,
+	))
+}
+
+func (store MySQLWebhookStore) SaveDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	_, err := store.db.ExecContext(
+		ctx,
+		`
+	INSERT INTO webhook_deliveries
+	    (id, webhook_id, event, payload, created, attempts, attempted, status, error, next_attempt)
+	    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	    ON DUPLICATE KEY UPDATE attempts=VALUES(attempts), attempted=VALUES(attempted), status=VALUES(status),
+	        error=VALUES(error), next_attempt=VALUES(next_attempt)`,
+		delivery.ID,
+		delivery.WebhookID,
+		delivery.Event,
+		delivery.Payload,
+		delivery.Created.UTC(),
+		delivery.Attempts,
+		delivery.Attempted.UTC(),
+		delivery.Status,
+		delivery.Error,
+		nullTime(delivery.NextAttempt),
+	)
+	if err != nil {
+		return mysqlError(err)
+	}
+
+	// remove the oldest deliveries beyond the history limit, like the job runs the oldest kept
+	// delivery is looked up first
+	var oldest time.Time
+	err = store.db.QueryRowContext(
+		ctx,
+		`
+		SELECT created FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY created DESC
+		LIMIT 1 OFFSET ?`,
+		delivery.WebhookID,
+		webhookDeliveryHistory-1,
+	).Scan(&oldest)
+	if err != nil {
+		if err = mysqlError(err); errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	_, err = store.db.ExecContext(
+		ctx,
+		`
+		DELETE FROM webhook_deliveries
+		WHERE webhook_id = ? AND created < ?`,
+		delivery.WebhookID,
+		oldest,
+	)
+	return mysqlError(err)
+}
+
+func (store MySQLWebhookStore) FindDelivery(ctx context.Context, id string) (*WebhookDelivery, error) {
+	deliveries, err := store.queryDeliveries(ctx, "WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, ErrNotFound
+	}
+	return &deliveries[0], nil
+}
+
+func (store MySQLWebhookStore) Deliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = webhookDeliveryHistory
+	}
+	return store.queryDeliveries(ctx, "WHERE webhook_id = ? ORDER BY created DESC LIMIT ?", webhookID, limit)
+}
+
+func (store MySQLWebhookStore) DeliveriesDue(ctx context.Context, before time.Time) ([]WebhookDelivery, error) {
+	return store.queryDeliveries(ctx, "WHERE next_attempt < ? ORDER BY next_attempt", before.UTC())
+}
+
+// queryDeliveries selects the deliveries matching the condition
+func (store MySQLWebhookStore) queryDeliveries(ctx context.Context, condition string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := store.db.QueryContext(
+		ctx,
+		`
+		SELECT id, webhook_id, event, payload, created, attempts, attempted, status, error, next_attempt
+		FROM webhook_deliveries
+		`+condition,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
@@ -0,0 +1,239 @@
+package webapp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a delivery received by a webhookReceiver
+type webhookRequest struct {
+	header http.Header
+	body   string
+}
+
+// webhookReceiver is a test server receiving webhook deliveries. It answers them with the given statuses
+// in order and repeats the last one.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []webhookRequest
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, webhookRequest{header: r.Header.Clone(), body: string(body)})
+		status := receiver.statuses[len(receiver.statuses)-1]
+		if len(receiver.requests) <= len(receiver.statuses) {
+			status = receiver.statuses[len(receiver.requests)-1]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (receiver *webhookReceiver) received() []webhookRequest {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return append([]webhookRequest(nil), receiver.requests...)
+}
+
+// useMemoryWebhookStore replaces GlobalWebhookStore with an empty memory store for the test
+func useMemoryWebhookStore(t *testing.T) {
+	t.Helper()
+
+	previous := GlobalWebhookStore
+	GlobalWebhookStore = NewMemoryWebhookStore()
+	t.Cleanup(func() { GlobalWebhookStore = previous })
+}
+
+// newTestWebhookDelivery saves a webhook delivering to the receiver and a new delivery of it
+func newTestWebhookDelivery(t *testing.T, receiver *webhookReceiver) (*Webhook, *WebhookDelivery) {
+	t.Helper()
+
+	ctx := context.Background()
+	webhook, err := NewWebhook(receiver.URL, nil, "s3cr3t", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GlobalWebhookStore.Save(ctx, &webhook); err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := newWebhookDelivery(ctx, webhook.ID, WebhookUserCreated, `{"event":"user.created"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webhook, delivery
+}
+
+func TestWebhookSignature(t *testing.T) {
+	useMemoryWebhookStore(t)
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	webhook, delivery := newTestWebhookDelivery(t, receiver)
+
+	attemptWebhookDelivery(context.Background(), webhook, delivery)
+
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(requests))
+	}
+	request := requests[0]
+	if request.body != delivery.Payload {
+		t.Errorf("body = %q, want %q", request.body, delivery.Payload)
+	}
+	timestamp := request.header.Get("X-Webhook-Timestamp")
+	if timestamp == "" {
+		t.Fatal("X-Webhook-Timestamp is missing")
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(timestamp + "." + delivery.Payload))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := request.header.Get("X-Webhook-Signature"); got != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got, want)
+	}
+	if got := request.header.Get("X-Webhook-Delivery"); got != delivery.ID {
+		t.Errorf("X-Webhook-Delivery = %q, want %q", got, delivery.ID)
+	}
+	if !delivery.Succeeded() || delivery.NextAttempt != nil {
+		t.Errorf("delivery = status %d, next attempt %v, want succeeded", delivery.Status, delivery.NextAttempt)
+	}
+}
+
+func TestWebhookRetryWithBackoff(t *testing.T) {
+	useMemoryWebhookStore(t)
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+	webhook, delivery := newTestWebhookDelivery(t, receiver)
+	ctx := context.Background()
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		attemptWebhookDelivery(ctx, webhook, delivery)
+		if delivery.Status != http.StatusInternalServerError || delivery.Error == "" {
+			t.Fatalf("attempt %d: status = %d, error = %q, want a failed attempt", attempt, delivery.Status, delivery.Error)
+		}
+		backoff := webhookRetryBackoff << (attempt - 1)
+		if delivery.NextAttempt == nil || !delivery.NextAttempt.Equal(delivery.Attempted.Add(backoff)) {
+			t.Fatalf("attempt %d: next attempt = %v, want %s after %v", attempt, delivery.NextAttempt, backoff, delivery.Attempted)
+		}
+	}
+
+	// the retry is only due once its backoff has passed
+	if n, err := RetryWebhookDeliveries(ctx); err != nil || n != 0 {
+		t.Fatalf("RetryWebhookDeliveries() = %d, %v before the backoff, want 0", n, err)
+	}
+	due := time.Now().Add(-time.Second)
+	delivery.NextAttempt = &due
+	if err := GlobalWebhookStore.SaveDelivery(ctx, delivery); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := RetryWebhookDeliveries(ctx); err != nil || n != 1 {
+		t.Fatalf("RetryWebhookDeliveries() = %d, %v, want 1", n, err)
+	}
+
+	retried, err := GlobalWebhookStore.FindDelivery(ctx, delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Attempts != 3 || !retried.Succeeded() || retried.NextAttempt != nil {
+		t.Errorf("delivery = %d attempts, status %d, next attempt %v, want 3 attempts and succeeded",
+			retried.Attempts, retried.Status, retried.NextAttempt)
+	}
+	if n := len(receiver.received()); n != 3 {
+		t.Errorf("received %d requests, want 3", n)
+	}
+}
+
+func TestWebhookGivesUpAfterMaxAttempts(t *testing.T) {
+	useMemoryWebhookStore(t)
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	webhook, delivery := newTestWebhookDelivery(t, receiver)
+	ctx := context.Background()
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		attemptWebhookDelivery(ctx, webhook, delivery)
+		if attempt < webhookMaxAttempts && delivery.NextAttempt == nil {
+			t.Fatalf("attempt %d: delivery has been given up before %d attempts", attempt, webhookMaxAttempts)
+		}
+	}
+	if delivery.NextAttempt != nil {
+		t.Errorf("next attempt = %v after %d attempts, want the delivery given up", delivery.NextAttempt, webhookMaxAttempts)
+	}
+	if delivery.Status != http.StatusInternalServerError || delivery.Error == "" {
+		t.Errorf("status = %d, error = %q, want the failure of the last attempt", delivery.Status, delivery.Error)
+	}
+
+	stored, err := GlobalWebhookStore.FindDelivery(ctx, delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.NextAttempt != nil || stored.Attempts != webhookMaxAttempts {
+		t.Errorf("stored delivery = %d attempts, next attempt %v, want %d attempts and given up",
+			stored.Attempts, stored.NextAttempt, webhookMaxAttempts)
+	}
+	if n, err := RetryWebhookDeliveries(ctx); err != nil || n != 0 {
+		t.Errorf("RetryWebhookDeliveries() = %d, %v for a given up delivery, want 0", n, err)
+	}
+	if n := len(receiver.received()); n != webhookMaxAttempts {
+		t.Errorf("received %d requests, want %d", n, webhookMaxAttempts)
+	}
+}
+
+func TestWebhookUserPayloadHasNoSessions(t *testing.T) {
+	useMemoryWebhookStore(t)
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	webhook, err := NewWebhook(receiver.URL, []string{WebhookUserUpdated}, "s3cr3t", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GlobalWebhookStore.Save(context.Background(), &webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionID := "ses_secretsessiontoken"
+	user := User{
+		ID:             "usr_webhook",
+		Username:       "bob",
+		Email:          "bob@example.com",
+		HashedPassword: "$2a$10$secrethash",
+		Sessions:       []Session{{ID: sessionID, UserID: "usr_webhook", Expiry: time.Now().Add(time.Hour)}},
+		Version:        2,
+	}
+	PublishWebhookEvent(context.Background(), WebhookUserUpdated, webhookUser(user))
+	WaitWebhookDeliveries()
+
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(requests))
+	}
+	body := requests[0].body
+	for _, secret := range []string{sessionID, user.HashedPassword} {
+		if strings.Contains(body, secret) {
+			t.Errorf("payload %s contains %q", body, secret)
+		}
+	}
+	if !strings.Contains(body, user.ID) {
+		t.Errorf("payload %s doesn't contain the user", body)
+	}
+	if len(user.Sessions) != 1 {
+		t.Error("webhookUser changed the sessions of the user")
+	}
+}